@@ -0,0 +1,394 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"github.com/okcthulhu/ChooseYourOwnAdventure/api/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"gopkg.in/yaml.v3"
+)
+
+// AchievementHandler evaluates the achievement catalog against players and
+// serves the catalog and each player's unlocked achievements.
+type AchievementHandler struct {
+	// Catalog holds every achievement that can be unlocked.
+	Catalog []models.Achievement
+
+	// PlayerCol is the collection the unlocked achievements are stored in.
+	PlayerCol PlayerCollection
+
+	// StoryCol is used to look up the wisdoms a story offers.
+	StoryCol StoryCollection
+
+	// EventCol holds the recorded choice events the rules are evaluated against.
+	EventCol EventCollection
+
+	// Audit records the achievements unlocked for a player. It may be nil.
+	Audit AuditRecorder
+
+	// Timeouts bounds the storage calls of each operation.
+	Timeouts Timeouts
+
+	now func() time.Time
+}
+
+// NewAchievementHandler creates an AchievementHandler for the given catalog.
+func NewAchievementHandler(catalog []models.Achievement, playerCol PlayerCollection, storyCol StoryCollection, eventCol EventCollection) *AchievementHandler {
+	return &AchievementHandler{
+		Catalog:   catalog,
+		PlayerCol: playerCol,
+		StoryCol:  storyCol,
+		EventCol:  eventCol,
+		Timeouts:  DefaultTimeouts,
+		now:       time.Now,
+	}
+}
+
+// LoadAchievementCatalog reads the achievement definitions from a YAML file
+// holding a list of Achievement documents, and validates them.
+func LoadAchievementCatalog(path string) ([]models.Achievement, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// The models only carry JSON tags, so the YAML is decoded generically and
+	// re-encoded as JSON to keep a single set of field names.
+	var raw interface{}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	encoded, err := json.Marshal(raw)
+	if err != nil {
+		return nil, err
+	}
+	var catalog []models.Achievement
+	if err := json.Unmarshal(encoded, &catalog); err != nil {
+		return nil, err
+	}
+
+	if err := ValidateAchievementCatalog(catalog); err != nil {
+		return nil, err
+	}
+	return catalog, nil
+}
+
+// ValidateAchievementCatalog checks that achievement IDs are unique and that
+// every rule is known and carries the parameters it needs.
+func ValidateAchievementCatalog(catalog []models.Achievement) error {
+	seen := map[string]bool{}
+	for _, achievement := range catalog {
+		if achievement.AchievementID == "" {
+			return fmt.Errorf("achievement %q has no achievementID", achievement.Name)
+		}
+		if seen[achievement.AchievementID] {
+			return fmt.Errorf("duplicate achievement %q", achievement.AchievementID)
+		}
+		seen[achievement.AchievementID] = true
+
+		rule := achievement.Rule
+		switch rule.Type {
+		case models.CollectAllWisdoms, models.CompleteStory:
+			if rule.StoryID == nil || *rule.StoryID == "" {
+				return fmt.Errorf("achievement %q: %s requires a storyID", achievement.AchievementID, rule.Type)
+			}
+		case models.DistinctEndings:
+			if rule.Count == nil || *rule.Count < 1 {
+				return fmt.Errorf("achievement %q: distinctEndings requires a positive count", achievement.AchievementID)
+			}
+		case models.FinishWithoutGatedChoices:
+		default:
+			return fmt.Errorf("achievement %q: unknown rule type %q", achievement.AchievementID, rule.Type)
+		}
+	}
+	return nil
+}
+
+// HandleEvent is an event bus subscriber that re-evaluates the achievements of
+// the player an event belongs to. Evaluation is idempotent, so redelivered
+// events are harmless.
+func (h *AchievementHandler) HandleEvent(ctx context.Context, event models.DomainEvent) error {
+	if event.WixID == nil {
+		return nil
+	}
+	_, err := h.Evaluate(ctx, *event.WixID, event.Choice)
+	return err
+}
+
+// Evaluate checks every achievement the player has not unlocked yet and stores
+// the ones whose rule is now satisfied. pending is an optional choice event that
+// may not have been recorded yet; it is considered alongside the recorded ones.
+// The newly unlocked achievements are returned.
+func (h *AchievementHandler) Evaluate(ctx context.Context, wixID uuid.UUID, pending *models.ChoiceEvent) ([]models.UnlockedAchievement, error) {
+	var player models.Player
+	if err := h.PlayerCol.FindOne(ctx, bson.M{"wixID": binaryWixID(wixID)}).Decode(&player); err != nil {
+		return nil, err
+	}
+
+	unlocked := map[string]bool{}
+	if player.Achievements != nil {
+		for _, achievement := range *player.Achievements {
+			unlocked[achievement.AchievementID] = true
+		}
+	}
+
+	progress := &achievementProgress{handler: h, player: &player, pending: pending}
+	var newlyUnlocked []models.UnlockedAchievement
+	for _, achievement := range h.Catalog {
+		if unlocked[achievement.AchievementID] {
+			continue
+		}
+		satisfied, err := progress.satisfies(ctx, achievement.Rule)
+		if err != nil {
+			return nil, err
+		}
+		if !satisfied {
+			continue
+		}
+
+		entry := models.UnlockedAchievement{
+			AchievementID: achievement.AchievementID,
+			UnlockedAt:    h.now().UTC(),
+		}
+		// The guard keeps concurrent evaluations from unlocking the same achievement twice.
+		filter := bson.M{
+			"wixID":                      binaryWixID(wixID),
+			"achievements.achievementID": bson.M{"$ne": achievement.AchievementID},
+		}
+		result, err := h.PlayerCol.UpdateOne(ctx, filter, bson.M{"$push": bson.M{"achievements": entry}})
+		if err != nil {
+			return nil, err
+		}
+		if result.MatchedCount > 0 {
+			newlyUnlocked = append(newlyUnlocked, entry)
+		}
+	}
+
+	if len(newlyUnlocked) > 0 && h.Audit != nil {
+		h.Audit.Record(ctx, playerChange(models.AuditActionPlayerAchievementUnlocked, wixID, &player, loadAudited(ctx, h.PlayerCol, h.Timeouts, wixID)))
+	}
+	return newlyUnlocked, nil
+}
+
+// GetPlayerAchievements returns the achievements a player has unlocked, along
+// with their name and description from the catalog.
+func (h *AchievementHandler) GetPlayerAchievements(c echo.Context, wixID string) error {
+	parsedUUID, err := uuid.Parse(wixID)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, "Invalid WixID format")
+	}
+
+	ctx, cancel := h.Timeouts.context(c, "GetPlayerAchievements")
+	defer cancel()
+
+	var player models.Player
+	opts := options.FindOne().SetProjection(bson.M{"wixID": 1, "achievements": 1})
+	if err := h.PlayerCol.FindOne(ctx, bson.M{"wixID": binaryWixID(parsedUUID)}, opts).Decode(&player); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return c.JSON(http.StatusNotFound, "Player not found")
+		}
+		return storageError(c, err, "to load player achievements", "An error occurred")
+	}
+
+	catalog := map[string]models.Achievement{}
+	for _, achievement := range h.Catalog {
+		catalog[achievement.AchievementID] = achievement
+	}
+
+	achievements := []models.PlayerAchievement{}
+	if player.Achievements != nil {
+		for _, unlocked := range *player.Achievements {
+			entry := models.PlayerAchievement{
+				AchievementID: unlocked.AchievementID,
+				Name:          unlocked.AchievementID,
+				UnlockedAt:    unlocked.UnlockedAt,
+			}
+			// Achievements retired from the catalog stay unlocked under their ID.
+			if achievement, ok := catalog[unlocked.AchievementID]; ok {
+				entry.Name = achievement.Name
+				entry.Description = achievement.Description
+			}
+			achievements = append(achievements, entry)
+		}
+	}
+	return c.JSON(http.StatusOK, achievements)
+}
+
+// GetAchievementCatalog returns every achievement that can be unlocked.
+func (h *AchievementHandler) GetAchievementCatalog(c echo.Context) error {
+	catalog := h.Catalog
+	if catalog == nil {
+		catalog = []models.Achievement{}
+	}
+	return c.JSON(http.StatusOK, catalog)
+}
+
+// achievementProgress lazily gathers what the rules of one evaluation need, so
+// that each collection is queried at most once per player.
+type achievementProgress struct {
+	handler *AchievementHandler
+	player  *models.Player
+	pending *models.ChoiceEvent
+
+	choices      []models.ChoiceEvent
+	choicesReady bool
+	storyWisdoms map[string][]string
+}
+
+func (p *achievementProgress) satisfies(ctx context.Context, rule models.AchievementRule) (bool, error) {
+	switch rule.Type {
+	case models.CollectAllWisdoms:
+		return p.collectedAllWisdoms(ctx, *rule.StoryID)
+	case models.CompleteStory:
+		storyState := findStoryState(p.player, *rule.StoryID)
+		return storyState != nil && storyState.Completed != nil && *storyState.Completed, nil
+	case models.DistinctEndings:
+		return p.countEndings(rule.StoryID) >= *rule.Count, nil
+	case models.FinishWithoutGatedChoices:
+		return p.finishedUngated(ctx, rule.StoryID)
+	}
+	return false, nil
+}
+
+// countEndings returns the number of distinct endings the player has discovered,
+// optionally limited to a single story.
+func (p *achievementProgress) countEndings(storyID *string) int {
+	if p.player.StoryStates == nil {
+		return 0
+	}
+	count := 0
+	for _, storyState := range *p.player.StoryStates {
+		if storyID != nil && storyState.StoryID != *storyID {
+			continue
+		}
+		if storyState.EndingsDiscovered != nil {
+			count += len(*storyState.EndingsDiscovered)
+		}
+	}
+	return count
+}
+
+// finishedUngated reports whether the player completed a story, optionally a
+// specific one, without taking any choice that required a wisdom.
+func (p *achievementProgress) finishedUngated(ctx context.Context, storyID *string) (bool, error) {
+	choices, err := p.loadChoices(ctx)
+	if err != nil {
+		return false, err
+	}
+	completed := map[string]bool{}
+	gated := map[string]bool{}
+	for _, choice := range choices {
+		if storyID != nil && choice.StoryID != *storyID {
+			continue
+		}
+		if choice.Completed != nil && *choice.Completed {
+			completed[choice.StoryID] = true
+		}
+		if choice.Gated != nil && *choice.Gated {
+			gated[choice.StoryID] = true
+		}
+	}
+	for story := range completed {
+		if !gated[story] {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// collectedAllWisdoms reports whether the player holds every wisdom offered by
+// the story's elements. Stories without wisdoms never satisfy the rule.
+func (p *achievementProgress) collectedAllWisdoms(ctx context.Context, storyID string) (bool, error) {
+	storyState := findStoryState(p.player, storyID)
+	if storyState == nil {
+		return false, nil
+	}
+	wisdomIDs, err := p.loadStoryWisdoms(ctx, storyID)
+	if err != nil {
+		return false, err
+	}
+	if len(wisdomIDs) == 0 {
+		return false, nil
+	}
+	for _, wisdomID := range wisdomIDs {
+		if !holdsWisdom(storyState, wisdomID) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func (p *achievementProgress) loadChoices(ctx context.Context) ([]models.ChoiceEvent, error) {
+	if p.choicesReady {
+		return p.choices, nil
+	}
+	cursor, err := p.handler.EventCol.Find(ctx, bson.M{"wixID": binaryWixID(p.player.WixID)})
+	if err != nil {
+		return nil, err
+	}
+	var choices []models.ChoiceEvent
+	if err := cursor.All(ctx, &choices); err != nil {
+		return nil, err
+	}
+
+	if p.pending != nil {
+		recorded := false
+		for _, choice := range choices {
+			if choice.Id != nil && p.pending.Id != nil && *choice.Id == *p.pending.Id {
+				recorded = true
+				break
+			}
+		}
+		if !recorded {
+			choices = append(choices, *p.pending)
+		}
+	}
+
+	p.choices = choices
+	p.choicesReady = true
+	return choices, nil
+}
+
+func (p *achievementProgress) loadStoryWisdoms(ctx context.Context, storyID string) ([]string, error) {
+	if wisdomIDs, ok := p.storyWisdoms[storyID]; ok {
+		return wisdomIDs, nil
+	}
+	opts := options.Find().SetProjection(bson.M{"wisdoms": 1})
+	cursor, err := p.handler.StoryCol.Find(ctx, bson.M{"storyID": storyID}, opts)
+	if err != nil {
+		return nil, err
+	}
+	var elements []models.StoryElement
+	if err := cursor.All(ctx, &elements); err != nil {
+		return nil, err
+	}
+
+	seen := map[string]bool{}
+	var wisdomIDs []string
+	for _, element := range elements {
+		if element.Wisdoms == nil {
+			continue
+		}
+		for _, wisdom := range *element.Wisdoms {
+			if !seen[wisdom.WisdomID] {
+				seen[wisdom.WisdomID] = true
+				wisdomIDs = append(wisdomIDs, wisdom.WisdomID)
+			}
+		}
+	}
+
+	if p.storyWisdoms == nil {
+		p.storyWisdoms = map[string][]string{}
+	}
+	p.storyWisdoms[storyID] = wisdomIDs
+	return wisdomIDs, nil
+}
@@ -0,0 +1,274 @@
+package api_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"github.com/okcthulhu/ChooseYourOwnAdventure/api"
+	"github.com/okcthulhu/ChooseYourOwnAdventure/api/models"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func intPtr(i int) *int { return &i }
+
+func achievement(id string, rule models.AchievementRule) models.Achievement {
+	return models.Achievement{AchievementID: id, Name: "Name of " + id, Rule: rule}
+}
+
+func choiceEventDocument(storyID, toNodeID string, completed, gated bool) bson.D {
+	return bson.D{
+		{Key: "storyID", Value: storyID},
+		{Key: "fromNodeID", Value: "start"},
+		{Key: "toNodeID", Value: toNodeID},
+		{Key: "choiceIndex", Value: 0},
+		{Key: "completed", Value: completed},
+		{Key: "gated", Value: gated},
+		{Key: "occurredAt", Value: time.Now()},
+	}
+}
+
+// LoadAchievementCatalog
+
+func TestLoadAchievementCatalog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "achievements.yaml")
+	os.WriteFile(path, []byte(`
+- achievementID: explorer
+  name: Explorer
+  rule:
+    type: distinctEndings
+    count: 3
+`), 0o644)
+
+	catalog, err := api.LoadAchievementCatalog(path)
+
+	assert.NoError(t, err)
+	if assert.Len(t, catalog, 1) {
+		assert.Equal(t, "explorer", catalog[0].AchievementID)
+		assert.Equal(t, models.DistinctEndings, catalog[0].Rule.Type)
+		assert.Equal(t, 3, *catalog[0].Rule.Count)
+	}
+}
+
+func TestValidateAchievementCatalog(t *testing.T) {
+	assert.Error(t, api.ValidateAchievementCatalog([]models.Achievement{
+		achievement("all-wisdoms", models.AchievementRule{Type: models.CollectAllWisdoms}),
+	}), "collectAllWisdoms needs a story")
+	assert.Error(t, api.ValidateAchievementCatalog([]models.Achievement{
+		achievement("dup", models.AchievementRule{Type: models.FinishWithoutGatedChoices}),
+		achievement("dup", models.AchievementRule{Type: models.FinishWithoutGatedChoices}),
+	}), "IDs must be unique")
+	assert.Error(t, api.ValidateAchievementCatalog([]models.Achievement{
+		achievement("unknown", models.AchievementRule{Type: "speedrun"}),
+	}))
+}
+
+// Evaluate
+
+func TestEvaluate_DistinctEndings(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("endings counted across stories", func(mt *mtest.T) {
+		wixID := uuid.New()
+		h := api.NewAchievementHandler([]models.Achievement{
+			achievement("two-endings", models.AchievementRule{Type: models.DistinctEndings, Count: intPtr(2)}),
+			achievement("three-endings", models.AchievementRule{Type: models.DistinctEndings, Count: intPtr(3)}),
+		}, mt.Coll, mt.Coll, mt.Coll)
+
+		discovered := func(storyID, endingID string) bson.D {
+			return bson.D{
+				{Key: "storyID", Value: storyID},
+				{Key: "currentStoryNodeID", Value: endingID},
+				{Key: "endingsDiscovered", Value: bson.A{bson.D{
+					{Key: "endingID", Value: endingID},
+					{Key: "title", Value: endingID},
+					{Key: "outcome", Value: "neutral"},
+					{Key: "nodeID", Value: endingID},
+					{Key: "discoveredAt", Value: time.Now()},
+				}}},
+			}
+		}
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, bson.D{
+				{Key: "wixID", Value: wixID},
+				{Key: "storyStates", Value: bson.A{discovered("s", "lost"), discovered("t", "home")}},
+			}),
+			matchedResponse(),
+		)
+
+		unlocked, err := h.Evaluate(context.Background(), wixID, nil)
+
+		assert.NoError(t, err)
+		if assert.Len(t, unlocked, 1) {
+			assert.Equal(t, "two-endings", unlocked[0].AchievementID)
+		}
+	})
+}
+
+func TestEvaluate_UnlocksFromPendingChoice(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("the choice being handled counts", func(mt *mtest.T) {
+		wixID := uuid.New()
+		h := api.NewAchievementHandler([]models.Achievement{
+			achievement("plain-wits", models.AchievementRule{Type: models.FinishWithoutGatedChoices}),
+		}, mt.Coll, mt.Coll, mt.Coll)
+
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, playerDocument(wixID, "s", "end")),
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch),
+			matchedResponse(),
+		)
+
+		pending := models.ChoiceEvent{StoryID: "s", ToNodeID: "end", Completed: boolPtr(true), Gated: boolPtr(false)}
+		unlocked, err := h.Evaluate(context.Background(), wixID, &pending)
+
+		assert.NoError(t, err)
+		assert.Len(t, unlocked, 1)
+	})
+}
+
+func TestEvaluate_CollectAllWisdoms(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("every wisdom of the story held", func(mt *mtest.T) {
+		wixID := uuid.New()
+		h := api.NewAchievementHandler([]models.Achievement{
+			achievement("sage", models.AchievementRule{Type: models.CollectAllWisdoms, StoryID: strPtr("s")}),
+		}, mt.Coll, mt.Coll, mt.Coll)
+
+		wisdomElement := func(wisdomID string) bson.D {
+			return bson.D{{Key: "wisdoms", Value: bson.D{
+				{Key: wisdomID, Value: bson.D{{Key: "wisdomID", Value: wisdomID}, {Key: "name", Value: wisdomID}}},
+			}}}
+		}
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, playerDocument(wixID, "s", "start", "w1", "w2")),
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, wisdomElement("w1"), wisdomElement("w2")),
+			matchedResponse(),
+		)
+
+		unlocked, err := h.Evaluate(context.Background(), wixID, nil)
+
+		assert.NoError(t, err)
+		assert.Len(t, unlocked, 1)
+
+		update := mt.GetAllStartedEvents()[2].Command
+		filter := update.Lookup("updates").Array().Index(0).Value().Document().Lookup("q").Document()
+		assert.Equal(t, "sage", filter.Lookup("achievements.achievementID", "$ne").StringValue())
+	})
+}
+
+func TestEvaluate_GatedChoiceBlocksUngatedFinish(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("gated choice taken", func(mt *mtest.T) {
+		wixID := uuid.New()
+		h := api.NewAchievementHandler([]models.Achievement{
+			achievement("plain-wits", models.AchievementRule{Type: models.FinishWithoutGatedChoices}),
+		}, mt.Coll, mt.Coll, mt.Coll)
+
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, playerDocument(wixID, "s", "end")),
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch,
+				choiceEventDocument("s", "middle", false, true),
+				choiceEventDocument("s", "end", true, false)),
+		)
+
+		unlocked, err := h.Evaluate(context.Background(), wixID, nil)
+
+		assert.NoError(t, err)
+		assert.Empty(t, unlocked)
+	})
+}
+
+func TestEvaluate_SkipsUnlockedAchievements(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("nothing left to evaluate", func(mt *mtest.T) {
+		wixID := uuid.New()
+		h := api.NewAchievementHandler([]models.Achievement{
+			achievement("first-ending", models.AchievementRule{Type: models.DistinctEndings, Count: intPtr(1)}),
+		}, mt.Coll, mt.Coll, mt.Coll)
+
+		player := append(playerDocument(wixID, "s", "end"), bson.E{Key: "achievements", Value: bson.A{
+			bson.D{{Key: "achievementID", Value: "first-ending"}, {Key: "unlockedAt", Value: time.Now()}},
+		}})
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, player))
+
+		unlocked, err := h.Evaluate(context.Background(), wixID, nil)
+
+		assert.NoError(t, err)
+		assert.Empty(t, unlocked)
+		assert.Len(t, mt.GetAllStartedEvents(), 1, "choice events are not queried")
+	})
+}
+
+// GetPlayerAchievements
+
+func TestGetPlayerAchievements(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("unlocked achievements listed", func(mt *mtest.T) {
+		wixID := uuid.New()
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/", nil), rec)
+
+		h := api.NewAchievementHandler([]models.Achievement{
+			achievement("first-ending", models.AchievementRule{Type: models.DistinctEndings, Count: intPtr(1)}),
+		}, mt.Coll, mt.Coll, mt.Coll)
+
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, bson.D{
+			{Key: "wixID", Value: wixID},
+			{Key: "achievements", Value: bson.A{
+				bson.D{{Key: "achievementID", Value: "first-ending"}, {Key: "unlockedAt", Value: time.Now()}},
+				bson.D{{Key: "achievementID", Value: "retired"}, {Key: "unlockedAt", Value: time.Now()}},
+			}},
+		}))
+
+		err := h.GetPlayerAchievements(c, wixID.String())
+
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, rec.Code)
+		var achievements []models.PlayerAchievement
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &achievements))
+		if assert.Len(t, achievements, 2) {
+			assert.Equal(t, "Name of first-ending", achievements[0].Name)
+			assert.Equal(t, "retired", achievements[1].Name)
+		}
+	})
+}
+
+func TestGetPlayerAchievements_NotFound(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("player not found", func(mt *mtest.T) {
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/", nil), rec)
+
+		h := api.NewAchievementHandler(nil, mt.Coll, mt.Coll, mt.Coll)
+
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch))
+
+		h.GetPlayerAchievements(c, uuid.NewString())
+
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+		assert.Contains(t, rec.Body.String(), "Player not found")
+	})
+}
@@ -0,0 +1,31 @@
+package api
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// RequireAdmin returns a middleware that only lets through requests carrying the
+// given token as a bearer token in the Authorization header. Requests without a
+// token get a 401 status code and requests with a wrong one a 403. If no token is
+// configured, admin routes reject every request.
+func RequireAdmin(token string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if token == "" {
+				return c.JSON(http.StatusForbidden, "Admin access is not configured")
+			}
+			presented, ok := strings.CutPrefix(c.Request().Header.Get(echo.HeaderAuthorization), "Bearer ")
+			if !ok || presented == "" {
+				return c.JSON(http.StatusUnauthorized, "Missing admin token")
+			}
+			if subtle.ConstantTimeCompare([]byte(presented), []byte(token)) != 1 {
+				return c.JSON(http.StatusForbidden, "Invalid admin token")
+			}
+			return next(c)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package api_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/okcthulhu/ChooseYourOwnAdventure/api"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequireAdmin(t *testing.T) {
+	cases := []struct {
+		name          string
+		token         string
+		authorization string
+		status        int
+	}{
+		{"valid token", "s3cret", "Bearer s3cret", http.StatusOK},
+		{"missing token", "s3cret", "", http.StatusUnauthorized},
+		{"wrong scheme", "s3cret", "Basic s3cret", http.StatusUnauthorized},
+		{"wrong token", "s3cret", "Bearer guess", http.StatusForbidden},
+		{"not configured", "", "Bearer ", http.StatusForbidden},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/players", nil)
+			if tc.authorization != "" {
+				req.Header.Set(echo.HeaderAuthorization, tc.authorization)
+			}
+			rec := httptest.NewRecorder()
+			c := echo.New().NewContext(req, rec)
+
+			handler := api.RequireAdmin(tc.token)(func(c echo.Context) error {
+				return c.NoContent(http.StatusOK)
+			})
+			handler(c)
+
+			assert.Equal(t, tc.status, rec.Code)
+		})
+	}
+}
@@ -0,0 +1,357 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/okcthulhu/ChooseYourOwnAdventure/api/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// EventCollection defines the required behavior for interacting with
+// the recorded choice events in MongoDB. By isolating these methods, we can
+// easily swap out the actual MongoDB collection with a mock for testing.
+type EventCollection interface {
+	// InsertOne appends a new event document to the events collection.
+	InsertOne(ctx context.Context, document interface{}, opts ...*options.InsertOneOptions) (*mongo.InsertOneResult, error)
+
+	// Find returns a cursor over all event documents matching the filter.
+	Find(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (*mongo.Cursor, error)
+}
+
+// ChoiceEventIndexes are the indexes the choice events collection needs for the
+// story reports and for evaluating a player's achievements.
+var ChoiceEventIndexes = []mongo.IndexModel{
+	{Keys: bson.D{{Key: "storyID", Value: 1}, {Key: "occurredAt", Value: 1}}},
+	{Keys: bson.D{{Key: "wixID", Value: 1}}},
+}
+
+// AnalyticsHandler records choice events and serves the per-story progress
+// and funnel reports computed from them.
+type AnalyticsHandler struct {
+	// EventCol is an abstraction for the MongoDB collection containing choice events.
+	EventCol EventCollection
+
+	// Timeouts bounds the storage calls of each operation.
+	Timeouts Timeouts
+}
+
+// NewAnalyticsHandler creates a new AnalyticsHandler backed by the given event collection.
+func NewAnalyticsHandler(eventCol EventCollection) *AnalyticsHandler {
+	return &AnalyticsHandler{
+		EventCol: eventCol,
+		Timeouts: DefaultTimeouts,
+	}
+}
+
+// RecordChoice stores a single choice event.
+func (h *AnalyticsHandler) RecordChoice(ctx context.Context, event models.ChoiceEvent) error {
+	_, err := h.EventCol.InsertOne(ctx, event)
+	return err
+}
+
+// HandleEvent is an event bus subscriber that records the choice carried by
+// ChoiceTaken events. Other events are ignored. The bus may deliver an event more
+// than once, so the choice is stored under the event's ID and duplicates are dropped.
+func (h *AnalyticsHandler) HandleEvent(ctx context.Context, event models.DomainEvent) error {
+	if event.Type != models.ChoiceTaken || event.Choice == nil {
+		return nil
+	}
+	choice := *event.Choice
+	if event.Id != "" {
+		choice.Id = &event.Id
+	}
+	err := h.RecordChoice(ctx, choice)
+	if mongo.IsDuplicateKeyError(err) {
+		return nil
+	}
+	return err
+}
+
+// GetStoryReport builds the funnel report for a story from the choice events
+// recorded between the optional `from` and `to` query parameters (RFC 3339).
+// An invalid timestamp results in a 400 status code.
+func (h *AnalyticsHandler) GetStoryReport(c echo.Context, storyID string) error {
+	from, err := parseTimeParam(c.QueryParam("from"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, "Invalid from timestamp")
+	}
+	to, err := parseTimeParam(c.QueryParam("to"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, "Invalid to timestamp")
+	}
+
+	filter := bson.M{"storyID": storyID}
+	window := bson.M{}
+	if from != nil {
+		window["$gte"] = *from
+	}
+	if to != nil {
+		window["$lte"] = *to
+	}
+	if len(window) > 0 {
+		filter["occurredAt"] = window
+	}
+
+	ctx, cancel := h.Timeouts.context(c, "GetStoryReport")
+	defer cancel()
+
+	cursor, err := h.EventCol.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "occurredAt", Value: 1}}))
+	if err != nil {
+		return storageError(c, err, "to query choice events", "Failed to build story report")
+	}
+
+	var events []models.ChoiceEvent
+	if err := cursor.All(ctx, &events); err != nil {
+		return storageError(c, err, "to decode choice events", "Failed to build story report")
+	}
+
+	report := BuildStoryReport(storyID, events)
+	report.From = from
+	report.To = to
+
+	return c.JSON(http.StatusOK, report)
+}
+
+// BuildStoryReport aggregates choice events of a single story into a funnel report.
+// Events do not need to be sorted; they are ordered by occurrence before processing.
+func BuildStoryReport(storyID string, events []models.ChoiceEvent) models.StoryFunnelReport {
+	sorted := make([]models.ChoiceEvent, len(events))
+	copy(sorted, events)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].OccurredAt.Before(sorted[j].OccurredAt)
+	})
+
+	// Group every player's events together, preserving their order.
+	byPlayer := map[string][]models.ChoiceEvent{}
+	var players []string
+	for _, event := range sorted {
+		key := event.WixID.String()
+		if _, seen := byPlayer[key]; !seen {
+			players = append(players, key)
+		}
+		byPlayer[key] = append(byPlayer[key], event)
+	}
+
+	return models.StoryFunnelReport{
+		StoryID:        storyID,
+		NodePopulation: nodePopulation(players, byPlayer),
+		ChoiceRates:    choiceRates(sorted),
+		ChapterDropOff: chapterDropOff(sorted, players, byPlayer),
+		NodeDwellTimes: nodeDwellTimes(players, byPlayer),
+		Completion:     completion(players, byPlayer),
+	}
+}
+
+// nodePopulation counts, per node, the players whose latest choice left them there.
+func nodePopulation(players []string, byPlayer map[string][]models.ChoiceEvent) []models.NodePopulation {
+	counts := map[string]int{}
+	for _, player := range players {
+		events := byPlayer[player]
+		counts[events[len(events)-1].ToNodeID]++
+	}
+
+	population := make([]models.NodePopulation, 0, len(counts))
+	for nodeID, count := range counts {
+		population = append(population, models.NodePopulation{NodeID: nodeID, Players: count})
+	}
+	sort.Slice(population, func(i, j int) bool {
+		return population[i].NodeID < population[j].NodeID
+	})
+	return population
+}
+
+// choiceRates computes how often each choice was taken relative to all choices
+// taken at its node. A choice that led to several nodes, as one with outcomes
+// can, reports how often it led to each instead of a single next node.
+func choiceRates(events []models.ChoiceEvent) []models.ChoiceRate {
+	type choiceKey struct {
+		nodeID string
+		index  int
+	}
+
+	taken := map[choiceKey]*models.ChoiceRate{}
+	targets := map[choiceKey]map[string]int{}
+	totals := map[string]int{}
+	for _, event := range events {
+		key := choiceKey{event.FromNodeID, event.ChoiceIndex}
+		rate, ok := taken[key]
+		if !ok {
+			rate = &models.ChoiceRate{NodeID: event.FromNodeID, ChoiceIndex: event.ChoiceIndex}
+			taken[key] = rate
+			targets[key] = map[string]int{}
+		}
+		rate.Taken++
+		targets[key][event.ToNodeID]++
+		totals[event.FromNodeID]++
+	}
+
+	rates := make([]models.ChoiceRate, 0, len(taken))
+	for key, rate := range taken {
+		rate.Rate = float32(rate.Taken) / float32(totals[rate.NodeID])
+		counts := make([]models.ChoiceTarget, 0, len(targets[key]))
+		for nodeID, count := range targets[key] {
+			counts = append(counts, models.ChoiceTarget{NextNodeID: nodeID, Taken: count})
+		}
+		if len(counts) == 1 {
+			rate.NextNodeID = &counts[0].NextNodeID
+		} else {
+			sort.Slice(counts, func(i, j int) bool {
+				return counts[i].NextNodeID < counts[j].NextNodeID
+			})
+			rate.Targets = &counts
+		}
+		rates = append(rates, *rate)
+	}
+	sort.Slice(rates, func(i, j int) bool {
+		if rates[i].NodeID != rates[j].NodeID {
+			return rates[i].NodeID < rates[j].NodeID
+		}
+		return rates[i].ChoiceIndex < rates[j].ChoiceIndex
+	})
+	return rates
+}
+
+// chapterDropOff reports, per chapter in order of first appearance, how many
+// players reached it and how many moved on to another chapter or finished in it.
+func chapterDropOff(events []models.ChoiceEvent, players []string, byPlayer map[string][]models.ChoiceEvent) []models.ChapterDropOff {
+	var chapters []string
+	known := map[string]bool{}
+	addChapter := func(name *string) {
+		if name == nil || *name == "" || known[*name] {
+			return
+		}
+		known[*name] = true
+		chapters = append(chapters, *name)
+	}
+	for _, event := range events {
+		addChapter(event.ChapterName)
+		addChapter(event.NextChapterName)
+	}
+
+	reached := map[string]int{}
+	continued := map[string]int{}
+	for _, player := range players {
+		playerReached := map[string]bool{}
+		playerContinued := map[string]bool{}
+		for _, event := range byPlayer[player] {
+			from, to := deref(event.ChapterName), deref(event.NextChapterName)
+			if from != "" {
+				playerReached[from] = true
+			}
+			if to != "" {
+				playerReached[to] = true
+			}
+			if from != "" && to != "" && from != to {
+				playerContinued[from] = true
+			}
+			if to != "" && event.Completed != nil && *event.Completed {
+				playerContinued[to] = true
+			}
+		}
+		for chapter := range playerReached {
+			reached[chapter]++
+		}
+		for chapter := range playerContinued {
+			continued[chapter]++
+		}
+	}
+
+	dropOff := make([]models.ChapterDropOff, 0, len(chapters))
+	for _, chapter := range chapters {
+		entry := models.ChapterDropOff{
+			ChapterName: chapter,
+			Reached:     reached[chapter],
+			Continued:   continued[chapter],
+		}
+		if entry.Reached > 0 {
+			entry.DropOffRate = float32(entry.Reached-entry.Continued) / float32(entry.Reached)
+		}
+		dropOff = append(dropOff, entry)
+	}
+	return dropOff
+}
+
+// nodeDwellTimes measures the time between a player arriving at a node and
+// taking a choice there, and reports the median per node.
+func nodeDwellTimes(players []string, byPlayer map[string][]models.ChoiceEvent) []models.NodeDwellTime {
+	samples := map[string][]float64{}
+	for _, player := range players {
+		events := byPlayer[player]
+		for i := 1; i < len(events); i++ {
+			arrived, left := events[i-1], events[i]
+			if arrived.ToNodeID != left.FromNodeID {
+				continue
+			}
+			samples[left.FromNodeID] = append(samples[left.FromNodeID], left.OccurredAt.Sub(arrived.OccurredAt).Seconds())
+		}
+	}
+
+	dwell := make([]models.NodeDwellTime, 0, len(samples))
+	for nodeID, durations := range samples {
+		dwell = append(dwell, models.NodeDwellTime{
+			NodeID:        nodeID,
+			Samples:       len(durations),
+			MedianSeconds: float32(median(durations)),
+		})
+	}
+	sort.Slice(dwell, func(i, j int) bool {
+		return dwell[i].NodeID < dwell[j].NodeID
+	})
+	return dwell
+}
+
+// completion counts the players who took any choice and those who reached an ending.
+func completion(players []string, byPlayer map[string][]models.ChoiceEvent) models.CompletionStats {
+	stats := models.CompletionStats{Started: len(players)}
+	for _, player := range players {
+		for _, event := range byPlayer[player] {
+			if event.Completed != nil && *event.Completed {
+				stats.Completed++
+				break
+			}
+		}
+	}
+	if stats.Started > 0 {
+		stats.Rate = float32(stats.Completed) / float32(stats.Started)
+	}
+	return stats
+}
+
+func median(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sorted := make([]float64, len(values))
+	copy(sorted, values)
+	sort.Float64s(sorted)
+	mid := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[mid-1] + sorted[mid]) / 2
+	}
+	return sorted[mid]
+}
+
+func deref(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+// parseTimeParam parses an optional RFC 3339 query parameter.
+func parseTimeParam(value string) (*time.Time, error) {
+	if value == "" {
+		return nil, nil
+	}
+	parsed, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return nil, err
+	}
+	return &parsed, nil
+}
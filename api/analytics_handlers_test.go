@@ -0,0 +1,180 @@
+package api_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"github.com/okcthulhu/ChooseYourOwnAdventure/api"
+	"github.com/okcthulhu/ChooseYourOwnAdventure/api/models"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func strPtr(s string) *string { return &s }
+
+func boolPtr(b bool) *bool { return &b }
+
+// BuildStoryReport
+
+func TestBuildStoryReport_Funnel(t *testing.T) {
+	start := time.Date(2023, 11, 1, 12, 0, 0, 0, time.UTC)
+	alice, bob := uuid.New(), uuid.New()
+
+	events := []models.ChoiceEvent{
+		{StoryID: "s", WixID: alice, FromNodeID: "start", ToNodeID: "cave", ChoiceIndex: 0,
+			ChapterName: strPtr("one"), NextChapterName: strPtr("one"), OccurredAt: start},
+		{StoryID: "s", WixID: bob, FromNodeID: "start", ToNodeID: "forest", ChoiceIndex: 1,
+			ChapterName: strPtr("one"), NextChapterName: strPtr("one"), OccurredAt: start.Add(time.Second)},
+		{StoryID: "s", WixID: alice, FromNodeID: "cave", ToNodeID: "end", ChoiceIndex: 0,
+			ChapterName: strPtr("one"), NextChapterName: strPtr("two"), Completed: boolPtr(true), OccurredAt: start.Add(30 * time.Second)},
+	}
+
+	report := api.BuildStoryReport("s", events)
+
+	assert.Equal(t, []models.NodePopulation{{NodeID: "end", Players: 1}, {NodeID: "forest", Players: 1}}, report.NodePopulation)
+	assert.Equal(t, []models.ChoiceRate{
+		{NodeID: "cave", ChoiceIndex: 0, NextNodeID: strPtr("end"), Taken: 1, Rate: 1},
+		{NodeID: "start", ChoiceIndex: 0, NextNodeID: strPtr("cave"), Taken: 1, Rate: 0.5},
+		{NodeID: "start", ChoiceIndex: 1, NextNodeID: strPtr("forest"), Taken: 1, Rate: 0.5},
+	}, report.ChoiceRates)
+	assert.Equal(t, []models.ChapterDropOff{
+		{ChapterName: "one", Reached: 2, Continued: 1, DropOffRate: 0.5},
+		{ChapterName: "two", Reached: 1, Continued: 1, DropOffRate: 0},
+	}, report.ChapterDropOff)
+	assert.Equal(t, []models.NodeDwellTime{{NodeID: "cave", Samples: 1, MedianSeconds: 30}}, report.NodeDwellTimes)
+	assert.Equal(t, models.CompletionStats{Started: 2, Completed: 1, Rate: 0.5}, report.Completion)
+}
+
+func TestBuildStoryReport_ChanceChoice(t *testing.T) {
+	start := time.Date(2023, 11, 1, 12, 0, 0, 0, time.UTC)
+	alice, bob, carol := uuid.New(), uuid.New(), uuid.New()
+
+	events := []models.ChoiceEvent{
+		{StoryID: "s", WixID: alice, FromNodeID: "start", ToNodeID: "win", ChoiceIndex: 0, OccurredAt: start},
+		{StoryID: "s", WixID: bob, FromNodeID: "start", ToNodeID: "lose", ChoiceIndex: 0, OccurredAt: start},
+		{StoryID: "s", WixID: carol, FromNodeID: "start", ToNodeID: "win", ChoiceIndex: 0, OccurredAt: start},
+	}
+
+	report := api.BuildStoryReport("s", events)
+
+	assert.Equal(t, []models.ChoiceRate{{
+		NodeID: "start", ChoiceIndex: 0, Taken: 3, Rate: 1,
+		Targets: &[]models.ChoiceTarget{{NextNodeID: "lose", Taken: 1}, {NextNodeID: "win", Taken: 2}},
+	}}, report.ChoiceRates, "a choice that led to several nodes has no single next node")
+}
+
+func TestBuildStoryReport_NoEvents(t *testing.T) {
+	report := api.BuildStoryReport("s", nil)
+
+	assert.Equal(t, "s", report.StoryID)
+	assert.Empty(t, report.NodePopulation)
+	assert.Empty(t, report.ChoiceRates)
+	assert.Equal(t, models.CompletionStats{}, report.Completion)
+}
+
+// GetStoryReport
+
+func TestGetStoryReport_ReportBuilt(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("report built", func(mt *mtest.T) {
+		req := httptest.NewRequest(http.MethodGet, "/stories/s/analytics?from=2023-11-01T00:00:00Z", nil)
+		rec := httptest.NewRecorder()
+		e := echo.New()
+		c := e.NewContext(req, rec)
+
+		h := api.NewAnalyticsHandler(mt.Coll)
+
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, bson.D{
+			{Key: "storyID", Value: "s"},
+			{Key: "wixID", Value: uuid.New()},
+			{Key: "fromNodeID", Value: "start"},
+			{Key: "toNodeID", Value: "cave"},
+			{Key: "choiceIndex", Value: 0},
+			{Key: "occurredAt", Value: time.Date(2023, 11, 2, 0, 0, 0, 0, time.UTC)},
+		}))
+
+		err := h.GetStoryReport(c, "s")
+
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Contains(t, rec.Body.String(), `"nodePopulation":[{"nodeID":"cave","players":1}]`)
+		assert.Contains(t, rec.Body.String(), `"from":"2023-11-01T00:00:00Z"`)
+	})
+}
+
+func TestGetStoryReport_InvalidWindow(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("invalid from timestamp", func(mt *mtest.T) {
+		req := httptest.NewRequest(http.MethodGet, "/stories/s/analytics?from=yesterday", nil)
+		rec := httptest.NewRecorder()
+		e := echo.New()
+		c := e.NewContext(req, rec)
+
+		h := api.NewAnalyticsHandler(mt.Coll)
+		h.GetStoryReport(c, "s")
+
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+		assert.Contains(t, rec.Body.String(), "Invalid from timestamp")
+	})
+}
+
+func TestGetStoryReport_QueryFailed(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("query failed", func(mt *mtest.T) {
+		req := httptest.NewRequest(http.MethodGet, "/stories/s/analytics", nil)
+		rec := httptest.NewRecorder()
+		e := echo.New()
+		c := e.NewContext(req, rec)
+
+		h := api.NewAnalyticsHandler(mt.Coll)
+
+		mt.AddMockResponses(bson.D{{Key: "ok", Value: 0}, {Key: "errmsg", Value: "Internal Server Error"}})
+
+		h.GetStoryReport(c, "s")
+
+		assert.Equal(t, http.StatusInternalServerError, rec.Code)
+		assert.Contains(t, rec.Body.String(), "Failed to build story report")
+	})
+}
+
+// HandleEvent
+
+func TestHandleEvent_RecordsChoiceTaken(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("choice recorded", func(mt *mtest.T) {
+		h := api.NewAnalyticsHandler(mt.Coll)
+
+		mt.AddMockResponses(mtest.CreateSuccessResponse())
+
+		err := h.HandleEvent(context.Background(), models.DomainEvent{
+			Type:   models.ChoiceTaken,
+			Choice: &models.ChoiceEvent{StoryID: "s", FromNodeID: "start", ToNodeID: "cave"},
+		})
+
+		assert.NoError(t, err)
+		assert.Equal(t, "insert", mt.GetStartedEvent().CommandName)
+	})
+
+	mt.Run("other events ignored", func(mt *mtest.T) {
+		h := api.NewAnalyticsHandler(mt.Coll)
+
+		err := h.HandleEvent(context.Background(), models.DomainEvent{Type: models.PlayerCreated})
+
+		assert.NoError(t, err)
+		assert.Nil(t, mt.GetStartedEvent())
+	})
+}
@@ -0,0 +1,428 @@
+package api
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"github.com/okcthulhu/ChooseYourOwnAdventure/api/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// DefaultMaxUploadSize bounds the content of an uploaded asset unless configured otherwise.
+const DefaultMaxUploadSize = 200 << 20
+
+// multipartOverhead is what the multipart encoding of an upload may add to its content.
+const multipartOverhead = 1 << 20
+
+// assetCacheControl lets browsers and CDNs keep asset content for good: the
+// content of an asset never changes.
+const assetCacheControl = "public, max-age=31536000, immutable"
+
+// AssetCollection defines the required behavior for interacting with
+// the asset records in MongoDB. By isolating these methods, we can
+// easily swap out the actual MongoDB collection with a mock for testing.
+type AssetCollection interface {
+	// InsertOne adds a new asset record.
+	InsertOne(ctx context.Context, document interface{}, opts ...*options.InsertOneOptions) (*mongo.InsertOneResult, error)
+
+	// FindOne looks up a single asset record matching the filter.
+	FindOne(ctx context.Context, filter interface{}, opts ...*options.FindOneOptions) *mongo.SingleResult
+
+	// Find returns a cursor over the asset records matching the filter.
+	Find(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (*mongo.Cursor, error)
+
+	// DeleteOne removes a single asset record matching the filter.
+	DeleteOne(ctx context.Context, filter interface{}, opts ...*options.DeleteOptions) (*mongo.DeleteResult, error)
+}
+
+// AssetIndexes are the indexes the assets collection needs. Uploads of content
+// that is already stored return the existing asset, which is looked up by its
+// checksum; the index being unique settles concurrent uploads of the same content.
+var AssetIndexes = []mongo.IndexModel{
+	{Keys: bson.D{{Key: "checksum", Value: 1}}, Options: options.Index().SetUnique(true)},
+}
+
+// AssetLookup looks up assets by their IDs.
+type AssetLookup interface {
+	// FindAssets returns the assets with the given IDs that exist, by ID.
+	FindAssets(ctx context.Context, assetIDs []string) (map[string]models.Asset, error)
+}
+
+// AssetHandler serves the media assets that story elements use as art and video.
+// The asset records are kept in MongoDB and their content in a blob store.
+type AssetHandler struct {
+	// AssetCol is an abstraction for the MongoDB collection containing asset records.
+	AssetCol AssetCollection
+
+	// StoryCol is scanned for references to assets that do not exist.
+	StoryCol StoryCollection
+
+	// Blobs keeps the content of the assets.
+	Blobs BlobStore
+
+	// MaxSize bounds the content of an uploaded asset in bytes.
+	MaxSize int64
+
+	// Signer verifies the signed URLs the content is requested with. It may be
+	// nil, in which case the content is served to everyone.
+	Signer *MediaSigner
+
+	// Timeouts bounds the storage calls of each operation.
+	Timeouts Timeouts
+
+	now func() time.Time
+}
+
+// NewAssetHandler creates a new AssetHandler keeping the asset records in assetCol
+// and their content in blobs.
+func NewAssetHandler(assetCol AssetCollection, storyCol StoryCollection, blobs BlobStore) *AssetHandler {
+	return &AssetHandler{
+		AssetCol: assetCol,
+		StoryCol: storyCol,
+		Blobs:    blobs,
+		MaxSize:  DefaultMaxUploadSize,
+		Timeouts: DefaultTimeouts,
+		now:      time.Now,
+	}
+}
+
+// MaxBody is the largest request body UploadAsset accepts.
+func (h *AssetHandler) MaxBody() int64 {
+	return h.MaxSize + multipartOverhead
+}
+
+// UploadAsset stores the image or video uploaded as the file field of a multipart
+// form. Its media type is sniffed from the content, and PNG, JPEG, GIF and WebP
+// images and MP4 and WebM videos are accepted; anything else gets a 415 status
+// code and content over the size limit a 413. The record of the new asset is
+// returned with a 201 status code. Content that is already stored is not stored
+// again; the existing asset is returned with a 200 status code.
+func (h *AssetHandler) UploadAsset(c echo.Context) error {
+	c.Request().Body = http.MaxBytesReader(c.Response(), c.Request().Body, h.MaxBody())
+	header, err := c.FormFile("file")
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return c.JSON(http.StatusRequestEntityTooLarge, "Asset too large")
+		}
+		return c.JSON(http.StatusBadRequest, "Missing file")
+	}
+	if header.Size > h.MaxSize {
+		return c.JSON(http.StatusRequestEntityTooLarge, "Asset too large")
+	}
+	file, err := header.Open()
+	if err != nil {
+		slog.ErrorContext(c.Request().Context(), "Failed to open uploaded asset", "error", err)
+		return c.JSON(http.StatusInternalServerError, "Failed to read the upload")
+	}
+	defer file.Close()
+
+	sniffed := make([]byte, 512)
+	n, err := io.ReadFull(file, sniffed)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return c.JSON(http.StatusBadRequest, "Failed to read the upload")
+	}
+	contentType := http.DetectContentType(sniffed[:n])
+	kind, ok := assetKinds[contentType]
+	if !ok {
+		return c.JSON(http.StatusUnsupportedMediaType, "Unsupported media type "+contentType)
+	}
+
+	hash := sha256.New()
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return c.JSON(http.StatusInternalServerError, "Failed to read the upload")
+	}
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, "Failed to read the upload")
+	}
+
+	asset := models.Asset{
+		AssetID:     uuid.NewString(),
+		Checksum:    hex.EncodeToString(hash.Sum(nil)),
+		ContentType: contentType,
+		Kind:        models.AssetKind(kind),
+		Size:        size,
+		CreatedAt:   h.now().UTC(),
+	}
+	asset.Url = "/assets/" + asset.AssetID + "/content"
+	if header.Filename != "" {
+		asset.Filename = &header.Filename
+	}
+	switch contentType {
+	case "image/png", "image/jpeg", "image/gif":
+		if _, err := file.Seek(0, io.SeekStart); err == nil {
+			if width, height, ok := imageSize(file); ok {
+				asset.Width, asset.Height = &width, &height
+			}
+		}
+	case "video/mp4":
+		if duration, ok := mp4Duration(file, size); ok {
+			asset.Duration = &duration
+		}
+	}
+
+	ctx, cancel := h.Timeouts.context(c, "UploadAsset")
+	defer cancel()
+
+	existing, err := h.findByChecksum(ctx, asset.Checksum)
+	if err == nil {
+		return c.JSON(http.StatusOK, existing)
+	}
+	if err != mongo.ErrNoDocuments {
+		return storageError(c, err, "to look up asset", "Failed to store asset")
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return c.JSON(http.StatusInternalServerError, "Failed to read the upload")
+	}
+	if err := h.Blobs.Put(ctx, asset.AssetID, file, contentType); err != nil {
+		return storageError(c, err, "to store asset content", "Failed to store asset")
+	}
+	if _, err := h.AssetCol.InsertOne(ctx, asset); err != nil {
+		// Content without a record is never served, so it is removed.
+		h.deleteBlob(ctx, asset.AssetID)
+		if mongo.IsDuplicateKeyError(err) {
+			// The same content was uploaded concurrently.
+			if existing, err := h.findByChecksum(ctx, asset.Checksum); err == nil {
+				return c.JSON(http.StatusOK, existing)
+			}
+		}
+		return storageError(c, err, "to insert asset", "Failed to store asset")
+	}
+
+	return c.JSON(http.StatusCreated, asset)
+}
+
+// findByChecksum looks up the asset with the given content checksum.
+func (h *AssetHandler) findByChecksum(ctx context.Context, checksum string) (models.Asset, error) {
+	var asset models.Asset
+	err := h.AssetCol.FindOne(ctx, bson.M{"checksum": checksum}).Decode(&asset)
+	return asset, err
+}
+
+// deleteBlob removes the content of an asset. A failure is logged rather than
+// failing the request; content left behind takes room but is never served.
+func (h *AssetHandler) deleteBlob(ctx context.Context, assetID string) {
+	ctx, cancel := h.Timeouts.detached(ctx)
+	defer cancel()
+	if err := h.Blobs.Delete(ctx, assetID); err != nil {
+		slog.ErrorContext(ctx, "Failed to delete asset content", "assetID", assetID, "error", err)
+	}
+}
+
+// GetAsset returns the record of an asset. A 404 status code is returned if the
+// asset does not exist.
+func (h *AssetHandler) GetAsset(c echo.Context, assetID string) error {
+	ctx, cancel := h.Timeouts.context(c, "GetAsset")
+	defer cancel()
+
+	var asset models.Asset
+	if err := h.AssetCol.FindOne(ctx, bson.M{"_id": assetID}).Decode(&asset); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return c.JSON(http.StatusNotFound, "Asset not found")
+		}
+		return storageError(c, err, "to load asset", "Failed to load asset")
+	}
+	return c.JSON(http.StatusOK, asset)
+}
+
+// GetAssetContent serves the content of an asset with its media type. The
+// content never changes, so it is tagged with its checksum and may be kept for
+// good; range requests are served when the blob store can seek. With a signer,
+// only requests carrying a valid signed URL or the admin token are served, the
+// others get a 403 status code, and the content is only kept until the URL
+// expires. A 404 status code is returned if the asset or its content does not exist.
+func (h *AssetHandler) GetAssetContent(c echo.Context, assetID string) error {
+	cacheControl := assetCacheControl
+	if h.Signer != nil && ActorFrom(c.Request().Context()) != ActorAdmin {
+		remaining, ok := h.Signer.Verify(assetID, c.QueryParams())
+		if !ok {
+			return c.JSON(http.StatusForbidden, "Invalid or expired media URL")
+		}
+		cacheControl = "private, max-age=" + strconv.Itoa(int(remaining.Seconds()))
+	}
+
+	ctx, cancel := h.Timeouts.context(c, "GetAssetContent")
+	defer cancel()
+
+	var asset models.Asset
+	if err := h.AssetCol.FindOne(ctx, bson.M{"_id": assetID}).Decode(&asset); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return c.JSON(http.StatusNotFound, "Asset not found")
+		}
+		return storageError(c, err, "to load asset", "Failed to load asset")
+	}
+
+	// The content may take longer to send than the storage calls may take.
+	content, err := h.Blobs.Get(c.Request().Context(), asset.AssetID)
+	if err != nil {
+		if errors.Is(err, ErrBlobNotFound) {
+			return c.JSON(http.StatusNotFound, "Asset content not found")
+		}
+		return storageError(c, err, "to load asset content", "Failed to load asset content")
+	}
+	defer content.Close()
+
+	header := c.Response().Header()
+	header.Set(echo.HeaderContentType, asset.ContentType)
+	header.Set(ETagHeader, `"`+asset.Checksum+`"`)
+	header.Set(echo.HeaderCacheControl, cacheControl)
+	if seeker, ok := content.(io.ReadSeeker); ok {
+		http.ServeContent(c.Response(), c.Request(), "", asset.CreatedAt, seeker)
+		return nil
+	}
+	if noneMatch(c.Request().Header.Get(IfNoneMatchHeader), `"`+asset.Checksum+`"`) {
+		return c.NoContent(http.StatusNotModified)
+	}
+	header.Set(echo.HeaderContentLength, strconv.FormatInt(asset.Size, 10))
+	return c.Stream(http.StatusOK, asset.ContentType, content)
+}
+
+// DeleteAsset removes an asset and its content. Story elements referencing the
+// asset keep doing so and show up in the missing asset report. A 404 status
+// code is returned if the asset does not exist.
+func (h *AssetHandler) DeleteAsset(c echo.Context, assetID string) error {
+	ctx, cancel := h.Timeouts.context(c, "DeleteAsset")
+	defer cancel()
+
+	result, err := h.AssetCol.DeleteOne(ctx, bson.M{"_id": assetID})
+	if err != nil {
+		return storageError(c, err, "to delete asset", "Delete failed due to an internal error")
+	}
+	if result.DeletedCount == 0 {
+		return c.JSON(http.StatusNotFound, "Asset not found")
+	}
+	h.deleteBlob(ctx, assetID)
+
+	return c.JSON(http.StatusOK, "Asset deleted successfully")
+}
+
+// FindAssets returns the assets with the given IDs that exist, by ID.
+func (h *AssetHandler) FindAssets(ctx context.Context, assetIDs []string) (map[string]models.Asset, error) {
+	found := make(map[string]models.Asset, len(assetIDs))
+	if len(assetIDs) == 0 {
+		return found, nil
+	}
+	cursor, err := h.AssetCol.Find(ctx, bson.M{"_id": bson.M{"$in": assetIDs}})
+	if err != nil {
+		return nil, err
+	}
+	var assets []models.Asset
+	if err := cursor.All(ctx, &assets); err != nil {
+		return nil, err
+	}
+	for _, asset := range assets {
+		found[asset.AssetID] = asset
+	}
+	return found, nil
+}
+
+// assetReference is a field of a story element referencing an asset of the
+// given kind. setURL sets the URL field the asset takes the place of.
+type assetReference struct {
+	field   string
+	assetID string
+	kind    models.AssetKind
+	setURL  func(url string)
+}
+
+// assetReferences returns the asset references of a story element, ordered by field.
+func assetReferences(storyElement *models.StoryElement) []assetReference {
+	var references []assetReference
+	add := func(field string, assetID *string, kind models.AssetKind, setURL func(url string)) {
+		if assetID != nil && *assetID != "" {
+			references = append(references, assetReference{field: field, assetID: *assetID, kind: kind, setURL: setURL})
+		}
+	}
+	add("artAssetID", storyElement.ArtAssetID, models.AssetKindImage, func(url string) { storyElement.ArtURL = &url })
+	if storyElement.Choices != nil {
+		choices := *storyElement.Choices
+		for i := range choices {
+			choice := &choices[i]
+			add(fmt.Sprintf("choices.%d.imageAssetID", i), choice.ImageAssetID, models.AssetKindImage, func(url string) { choice.ImageUrl = &url })
+		}
+	}
+	add("videoAssetID", storyElement.VideoAssetID, models.AssetKindVideo, func(url string) { storyElement.VideoURL = &url })
+	if storyElement.Wisdoms != nil {
+		wisdoms := *storyElement.Wisdoms
+		for _, wisdomID := range sortedKeys(wisdoms) {
+			wisdomID := wisdomID
+			add("wisdoms."+wisdomID+".artAssetID", wisdoms[wisdomID].ArtAssetID, models.AssetKindImage, func(url string) {
+				// Map values cannot be changed in place.
+				wisdom := wisdoms[wisdomID]
+				wisdom.ArtURL = &url
+				wisdoms[wisdomID] = wisdom
+			})
+		}
+	}
+	return references
+}
+
+// GetMissingAssets reports the story elements referencing assets that do not
+// exist, ordered by story, node and field. The report can be narrowed to a story
+// with the storyID query parameter.
+func (h *AssetHandler) GetMissingAssets(c echo.Context) error {
+	ctx, cancel := h.Timeouts.context(c, "GetMissingAssets")
+	defer cancel()
+
+	filter := bson.M{}
+	if storyID := c.QueryParam("storyID"); storyID != "" {
+		filter["storyID"] = storyID
+	}
+	projection := bson.M{"storyID": 1, "nodeID": 1, "artAssetID": 1, "videoAssetID": 1, "choices": 1, "wisdoms": 1}
+	cursor, err := h.StoryCol.Find(ctx, filter, options.Find().SetProjection(projection))
+	if err != nil {
+		return storageError(c, err, "to query story elements", "Failed to report missing assets")
+	}
+	var elements []models.StoryElement
+	if err := cursor.All(ctx, &elements); err != nil {
+		return storageError(c, err, "to decode story elements", "Failed to report missing assets")
+	}
+
+	var references []models.MissingAssetReference
+	referenced := map[string]bool{}
+	for i := range elements {
+		for _, reference := range assetReferences(&elements[i]) {
+			references = append(references, models.MissingAssetReference{
+				StoryID: elements[i].StoryID,
+				NodeID:  elements[i].NodeID,
+				Field:   reference.field,
+				AssetID: reference.assetID,
+			})
+			referenced[reference.assetID] = true
+		}
+	}
+	assets, err := h.FindAssets(ctx, sortedKeys(referenced))
+	if err != nil {
+		return storageError(c, err, "to look up assets", "Failed to report missing assets")
+	}
+
+	report := models.MissingAssetReport{Items: []models.MissingAssetReference{}}
+	for _, reference := range references {
+		if _, ok := assets[reference.AssetID]; !ok {
+			report.Items = append(report.Items, reference)
+		}
+	}
+	sort.SliceStable(report.Items, func(i, j int) bool {
+		a, b := report.Items[i], report.Items[j]
+		if a.StoryID != b.StoryID {
+			return a.StoryID < b.StoryID
+		}
+		return a.NodeID < b.NodeID
+	})
+	return c.JSON(http.StatusOK, report)
+}
@@ -0,0 +1,381 @@
+package api_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"image"
+	"image/png"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/okcthulhu/ChooseYourOwnAdventure/api"
+	"github.com/okcthulhu/ChooseYourOwnAdventure/api/models"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+// pngImage encodes a blank PNG image of the given dimensions.
+func pngImage(width, height int) []byte {
+	var buf bytes.Buffer
+	png.Encode(&buf, image.NewGray(image.Rect(0, 0, width, height)))
+	return buf.Bytes()
+}
+
+// mp4Video builds the boxes of an MP4 video lasting duration units of timescale.
+func mp4Video(timescale, duration uint32) []byte {
+	box := func(boxType string, payload []byte) []byte {
+		header := make([]byte, 8)
+		binary.BigEndian.PutUint32(header, uint32(8+len(payload)))
+		copy(header[4:], boxType)
+		return append(header, payload...)
+	}
+	mvhd := make([]byte, 100)
+	binary.BigEndian.PutUint32(mvhd[12:], timescale)
+	binary.BigEndian.PutUint32(mvhd[16:], duration)
+	video := box("ftyp", []byte("mp42\x00\x00\x00\x00mp42isom"))
+	video = append(video, box("mdat", make([]byte, 64))...)
+	return append(video, box("moov", box("mvhd", mvhd))...)
+}
+
+// uploadRequest posts content as the file field of a multipart form.
+func uploadRequest(filename string, content []byte) *http.Request {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	file, _ := form.CreateFormFile("file", filename)
+	file.Write(content)
+	form.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/assets", &body)
+	req.Header.Set(echo.HeaderContentType, form.FormDataContentType())
+	return req
+}
+
+func assetDocument(assetID string, kind models.AssetKind) bson.D {
+	return bson.D{
+		{Key: "_id", Value: assetID},
+		{Key: "kind", Value: string(kind)},
+		{Key: "contentType", Value: "image/png"},
+		{Key: "size", Value: int64(4)},
+		{Key: "checksum", Value: "checksum-of-" + assetID},
+		{Key: "url", Value: "/assets/" + assetID + "/content"},
+		{Key: "createdAt", Value: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)},
+	}
+}
+
+func newAssetHandler(t *testing.T, mt *mtest.T) (*api.AssetHandler, *api.LocalBlobStore) {
+	blobs, err := api.NewLocalBlobStore(t.TempDir())
+	assert.NoError(t, err)
+	return api.NewAssetHandler(mt.Coll, mt.Coll, blobs), blobs
+}
+
+func TestUploadAsset(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("image stored and measured", func(mt *mtest.T) {
+		h, blobs := newAssetHandler(t, mt)
+		content := pngImage(3, 2)
+		sum := sha256.Sum256(content)
+
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch), mtest.CreateSuccessResponse())
+		rec := httptest.NewRecorder()
+		assert.NoError(t, h.UploadAsset(echo.New().NewContext(uploadRequest("door.png", content), rec)))
+
+		assert.Equal(t, http.StatusCreated, rec.Code)
+		var asset models.Asset
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &asset))
+		assert.Equal(t, models.AssetKindImage, asset.Kind)
+		assert.Equal(t, "image/png", asset.ContentType)
+		assert.Equal(t, hex.EncodeToString(sum[:]), asset.Checksum)
+		assert.Equal(t, int64(len(content)), asset.Size)
+		assert.Equal(t, "/assets/"+asset.AssetID+"/content", asset.Url)
+		if assert.NotNil(t, asset.Width) && assert.NotNil(t, asset.Height) {
+			assert.Equal(t, 3, *asset.Width)
+			assert.Equal(t, 2, *asset.Height)
+		}
+		if assert.NotNil(t, asset.Filename) {
+			assert.Equal(t, "door.png", *asset.Filename)
+		}
+
+		stored, err := blobs.Get(context.Background(), asset.AssetID)
+		if assert.NoError(t, err) {
+			defer stored.Close()
+			data, _ := io.ReadAll(stored)
+			assert.Equal(t, content, data)
+		}
+	})
+
+	mt.Run("video length read", func(mt *mtest.T) {
+		h, _ := newAssetHandler(t, mt)
+
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch), mtest.CreateSuccessResponse())
+		rec := httptest.NewRecorder()
+		h.UploadAsset(echo.New().NewContext(uploadRequest("intro.mp4", mp4Video(1000, 12500)), rec))
+
+		assert.Equal(t, http.StatusCreated, rec.Code)
+		var asset models.Asset
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &asset))
+		assert.Equal(t, models.AssetKindVideo, asset.Kind)
+		if assert.NotNil(t, asset.Duration) {
+			assert.Equal(t, 12.5, *asset.Duration)
+		}
+	})
+
+	mt.Run("stored content not stored again", func(mt *mtest.T) {
+		h, _ := newAssetHandler(t, mt)
+
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, assetDocument("existing", models.AssetKindImage)))
+		rec := httptest.NewRecorder()
+		h.UploadAsset(echo.New().NewContext(uploadRequest("door.png", pngImage(3, 2)), rec))
+
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Contains(t, rec.Body.String(), `"assetID":"existing"`)
+		assert.Len(t, mt.GetAllStartedEvents(), 1, "nothing is inserted")
+	})
+
+	mt.Run("unsupported media type", func(mt *mtest.T) {
+		h, _ := newAssetHandler(t, mt)
+
+		rec := httptest.NewRecorder()
+		h.UploadAsset(echo.New().NewContext(uploadRequest("door.png", []byte("not an image")), rec))
+
+		assert.Equal(t, http.StatusUnsupportedMediaType, rec.Code)
+		assert.Empty(t, mt.GetAllStartedEvents())
+	})
+
+	mt.Run("too large", func(mt *mtest.T) {
+		h, _ := newAssetHandler(t, mt)
+		h.MaxSize = 10
+
+		rec := httptest.NewRecorder()
+		h.UploadAsset(echo.New().NewContext(uploadRequest("door.png", pngImage(3, 2)), rec))
+
+		assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+	})
+}
+
+func TestGetAssetContent(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("served with its checksum as ETag", func(mt *mtest.T) {
+		h, blobs := newAssetHandler(t, mt)
+		assert.NoError(t, blobs.Put(context.Background(), "a1", strings.NewReader("data"), "image/png"))
+
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, assetDocument("a1", models.AssetKindImage)))
+		rec := httptest.NewRecorder()
+		h.GetAssetContent(echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/assets/a1/content", nil), rec), "a1")
+
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "data", rec.Body.String())
+		assert.Equal(t, "image/png", rec.Header().Get(echo.HeaderContentType))
+		assert.Equal(t, `"checksum-of-a1"`, rec.Header().Get(api.ETagHeader))
+		assert.Contains(t, rec.Header().Get(echo.HeaderCacheControl), "immutable")
+
+		req := httptest.NewRequest(http.MethodGet, "/assets/a1/content", nil)
+		req.Header.Set(api.IfNoneMatchHeader, `"checksum-of-a1"`)
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, assetDocument("a1", models.AssetKindImage)))
+		rec = httptest.NewRecorder()
+		h.GetAssetContent(echo.New().NewContext(req, rec), "a1")
+
+		assert.Equal(t, http.StatusNotModified, rec.Code)
+	})
+
+	mt.Run("content missing", func(mt *mtest.T) {
+		h, _ := newAssetHandler(t, mt)
+
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, assetDocument("a1", models.AssetKindImage)))
+		rec := httptest.NewRecorder()
+		h.GetAssetContent(echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/assets/a1/content", nil), rec), "a1")
+
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+	})
+}
+
+func TestGetAssetContent_Signed(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("only served through signed URLs", func(mt *mtest.T) {
+		h, blobs := newAssetHandler(t, mt)
+		h.Signer = api.NewMediaSigner("s3cret")
+		assert.NoError(t, blobs.Put(context.Background(), "a1", strings.NewReader("data"), "image/png"))
+		e := echo.New()
+		e.Use(api.IdentifyActor("admin-token"))
+		e.GET("/assets/:assetID/content", func(c echo.Context) error {
+			return h.GetAssetContent(c, c.Param("assetID"))
+		})
+		get := func(target, authorization string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest(http.MethodGet, target, nil)
+			if authorization != "" {
+				req.Header.Set(echo.HeaderAuthorization, authorization)
+			}
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, req)
+			return rec
+		}
+
+		assert.Equal(t, http.StatusForbidden, get("/assets/a1/content", "").Code)
+		assert.Empty(t, mt.GetAllStartedEvents(), "unsigned requests do not reach the storage")
+
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, assetDocument("a1", models.AssetKindImage)))
+		rec := get(h.Signer.Sign("a1", models.AssetKindImage), "")
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "data", rec.Body.String())
+		assert.True(t, strings.HasPrefix(rec.Header().Get(echo.HeaderCacheControl), "private, max-age="), "content is kept no longer than the URL is valid")
+
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, assetDocument("a1", models.AssetKindImage)))
+		assert.Equal(t, http.StatusOK, get("/assets/a1/content", "Bearer admin-token").Code, "admins need no signature")
+	})
+}
+
+func TestGetNeighborhood_SignedPreload(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("preloaded media can be fetched", func(mt *mtest.T) {
+		assets, blobs := newAssetHandler(t, mt)
+		signer := api.NewMediaSigner("s3cret")
+		assets.Signer = signer
+		stories := api.NewStoryHandler(mt.Coll)
+		stories.Media = signer
+		assert.NoError(t, blobs.Put(context.Background(), "v1", strings.NewReader("data"), "video/mp4"))
+		e := echo.New()
+		e.Use(api.IdentifyActor("admin-token"))
+		e.GET("/stories/:storyID/elements/:nodeID/neighborhood", func(c echo.Context) error {
+			return stories.GetNeighborhood(c, c.Param("storyID"), c.Param("nodeID"))
+		})
+		e.GET("/assets/:assetID/content", func(c echo.Context) error {
+			return assets.GetAssetContent(c, c.Param("assetID"))
+		})
+
+		start := append(storyElementDocument("s", "start"),
+			bson.E{Key: "videoAssetID", Value: "v1"}, bson.E{Key: "videoURL", Value: "/assets/v1/content"})
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, start))
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/stories/s/elements/start/neighborhood?depth=0", nil))
+
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "private, no-store", rec.Header().Get(echo.HeaderCacheControl), "signed URLs expire")
+		var neighborhood models.StoryNeighborhood
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &neighborhood))
+		if assert.Len(t, neighborhood.Preload, 1) {
+			assert.Equal(t, *neighborhood.Elements[0].VideoURL, neighborhood.Preload[0].Url)
+
+			mt.AddMockResponses(mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, assetDocument("v1", models.AssetKindVideo)))
+			rec = httptest.NewRecorder()
+			e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, neighborhood.Preload[0].Url, nil))
+
+			assert.Equal(t, http.StatusOK, rec.Code)
+			assert.Equal(t, "data", rec.Body.String())
+		}
+
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, start))
+		req := httptest.NewRequest(http.MethodGet, "/stories/s/elements/start/neighborhood?depth=0", nil)
+		req.Header.Set(echo.HeaderAuthorization, "Bearer admin-token")
+		rec = httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &neighborhood))
+		assert.Equal(t, "/assets/v1/content", neighborhood.Preload[0].Url, "the admin gets the stored URLs")
+	})
+
+	mt.Run("cached elements keep their stored URLs", func(mt *mtest.T) {
+		h := api.NewStoryHandler(mt.Coll)
+		h.Cache = api.NewStoryCache(10, time.Minute)
+		h.Media = api.NewMediaSigner("s3cret")
+		get := func(authorization string) models.StoryElement {
+			rec := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if authorization != "" {
+				req.Header.Set(echo.HeaderAuthorization, authorization)
+			}
+			api.IdentifyActor("admin-token")(func(c echo.Context) error {
+				return h.GetStoryElement(c, "s", "start")
+			})(echo.New().NewContext(req, rec))
+			var storyElement models.StoryElement
+			assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &storyElement))
+			return storyElement
+		}
+
+		start := storyElementDocument("s", "start",
+			bson.D{{Key: "description", Value: "Open"}, {Key: "nextNodeID", Value: "b"}, {Key: "imageAssetID", Value: "i1"}, {Key: "imageUrl", Value: "/assets/i1/content"}})
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, start))
+
+		signed := get("")
+		stored := get("Bearer admin-token")
+
+		assert.Contains(t, *(*signed.Choices)[0].ImageUrl, api.SignatureParam+"=")
+		assert.Equal(t, "/assets/i1/content", *(*stored.Choices)[0].ImageUrl)
+	})
+}
+
+func TestGetMissingAssets(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("references to missing assets reported", func(mt *mtest.T) {
+		h, _ := newAssetHandler(t, mt)
+
+		start := append(storyElementDocument("s", "start",
+			bson.D{{Key: "description", Value: "Open"}, {Key: "nextNodeID", Value: "b"}, {Key: "imageAssetID", Value: "gone"}}),
+			bson.E{Key: "artAssetID", Value: "art"})
+		other := append(storyElementDocument("s", "b"),
+			bson.E{Key: "videoAssetID", Value: "lost"},
+			bson.E{Key: "wisdoms", Value: bson.D{{Key: "w1", Value: bson.D{
+				{Key: "wisdomID", Value: "w1"}, {Key: "name", Value: "W"}, {Key: "artAssetID", Value: "art"},
+			}}}})
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, start, other),
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, assetDocument("art", models.AssetKindImage)),
+		)
+		rec := httptest.NewRecorder()
+		h.GetMissingAssets(echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/assets/missing?storyID=s", nil), rec))
+
+		assert.Equal(t, http.StatusOK, rec.Code)
+		var report models.MissingAssetReport
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &report))
+		assert.Equal(t, []models.MissingAssetReference{
+			{StoryID: "s", NodeID: "b", Field: "videoAssetID", AssetID: "lost"},
+			{StoryID: "s", NodeID: "start", Field: "choices.0.imageAssetID", AssetID: "gone"},
+		}, report.Items)
+
+		events := mt.GetAllStartedEvents()
+		if assert.Len(t, events, 2) {
+			assert.Equal(t, "s", events[0].Command.Lookup("filter", "storyID").StringValue())
+		}
+	})
+}
+
+func TestLocalBlobStore(t *testing.T) {
+	blobs, err := api.NewLocalBlobStore(t.TempDir())
+	assert.NoError(t, err)
+	ctx := context.Background()
+
+	assert.NoError(t, blobs.Put(ctx, "a1", strings.NewReader("first"), "text/plain"))
+	assert.NoError(t, blobs.Put(ctx, "a1", strings.NewReader("second"), "text/plain"))
+	content, err := blobs.Get(ctx, "a1")
+	if assert.NoError(t, err) {
+		data, _ := io.ReadAll(content)
+		content.Close()
+		assert.Equal(t, "second", string(data), "a put replaces the content")
+	}
+
+	assert.NoError(t, blobs.Delete(ctx, "a1"))
+	_, err = blobs.Get(ctx, "a1")
+	assert.ErrorIs(t, err, api.ErrBlobNotFound)
+	assert.NoError(t, blobs.Delete(ctx, "a1"), "deleting a missing key succeeds")
+
+	assert.Error(t, blobs.Put(ctx, "../escape", strings.NewReader("x"), "text/plain"))
+}
@@ -0,0 +1,313 @@
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"github.com/okcthulhu/ChooseYourOwnAdventure/api/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Actors recorded in the audit log.
+const (
+	// ActorAdmin made the change with a request carrying the admin token.
+	ActorAdmin = "admin"
+
+	// ActorAnonymous made the change with a request carrying no admin token.
+	ActorAnonymous = "anonymous"
+
+	// ActorSystem made the change outside of a request, such as an event subscriber.
+	ActorSystem = "system"
+)
+
+// AuditCollection defines the required behavior for interacting with the audit
+// log in MongoDB, so that it can be replaced with a mock for testing.
+type AuditCollection interface {
+	// InsertOne records an audit entry.
+	InsertOne(ctx context.Context, document interface{}, opts ...*options.InsertOneOptions) (*mongo.InsertOneResult, error)
+
+	// Find returns a cursor over the audit entries matching the filter.
+	Find(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (*mongo.Cursor, error)
+}
+
+// AuditIndexes are the indexes the audit log needs for the admin queries, which
+// return the newest entries first. Entry IDs grow with time, so they order the
+// entries.
+var AuditIndexes = []mongo.IndexModel{
+	{Keys: bson.D{{Key: "wixID", Value: 1}, {Key: "_id", Value: -1}}},
+	{Keys: bson.D{{Key: "storyID", Value: 1}, {Key: "nodeID", Value: 1}, {Key: "_id", Value: -1}}},
+	{Keys: bson.D{{Key: "actor", Value: 1}, {Key: "_id", Value: -1}}},
+	{Keys: bson.D{{Key: "action", Value: 1}, {Key: "_id", Value: -1}}},
+	{Keys: bson.D{{Key: "requestID", Value: 1}}},
+}
+
+// AuditRecorder records the changes made to players and story elements.
+type AuditRecorder interface {
+	Record(ctx context.Context, entry models.AuditEntry)
+}
+
+// actor is who a request acts for, as carried by its context.
+type actor struct {
+	name     string
+	remoteIP string
+}
+
+type actorKey struct{}
+
+// IdentifyActor returns a middleware that records who each request acts for, so
+// that the changes it makes can be attributed in the audit log: the admin if
+// the request carries the given admin token as a bearer token, and an anonymous
+// client otherwise. It does not reject any request; RequireAdmin does that.
+func IdentifyActor(token string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			name := ActorAnonymous
+			presented, ok := strings.CutPrefix(c.Request().Header.Get(echo.HeaderAuthorization), "Bearer ")
+			if token != "" && ok && subtle.ConstantTimeCompare([]byte(presented), []byte(token)) == 1 {
+				name = ActorAdmin
+			}
+			req := c.Request()
+			c.SetRequest(req.WithContext(context.WithValue(req.Context(), actorKey{}, actor{name: name, remoteIP: c.RealIP()})))
+			return next(c)
+		}
+	}
+}
+
+// ActorFrom returns who the request a context belongs to acts for, or
+// ActorSystem if the context does not belong to a request.
+func ActorFrom(ctx context.Context) string {
+	return actorOf(ctx).name
+}
+
+func actorOf(ctx context.Context) actor {
+	if who, ok := ctx.Value(actorKey{}).(actor); ok {
+		return who
+	}
+	return actor{name: ActorSystem}
+}
+
+// AuditLog stores the audit entries of the changes made to players and story
+// elements, and serves them to admins.
+type AuditLog struct {
+	// Col is the collection the entries are stored in.
+	Col AuditCollection
+
+	// Timeouts bounds the storage calls of each operation.
+	Timeouts Timeouts
+
+	now func() time.Time
+}
+
+// NewAuditLog creates an AuditLog backed by the given collection.
+func NewAuditLog(col AuditCollection) *AuditLog {
+	return &AuditLog{
+		Col:      col,
+		Timeouts: DefaultTimeouts,
+		now:      time.Now,
+	}
+}
+
+// Record stores an audit entry. The ID and time of the entry are assigned here,
+// and the actor, request ID and client address are taken from the context. The
+// change has already been stored, so a failure to record it is logged rather
+// than failing the request, and the entry is recorded even if the client has
+// gone away in the meantime.
+func (a *AuditLog) Record(ctx context.Context, entry models.AuditEntry) {
+	now := a.now().UTC()
+	entry.AuditID = primitive.NewObjectIDFromTimestamp(now).Hex()
+	entry.OccurredAt = now
+	who := actorOf(ctx)
+	entry.Actor = who.name
+	if who.remoteIP != "" {
+		entry.RemoteIP = &who.remoteIP
+	}
+	if requestID := RequestIDFrom(ctx); requestID != "" {
+		entry.RequestID = &requestID
+	}
+
+	ctx, cancel := a.Timeouts.detached(ctx)
+	defer cancel()
+	if _, err := a.Col.InsertOne(ctx, entry); err != nil {
+		slog.ErrorContext(ctx, "Failed to record audit entry", "action", entry.Action, "error", err)
+	}
+}
+
+// ListAuditEntries is the admin audit log query. It returns a page of entries,
+// newest first, narrowed by the actor, action, wixID, storyID, nodeID, requestID,
+// from and to query parameters. Pages are walked by passing the returned
+// nextCursor as the cursor parameter. Malformed parameters result in a 400
+// status code.
+func (a *AuditLog) ListAuditEntries(c echo.Context) error {
+	limit, ok := parsePageLimit(c.QueryParam("limit"))
+	if !ok {
+		return c.JSON(http.StatusBadRequest, "Invalid limit")
+	}
+
+	filter := bson.M{}
+	if cursor := c.QueryParam("cursor"); cursor != "" {
+		before, err := decodeCursor(cursor)
+		if err != nil || before == "" {
+			return c.JSON(http.StatusBadRequest, "Invalid cursor")
+		}
+		filter["_id"] = bson.M{"$lt": before}
+	}
+	if name := c.QueryParam("actor"); name != "" {
+		filter["actor"] = name
+	}
+	if action := c.QueryParam("action"); action != "" {
+		if !knownAuditAction(models.AuditAction(action)) {
+			return c.JSON(http.StatusBadRequest, "Unknown action")
+		}
+		filter["action"] = action
+	}
+	if wixID := c.QueryParam("wixID"); wixID != "" {
+		parsedUUID, err := uuid.Parse(wixID)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, "Invalid WixID format")
+		}
+		filter["wixID"] = binaryWixID(parsedUUID)
+	}
+	if storyID := c.QueryParam("storyID"); storyID != "" {
+		filter["storyID"] = storyID
+	}
+	if nodeID := c.QueryParam("nodeID"); nodeID != "" {
+		// Node IDs are only unique within a story.
+		if filter["storyID"] == nil {
+			return c.JSON(http.StatusBadRequest, "The nodeID filter requires a storyID")
+		}
+		filter["nodeID"] = nodeID
+	}
+	if requestID := c.QueryParam("requestID"); requestID != "" {
+		filter["requestID"] = requestID
+	}
+	window := bson.M{}
+	for param, operator := range map[string]string{"from": "$gte", "to": "$lte"} {
+		bound, err := parseTimeParam(c.QueryParam(param))
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, "Invalid "+param+" timestamp")
+		}
+		if bound != nil {
+			window[operator] = *bound
+		}
+	}
+	if len(window) > 0 {
+		filter["occurredAt"] = window
+	}
+
+	ctx, cancel := a.Timeouts.context(c, "ListAuditEntries")
+	defer cancel()
+
+	// One extra entry tells whether there is a next page.
+	opts := options.Find().
+		SetSort(bson.D{{Key: "_id", Value: -1}}).
+		SetLimit(int64(limit + 1))
+	cursor, err := a.Col.Find(ctx, filter, opts)
+	if err != nil {
+		return storageError(c, err, "to query audit entries", "Failed to list audit entries")
+	}
+	entries := []models.AuditEntry{}
+	if err := cursor.All(ctx, &entries); err != nil {
+		return storageError(c, err, "to decode audit entries", "Failed to list audit entries")
+	}
+
+	page := models.AuditPage{Items: entries}
+	if len(entries) > limit {
+		page.Items = entries[:limit]
+		next := encodeCursor(page.Items[limit-1].AuditID)
+		page.NextCursor = &next
+	}
+	return c.JSON(http.StatusOK, page)
+}
+
+func knownAuditAction(action models.AuditAction) bool {
+	switch action {
+	case models.AuditActionPlayerCreated, models.AuditActionPlayerUpdated, models.AuditActionPlayerPatched,
+		models.AuditActionPlayerChoiceTaken, models.AuditActionPlayerCreatedParty, models.AuditActionPlayerJoinedParty, models.AuditActionPlayerPartyDecision,
+		models.AuditActionPlayerAchievementUnlocked, models.AuditActionPlayerEntitlementGranted,
+		models.AuditActionPlayerEntitlementRevoked, models.AuditActionStoryElementCreated,
+		models.AuditActionStoryElementUpdated, models.AuditActionStoryElementPatched, models.AuditActionStoryElementDeleted:
+		return true
+	}
+	return false
+}
+
+// playerChange builds the audit entry of a change to a player from the player
+// before and after it. Either may be nil, such as before a creation.
+func playerChange(action models.AuditAction, wixID uuid.UUID, before, after *models.Player) models.AuditEntry {
+	entry := models.AuditEntry{Action: action, WixID: &wixID}
+	if before != nil {
+		summary := summarizePlayer(before)
+		entry.Before = &models.AuditSnapshot{Player: &summary}
+	}
+	if after != nil {
+		summary := summarizePlayer(after)
+		entry.After = &models.AuditSnapshot{Player: &summary}
+	}
+	return entry
+}
+
+// storyElementChange builds the audit entry of a change to a story element from
+// the element before and after it. Either may be nil, such as after a deletion.
+func storyElementChange(action models.AuditAction, storyID string, nodeID string, before, after *models.StoryElement) models.AuditEntry {
+	entry := models.AuditEntry{Action: action, StoryID: &storyID, NodeID: &nodeID}
+	if before != nil {
+		summary := summarizeStoryElement(before)
+		entry.Before = &models.AuditSnapshot{StoryElement: &summary}
+	}
+	if after != nil {
+		summary := summarizeStoryElement(after)
+		entry.After = &models.AuditSnapshot{StoryElement: &summary}
+	}
+	return entry
+}
+
+// summarizeStoryElement condenses a story element into the summary recorded in
+// the audit log. The content itself is left out; its length tells that it changed.
+func summarizeStoryElement(storyElement *models.StoryElement) models.StoryElementSummary {
+	summary := models.StoryElementSummary{
+		StoryID:       storyElement.StoryID,
+		NodeID:        storyElement.NodeID,
+		ChapterName:   storyElement.ChapterName,
+		NextNodeIDs:   []string{},
+		HasVideo:      storyElement.VideoURL != nil && *storyElement.VideoURL != "",
+		HasArt:        storyElement.ArtURL != nil && *storyElement.ArtURL != "",
+		ContentLength: len(storyElement.Content),
+	}
+	if storyElement.Choices != nil {
+		for _, choice := range *storyElement.Choices {
+			summary.NextNodeIDs = append(summary.NextNodeIDs, choiceTargets(choice)...)
+		}
+	}
+	if storyElement.Wisdoms != nil && len(*storyElement.Wisdoms) > 0 {
+		wisdomIDs := sortedKeys(*storyElement.Wisdoms)
+		summary.WisdomIDs = &wisdomIDs
+	}
+	if storyElement.Ending != nil {
+		summary.EndingID = &storyElement.Ending.EndingID
+	}
+	return summary
+}
+
+// loadAudited reads back a player once a change has been stored, so that the
+// audit log can summarize the state the change left it in. The change belongs
+// in the log even if the client has gone away, so the read is detached from the
+// request. A player that cannot be read is logged and summarized as missing.
+func loadAudited(ctx context.Context, playerCol PlayerCollection, timeouts Timeouts, wixID uuid.UUID) *models.Player {
+	ctx, cancel := timeouts.detached(ctx)
+	defer cancel()
+	var player models.Player
+	if err := playerCol.FindOne(ctx, bson.M{"wixID": binaryWixID(wixID)}).Decode(&player); err != nil {
+		slog.WarnContext(ctx, "Failed to read back audited player", "wixID", wixID, "error", err)
+		return nil
+	}
+	return &player
+}
@@ -0,0 +1,216 @@
+package api_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"github.com/okcthulhu/ChooseYourOwnAdventure/api"
+	"github.com/okcthulhu/ChooseYourOwnAdventure/api/models"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+// recordedAudit collects the audit entries handlers record.
+type recordedAudit struct {
+	entries []models.AuditEntry
+}
+
+func (r *recordedAudit) Record(ctx context.Context, entry models.AuditEntry) {
+	r.entries = append(r.entries, entry)
+}
+
+func TestIdentifyActor(t *testing.T) {
+	cases := []struct {
+		name          string
+		token         string
+		authorization string
+		actor         string
+	}{
+		{"admin token", "s3cret", "Bearer s3cret", api.ActorAdmin},
+		{"no token", "s3cret", "", api.ActorAnonymous},
+		{"wrong token", "s3cret", "Bearer guess", api.ActorAnonymous},
+		{"admin access not configured", "", "Bearer ", api.ActorAnonymous},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/", nil)
+			if tc.authorization != "" {
+				req.Header.Set(echo.HeaderAuthorization, tc.authorization)
+			}
+			rec := httptest.NewRecorder()
+			c := echo.New().NewContext(req, rec)
+
+			var actor string
+			api.IdentifyActor(tc.token)(func(c echo.Context) error {
+				actor = api.ActorFrom(c.Request().Context())
+				return c.NoContent(http.StatusOK)
+			})(c)
+
+			assert.Equal(t, http.StatusOK, rec.Code, "requests are never rejected")
+			assert.Equal(t, tc.actor, actor)
+		})
+	}
+
+	assert.Equal(t, api.ActorSystem, api.ActorFrom(context.Background()))
+}
+
+func TestAuditLog_Record(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("entry attributed to the request", func(mt *mtest.T) {
+		req := httptest.NewRequest(http.MethodPatch, "/", nil)
+		req.Header.Set(api.RequestIDHeader, "req-1")
+		req.Header.Set(echo.HeaderAuthorization, "Bearer s3cret")
+		req.RemoteAddr = "192.0.2.1:1234"
+		c := echo.New().NewContext(req, httptest.NewRecorder())
+
+		audit := api.NewAuditLog(mt.Coll)
+		mt.AddMockResponses(mtest.CreateSuccessResponse())
+
+		storyID, nodeID := "s", "start"
+		api.RequestID(api.IdentifyActor("s3cret")(func(c echo.Context) error {
+			audit.Record(c.Request().Context(), models.AuditEntry{
+				Action:  models.AuditActionStoryElementDeleted,
+				StoryID: &storyID,
+				NodeID:  &nodeID,
+			})
+			return nil
+		}))(c)
+
+		started := mt.GetStartedEvent()
+		if assert.NotNil(t, started) {
+			doc := started.Command.Lookup("documents").Array().Index(0).Value().Document()
+			assert.Len(t, doc.Lookup("_id").StringValue(), 24)
+			assert.Equal(t, "storyElement.deleted", doc.Lookup("action").StringValue())
+			assert.Equal(t, api.ActorAdmin, doc.Lookup("actor").StringValue())
+			assert.Equal(t, "req-1", doc.Lookup("requestID").StringValue())
+			assert.Equal(t, "192.0.2.1", doc.Lookup("remoteIP").StringValue())
+			assert.Equal(t, "start", doc.Lookup("nodeID").StringValue())
+			_, hasBefore := doc.Lookup("before").DocumentOK()
+			assert.False(t, hasBefore)
+		}
+	})
+
+	mt.Run("changes outside a request attributed to the system", func(mt *mtest.T) {
+		audit := api.NewAuditLog(mt.Coll)
+		mt.AddMockResponses(mtest.CreateSuccessResponse())
+
+		audit.Record(context.Background(), models.AuditEntry{Action: models.AuditActionPlayerAchievementUnlocked})
+
+		doc := mt.GetStartedEvent().Command.Lookup("documents").Array().Index(0).Value().Document()
+		assert.Equal(t, api.ActorSystem, doc.Lookup("actor").StringValue())
+		_, hasRequestID := doc.Lookup("requestID").StringValueOK()
+		assert.False(t, hasRequestID)
+	})
+}
+
+func auditEntryDocument(auditID string, action models.AuditAction) bson.D {
+	return bson.D{
+		{Key: "_id", Value: auditID},
+		{Key: "action", Value: string(action)},
+		{Key: "actor", Value: api.ActorAdmin},
+		{Key: "storyID", Value: "s"},
+		{Key: "nodeID", Value: "start"},
+		{Key: "before", Value: bson.D{{Key: "storyElement", Value: bson.D{
+			{Key: "storyID", Value: "s"},
+			{Key: "nodeID", Value: "start"},
+			{Key: "nextNodeIDs", Value: bson.A{"left"}},
+		}}}},
+	}
+}
+
+func TestListAuditEntries(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("filtered page with a next cursor", func(mt *mtest.T) {
+		wixID := uuid.New()
+		req := httptest.NewRequest(http.MethodGet, "/audit?limit=2&actor=admin&action=storyElement.patched&storyID=s&nodeID=start&wixID="+wixID.String()+"&from=2024-01-01T00:00:00Z", nil)
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(req, rec)
+
+		audit := api.NewAuditLog(mt.Coll)
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch,
+			auditEntryDocument("0000000000000000000000c3", models.AuditActionStoryElementPatched),
+			auditEntryDocument("0000000000000000000000c2", models.AuditActionStoryElementPatched),
+			auditEntryDocument("0000000000000000000000c1", models.AuditActionStoryElementPatched),
+		))
+
+		err := audit.ListAuditEntries(c)
+
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Contains(t, rec.Body.String(), `"auditID":"0000000000000000000000c2"`)
+		assert.NotContains(t, rec.Body.String(), `"auditID":"0000000000000000000000c1"`)
+		assert.Contains(t, rec.Body.String(), `"nextNodeIDs":["left"]`)
+		assert.Contains(t, rec.Body.String(), `"nextCursor"`)
+
+		command := mt.GetStartedEvent().Command
+		filter := command.Lookup("filter").Document()
+		assert.Equal(t, "admin", filter.Lookup("actor").StringValue())
+		assert.Equal(t, "storyElement.patched", filter.Lookup("action").StringValue())
+		assert.Equal(t, "start", filter.Lookup("nodeID").StringValue())
+		_, data := filter.Lookup("wixID").Binary()
+		assert.Equal(t, wixID[:], data)
+		assert.NotNil(t, filter.Lookup("occurredAt", "$gte"))
+		assert.Equal(t, int32(-1), command.Lookup("sort", "_id").Int32())
+	})
+
+	mt.Run("cursor continues before the last entry", func(mt *mtest.T) {
+		req := httptest.NewRequest(http.MethodGet, "/audit?cursor=MDAwMDAwMDAwMDAwMDAwMDAwMDAwMGMy", nil)
+		c := echo.New().NewContext(req, httptest.NewRecorder())
+
+		audit := api.NewAuditLog(mt.Coll)
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch))
+
+		audit.ListAuditEntries(c)
+
+		filter := mt.GetStartedEvent().Command.Lookup("filter").Document()
+		assert.Equal(t, "0000000000000000000000c2", filter.Lookup("_id", "$lt").StringValue())
+	})
+}
+
+func TestListAuditEntries_EntitlementActions(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("filtered by a granted entitlement", func(mt *mtest.T) {
+		req := httptest.NewRequest(http.MethodGet, "/audit?action=player.entitlementGranted", nil)
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(req, rec)
+
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch))
+
+		api.NewAuditLog(mt.Coll).ListAuditEntries(c)
+
+		assert.Equal(t, http.StatusOK, rec.Code)
+		filter := mt.GetStartedEvent().Command.Lookup("filter").Document()
+		assert.Equal(t, "player.entitlementGranted", filter.Lookup("action").StringValue())
+	})
+}
+
+func TestListAuditEntries_InvalidParameters(t *testing.T) {
+	for _, query := range []string{
+		"limit=0",
+		"cursor=%21%21",
+		"action=player.deleted",
+		"wixID=not-a-uuid",
+		"nodeID=start",
+		"to=yesterday",
+	} {
+		t.Run(query, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/audit?"+query, nil), rec)
+
+			api.NewAuditLog(nil).ListAuditEntries(c)
+
+			assert.Equal(t, http.StatusBadRequest, rec.Code)
+		})
+	}
+}
@@ -0,0 +1,112 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// ErrBlobNotFound is returned for keys a blob store holds nothing under.
+var ErrBlobNotFound = errors.New("blob not found")
+
+// BlobStore keeps the content of the media assets. It is shaped after
+// S3-compatible object stores, so that one can be plugged in: objects are
+// written whole under a key together with their content type, read back
+// whole and deleted. Keys are asset IDs.
+type BlobStore interface {
+	// Put stores the content read from r under key, replacing what was there.
+	Put(ctx context.Context, key string, r io.Reader, contentType string) error
+
+	// Get opens the content stored under key, or fails with ErrBlobNotFound.
+	// Stores that can seek return an io.ReadSeekCloser, which lets clients
+	// request ranges of the content.
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+
+	// Delete removes the content stored under key. Deleting a missing key
+	// succeeds.
+	Delete(ctx context.Context, key string) error
+}
+
+// LocalBlobStore is a BlobStore keeping the content in files under a directory,
+// fanned out into subdirectories named after the first two characters of the
+// keys. The content type is not kept; the asset records have it.
+type LocalBlobStore struct {
+	// Root is the directory the files are kept under.
+	Root string
+}
+
+// NewLocalBlobStore creates a LocalBlobStore under root, creating the directory
+// if it does not exist.
+func NewLocalBlobStore(root string) (*LocalBlobStore, error) {
+	if err := os.MkdirAll(root, 0o755); err != nil {
+		return nil, err
+	}
+	return &LocalBlobStore{Root: root}, nil
+}
+
+// path returns the file of a key. Keys are restricted to letters, digits,
+// dashes, dots and underscores, so that they cannot escape the root.
+func (s *LocalBlobStore) path(key string) (string, error) {
+	if len(key) < 2 || key[0] == '.' {
+		return "", errors.New("invalid blob key")
+	}
+	for _, r := range key {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '.' || r == '_') {
+			return "", errors.New("invalid blob key")
+		}
+	}
+	return filepath.Join(s.Root, key[:2], key), nil
+}
+
+// Put writes the content to a temporary file first and renames it into place,
+// so that readers never see partial content.
+func (s *LocalBlobStore) Put(ctx context.Context, key string, r io.Reader, contentType string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+key+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Get opens the file of a key, which can seek.
+func (s *LocalBlobStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrBlobNotFound
+	}
+	return file, err
+}
+
+// Delete removes the file of a key.
+func (s *LocalBlobStore) Delete(ctx context.Context, key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,249 @@
+package api
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/okcthulhu/ChooseYourOwnAdventure/api/models"
+)
+
+// HTTP caching headers not named by echo.
+const (
+	ETagHeader        = "ETag"
+	IfNoneMatchHeader = "If-None-Match"
+)
+
+// Defaults of the story cache and of the Cache-Control of story elements.
+const (
+	DefaultCacheSize   = 1000
+	DefaultCacheTTL    = time.Minute
+	DefaultCacheMaxAge = time.Minute
+)
+
+// StoryCache is an in-process LRU cache of story elements and of whole stories,
+// the latter being every element of a story ordered by node ID. Writes through
+// the StoryHandler invalidate what they change, but only in the instance that
+// handled them, so entries also expire after a TTL to bound how long other
+// instances serve what was changed elsewhere. A nil cache caches nothing.
+type StoryCache struct {
+	mu       sync.Mutex
+	capacity int
+	ttl      time.Duration
+	entries  map[string]*list.Element
+	order    *list.List
+
+	// generations counts the invalidations of each story, so that an entry
+	// loaded before an invalidation is not stored after it.
+	generations map[string]uint64
+
+	now func() time.Time
+}
+
+// cacheEntry is a story element or a whole story in the cache.
+type cacheEntry struct {
+	key     string
+	element models.StoryElement
+	story   []models.StoryElement
+	expires time.Time
+}
+
+// NewStoryCache creates a cache holding up to capacity story elements and
+// stories, each for the given TTL. A capacity of zero or less caches nothing.
+func NewStoryCache(capacity int, ttl time.Duration) *StoryCache {
+	if capacity <= 0 {
+		return nil
+	}
+	return &StoryCache{
+		capacity:    capacity,
+		ttl:         ttl,
+		entries:     map[string]*list.Element{},
+		order:       list.New(),
+		generations: map[string]uint64{},
+		now:         time.Now,
+	}
+}
+
+func elementCacheKey(storyID, nodeID string) string {
+	return "element\x00" + storyID + "\x00" + nodeID
+}
+
+func storyCacheKey(storyID string) string {
+	return "story\x00" + storyID
+}
+
+// generation returns the generation of a story, to be passed back when storing
+// what is loaded from it.
+func (s *StoryCache) generation(storyID string) uint64 {
+	if s == nil {
+		return 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.generations[storyID]
+}
+
+// get returns the live entry of a key, marking it as recently used.
+func (s *StoryCache) get(key string) (*cacheEntry, bool) {
+	item, ok := s.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := item.Value.(*cacheEntry)
+	if !s.now().Before(entry.expires) {
+		s.order.Remove(item)
+		delete(s.entries, key)
+		return nil, false
+	}
+	s.order.MoveToFront(item)
+	return entry, true
+}
+
+// put stores an entry loaded at the given generation of its story, evicting the
+// least recently used entries over capacity.
+func (s *StoryCache) put(storyID string, generation uint64, entry *cacheEntry) {
+	if s.generations[storyID] != generation {
+		return
+	}
+	entry.expires = s.now().Add(s.ttl)
+	if item, ok := s.entries[entry.key]; ok {
+		item.Value = entry
+		s.order.MoveToFront(item)
+		return
+	}
+	s.entries[entry.key] = s.order.PushFront(entry)
+	for s.order.Len() > s.capacity {
+		oldest := s.order.Back()
+		s.order.Remove(oldest)
+		delete(s.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// element returns a cached story element, from its own entry or from its story's.
+// The element is shared and must not be modified.
+func (s *StoryCache) element(storyID, nodeID string) (models.StoryElement, bool) {
+	if s == nil {
+		return models.StoryElement{}, false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if entry, ok := s.get(elementCacheKey(storyID, nodeID)); ok {
+		return entry.element, true
+	}
+	if entry, ok := s.get(storyCacheKey(storyID)); ok {
+		return findNode(entry.story, nodeID)
+	}
+	return models.StoryElement{}, false
+}
+
+// findNode looks up an element of a story ordered by node ID.
+func findNode(story []models.StoryElement, nodeID string) (models.StoryElement, bool) {
+	i := sort.Search(len(story), func(i int) bool { return story[i].NodeID >= nodeID })
+	if i < len(story) && story[i].NodeID == nodeID {
+		return story[i], true
+	}
+	return models.StoryElement{}, false
+}
+
+// putElement caches a story element loaded at the given generation of its story.
+func (s *StoryCache) putElement(generation uint64, storyElement models.StoryElement) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.put(storyElement.StoryID, generation, &cacheEntry{key: elementCacheKey(storyElement.StoryID, storyElement.NodeID), element: storyElement})
+}
+
+// story returns every element of a cached story ordered by node ID. The elements
+// are shared and must not be modified.
+func (s *StoryCache) story(storyID string) ([]models.StoryElement, bool) {
+	if s == nil {
+		return nil, false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if entry, ok := s.get(storyCacheKey(storyID)); ok {
+		return entry.story, true
+	}
+	return nil, false
+}
+
+// putStory caches every element of a story, ordered by node ID, loaded at the
+// given generation of the story.
+func (s *StoryCache) putStory(storyID string, generation uint64, elements []models.StoryElement) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.put(storyID, generation, &cacheEntry{key: storyCacheKey(storyID), story: elements})
+}
+
+// Invalidate drops a story element and its story from the cache, and keeps what
+// is being loaded from the story from being cached.
+func (s *StoryCache) Invalidate(storyID, nodeID string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.generations[storyID]++
+	for _, key := range []string{elementCacheKey(storyID, nodeID), storyCacheKey(storyID)} {
+		if item, ok := s.entries[key]; ok {
+			s.order.Remove(item)
+			delete(s.entries, key)
+		}
+	}
+}
+
+// cacheControl returns the Cache-Control of responses that browsers and CDNs may
+// keep for maxAge. Without one they must revalidate every time.
+func cacheControl(maxAge time.Duration) string {
+	if maxAge <= 0 {
+		return "no-cache"
+	}
+	return fmt.Sprintf("public, max-age=%d", int(maxAge.Seconds()))
+}
+
+// respondCacheable responds with value as JSON, tagged with a strong ETag of the
+// body and the given Cache-Control. A request whose If-None-Match header names
+// the tag gets a 304 status code without the body.
+func respondCacheable(c echo.Context, value interface{}, cacheControl string) error {
+	body, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(body)
+	etag := `"` + base64.RawURLEncoding.EncodeToString(sum[:18]) + `"`
+
+	header := c.Response().Header()
+	header.Set(ETagHeader, etag)
+	header.Set(echo.HeaderCacheControl, cacheControl)
+	if noneMatch(c.Request().Header.Get(IfNoneMatchHeader), etag) {
+		return c.NoContent(http.StatusNotModified)
+	}
+	return c.JSONBlob(http.StatusOK, body)
+}
+
+// noneMatch reports whether an If-None-Match header names the ETag. Tags are
+// compared weakly, as RFC 9110 requires for If-None-Match.
+func noneMatch(header, etag string) bool {
+	if strings.TrimSpace(header) == "*" {
+		return true
+	}
+	for _, tag := range strings.Split(header, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(tag), "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,177 @@
+package api_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/okcthulhu/ChooseYourOwnAdventure/api"
+	"github.com/okcthulhu/ChooseYourOwnAdventure/api/models"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+// getStoryElement gets a story element through the handler, with the given
+// If-None-Match header if it is not empty.
+func getStoryElement(h *api.StoryHandler, storyID, nodeID, ifNoneMatch string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/stories/"+storyID+"/elements/"+nodeID, nil)
+	if ifNoneMatch != "" {
+		req.Header.Set(api.IfNoneMatchHeader, ifNoneMatch)
+	}
+	rec := httptest.NewRecorder()
+	h.GetStoryElement(echo.New().NewContext(req, rec), storyID, nodeID)
+	return rec
+}
+
+func TestGetStoryElement_ConditionalGet(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("not modified when the ETag matches", func(mt *mtest.T) {
+		h := api.NewStoryHandler(mt.Coll)
+
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, storyElementDocument("s", "start")))
+		first := getStoryElement(h, "s", "start", "")
+
+		etag := first.Header().Get(api.ETagHeader)
+		assert.Equal(t, http.StatusOK, first.Code)
+		assert.True(t, strings.HasPrefix(etag, `"`) && strings.HasSuffix(etag, `"`), "the ETag is strong")
+		assert.Equal(t, "public, max-age=60", first.Header().Get(echo.HeaderCacheControl))
+
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, storyElementDocument("s", "start")))
+		second := getStoryElement(h, "s", "start", `"other", `+etag)
+
+		assert.Equal(t, http.StatusNotModified, second.Code)
+		assert.Empty(t, second.Body.String())
+		assert.Equal(t, etag, second.Header().Get(api.ETagHeader))
+
+		changed := storyElementDocument("s", "start")
+		changed[2].Value = "new content"
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, changed))
+		third := getStoryElement(h, "s", "start", etag)
+
+		assert.Equal(t, http.StatusOK, third.Code, "a changed element is sent again")
+		assert.NotEqual(t, etag, third.Header().Get(api.ETagHeader))
+	})
+
+	mt.Run("revalidated every time without a max age", func(mt *mtest.T) {
+		h := api.NewStoryHandler(mt.Coll)
+		h.CacheMaxAge = 0
+
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, storyElementDocument("s", "start")))
+		rec := getStoryElement(h, "s", "start", "")
+
+		assert.Equal(t, "no-cache", rec.Header().Get(echo.HeaderCacheControl))
+	})
+}
+
+func TestGetStoryElement_Cached(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("served from the cache until changed", func(mt *mtest.T) {
+		h := api.NewStoryHandler(mt.Coll)
+		h.Cache = api.NewStoryCache(10, time.Minute)
+
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, storyElementDocument("s", "start")))
+		getStoryElement(h, "s", "start", "")
+		rec := getStoryElement(h, "s", "start", "")
+
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Contains(t, rec.Body.String(), `"content":"content of start"`)
+		assert.Len(t, mt.GetAllStartedEvents(), 1, "the second read is served from the cache")
+
+		req := httptest.NewRequest(http.MethodPatch, "/", strings.NewReader(`{"content":"new content"}`))
+		req.Header.Set(echo.HeaderContentType, api.MIMEMergePatch)
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, storyElementDocument("s", "start")),
+			bson.D{{Key: "ok", Value: 1}, {Key: "n", Value: 1}, {Key: "nModified", Value: 1}},
+		)
+		h.PatchStoryElement(echo.New().NewContext(req, httptest.NewRecorder()), "s", "start")
+
+		changed := storyElementDocument("s", "start")
+		changed[2].Value = "new content"
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, changed))
+		rec = getStoryElement(h, "s", "start", "")
+
+		assert.Contains(t, rec.Body.String(), `"content":"new content"`, "a patch invalidates the element")
+		assert.Len(t, mt.GetAllStartedEvents(), 4)
+	})
+
+	mt.Run("least recently used elements evicted", func(mt *mtest.T) {
+		h := api.NewStoryHandler(mt.Coll)
+		h.Cache = api.NewStoryCache(1, time.Minute)
+
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, storyElementDocument("s", "a")),
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, storyElementDocument("s", "b")),
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, storyElementDocument("s", "a")),
+		)
+		getStoryElement(h, "s", "a", "")
+		getStoryElement(h, "s", "b", "")
+		getStoryElement(h, "s", "b", "")
+		getStoryElement(h, "s", "a", "")
+
+		assert.Len(t, mt.GetAllStartedEvents(), 3)
+	})
+
+	mt.Run("entries expire", func(mt *mtest.T) {
+		h := api.NewStoryHandler(mt.Coll)
+		h.Cache = api.NewStoryCache(10, time.Nanosecond)
+
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, storyElementDocument("s", "a")),
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, storyElementDocument("s", "a")),
+		)
+		getStoryElement(h, "s", "a", "")
+		time.Sleep(time.Millisecond)
+		getStoryElement(h, "s", "a", "")
+
+		assert.Len(t, mt.GetAllStartedEvents(), 2)
+	})
+}
+
+func TestListStoryElements_Cached(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("pages cut from the cached story", func(mt *mtest.T) {
+		h := api.NewStoryHandler(mt.Coll)
+		h.Cache = api.NewStoryCache(10, time.Minute)
+
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch,
+			storyElementDocument("s", "a"), storyElementDocument("s", "b"), storyElementDocument("s", "c")))
+
+		rec := httptest.NewRecorder()
+		h.ListStoryElements(echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/?limit=2", nil), rec), "s")
+
+		var page models.StoryElementPage
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &page))
+		if assert.Len(t, page.Items, 2) && assert.NotNil(t, page.NextCursor) {
+			rec = httptest.NewRecorder()
+			h.ListStoryElements(echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/?limit=2&cursor="+*page.NextCursor, nil), rec), "s")
+
+			page = models.StoryElementPage{}
+			assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &page))
+			if assert.Len(t, page.Items, 1) {
+				assert.Equal(t, "c", page.Items[0].NodeID)
+			}
+			assert.Nil(t, page.NextCursor)
+		}
+		assert.NotEmpty(t, rec.Header().Get(api.ETagHeader))
+
+		rec = getStoryElement(h, "s", "b", "")
+		assert.Contains(t, rec.Body.String(), `"nodeID":"b"`, "elements are served from the cached story")
+
+		events := mt.GetAllStartedEvents()
+		if assert.Len(t, events, 1) {
+			_, err := events[0].Command.LookupErr("limit")
+			assert.Error(t, err, "the whole story is loaded")
+		}
+	})
+}
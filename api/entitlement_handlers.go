@@ -0,0 +1,243 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"github.com/okcthulhu/ChooseYourOwnAdventure/api/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"gopkg.in/yaml.v3"
+)
+
+// LockedMessage is the message of the response to a request for a locked story element.
+const LockedMessage = "Story element is locked"
+
+// Paywalls are the products required to read the stories and chapters sold
+// separately. A chapter with a paywall of its own requires its product; any
+// other element of a story with a paywall requires the story's product. A nil
+// Paywalls locks nothing.
+type Paywalls struct {
+	stories  map[string]string
+	chapters map[chapterKey]string
+}
+
+type chapterKey struct {
+	storyID     string
+	chapterName string
+}
+
+// NewPaywalls indexes a validated paywall catalog. An empty catalog locks
+// nothing and returns nil.
+func NewPaywalls(catalog []models.Paywall) *Paywalls {
+	if len(catalog) == 0 {
+		return nil
+	}
+	p := &Paywalls{stories: map[string]string{}, chapters: map[chapterKey]string{}}
+	for _, paywall := range catalog {
+		if paywall.ChapterName == nil {
+			p.stories[paywall.StoryID] = paywall.ProductID
+		} else {
+			p.chapters[chapterKey{paywall.StoryID, *paywall.ChapterName}] = paywall.ProductID
+		}
+	}
+	return p
+}
+
+// LoadPaywallCatalog reads the paywalls from a YAML file holding a list of
+// Paywall documents, and validates them.
+func LoadPaywallCatalog(path string) ([]models.Paywall, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// Decoded like the achievement catalog, to keep the models' JSON field names.
+	var raw interface{}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	encoded, err := json.Marshal(raw)
+	if err != nil {
+		return nil, err
+	}
+	var catalog []models.Paywall
+	if err := json.Unmarshal(encoded, &catalog); err != nil {
+		return nil, err
+	}
+
+	if err := ValidatePaywallCatalog(catalog); err != nil {
+		return nil, err
+	}
+	return catalog, nil
+}
+
+// ValidatePaywallCatalog checks that every paywall names a story and a product,
+// and that no story or chapter has two paywalls.
+func ValidatePaywallCatalog(catalog []models.Paywall) error {
+	seen := map[chapterKey]bool{}
+	for _, paywall := range catalog {
+		if paywall.StoryID == "" {
+			return fmt.Errorf("paywall of product %q has no storyID", paywall.ProductID)
+		}
+		key, name := chapterKey{storyID: paywall.StoryID}, fmt.Sprintf("story %q", paywall.StoryID)
+		if paywall.ChapterName != nil {
+			if *paywall.ChapterName == "" {
+				return fmt.Errorf("paywall of %s has an empty chapterName", name)
+			}
+			key.chapterName = *paywall.ChapterName
+			name = fmt.Sprintf("chapter %q of story %q", *paywall.ChapterName, paywall.StoryID)
+		}
+		if paywall.ProductID == "" {
+			return fmt.Errorf("paywall of %s has no productID", name)
+		}
+		if seen[key] {
+			return fmt.Errorf("duplicate paywall of %s", name)
+		}
+		seen[key] = true
+	}
+	return nil
+}
+
+// productFor returns the product required to read a story element, or an empty
+// string if the element is free.
+func (p *Paywalls) productFor(storyElement *models.StoryElement) string {
+	if p == nil {
+		return ""
+	}
+	if storyElement.ChapterName != nil {
+		if productID, ok := p.chapters[chapterKey{storyElement.StoryID, *storyElement.ChapterName}]; ok {
+			return productID
+		}
+	}
+	return p.stories[storyElement.StoryID]
+}
+
+// lockFor returns the locked response of a story element, or nil if the element
+// is free or the player holds its product at the given time. A nil player holds
+// nothing.
+func (p *Paywalls) lockFor(storyElement *models.StoryElement, player *models.Player, at time.Time) *models.LockedContent {
+	productID := p.productFor(storyElement)
+	if productID == "" || player != nil && entitled(player, productID, at) {
+		return nil
+	}
+	return &models.LockedContent{
+		Message:     LockedMessage,
+		StoryID:     storyElement.StoryID,
+		NodeID:      storyElement.NodeID,
+		ChapterName: storyElement.ChapterName,
+		ProductID:   productID,
+	}
+}
+
+// entitled reports whether the player holds the product at the given time.
+func entitled(player *models.Player, productID string, at time.Time) bool {
+	if player.Entitlements == nil {
+		return false
+	}
+	for _, entitlement := range *player.Entitlements {
+		if entitlement.ProductID == productID && (entitlement.ExpiresAt == nil || entitlement.ExpiresAt.After(at)) {
+			return true
+		}
+	}
+	return false
+}
+
+// GrantEntitlement grants a product to a player, until the expiry given in the
+// request or for good. Granting a product the player already holds replaces its
+// expiry. On success the entitlement is returned. A 404 status code is returned
+// if the player does not exist.
+func (h *PlayerHandler) GrantEntitlement(c echo.Context, wixID string) error {
+	parsedUUID, err := uuid.Parse(wixID)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, "Invalid WixID format")
+	}
+	request := new(models.PostPlayersPlayerIdEntitlementsJSONRequestBody)
+	if err := c.Bind(request); err != nil {
+		return c.JSON(http.StatusBadRequest, "Failed to bind the request to the entitlement")
+	}
+	if request.ProductID == "" {
+		return c.JSON(http.StatusBadRequest, "Missing productID")
+	}
+
+	ctx, cancel := h.Timeouts.context(c, "GrantEntitlement")
+	defer cancel()
+
+	var player models.Player
+	if err := h.PlayerCol.FindOne(ctx, bson.M{"wixID": binaryWixID(parsedUUID)}).Decode(&player); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return c.JSON(http.StatusNotFound, "Player not found")
+		}
+		return storageError(c, err, "to load player", "Failed to grant entitlement")
+	}
+
+	now := time.Now().UTC()
+	entitlement := models.Entitlement{
+		ProductID: request.ProductID,
+		GrantedAt: now,
+		ExpiresAt: request.ExpiresAt,
+	}
+	// The entitlement replaces the one the player holds, or is added if they hold none.
+	result, err := h.PlayerCol.UpdateOne(ctx,
+		bson.M{"wixID": binaryWixID(parsedUUID), "entitlements.productID": request.ProductID},
+		bson.M{"$set": bson.M{"entitlements.$": entitlement, "updatedAt": now}})
+	if err == nil && result.MatchedCount == 0 {
+		_, err = h.PlayerCol.UpdateOne(ctx,
+			bson.M{"wixID": binaryWixID(parsedUUID), "entitlements.productID": bson.M{"$ne": request.ProductID}},
+			bson.M{"$push": bson.M{"entitlements": entitlement}, "$set": bson.M{"updatedAt": now}})
+	}
+	if err != nil {
+		return storageError(c, err, "to grant entitlement", "Failed to grant entitlement")
+	}
+
+	if h.Audit != nil {
+		h.Audit.Record(ctx, playerChange(models.AuditActionPlayerEntitlementGranted, parsedUUID, &player, loadAudited(ctx, h.PlayerCol, h.Timeouts, parsedUUID)))
+	}
+
+	return c.JSON(http.StatusOK, entitlement)
+}
+
+// RevokeEntitlement takes a product away from a player. A 404 status code is
+// returned if the player does not exist or does not hold the product.
+func (h *PlayerHandler) RevokeEntitlement(c echo.Context, wixID string, productID string) error {
+	parsedUUID, err := uuid.Parse(wixID)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, "Invalid WixID format")
+	}
+
+	ctx, cancel := h.Timeouts.context(c, "RevokeEntitlement")
+	defer cancel()
+
+	var player models.Player
+	filter := bson.M{"wixID": binaryWixID(parsedUUID), "entitlements.productID": productID}
+	if err := h.PlayerCol.FindOne(ctx, filter).Decode(&player); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return c.JSON(http.StatusNotFound, "Player or entitlement not found")
+		}
+		return storageError(c, err, "to load player", "Failed to revoke entitlement")
+	}
+
+	now := time.Now().UTC()
+	update := bson.M{
+		"$pull": bson.M{"entitlements": bson.M{"productID": productID}},
+		"$set":  bson.M{"updatedAt": now},
+	}
+	result, err := h.PlayerCol.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return storageError(c, err, "to revoke entitlement", "Failed to revoke entitlement")
+	}
+	if result.ModifiedCount == 0 {
+		return c.JSON(http.StatusNotFound, "Player or entitlement not found")
+	}
+
+	if h.Audit != nil {
+		h.Audit.Record(ctx, playerChange(models.AuditActionPlayerEntitlementRevoked, parsedUUID, &player, loadAudited(ctx, h.PlayerCol, h.Timeouts, parsedUUID)))
+	}
+
+	return c.JSON(http.StatusOK, "Entitlement revoked")
+}
@@ -0,0 +1,507 @@
+package api_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"github.com/okcthulhu/ChooseYourOwnAdventure/api"
+	"github.com/okcthulhu/ChooseYourOwnAdventure/api/models"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+// samplePaywalls sells story "s" as a whole and its "Finale" chapter separately.
+func samplePaywalls() *api.Paywalls {
+	return api.NewPaywalls([]models.Paywall{
+		{StoryID: "s", ProductID: "story-s"},
+		{StoryID: "s", ChapterName: strPtr("Finale"), ProductID: "finale"},
+	})
+}
+
+func inChapter(document bson.D, chapterName string) bson.D {
+	return append(document, bson.E{Key: "chapterName", Value: chapterName})
+}
+
+func withEntitlement(document bson.D, productID string, expiresAt *time.Time) bson.D {
+	entitlement := bson.D{{Key: "productID", Value: productID}, {Key: "grantedAt", Value: time.Now()}}
+	if expiresAt != nil {
+		entitlement = append(entitlement, bson.E{Key: "expiresAt", Value: *expiresAt})
+	}
+	return append(document, bson.E{Key: "entitlements", Value: bson.A{entitlement}})
+}
+
+func TestLoadPaywallCatalog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "paywalls.yaml")
+	os.WriteFile(path, []byte(`
+- storyID: s
+  productID: story-s
+- storyID: s
+  chapterName: Finale
+  productID: finale
+`), 0o644)
+
+	catalog, err := api.LoadPaywallCatalog(path)
+
+	assert.NoError(t, err)
+	if assert.Len(t, catalog, 2) {
+		assert.Nil(t, catalog[0].ChapterName)
+		assert.Equal(t, "Finale", *catalog[1].ChapterName)
+		assert.Equal(t, "finale", catalog[1].ProductID)
+	}
+
+	shipped, err := api.LoadPaywallCatalog("../paywalls.yaml")
+	assert.NoError(t, err, "the shipped catalog loads")
+	assert.Empty(t, shipped)
+}
+
+func TestValidatePaywallCatalog(t *testing.T) {
+	assert.Error(t, api.ValidatePaywallCatalog([]models.Paywall{{ProductID: "p"}}), "a story is required")
+	assert.Error(t, api.ValidatePaywallCatalog([]models.Paywall{{StoryID: "s"}}), "a product is required")
+	assert.Error(t, api.ValidatePaywallCatalog([]models.Paywall{
+		{StoryID: "s", ChapterName: strPtr("Finale"), ProductID: "a"},
+		{StoryID: "s", ChapterName: strPtr("Finale"), ProductID: "b"},
+	}), "a chapter has one paywall")
+	assert.NoError(t, api.ValidatePaywallCatalog([]models.Paywall{
+		{StoryID: "s", ProductID: "a"},
+		{StoryID: "s", ChapterName: strPtr("Finale"), ProductID: "b"},
+	}))
+}
+
+func TestTakeChoice_Paywall(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	past, future := time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+	cases := []struct {
+		name   string
+		player func(uuid.UUID) bson.D
+		status int
+	}{
+		{"not entitled", func(wixID uuid.UUID) bson.D { return playerDocument(wixID, "s", "start") }, http.StatusPaymentRequired},
+		{"entitled to the story only", func(wixID uuid.UUID) bson.D {
+			return withEntitlement(playerDocument(wixID, "s", "start"), "story-s", nil)
+		}, http.StatusPaymentRequired},
+		{"entitlement expired", func(wixID uuid.UUID) bson.D {
+			return withEntitlement(playerDocument(wixID, "s", "start"), "finale", &past)
+		}, http.StatusPaymentRequired},
+		{"entitled", func(wixID uuid.UUID) bson.D {
+			return withEntitlement(playerDocument(wixID, "s", "start"), "finale", &future)
+		}, http.StatusOK},
+	}
+	for _, tc := range cases {
+		mt.Run(tc.name, func(mt *mtest.T) {
+			wixID := uuid.New()
+			rec := httptest.NewRecorder()
+			c := echo.New().NewContext(choiceRequest(0), rec)
+
+			h := api.NewPlayerHandler(mt.Coll, mt.Coll)
+			h.Paywalls = samplePaywalls()
+
+			mt.AddMockResponses(
+				mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, tc.player(wixID)),
+				mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch,
+					storyElementDocument("s", "start", bson.D{{Key: "description", Value: "On"}, {Key: "nextNodeID", Value: "last"}})),
+				mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, inChapter(storyElementDocument("s", "last"), "Finale")),
+				matchedResponse(),
+			)
+
+			err := h.TakeChoice(c, wixID.String(), "s")
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.status, rec.Code)
+			if tc.status != http.StatusPaymentRequired {
+				return
+			}
+			var locked models.LockedContent
+			assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &locked))
+			assert.Equal(t, models.LockedContent{
+				Message:     api.LockedMessage,
+				StoryID:     "s",
+				NodeID:      "last",
+				ChapterName: strPtr("Finale"),
+				ProductID:   "finale",
+			}, locked)
+			for _, event := range mt.GetAllStartedEvents() {
+				assert.NotEqual(t, "update", event.CommandName, "the player stays where they are")
+			}
+		})
+	}
+}
+
+func TestGetCurrentStoryElement_Paywall(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("story sold as a whole", func(mt *mtest.T) {
+		wixID := uuid.New()
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/", nil), rec)
+
+		h := api.NewPlayerHandler(mt.Coll, mt.Coll)
+		h.Paywalls = samplePaywalls()
+
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, playerDocument(wixID, "s", "start")),
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, storyElementDocument("s", "start")),
+		)
+
+		h.GetCurrentStoryElement(c, wixID.String(), "s")
+
+		assert.Equal(t, http.StatusPaymentRequired, rec.Code)
+		var locked models.LockedContent
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &locked))
+		assert.Equal(t, "story-s", locked.ProductID)
+		assert.Nil(t, locked.ChapterName)
+	})
+
+	mt.Run("other stories are free", func(mt *mtest.T) {
+		wixID := uuid.New()
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/", nil), rec)
+
+		h := api.NewPlayerHandler(mt.Coll, mt.Coll)
+		h.Paywalls = samplePaywalls()
+
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, playerDocument(wixID, "free", "start")),
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, storyElementDocument("free", "start")),
+		)
+
+		h.GetCurrentStoryElement(c, wixID.String(), "free")
+
+		assert.Equal(t, http.StatusOK, rec.Code)
+	})
+}
+
+func TestGetStoryElement_Paywall(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("only the admin reads locked elements", func(mt *mtest.T) {
+		h := api.NewStoryHandler(mt.Coll)
+		h.Paywalls = samplePaywalls()
+		e := echo.New()
+		e.Use(api.IdentifyActor("admin-token"))
+		e.GET("/stories/:storyID/elements/:nodeId", func(c echo.Context) error {
+			return h.GetStoryElement(c, c.Param("storyID"), c.Param("nodeId"))
+		})
+		get := func(authorization string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest(http.MethodGet, "/stories/s/elements/start", nil)
+			if authorization != "" {
+				req.Header.Set(echo.HeaderAuthorization, authorization)
+			}
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, req)
+			return rec
+		}
+
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, storyElementDocument("s", "start")))
+		rec := get("")
+		assert.Equal(t, http.StatusPaymentRequired, rec.Code)
+		assert.Contains(t, rec.Body.String(), `"productID":"story-s"`)
+		assert.Empty(t, rec.Header().Get(api.ETagHeader))
+
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, storyElementDocument("s", "start")))
+		rec = get("Bearer admin-token")
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "private, max-age=60", rec.Header().Get(echo.HeaderCacheControl), "shared caches do not keep locked elements")
+	})
+}
+
+func TestPatchStoryElement_Paywall(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("patching does not read around the paywall", func(mt *mtest.T) {
+		h := api.NewStoryHandler(mt.Coll)
+		h.Paywalls = samplePaywalls()
+		e := echo.New()
+		e.Use(api.IdentifyActor("admin-token"))
+		e.PATCH("/stories/:storyID/elements/:nodeId", func(c echo.Context) error {
+			return h.PatchStoryElement(c, c.Param("storyID"), c.Param("nodeId"))
+		})
+		patch := func(authorization string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest(http.MethodPatch, "/stories/s/elements/start", strings.NewReader(`{}`))
+			req.Header.Set(echo.HeaderContentType, api.MIMEMergePatch)
+			if authorization != "" {
+				req.Header.Set(echo.HeaderAuthorization, authorization)
+			}
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, req)
+			return rec
+		}
+
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, storyElementDocument("s", "start")))
+		rec := patch("")
+		assert.Equal(t, http.StatusPaymentRequired, rec.Code)
+		assert.Contains(t, rec.Body.String(), `"productID":"story-s"`)
+		assert.NotContains(t, rec.Body.String(), "content of start")
+
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, storyElementDocument("s", "start")))
+		rec = patch("Bearer admin-token")
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Contains(t, rec.Body.String(), "content of start")
+	})
+}
+
+func TestListStoryElements_Paywall(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("locked elements left out of the page", func(mt *mtest.T) {
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/?limit=2", nil), rec)
+
+		h := api.NewStoryHandler(mt.Coll)
+		h.Paywalls = samplePaywalls()
+
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch,
+			inChapter(storyElementDocument("s", "a"), "Prologue"),
+			inChapter(storyElementDocument("s", "b"), "Finale"),
+			inChapter(storyElementDocument("s", "c"), "Finale"),
+		))
+
+		h.ListStoryElements(c, "s")
+
+		assert.Equal(t, http.StatusOK, rec.Code)
+		var page models.StoryElementPage
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &page))
+		assert.Empty(t, page.Items, "the story is sold as a whole")
+		assert.NotNil(t, page.NextCursor, "the next page starts after the withheld elements")
+	})
+
+	mt.Run("free chapters of a story with locked ones", func(mt *mtest.T) {
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/", nil), rec)
+
+		h := api.NewStoryHandler(mt.Coll)
+		h.Paywalls = api.NewPaywalls([]models.Paywall{{StoryID: "s", ChapterName: strPtr("Finale"), ProductID: "finale"}})
+
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch,
+			inChapter(storyElementDocument("s", "a"), "Prologue"),
+			inChapter(storyElementDocument("s", "b"), "Finale"),
+		))
+
+		h.ListStoryElements(c, "s")
+
+		var page models.StoryElementPage
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &page))
+		if assert.Len(t, page.Items, 1) {
+			assert.Equal(t, "a", page.Items[0].NodeID)
+		}
+	})
+}
+
+func entitlementRequest(body string) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, "/", bytes.NewBufferString(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	return req
+}
+
+func TestGrantEntitlement(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("product added", func(mt *mtest.T) {
+		wixID := uuid.New()
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(entitlementRequest(`{"productID":"finale","expiresAt":"2030-01-01T00:00:00Z"}`), rec)
+
+		audit := &recordedAudit{}
+		h := api.NewPlayerHandler(mt.Coll, mt.Coll)
+		h.Audit = audit
+
+		granted := withEntitlement(playerDocument(wixID, "s", "start"), "finale", nil)
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, playerDocument(wixID, "s", "start")),
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 0}),
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}, bson.E{Key: "nModified", Value: 1}),
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, granted),
+		)
+
+		err := h.GrantEntitlement(c, wixID.String())
+
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, rec.Code)
+		var entitlement models.Entitlement
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &entitlement))
+		assert.Equal(t, "finale", entitlement.ProductID)
+		assert.Equal(t, time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC), entitlement.ExpiresAt.UTC())
+
+		var updates []bson.Raw
+		for _, event := range mt.GetAllStartedEvents() {
+			if event.CommandName == "update" {
+				updates = append(updates, event.Command.Lookup("updates").Array().Index(0).Value().Document())
+			}
+		}
+		if assert.Len(t, updates, 2) {
+			_, err := updates[0].LookupErr("u", "$set", "entitlements.$")
+			assert.NoError(t, err, "an entitlement held is replaced")
+			pushed := updates[1].Lookup("u", "$push", "entitlements", "productID").StringValue()
+			assert.Equal(t, "finale", pushed, "otherwise it is added")
+		}
+
+		if assert.Len(t, audit.entries, 1) {
+			assert.Equal(t, models.AuditActionPlayerEntitlementGranted, audit.entries[0].Action)
+			assert.Nil(t, audit.entries[0].Before.Player.ProductIDs)
+			assert.Equal(t, []string{"finale"}, *audit.entries[0].After.Player.ProductIDs)
+		}
+	})
+
+	mt.Run("missing product", func(mt *mtest.T) {
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(entitlementRequest(`{}`), rec)
+
+		api.NewPlayerHandler(mt.Coll, mt.Coll).GrantEntitlement(c, uuid.NewString())
+
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+	})
+
+	mt.Run("unknown player", func(mt *mtest.T) {
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(entitlementRequest(`{"productID":"finale"}`), rec)
+
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch))
+
+		api.NewPlayerHandler(mt.Coll, mt.Coll).GrantEntitlement(c, uuid.NewString())
+
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+	})
+}
+
+func TestRevokeEntitlement(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("product pulled", func(mt *mtest.T) {
+		wixID := uuid.New()
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(httptest.NewRequest(http.MethodDelete, "/", nil), rec)
+
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, withEntitlement(playerDocument(wixID, "s", "start"), "finale", nil)),
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}, bson.E{Key: "nModified", Value: 1}),
+		)
+
+		err := api.NewPlayerHandler(mt.Coll, mt.Coll).RevokeEntitlement(c, wixID.String(), "finale")
+
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, rec.Code)
+		update := mt.GetStartedEvent()
+		for update != nil && update.CommandName != "update" {
+			update = mt.GetStartedEvent()
+		}
+		if assert.NotNil(t, update) {
+			pulled := update.Command.Lookup("updates").Array().Index(0).Value().Document().Lookup("u", "$pull", "entitlements", "productID")
+			assert.Equal(t, "finale", pulled.StringValue())
+		}
+	})
+
+	mt.Run("product not held", func(mt *mtest.T) {
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(httptest.NewRequest(http.MethodDelete, "/", nil), rec)
+
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch))
+
+		api.NewPlayerHandler(mt.Coll, mt.Coll).RevokeEntitlement(c, uuid.NewString(), "finale")
+
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+	})
+}
+
+func TestPatchPlayerState_EntitlementsImmutable(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("players cannot grant themselves products", func(mt *mtest.T) {
+		wixID := uuid.New()
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(patchRequest(api.MIMEMergePatch, `{"entitlements":[{"productID":"finale","grantedAt":"2024-01-01T00:00:00Z"}]}`), rec)
+
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, playerDocument(wixID, "s", "start")))
+
+		api.NewPlayerHandler(mt.Coll, mt.Coll).PatchPlayerState(c, wixID.String())
+
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+		assert.Contains(t, rec.Body.String(), "The entitlements of a player cannot be changed")
+	})
+}
+
+func TestParty_Paywalls(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("host not entitled to the start node", func(mt *mtest.T) {
+		host := uuid.New()
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(jsonRequest(http.MethodPost, models.CreatePartyRequest{
+			StoryID:     "s",
+			StartNodeID: "start",
+			HostWixID:   host,
+		}), rec)
+
+		h := api.NewPartyHandler(mt.Coll, mt.Coll, mt.Coll)
+		h.Paywalls = samplePaywalls()
+
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, twoWayNode()),
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, playerDocument(host, "s", "start")),
+		)
+
+		h.CreateParty(c)
+
+		assert.Equal(t, http.StatusPaymentRequired, rec.Code)
+		var locked models.LockedContent
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &locked))
+		assert.Equal(t, "story-s", locked.ProductID)
+		for _, event := range mt.GetAllStartedEvents() {
+			assert.NotEqual(t, "update", event.CommandName)
+			assert.NotEqual(t, "insert", event.CommandName)
+		}
+	})
+
+	mt.Run("vote into a chapter a member is not entitled to", func(mt *mtest.T) {
+		host, guest := uuid.New(), uuid.New()
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(jsonRequest(http.MethodPost, models.CastVoteRequest{WixID: guest, ChoiceIndex: 1}), rec)
+
+		h := api.NewPartyHandler(mt.Coll, mt.Coll, mt.Coll)
+		h.Paywalls = api.NewPaywalls([]models.Paywall{{StoryID: "s", ChapterName: strPtr("Finale"), ProductID: "finale"}})
+
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch,
+				partyDocument(host, []uuid.UUID{host, guest}, models.PartyTieBreakLowestIndex, bson.D{{Key: host.String(), Value: 1}})),
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, twoWayNode()),
+			matchedResponse(),
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, twoWayNode()),
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, inChapter(storyElementDocument("s", "right"), "Finale")),
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, withEntitlement(playerDocument(host, "s", "start"), "finale", nil)),
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, playerDocument(guest, "s", "start")),
+		)
+
+		h.CastVote(c, "p1")
+
+		assert.Equal(t, http.StatusPaymentRequired, rec.Code)
+		var locked models.LockedContent
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &locked))
+		assert.Equal(t, "finale", locked.ProductID)
+		assert.Equal(t, "right", locked.NodeID)
+		updates := 0
+		for _, event := range mt.GetAllStartedEvents() {
+			if event.CommandName == "update" {
+				updates++
+			}
+		}
+		assert.Equal(t, 1, updates, "only the ballot is recorded")
+	})
+}
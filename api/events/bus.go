@@ -0,0 +1,265 @@
+// Package events implements the domain event bus. Events are written to an
+// outbox collection next to the player data, or staged on the documents whose
+// changes raised them and relayed to the outbox, and are then delivered, at
+// least once, to every configured sink and in-process subscriber by a dispatcher.
+package events
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/okcthulhu/ChooseYourOwnAdventure/api/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Outbox entry states.
+const (
+	StatusPending   = "pending"
+	StatusDelivered = "delivered"
+	StatusFailed    = "failed"
+)
+
+// subscribersSink is the name under which in-process subscribers are tracked
+// in an entry's delivery list.
+const subscribersSink = "subscribers"
+
+// OutboxIndexes are the indexes the outbox collection needs for the dispatcher to
+// claim the next entry that is due without scanning the delivered ones.
+var OutboxIndexes = []mongo.IndexModel{
+	{Keys: bson.D{{Key: "status", Value: 1}, {Key: "nextAttemptAt", Value: 1}}},
+}
+
+// OutboxCollection defines the required behavior for interacting with
+// the event outbox in MongoDB. By isolating these methods, we can
+// easily swap out the actual MongoDB collection with a mock for testing.
+type OutboxCollection interface {
+	// InsertOne stores a newly published event.
+	InsertOne(ctx context.Context, document interface{}, opts ...*options.InsertOneOptions) (*mongo.InsertOneResult, error)
+
+	// FindOneAndUpdate claims the next entry that is due for delivery.
+	FindOneAndUpdate(ctx context.Context, filter interface{}, update interface{},
+		opts ...*options.FindOneAndUpdateOptions) *mongo.SingleResult
+
+	// UpdateOne records the outcome of a delivery attempt.
+	UpdateOne(ctx context.Context, filter interface{}, update interface{},
+		opts ...*options.UpdateOptions) (*mongo.UpdateResult, error)
+}
+
+// OutboxEntry is the stored form of a published event together with its delivery state.
+type OutboxEntry struct {
+	ID            string             `bson:"_id"`
+	Event         models.DomainEvent `bson:"event"`
+	Status        string             `bson:"status"`
+	Attempts      int                `bson:"attempts"`
+	DeliveredTo   []string           `bson:"deliveredTo"`
+	NextAttemptAt time.Time          `bson:"nextAttemptAt"`
+	LastError     string             `bson:"lastError,omitempty"`
+}
+
+// Sink receives every event published on the bus. Deliver may be called more
+// than once for the same event, so sinks should use the event ID to de-duplicate.
+type Sink interface {
+	// Name identifies the sink in the outbox delivery bookkeeping. It must be stable.
+	Name() string
+	Deliver(ctx context.Context, event models.DomainEvent) error
+}
+
+// Subscriber is an in-process event handler registered with Subscribe.
+type Subscriber func(ctx context.Context, event models.DomainEvent) error
+
+// Bus publishes domain events into the outbox and dispatches them to sinks and subscribers.
+type Bus struct {
+	// Outbox is the collection events are staged in until delivered.
+	Outbox OutboxCollection
+
+	// Sinks receive every event.
+	Sinks []Sink
+
+	// Staging are the collections whose documents stage the events raised by
+	// their changes, for Relay to move them to the outbox.
+	Staging []StagingCollection
+
+	// MaxAttempts is the number of delivery attempts after which an entry is marked failed.
+	MaxAttempts int
+
+	// Backoff is the delay before the first retry. It doubles with every further attempt.
+	Backoff time.Duration
+
+	// Lease is how long a claimed entry is hidden from other dispatchers.
+	Lease time.Duration
+
+	mu          sync.RWMutex
+	subscribers map[models.DomainEventType][]Subscriber
+
+	now func() time.Time
+}
+
+// NewBus creates a Bus backed by the given outbox collection and delivering to the given sinks.
+func NewBus(outbox OutboxCollection, sinks ...Sink) *Bus {
+	return &Bus{
+		Outbox:      outbox,
+		Sinks:       sinks,
+		MaxAttempts: 10,
+		Backoff:     time.Second,
+		Lease:       30 * time.Second,
+		subscribers: map[models.DomainEventType][]Subscriber{},
+		now:         time.Now,
+	}
+}
+
+// Subscribe registers an in-process handler for the given event types. Subscribers
+// are invoked by the dispatcher, with the same at-least-once guarantee as sinks.
+func (b *Bus) Subscribe(handler Subscriber, types ...models.DomainEventType) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, eventType := range types {
+		b.subscribers[eventType] = append(b.subscribers[eventType], handler)
+	}
+}
+
+// Publish assigns the event an ID and timestamp if missing and stores it in the outbox.
+// The event is considered published once this returns without error.
+func (b *Bus) Publish(ctx context.Context, event models.DomainEvent) error {
+	return b.store(ctx, Stage(b.now(), event)[0])
+}
+
+// store adds an event that has an ID and timestamp to the outbox.
+func (b *Bus) store(ctx context.Context, event models.DomainEvent) error {
+	entry := OutboxEntry{
+		ID:            event.Id,
+		Event:         event,
+		Status:        StatusPending,
+		DeliveredTo:   []string{},
+		NextAttemptAt: event.OccurredAt,
+	}
+	_, err := b.Outbox.InsertOne(ctx, entry)
+	return err
+}
+
+// Dispatch delivers up to limit due outbox entries and reports how many were processed.
+func (b *Bus) Dispatch(ctx context.Context, limit int) (int, error) {
+	processed := 0
+	for processed < limit {
+		entry, err := b.claim(ctx)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return processed, nil
+		}
+		if err != nil {
+			return processed, err
+		}
+		if err := b.deliver(ctx, entry); err != nil {
+			return processed, err
+		}
+		processed++
+	}
+	return processed, nil
+}
+
+// Run moves staged events to the outbox and dispatches outbox entries every
+// interval until the context is cancelled.
+func (b *Bus) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if _, err := b.Relay(ctx, 100); err != nil && ctx.Err() == nil {
+			slog.ErrorContext(ctx, "Failed to relay staged events", "error", err)
+		}
+		if _, err := b.Dispatch(ctx, 100); err != nil && ctx.Err() == nil {
+			slog.ErrorContext(ctx, "Failed to dispatch outbox events", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// claim atomically pushes the next due entry's attempt time past the lease so
+// that concurrent dispatchers do not deliver it at the same time.
+func (b *Bus) claim(ctx context.Context) (*OutboxEntry, error) {
+	now := b.now()
+	filter := bson.M{
+		"status":        StatusPending,
+		"nextAttemptAt": bson.M{"$lte": now},
+	}
+	update := bson.M{"$set": bson.M{"nextAttemptAt": now.Add(b.Lease)}}
+	opts := options.FindOneAndUpdate().
+		SetSort(bson.D{{Key: "nextAttemptAt", Value: 1}}).
+		SetReturnDocument(options.After)
+
+	var entry OutboxEntry
+	if err := b.Outbox.FindOneAndUpdate(ctx, filter, update, opts).Decode(&entry); err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// deliver hands the entry to every sink that has not yet acknowledged it and
+// records the outcome in the outbox.
+func (b *Bus) deliver(ctx context.Context, entry *OutboxEntry) error {
+	delivered := map[string]bool{}
+	for _, name := range entry.DeliveredTo {
+		delivered[name] = true
+	}
+
+	var lastErr error
+	for _, sink := range b.Sinks {
+		if delivered[sink.Name()] {
+			continue
+		}
+		if err := sink.Deliver(ctx, entry.Event); err != nil {
+			slog.WarnContext(ctx, "Failed to deliver event", "eventID", entry.ID, "sink", sink.Name(), "error", err)
+			lastErr = err
+			continue
+		}
+		entry.DeliveredTo = append(entry.DeliveredTo, sink.Name())
+	}
+
+	if !delivered[subscribersSink] {
+		if err := b.notify(ctx, entry.Event); err != nil {
+			slog.WarnContext(ctx, "Failed to notify subscribers of event", "eventID", entry.ID, "error", err)
+			lastErr = err
+		} else {
+			entry.DeliveredTo = append(entry.DeliveredTo, subscribersSink)
+		}
+	}
+
+	set := bson.M{"deliveredTo": entry.DeliveredTo}
+	update := bson.M{"$set": set}
+	switch {
+	case lastErr == nil:
+		set["status"] = StatusDelivered
+	case entry.Attempts+1 >= b.MaxAttempts:
+		set["status"] = StatusFailed
+		set["lastError"] = lastErr.Error()
+		update["$inc"] = bson.M{"attempts": 1}
+	default:
+		set["lastError"] = lastErr.Error()
+		set["nextAttemptAt"] = b.now().Add(b.Backoff << entry.Attempts)
+		update["$inc"] = bson.M{"attempts": 1}
+	}
+
+	_, err := b.Outbox.UpdateOne(ctx, bson.M{"_id": entry.ID}, update)
+	return err
+}
+
+// notify runs every subscriber registered for the event's type.
+func (b *Bus) notify(ctx context.Context, event models.DomainEvent) error {
+	b.mu.RLock()
+	subscribers := b.subscribers[event.Type]
+	b.mu.RUnlock()
+
+	var errs []error
+	for _, subscriber := range subscribers {
+		if err := subscriber(ctx, event); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
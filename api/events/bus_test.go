@@ -0,0 +1,166 @@
+package events_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/okcthulhu/ChooseYourOwnAdventure/api/events"
+	"github.com/okcthulhu/ChooseYourOwnAdventure/api/models"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+type fakeSink struct {
+	name      string
+	err       error
+	delivered []models.DomainEvent
+}
+
+func (s *fakeSink) Name() string { return s.name }
+
+func (s *fakeSink) Deliver(ctx context.Context, event models.DomainEvent) error {
+	if s.err != nil {
+		return s.err
+	}
+	s.delivered = append(s.delivered, event)
+	return nil
+}
+
+func outboxDocument(id string, eventType models.DomainEventType, deliveredTo ...string) bson.D {
+	delivered := bson.A{}
+	for _, name := range deliveredTo {
+		delivered = append(delivered, name)
+	}
+	return bson.D{
+		{Key: "_id", Value: id},
+		{Key: "event", Value: bson.D{
+			{Key: "id", Value: id},
+			{Key: "type", Value: string(eventType)},
+			{Key: "occurredAt", Value: time.Now()},
+			{Key: "wixID", Value: uuid.New()},
+		}},
+		{Key: "status", Value: events.StatusPending},
+		{Key: "attempts", Value: 0},
+		{Key: "deliveredTo", Value: delivered},
+		{Key: "nextAttemptAt", Value: time.Now()},
+	}
+}
+
+func claimedResponse(doc bson.D) bson.D {
+	return bson.D{{Key: "ok", Value: 1}, {Key: "value", Value: doc}}
+}
+
+func noEntryResponse() bson.D {
+	return bson.D{{Key: "ok", Value: 1}, {Key: "value", Value: nil}}
+}
+
+// Publish
+
+func TestPublish_AssignsIDAndTimestamp(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("event stored in outbox", func(mt *mtest.T) {
+		bus := events.NewBus(mt.Coll)
+
+		mt.AddMockResponses(mtest.CreateSuccessResponse())
+
+		wixID := uuid.New()
+		err := bus.Publish(context.Background(), models.DomainEvent{Type: models.PlayerCreated, WixID: &wixID})
+
+		assert.NoError(t, err)
+		inserted := mt.GetStartedEvent().Command.Lookup("documents").Array().Index(0).Value().Document()
+		assert.NotEmpty(t, inserted.Lookup("_id").StringValue())
+		assert.Equal(t, events.StatusPending, inserted.Lookup("status").StringValue())
+		assert.False(t, inserted.Lookup("event", "occurredAt").Time().IsZero())
+	})
+}
+
+// Dispatch
+
+func TestDispatch_DeliversToSinksAndSubscribers(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("entry delivered", func(mt *mtest.T) {
+		sink := &fakeSink{name: "fake"}
+		bus := events.NewBus(mt.Coll, sink)
+
+		var notified []models.DomainEvent
+		bus.Subscribe(func(ctx context.Context, event models.DomainEvent) error {
+			notified = append(notified, event)
+			return nil
+		}, models.ChoiceTaken)
+
+		mt.AddMockResponses(
+			claimedResponse(outboxDocument("e1", models.ChoiceTaken)),
+			mtest.CreateSuccessResponse(),
+			noEntryResponse(),
+		)
+
+		processed, err := bus.Dispatch(context.Background(), 10)
+
+		assert.NoError(t, err)
+		assert.Equal(t, 1, processed)
+		assert.Len(t, sink.delivered, 1)
+		assert.Len(t, notified, 1)
+	})
+}
+
+func TestDispatch_SkipsSinksThatAlreadyAcknowledged(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("redelivery skips acknowledged sink", func(mt *mtest.T) {
+		done := &fakeSink{name: "done"}
+		pending := &fakeSink{name: "pending"}
+		bus := events.NewBus(mt.Coll, done, pending)
+
+		mt.AddMockResponses(
+			claimedResponse(outboxDocument("e1", models.PlayerCreated, "done")),
+			mtest.CreateSuccessResponse(),
+			noEntryResponse(),
+		)
+
+		_, err := bus.Dispatch(context.Background(), 10)
+
+		assert.NoError(t, err)
+		assert.Empty(t, done.delivered)
+		assert.Len(t, pending.delivered, 1)
+	})
+}
+
+func TestDispatch_FailedSinkIsRetried(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("failure schedules retry", func(mt *mtest.T) {
+		bus := events.NewBus(mt.Coll, &fakeSink{name: "broken", err: errors.New("unreachable")})
+
+		mt.AddMockResponses(
+			claimedResponse(outboxDocument("e1", models.PlayerCreated)),
+			mtest.CreateSuccessResponse(),
+			noEntryResponse(),
+		)
+
+		_, err := bus.Dispatch(context.Background(), 10)
+		assert.NoError(t, err)
+
+		var update bson.Raw
+		for _, started := range mt.GetAllStartedEvents() {
+			if started.CommandName == "update" {
+				update = started.Command.Lookup("updates").Array().Index(0).Value().Document().Lookup("u").Document()
+			}
+		}
+		if assert.NotNil(t, update) {
+			_, err := update.LookupErr("$set", "status")
+			assert.Error(t, err, "entry should stay pending")
+			assert.Equal(t, "unreachable", update.Lookup("$set", "lastError").StringValue())
+			assert.Equal(t, int32(1), update.Lookup("$inc", "attempts").Int32())
+		}
+	})
+}
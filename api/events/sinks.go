@@ -0,0 +1,154 @@
+package events
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/okcthulhu/ChooseYourOwnAdventure/api/models"
+)
+
+// Headers set on every webhook delivery.
+const (
+	HeaderEventID   = "X-CYOA-Event-ID"
+	HeaderEventType = "X-CYOA-Event-Type"
+	HeaderSignature = "X-CYOA-Signature"
+)
+
+// FileSink appends every event as a single JSON line to a local file.
+type FileSink struct {
+	Path string
+
+	mu sync.Mutex
+}
+
+// NewFileSink creates a FileSink writing to the file at path. The file is created on first delivery.
+func NewFileSink(path string) *FileSink {
+	return &FileSink{Path: path}
+}
+
+// Name implements Sink.
+func (s *FileSink) Name() string {
+	return "file:" + s.Path
+}
+
+// Deliver implements Sink.
+func (s *FileSink) Deliver(ctx context.Context, event models.DomainEvent) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	file, err := os.OpenFile(s.Path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// WebhookSink POSTs every event as JSON to a URL. The body is signed with
+// HMAC-SHA256 using Secret and the hex digest is sent as "sha256=<digest>" in
+// the X-CYOA-Signature header. Failed requests are retried with exponential backoff.
+type WebhookSink struct {
+	URL    string
+	Secret []byte
+	Client *http.Client
+
+	// Retries is the number of additional attempts after the first failed request.
+	Retries int
+
+	// Backoff is the delay before the first retry. It doubles with every further retry.
+	Backoff time.Duration
+}
+
+// NewWebhookSink creates a WebhookSink for the given URL and signing secret.
+func NewWebhookSink(url string, secret string) *WebhookSink {
+	return &WebhookSink{
+		URL:     url,
+		Secret:  []byte(secret),
+		Client:  &http.Client{Timeout: 10 * time.Second},
+		Retries: 3,
+		Backoff: 500 * time.Millisecond,
+	}
+}
+
+// Name implements Sink.
+func (s *WebhookSink) Name() string {
+	return "webhook:" + s.URL
+}
+
+// Deliver implements Sink.
+func (s *WebhookSink) Deliver(ctx context.Context, event models.DomainEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	signature := Sign(s.Secret, body)
+
+	var lastErr error
+	for attempt := 0; attempt <= s.Retries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(s.Backoff << (attempt - 1)):
+			}
+		}
+
+		retry, err := s.post(ctx, event, body, signature)
+		if err == nil {
+			return nil
+		}
+		lastErr = err
+		if !retry {
+			break
+		}
+	}
+	return lastErr
+}
+
+// post sends a single delivery and reports whether a failure is worth retrying.
+func (s *WebhookSink) post(ctx context.Context, event models.DomainEvent, body []byte, signature string) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderEventID, event.Id)
+	req.Header.Set(HeaderEventType, string(event.Type))
+	req.Header.Set(HeaderSignature, signature)
+
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+	return retry, fmt.Errorf("webhook responded with status %d", resp.StatusCode)
+}
+
+// Sign returns the signature header value for a webhook body.
+func Sign(secret []byte, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
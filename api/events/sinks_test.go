@@ -0,0 +1,101 @@
+package events_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/okcthulhu/ChooseYourOwnAdventure/api/events"
+	"github.com/okcthulhu/ChooseYourOwnAdventure/api/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func sampleEvent() models.DomainEvent {
+	wixID := uuid.New()
+	return models.DomainEvent{
+		Id:         "evt-1",
+		Type:       models.PlayerCreated,
+		OccurredAt: time.Date(2023, 11, 1, 12, 0, 0, 0, time.UTC),
+		WixID:      &wixID,
+	}
+}
+
+// FileSink
+
+func TestFileSink_AppendsJSONLines(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+	sink := events.NewFileSink(path)
+
+	assert.NoError(t, sink.Deliver(context.Background(), sampleEvent()))
+	assert.NoError(t, sink.Deliver(context.Background(), sampleEvent()))
+
+	data, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	assert.Len(t, lines, 2)
+
+	var decoded models.DomainEvent
+	assert.NoError(t, json.Unmarshal([]byte(lines[0]), &decoded))
+	assert.Equal(t, "evt-1", decoded.Id)
+}
+
+// WebhookSink
+
+func TestWebhookSink_SignsBody(t *testing.T) {
+	var signature, body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		raw, _ := io.ReadAll(r.Body)
+		body = string(raw)
+		signature = r.Header.Get(events.HeaderSignature)
+		assert.Equal(t, "evt-1", r.Header.Get(events.HeaderEventID))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	sink := events.NewWebhookSink(server.URL, "secret")
+
+	assert.NoError(t, sink.Deliver(context.Background(), sampleEvent()))
+	assert.Equal(t, events.Sign([]byte("secret"), []byte(body)), signature)
+}
+
+func TestWebhookSink_RetriesServerErrors(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	sink := events.NewWebhookSink(server.URL, "secret")
+	sink.Backoff = time.Millisecond
+
+	assert.NoError(t, sink.Deliver(context.Background(), sampleEvent()))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+}
+
+func TestWebhookSink_DoesNotRetryClientErrors(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	sink := events.NewWebhookSink(server.URL, "secret")
+	sink.Backoff = time.Millisecond
+
+	assert.Error(t, sink.Deliver(context.Background(), sampleEvent()))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+}
@@ -0,0 +1,97 @@
+package events
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/okcthulhu/ChooseYourOwnAdventure/api/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// StagedField is the field of a document that stages the events raised by its
+// changes. Writing the events with the change that raised them makes them as
+// durable as the change, which the outbox, being another collection, cannot
+// guarantee without a transaction.
+const StagedField = "pendingEvents"
+
+// StagingIndexes are the indexes a staging collection needs for Relay to find
+// the documents with staged events without scanning the others.
+var StagingIndexes = []mongo.IndexModel{
+	{
+		Keys:    bson.D{{Key: StagedField + ".id", Value: 1}},
+		Options: options.Index().SetName("stagedEvents").SetSparse(true),
+	},
+}
+
+// StagingCollection defines the required behavior for interacting with
+// a collection whose documents stage events in MongoDB. By isolating these
+// methods, we can easily swap out the actual MongoDB collection with a mock
+// for testing.
+type StagingCollection interface {
+	// Find returns the documents with staged events.
+	Find(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (*mongo.Cursor, error)
+
+	// UpdateOne removes the events relayed to the outbox from a document.
+	UpdateOne(ctx context.Context, filter interface{}, update interface{},
+		opts ...*options.UpdateOptions) (*mongo.UpdateResult, error)
+}
+
+// Stage assigns the events an ID and timestamp where missing, for them to be
+// written to a document together with the change that raised them.
+func Stage(now time.Time, events ...models.DomainEvent) []models.DomainEvent {
+	staged := make([]models.DomainEvent, len(events))
+	for i, event := range events {
+		if event.Id == "" {
+			event.Id = uuid.NewString()
+		}
+		if event.OccurredAt.IsZero() {
+			event.OccurredAt = now.UTC()
+		}
+		staged[i] = event
+	}
+	return staged
+}
+
+// stagingDocument is a document with staged events, as read by Relay.
+type stagingDocument struct {
+	ID     interface{}          `bson:"_id"`
+	Events []models.DomainEvent `bson:"pendingEvents"`
+}
+
+// Relay moves the events staged on up to limit documents of every staging
+// collection to the outbox and reports how many it moved. An event is removed
+// from its document once it is in the outbox; one found there already, as
+// after a relay that failed to remove it, is not stored again.
+func (b *Bus) Relay(ctx context.Context, limit int) (int, error) {
+	relayed := 0
+	for _, collection := range b.Staging {
+		opts := options.Find().SetProjection(bson.M{StagedField: 1}).SetLimit(int64(limit))
+		cursor, err := collection.Find(ctx, bson.M{StagedField + ".id": bson.M{"$exists": true}}, opts)
+		if err != nil {
+			return relayed, err
+		}
+		var documents []stagingDocument
+		if err := cursor.All(ctx, &documents); err != nil {
+			return relayed, err
+		}
+
+		for _, document := range documents {
+			ids := make([]string, 0, len(document.Events))
+			for _, event := range document.Events {
+				if err := b.store(ctx, event); err != nil && !mongo.IsDuplicateKeyError(err) {
+					return relayed, err
+				}
+				ids = append(ids, event.Id)
+			}
+			update := bson.M{"$pull": bson.M{StagedField: bson.M{"id": bson.M{"$in": ids}}}}
+			if _, err := collection.UpdateOne(ctx, bson.M{"_id": document.ID}, update); err != nil {
+				return relayed, err
+			}
+			relayed += len(ids)
+		}
+	}
+	return relayed, nil
+}
@@ -0,0 +1,101 @@
+package events_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/okcthulhu/ChooseYourOwnAdventure/api/events"
+	"github.com/okcthulhu/ChooseYourOwnAdventure/api/models"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func stagedDocument(ids ...string) bson.D {
+	staged := bson.A{}
+	for _, id := range ids {
+		staged = append(staged, bson.D{
+			{Key: "id", Value: id},
+			{Key: "type", Value: string(models.NodeEntered)},
+			{Key: "occurredAt", Value: time.Now()},
+		})
+	}
+	return bson.D{{Key: "_id", Value: "player"}, {Key: events.StagedField, Value: staged}}
+}
+
+func TestStage_AssignsIDAndTimestamp(t *testing.T) {
+	at := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	wixID := uuid.New()
+
+	staged := events.Stage(at,
+		models.DomainEvent{Type: models.PlayerCreated, WixID: &wixID},
+		models.DomainEvent{Id: "kept", Type: models.NodeEntered, OccurredAt: at.Add(time.Hour)},
+	)
+
+	assert.NotEmpty(t, staged[0].Id)
+	assert.Equal(t, at, staged[0].OccurredAt)
+	assert.Equal(t, "kept", staged[1].Id)
+	assert.Equal(t, at.Add(time.Hour), staged[1].OccurredAt)
+}
+
+func TestRelay_MovesStagedEventsToOutbox(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("events stored then removed", func(mt *mtest.T) {
+		bus := events.NewBus(mt.Coll)
+		bus.Staging = []events.StagingCollection{mt.Coll}
+
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "foo.players", mtest.FirstBatch, stagedDocument("e1", "e2")),
+			mtest.CreateSuccessResponse(),
+			mtest.CreateSuccessResponse(),
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}, bson.E{Key: "nModified", Value: 1}),
+		)
+
+		relayed, err := bus.Relay(context.Background(), 10)
+
+		assert.NoError(t, err)
+		assert.Equal(t, 2, relayed)
+		started := mt.GetAllStartedEvents()
+		assert.Equal(t, "e1", started[1].Command.Lookup("documents").Array().Index(0).Value().Document().Lookup("_id").StringValue())
+		assert.Equal(t, "e2", started[2].Command.Lookup("documents").Array().Index(0).Value().Document().Lookup("_id").StringValue())
+		pulled, _ := started[3].Command.Lookup("updates").Array().Index(0).Value().Document().
+			Lookup("u", "$pull", events.StagedField, "id", "$in").Array().Values()
+		assert.Len(t, pulled, 2)
+	})
+
+	mt.Run("events already in the outbox are not stored again", func(mt *mtest.T) {
+		bus := events.NewBus(mt.Coll)
+		bus.Staging = []events.StagingCollection{mt.Coll}
+
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "foo.players", mtest.FirstBatch, stagedDocument("e1")),
+			mtest.CreateWriteErrorsResponse(mtest.WriteError{Index: 0, Code: 11000, Message: "duplicate key error"}),
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}, bson.E{Key: "nModified", Value: 1}),
+		)
+
+		relayed, err := bus.Relay(context.Background(), 10)
+
+		assert.NoError(t, err)
+		assert.Equal(t, 1, relayed)
+		assert.Equal(t, "update", mt.GetAllStartedEvents()[2].CommandName, "the event is still removed from the player")
+	})
+
+	mt.Run("events kept when the outbox fails", func(mt *mtest.T) {
+		bus := events.NewBus(mt.Coll)
+		bus.Staging = []events.StagingCollection{mt.Coll}
+
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "foo.players", mtest.FirstBatch, stagedDocument("e1")),
+			mtest.CreateCommandErrorResponse(mtest.CommandError{Code: 1, Message: "unavailable"}),
+		)
+
+		_, err := bus.Relay(context.Background(), 10)
+
+		assert.Error(t, err)
+		assert.Len(t, mt.GetAllStartedEvents(), 2, "nothing is removed from the player")
+	})
+}
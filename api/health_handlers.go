@@ -0,0 +1,66 @@
+package api
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+)
+
+// Pinger checks that the storage can be reached. A *mongo.Client satisfies it.
+type Pinger interface {
+	Ping(ctx context.Context, rp *readpref.ReadPref) error
+}
+
+// HealthHandler serves the liveness and readiness probes.
+type HealthHandler struct {
+	// Storage is pinged to decide whether the instance is ready to serve requests.
+	Storage Pinger
+
+	// Timeout bounds the storage ping of a readiness check.
+	Timeout time.Duration
+
+	draining atomic.Bool
+}
+
+// NewHealthHandler creates a HealthHandler checking the given storage.
+func NewHealthHandler(storage Pinger) *HealthHandler {
+	return &HealthHandler{
+		Storage: storage,
+		Timeout: 2 * time.Second,
+	}
+}
+
+// Healthz is the liveness probe. It succeeds as long as the process serves
+// requests; it does not check the storage, so that a storage outage does not
+// get every instance restarted.
+func (h *HealthHandler) Healthz(c echo.Context) error {
+	return c.JSON(http.StatusOK, "OK")
+}
+
+// Readyz is the readiness probe. It fails with a 503 status code while the
+// storage cannot be reached and once the instance has started shutting down.
+func (h *HealthHandler) Readyz(c echo.Context) error {
+	if h.draining.Load() {
+		return c.JSON(http.StatusServiceUnavailable, "Shutting down")
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request().Context(), h.Timeout)
+	defer cancel()
+
+	if err := h.Storage.Ping(ctx, readpref.Primary()); err != nil {
+		slog.WarnContext(ctx, "Readiness check failed to ping storage", "error", err)
+		return c.JSON(http.StatusServiceUnavailable, "Storage is unreachable")
+	}
+	return c.JSON(http.StatusOK, "Ready")
+}
+
+// Drain makes the readiness probe fail from now on, so that no new traffic is
+// routed to the instance while it finishes the requests in flight.
+func (h *HealthHandler) Drain() {
+	h.draining.Store(true)
+}
@@ -0,0 +1,63 @@
+package api_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/okcthulhu/ChooseYourOwnAdventure/api"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+)
+
+type fakePinger struct {
+	err error
+}
+
+func (p fakePinger) Ping(ctx context.Context, rp *readpref.ReadPref) error {
+	return p.err
+}
+
+func probe(handler echo.HandlerFunc) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	handler(echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/", nil), rec))
+	return rec
+}
+
+func TestHealthz(t *testing.T) {
+	h := api.NewHealthHandler(fakePinger{err: errors.New("unreachable")})
+
+	rec := probe(h.Healthz)
+
+	assert.Equal(t, http.StatusOK, rec.Code, "liveness does not depend on the storage")
+}
+
+func TestReadyz_Ready(t *testing.T) {
+	h := api.NewHealthHandler(fakePinger{})
+
+	rec := probe(h.Readyz)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
+
+func TestReadyz_StorageUnreachable(t *testing.T) {
+	h := api.NewHealthHandler(fakePinger{err: errors.New("unreachable")})
+
+	rec := probe(h.Readyz)
+
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.Contains(t, rec.Body.String(), "Storage is unreachable")
+}
+
+func TestReadyz_Draining(t *testing.T) {
+	h := api.NewHealthHandler(fakePinger{})
+
+	h.Drain()
+	rec := probe(h.Readyz)
+
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.Contains(t, rec.Body.String(), "Shutting down")
+}
@@ -0,0 +1,254 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// IdempotencyKeyHeader carries the client-chosen key that makes a mutating request safe to retry.
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// IdempotencyReplayedHeader marks a response that was replayed from an earlier request.
+const IdempotencyReplayedHeader = "Idempotent-Replayed"
+
+// idempotencyRetention is how long the response to an idempotent request is kept for replay.
+const idempotencyRetention = 24 * time.Hour
+
+// maxIdempotencyKeyLength bounds the keys clients may choose.
+const maxIdempotencyKeyLength = 255
+
+// IdempotencyIndexes are the indexes the idempotency keys collection needs. Stored
+// responses expire after a day.
+var IdempotencyIndexes = []mongo.IndexModel{
+	{
+		Keys:    bson.D{{Key: "createdAt", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(int32(idempotencyRetention.Seconds())),
+	},
+}
+
+// IdempotencyCollection defines the required behavior for interacting with
+// the stored idempotency keys in MongoDB. By isolating these methods, we can
+// easily swap out the actual MongoDB collection with a mock for testing.
+type IdempotencyCollection interface {
+	// InsertOne reserves a key for the request that uses it first.
+	InsertOne(ctx context.Context, document interface{}, opts ...*options.InsertOneOptions) (*mongo.InsertOneResult, error)
+
+	// FindOne looks up the request a key is reserved for.
+	FindOne(ctx context.Context, filter interface{}, opts ...*options.FindOneOptions) *mongo.SingleResult
+
+	// UpdateOne stores the response of a request or takes over an abandoned key.
+	UpdateOne(ctx context.Context, filter interface{}, update interface{},
+		opts ...*options.UpdateOptions) (*mongo.UpdateResult, error)
+
+	// DeleteOne releases the key of a request that failed.
+	DeleteOne(ctx context.Context, filter interface{}, opts ...*options.DeleteOptions) (*mongo.DeleteResult, error)
+}
+
+// IdempotencyRecord is a key reserved by a request and, once the request has been
+// handled, the response that is replayed to its retries.
+type IdempotencyRecord struct {
+	Key         string    `bson:"_id"`
+	Fingerprint string    `bson:"fingerprint"`
+	Completed   bool      `bson:"completed"`
+	Status      int       `bson:"status,omitempty"`
+	ContentType string    `bson:"contentType,omitempty"`
+	Body        []byte    `bson:"body,omitempty"`
+	CreatedAt   time.Time `bson:"createdAt"`
+}
+
+// Idempotency makes mutating requests that carry an Idempotency-Key header safe to
+// retry. The first request with a key is handled and its response stored; retries
+// with the same key and the same request get the stored response replayed.
+// Reusing a key for a different request is rejected with a 422 status code and a
+// retry that arrives while the first request is still being handled with a 409.
+// Requests that fail with an error, a 5xx status code, or a 401, 403 or 429 that
+// a retry may well not get, release their key so that they can be retried for
+// real. Keys are scoped by the credentials the request carries, so that a caller
+// reusing another's key neither replays nor blocks their request. The body is read
+// whole to fingerprint the request, up to MaxBody.
+type Idempotency struct {
+	// Col is an abstraction for the MongoDB collection containing the idempotency keys.
+	Col IdempotencyCollection
+
+	// Lease is how long a key stays reserved for a request that has not completed.
+	// After that the request is assumed to have been abandoned and a retry takes over.
+	Lease time.Duration
+
+	// Timeouts bounds the storage calls reserving and completing a key, named
+	// "Idempotency".
+	Timeouts Timeouts
+
+	// MaxBody bounds the bodies read to fingerprint a request. It should be the
+	// largest body any route accepts; larger ones get a 413 status code.
+	MaxBody int64
+
+	now func() time.Time
+}
+
+// NewIdempotency creates an Idempotency middleware backed by the given collection.
+func NewIdempotency(col IdempotencyCollection) *Idempotency {
+	return &Idempotency{
+		Col:      col,
+		Lease:    time.Minute,
+		Timeouts: DefaultTimeouts,
+		MaxBody:  DefaultMaxUploadSize + multipartOverhead,
+		now:      time.Now,
+	}
+}
+
+// Middleware is the echo middleware applying the idempotency keys. Requests
+// without a key and reading requests pass through.
+func (i *Idempotency) Middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		key := c.Request().Header.Get(IdempotencyKeyHeader)
+		if key == "" || !isMutating(c.Request().Method) {
+			return next(c)
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			return c.JSON(http.StatusBadRequest, "Invalid idempotency key")
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(c.Response(), c.Request().Body, i.MaxBody))
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				return c.JSON(http.StatusRequestEntityTooLarge, "Request body too large")
+			}
+			return c.JSON(http.StatusBadRequest, "Failed to read the request body")
+		}
+		c.Request().Body = io.NopCloser(bytes.NewReader(body))
+		fingerprint := requestFingerprint(c.Request(), body)
+
+		ctx, cancel := i.Timeouts.context(c, "Idempotency")
+		defer cancel()
+
+		key = scopedKey(c.Request(), key)
+		_, err = i.Col.InsertOne(ctx, IdempotencyRecord{Key: key, Fingerprint: fingerprint, CreatedAt: i.now()})
+		if mongo.IsDuplicateKeyError(err) {
+			return i.replay(ctx, c, key, fingerprint, next)
+		}
+		if err != nil {
+			return storageError(c, err, "to reserve idempotency key", "Failed to reserve idempotency key")
+		}
+		return i.handle(c, key, next)
+	}
+}
+
+// replay answers a request whose key is already reserved.
+func (i *Idempotency) replay(ctx context.Context, c echo.Context, key, fingerprint string, next echo.HandlerFunc) error {
+	var record IdempotencyRecord
+	if err := i.Col.FindOne(ctx, bson.M{"_id": key}).Decode(&record); err != nil {
+		return storageError(c, err, "to load idempotency key", "Failed to load idempotency key")
+	}
+	if record.Fingerprint != fingerprint {
+		return c.JSON(http.StatusUnprocessableEntity, "Idempotency key was used for a different request")
+	}
+
+	if !record.Completed {
+		if i.now().Sub(record.CreatedAt) < i.Lease {
+			return c.JSON(http.StatusConflict, "A request with this idempotency key is in progress")
+		}
+		// The request holding the key was abandoned; only one retry may take it over.
+		filter := bson.M{"_id": key, "completed": false, "createdAt": record.CreatedAt}
+		result, err := i.Col.UpdateOne(ctx, filter, bson.M{"$set": bson.M{"createdAt": i.now()}})
+		if err != nil {
+			return storageError(c, err, "to take over idempotency key", "Failed to reserve idempotency key")
+		}
+		if result.MatchedCount == 0 {
+			return c.JSON(http.StatusConflict, "A request with this idempotency key is in progress")
+		}
+		return i.handle(c, key, next)
+	}
+
+	c.Response().Header().Set(IdempotencyReplayedHeader, "true")
+	return c.Blob(record.Status, record.ContentType, record.Body)
+}
+
+// handle runs the request that holds the key and stores its response.
+func (i *Idempotency) handle(c echo.Context, key string, next echo.HandlerFunc) error {
+	capture := &responseCapture{ResponseWriter: c.Response().Writer}
+	c.Response().Writer = capture
+
+	handlerErr := next(c)
+
+	// The key is completed or released even if the client has gone away, so that it is not left reserved.
+	ctx, cancel := i.Timeouts.detached(c.Request().Context())
+	defer cancel()
+
+	status := c.Response().Status
+	if handlerErr != nil || !replayable(status) {
+		if _, err := i.Col.DeleteOne(ctx, bson.M{"_id": key, "completed": false}); err != nil {
+			slog.ErrorContext(ctx, "Failed to release idempotency key", "error", err)
+		}
+		return handlerErr
+	}
+
+	update := bson.M{"$set": bson.M{
+		"completed":   true,
+		"status":      status,
+		"contentType": c.Response().Header().Get(echo.HeaderContentType),
+		"body":        capture.body.Bytes(),
+	}}
+	if _, err := i.Col.UpdateOne(ctx, bson.M{"_id": key}, update); err != nil {
+		slog.ErrorContext(ctx, "Failed to store idempotent response", "error", err)
+	}
+	return nil
+}
+
+// responseCapture keeps a copy of the response body written through it.
+type responseCapture struct {
+	http.ResponseWriter
+	body bytes.Buffer
+}
+
+func (r *responseCapture) Write(b []byte) (int, error) {
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+// replayable reports whether a response may be stored and replayed to retries.
+// Server errors, refused credentials and exhausted rate limits are not: a retry
+// may succeed.
+func replayable(status int) bool {
+	switch status {
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusTooManyRequests:
+		return false
+	}
+	return status < http.StatusInternalServerError
+}
+
+// scopedKey is the stored form of an idempotency key, scoped by the admin token
+// and API key the request carries.
+func scopedKey(req *http.Request, key string) string {
+	hash := sha256.New()
+	io.WriteString(hash, req.Header.Get(echo.HeaderAuthorization)+"\n"+req.Header.Get(APIKeyHeader))
+	return hex.EncodeToString(hash.Sum(nil))[:32] + ":" + key
+}
+
+// requestFingerprint identifies a request by its method, target and body.
+func requestFingerprint(req *http.Request, body []byte) string {
+	hash := sha256.New()
+	io.WriteString(hash, req.Method+" "+req.URL.RequestURI()+"\n")
+	hash.Write(body)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+func isMutating(method string) bool {
+	switch method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		return true
+	}
+	return false
+}
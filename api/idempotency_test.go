@@ -0,0 +1,273 @@
+package api_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/okcthulhu/ChooseYourOwnAdventure/api"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func idempotentRequest(key string, body interface{}) *http.Request {
+	req := jsonRequest(http.MethodPost, body)
+	req.Header.Set(api.IdempotencyKeyHeader, key)
+	return req
+}
+
+func duplicateKeyResponse() bson.D {
+	return mtest.CreateWriteErrorsResponse(mtest.WriteError{Index: 0, Code: 11000, Message: "duplicate key error"})
+}
+
+func TestIdempotency_StoresResponse(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("first request handled and stored", func(mt *mtest.T) {
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(idempotentRequest("k1", map[string]string{"name": "x"}), rec)
+
+		calls := 0
+		handler := api.NewIdempotency(mt.Coll).Middleware(func(c echo.Context) error {
+			calls++
+			return c.JSON(http.StatusCreated, "created")
+		})
+
+		mt.AddMockResponses(mtest.CreateSuccessResponse(), matchedResponse())
+
+		err := handler(c)
+
+		assert.NoError(t, err)
+		assert.Equal(t, 1, calls)
+		assert.Equal(t, http.StatusCreated, rec.Code)
+		update := mt.GetAllStartedEvents()[1].Command.Lookup("updates").Array().Index(0).Value().Document()
+		set := update.Lookup("u", "$set").Document()
+		assert.True(t, set.Lookup("completed").Boolean())
+		assert.Equal(t, int32(http.StatusCreated), set.Lookup("status").Int32())
+		_, body := set.Lookup("body").Binary()
+		assert.Equal(t, rec.Body.Bytes(), body)
+	})
+}
+
+func TestIdempotency_ReplaysResponse(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("retry gets the stored response", func(mt *mtest.T) {
+		idempotency := api.NewIdempotency(mt.Coll)
+		calls := 0
+		handler := idempotency.Middleware(func(c echo.Context) error {
+			calls++
+			return c.JSON(http.StatusCreated, "created")
+		})
+
+		// The first request records the fingerprint the retry is compared with.
+		mt.AddMockResponses(mtest.CreateSuccessResponse(), matchedResponse())
+		handler(echo.New().NewContext(idempotentRequest("k1", map[string]string{"name": "x"}), httptest.NewRecorder()))
+		fingerprint := mt.GetStartedEvent().Command.Lookup("documents").Array().Index(0).Value().Document().Lookup("fingerprint").StringValue()
+
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(idempotentRequest("k1", map[string]string{"name": "x"}), rec)
+		mt.AddMockResponses(
+			duplicateKeyResponse(),
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, bson.D{
+				{Key: "_id", Value: "k1"},
+				{Key: "fingerprint", Value: fingerprint},
+				{Key: "completed", Value: true},
+				{Key: "status", Value: http.StatusCreated},
+				{Key: "contentType", Value: echo.MIMEApplicationJSON},
+				{Key: "body", Value: []byte(`"created"`)},
+				{Key: "createdAt", Value: time.Now()},
+			}),
+		)
+
+		err := handler(c)
+
+		assert.NoError(t, err)
+		assert.Equal(t, 1, calls, "the handler is not run again")
+		assert.Equal(t, http.StatusCreated, rec.Code)
+		assert.Equal(t, `"created"`, rec.Body.String())
+		assert.Equal(t, "true", rec.Header().Get(api.IdempotencyReplayedHeader))
+	})
+}
+
+func TestIdempotency_KeyReusedForDifferentRequest(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("different body rejected", func(mt *mtest.T) {
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(idempotentRequest("k1", map[string]string{"name": "y"}), rec)
+
+		handler := api.NewIdempotency(mt.Coll).Middleware(func(c echo.Context) error {
+			t.Fatal("handler must not run")
+			return nil
+		})
+
+		mt.AddMockResponses(
+			duplicateKeyResponse(),
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, bson.D{
+				{Key: "_id", Value: "k1"},
+				{Key: "fingerprint", Value: "other"},
+				{Key: "completed", Value: true},
+				{Key: "createdAt", Value: time.Now()},
+			}),
+		)
+
+		handler(c)
+
+		assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+		assert.Contains(t, rec.Body.String(), "Idempotency key was used for a different request")
+	})
+}
+
+func TestIdempotency_InProgress(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("concurrent retry rejected", func(mt *mtest.T) {
+		idempotency := api.NewIdempotency(mt.Coll)
+		handler := idempotency.Middleware(func(c echo.Context) error {
+			return c.JSON(http.StatusCreated, "created")
+		})
+
+		mt.AddMockResponses(mtest.CreateSuccessResponse(), matchedResponse())
+		handler(echo.New().NewContext(idempotentRequest("k1", nil), httptest.NewRecorder()))
+		fingerprint := mt.GetStartedEvent().Command.Lookup("documents").Array().Index(0).Value().Document().Lookup("fingerprint").StringValue()
+
+		rec := httptest.NewRecorder()
+		mt.AddMockResponses(
+			duplicateKeyResponse(),
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, bson.D{
+				{Key: "_id", Value: "k1"},
+				{Key: "fingerprint", Value: fingerprint},
+				{Key: "completed", Value: false},
+				{Key: "createdAt", Value: time.Now()},
+			}),
+		)
+
+		handler(echo.New().NewContext(idempotentRequest("k1", nil), rec))
+
+		assert.Equal(t, http.StatusConflict, rec.Code)
+		assert.Contains(t, rec.Body.String(), "in progress")
+	})
+}
+
+func TestIdempotency_FailureReleasesKey(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("server error not stored", func(mt *mtest.T) {
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(idempotentRequest("k1", nil), rec)
+
+		handler := api.NewIdempotency(mt.Coll).Middleware(func(c echo.Context) error {
+			return c.JSON(http.StatusInternalServerError, "boom")
+		})
+
+		mt.AddMockResponses(mtest.CreateSuccessResponse(), mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}))
+
+		handler(c)
+
+		assert.Equal(t, http.StatusInternalServerError, rec.Code)
+		assert.Equal(t, "delete", mt.GetAllStartedEvents()[1].CommandName)
+	})
+
+	for _, status := range []int{http.StatusUnauthorized, http.StatusForbidden, http.StatusTooManyRequests} {
+		mt.Run(http.StatusText(status)+" not stored", func(mt *mtest.T) {
+			rec := httptest.NewRecorder()
+			c := echo.New().NewContext(idempotentRequest("k1", nil), rec)
+
+			handler := api.NewIdempotency(mt.Coll).Middleware(func(c echo.Context) error {
+				return c.JSON(status, "refused")
+			})
+
+			mt.AddMockResponses(mtest.CreateSuccessResponse(), mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}))
+
+			handler(c)
+
+			assert.Equal(t, status, rec.Code)
+			assert.Equal(t, "delete", mt.GetAllStartedEvents()[1].CommandName)
+		})
+	}
+}
+
+func TestIdempotency_KeysScopedByCredentials(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("admin and anonymous keys differ", func(mt *mtest.T) {
+		handler := api.NewIdempotency(mt.Coll).Middleware(func(c echo.Context) error {
+			return c.JSON(http.StatusOK, "ok")
+		})
+
+		var stored []string
+		for _, authorization := range []string{"Bearer secret", ""} {
+			mt.ClearEvents()
+			req := idempotentRequest("k1", nil)
+			if authorization != "" {
+				req.Header.Set(echo.HeaderAuthorization, authorization)
+			}
+			mt.AddMockResponses(mtest.CreateSuccessResponse(), matchedResponse())
+
+			handler(echo.New().NewContext(req, httptest.NewRecorder()))
+
+			stored = append(stored, mt.GetStartedEvent().Command.Lookup("documents").Array().Index(0).Value().Document().Lookup("_id").StringValue())
+		}
+
+		assert.NotEqual(t, stored[0], stored[1])
+		for _, key := range stored {
+			assert.True(t, strings.HasSuffix(key, ":k1"))
+		}
+	})
+}
+
+func TestIdempotency_ReadsPassThrough(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("GET ignores the key", func(mt *mtest.T) {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set(api.IdempotencyKeyHeader, "k1")
+		rec := httptest.NewRecorder()
+
+		handler := api.NewIdempotency(mt.Coll).Middleware(func(c echo.Context) error {
+			return c.JSON(http.StatusOK, "ok")
+		})
+
+		handler(echo.New().NewContext(req, rec))
+
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Empty(t, mt.GetAllStartedEvents())
+	})
+}
+
+func TestIdempotency_BodyTooLarge(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("body over the limit refused", func(mt *mtest.T) {
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(idempotentRequest("k1", map[string]string{"name": strings.Repeat("x", 64)}), rec)
+
+		idempotency := api.NewIdempotency(mt.Coll)
+		idempotency.MaxBody = 32
+		calls := 0
+		handler := idempotency.Middleware(func(c echo.Context) error {
+			calls++
+			return c.JSON(http.StatusCreated, "created")
+		})
+
+		err := handler(c)
+
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+		assert.Zero(t, calls)
+		assert.Empty(t, mt.GetAllStartedEvents(), "no key is reserved")
+	})
+}
@@ -0,0 +1,138 @@
+package api
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+)
+
+// RequestIDHeader carries the ID that correlates a request with its logs. A
+// caller's ID is kept so that a request can be followed across services.
+const RequestIDHeader = echo.HeaderXRequestID
+
+// maxRequestIDLength bounds the request IDs taken from callers.
+const maxRequestIDLength = 128
+
+type requestIDKey struct{}
+
+// RequestID is the echo middleware that gives every request an ID, taken from
+// the X-Request-ID header if the caller sent a usable one and generated
+// otherwise. The ID is echoed in the response and carried by the request
+// context, where the logger and the audit log pick it up.
+func RequestID(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		req := c.Request()
+		id := req.Header.Get(RequestIDHeader)
+		if !validRequestID(id) {
+			id = uuid.NewString()
+		}
+		c.Response().Header().Set(RequestIDHeader, id)
+		c.SetRequest(req.WithContext(context.WithValue(req.Context(), requestIDKey{}, id)))
+		return next(c)
+	}
+}
+
+// RequestIDFrom returns the ID of the request a context belongs to, or "" if it
+// does not belong to one.
+func RequestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// validRequestID reports whether a caller's request ID can be logged as is: it
+// must be short and printable ASCII, so that it cannot forge log lines.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// Log formats.
+const (
+	// LogFormatJSON writes a JSON object per record.
+	LogFormatJSON = "json"
+
+	// LogFormatText writes a line of key=value pairs per record.
+	LogFormatText = "text"
+)
+
+// NewLogger creates the logger of the service, writing records of the given
+// level and above to w in the given format. Records logged with the context of
+// a request carry its request_id.
+func NewLogger(w io.Writer, format string, level slog.Level) *slog.Logger {
+	opts := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler
+	if format == LogFormatText {
+		handler = slog.NewTextHandler(w, opts)
+	} else {
+		handler = slog.NewJSONHandler(w, opts)
+	}
+	return slog.New(contextHandler{handler})
+}
+
+// contextHandler adds the request ID of the record's context to the record.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, record slog.Record) error {
+	if id := RequestIDFrom(ctx); id != "" {
+		record.AddAttrs(slog.String("request_id", id))
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// AccessLog is the echo middleware that logs every request once it has been
+// handled, with its route, status code and latency. Server errors are logged at
+// the error level, everything else at the info level.
+func AccessLog(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		start := time.Now()
+		err := next(c)
+		if err != nil {
+			// Let echo write the error response now, so that its status is logged.
+			c.Error(err)
+		}
+
+		req := c.Request()
+		res := c.Response()
+		level := slog.LevelInfo
+		if res.Status >= http.StatusInternalServerError {
+			level = slog.LevelError
+		}
+		attrs := []slog.Attr{
+			slog.String("method", req.Method),
+			slog.String("path", req.URL.Path),
+			slog.String("route", c.Path()),
+			slog.Int("status", res.Status),
+			slog.Int64("bytes", res.Size),
+			slog.Duration("duration", time.Since(start)),
+			slog.String("remote_ip", c.RealIP()),
+			slog.String("user_agent", req.UserAgent()),
+		}
+		if err != nil {
+			attrs = append(attrs, slog.String("error", err.Error()))
+		}
+		slog.LogAttrs(req.Context(), level, "Request handled", attrs...)
+		return nil
+	}
+}
@@ -0,0 +1,134 @@
+package api_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"github.com/okcthulhu/ChooseYourOwnAdventure/api"
+	"github.com/stretchr/testify/assert"
+)
+
+// captureLogs makes the default logger write JSON records to the returned buffer
+// for the rest of the test.
+func captureLogs(t *testing.T) *bytes.Buffer {
+	logs := &bytes.Buffer{}
+	previous := slog.Default()
+	slog.SetDefault(api.NewLogger(logs, api.LogFormatJSON, slog.LevelInfo))
+	t.Cleanup(func() { slog.SetDefault(previous) })
+	return logs
+}
+
+func logRecords(t *testing.T, logs *bytes.Buffer) []map[string]interface{} {
+	var records []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var record map[string]interface{}
+		if assert.NoError(t, json.Unmarshal([]byte(line), &record)) {
+			records = append(records, record)
+		}
+	}
+	return records
+}
+
+func TestRequestID(t *testing.T) {
+	cases := []struct {
+		name   string
+		header string
+		kept   bool
+	}{
+		{"generated without a header", "", false},
+		{"caller's ID kept", "abc-123", true},
+		{"ID with spaces replaced", "abc 123", false},
+		{"overlong ID replaced", strings.Repeat("a", 129), false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tc.header != "" {
+				req.Header.Set(api.RequestIDHeader, tc.header)
+			}
+			rec := httptest.NewRecorder()
+			c := echo.New().NewContext(req, rec)
+
+			var seen string
+			api.RequestID(func(c echo.Context) error {
+				seen = api.RequestIDFrom(c.Request().Context())
+				return c.NoContent(http.StatusOK)
+			})(c)
+
+			id := rec.Header().Get(api.RequestIDHeader)
+			assert.Equal(t, id, seen, "the handler sees the ID the response carries")
+			if tc.kept {
+				assert.Equal(t, tc.header, id)
+			} else {
+				_, err := uuid.Parse(id)
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestNewLogger_AddsRequestID(t *testing.T) {
+	logs := &bytes.Buffer{}
+	logger := api.NewLogger(logs, api.LogFormatJSON, slog.LevelInfo)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(api.RequestIDHeader, "req-1")
+	c := echo.New().NewContext(req, httptest.NewRecorder())
+	api.RequestID(func(c echo.Context) error {
+		logger.InfoContext(c.Request().Context(), "inside")
+		return nil
+	})(c)
+	logger.InfoContext(context.Background(), "outside")
+	logger.DebugContext(c.Request().Context(), "below the level")
+
+	records := logRecords(t, logs)
+	if assert.Len(t, records, 2) {
+		assert.Equal(t, "inside", records[0]["msg"])
+		assert.Equal(t, "req-1", records[0]["request_id"])
+		assert.Equal(t, "outside", records[1]["msg"])
+		assert.NotContains(t, records[1], "request_id")
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	logs := captureLogs(t)
+
+	e := echo.New()
+	e.Use(api.RequestID, api.AccessLog)
+	e.GET("/stories/:storyID/elements", func(c echo.Context) error {
+		return c.JSON(http.StatusOK, "listed")
+	})
+	e.GET("/broken", func(c echo.Context) error {
+		return echo.NewHTTPError(http.StatusServiceUnavailable, "down")
+	})
+
+	for _, path := range []string{"/stories/s/elements", "/broken"} {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set(api.RequestIDHeader, "req"+path)
+		e.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	records := logRecords(t, logs)
+	if assert.Len(t, records, 2) {
+		assert.Equal(t, "INFO", records[0]["level"])
+		assert.Equal(t, "/stories/:storyID/elements", records[0]["route"])
+		assert.Equal(t, "/stories/s/elements", records[0]["path"])
+		assert.Equal(t, float64(http.StatusOK), records[0]["status"])
+		assert.Equal(t, "req/stories/s/elements", records[0]["request_id"])
+
+		assert.Equal(t, "ERROR", records[1]["level"])
+		assert.Equal(t, float64(http.StatusServiceUnavailable), records[1]["status"])
+		assert.Contains(t, records[1]["error"], "down")
+	}
+}
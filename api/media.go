@@ -0,0 +1,102 @@
+package api
+
+import (
+	"encoding/binary"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+)
+
+// assetKinds maps the media types accepted as assets to the kind of asset they
+// make. The types are sniffed from the content, not taken from the client.
+var assetKinds = map[string]string{
+	"image/png":  "image",
+	"image/jpeg": "image",
+	"image/gif":  "image",
+	"image/webp": "image",
+	"video/mp4":  "video",
+	"video/webm": "video",
+}
+
+// imageSize reads the dimensions of a PNG, JPEG or GIF image from its header.
+// Other images, such as WebP ones, are not measured.
+func imageSize(r io.Reader) (width, height int, ok bool) {
+	config, _, err := image.DecodeConfig(r)
+	if err != nil {
+		return 0, 0, false
+	}
+	return config.Width, config.Height, true
+}
+
+// maxMovieHeader bounds the movie header box read to measure a video.
+const maxMovieHeader = 1 << 10
+
+// mp4Duration reads the length in seconds of an MP4 video of the given size from
+// its movie header box. The boxes are walked by their headers, so only the
+// movie header is read whether the movie box comes first or last. Other videos,
+// such as WebM ones, are not measured.
+func mp4Duration(r io.ReaderAt, size int64) (float64, bool) {
+	moovAt, moovSize, ok := mp4Box(r, 0, size, "moov")
+	if !ok {
+		return 0, false
+	}
+	mvhdAt, mvhdSize, ok := mp4Box(r, moovAt, moovAt+moovSize, "mvhd")
+	if !ok {
+		return 0, false
+	}
+	mvhd := make([]byte, min(mvhdSize, maxMovieHeader))
+	if _, err := r.ReadAt(mvhd, mvhdAt); err != nil && err != io.EOF {
+		return 0, false
+	}
+
+	// The fields after the version and flags are 32 bits wide in version 0, and
+	// the times and duration 64 bits wide in version 1.
+	var timescale uint32
+	var duration uint64
+	switch {
+	case len(mvhd) >= 20 && mvhd[0] == 0:
+		timescale = binary.BigEndian.Uint32(mvhd[12:16])
+		duration = uint64(binary.BigEndian.Uint32(mvhd[16:20]))
+	case len(mvhd) >= 32 && mvhd[0] == 1:
+		timescale = binary.BigEndian.Uint32(mvhd[20:24])
+		duration = binary.BigEndian.Uint64(mvhd[24:32])
+	default:
+		return 0, false
+	}
+	if timescale == 0 {
+		return 0, false
+	}
+	return float64(duration) / float64(timescale), true
+}
+
+// mp4Box finds the first box of the given type among the boxes between offsets
+// start and end, returning the offset and size of its payload.
+func mp4Box(r io.ReaderAt, start, end int64, boxType string) (int64, int64, bool) {
+	header := make([]byte, 16)
+	for offset := start; offset+8 <= end; {
+		if _, err := r.ReadAt(header[:8], offset); err != nil {
+			return 0, 0, false
+		}
+		size, headerSize := int64(binary.BigEndian.Uint32(header[:4])), int64(8)
+		switch size {
+		case 0:
+			// The box extends to the end of its parent.
+			size = end - offset
+		case 1:
+			if _, err := r.ReadAt(header[8:16], offset+8); err != nil {
+				return 0, 0, false
+			}
+			size, headerSize = int64(binary.BigEndian.Uint64(header[8:16])), 16
+		}
+		if size < headerSize || offset+size > end {
+			return 0, 0, false
+		}
+		if string(header[4:8]) == boxType {
+			return offset + headerSize, size - headerSize, true
+		}
+		offset += size
+	}
+	return 0, 0, false
+}
@@ -0,0 +1,149 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"maps"
+	"net/url"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/okcthulhu/ChooseYourOwnAdventure/api/models"
+)
+
+// Query parameters of signed media URLs.
+const (
+	ExpiresParam   = "expires"
+	SignatureParam = "signature"
+)
+
+// MediaTTLs are how long the signed URLs of each asset kind stay valid. Videos
+// are what is worth sharing, so they expire sooner.
+type MediaTTLs struct {
+	Image time.Duration `yaml:"image"`
+	Video time.Duration `yaml:"video"`
+}
+
+// DefaultMediaTTLs are the lifetimes used unless configured otherwise.
+var DefaultMediaTTLs = MediaTTLs{
+	Image: time.Hour,
+	Video: 15 * time.Minute,
+}
+
+// For returns the lifetime of the signed URLs of an asset kind.
+func (t MediaTTLs) For(kind models.AssetKind) time.Duration {
+	if kind == models.AssetKindVideo {
+		return t.Video
+	}
+	return t.Image
+}
+
+// MediaSigner signs the URLs of asset content with an HMAC of the asset and the
+// time the URL expires, so that the content is only served to those the API
+// handed a URL to, and only until it expires. A nil signer leaves URLs unsigned.
+type MediaSigner struct {
+	secret []byte
+
+	// TTLs are how long the signed URLs stay valid.
+	TTLs MediaTTLs
+
+	now func() time.Time
+}
+
+// NewMediaSigner creates a MediaSigner with the given secret and the default
+// lifetimes. An empty secret signs nothing and returns nil.
+func NewMediaSigner(secret string) *MediaSigner {
+	if secret == "" {
+		return nil
+	}
+	return &MediaSigner{
+		secret: []byte(secret),
+		TTLs:   DefaultMediaTTLs,
+		now:    time.Now,
+	}
+}
+
+// signature returns the signature of the content of an asset until expires.
+func (s *MediaSigner) signature(assetID string, expires int64) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(assetID + "\n" + strconv.FormatInt(expires, 10)))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Sign returns the URL of the content of an asset, valid for the lifetime of
+// its kind.
+func (s *MediaSigner) Sign(assetID string, kind models.AssetKind) string {
+	expires := s.now().Add(s.TTLs.For(kind)).Unix()
+	query := url.Values{
+		ExpiresParam:   {strconv.FormatInt(expires, 10)},
+		SignatureParam: {s.signature(assetID, expires)},
+	}
+	return "/assets/" + assetID + "/content?" + query.Encode()
+}
+
+// Verify reports whether the expires and signature query parameters of a
+// request for the content of an asset were signed and are still valid, and if
+// so how long they remain valid.
+func (s *MediaSigner) Verify(assetID string, query url.Values) (time.Duration, bool) {
+	expires, err := strconv.ParseInt(query.Get(ExpiresParam), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	expected := s.signature(assetID, expires)
+	if !hmac.Equal([]byte(query.Get(SignatureParam)), []byte(expected)) {
+		return 0, false
+	}
+	remaining := time.Unix(expires, 0).Sub(s.now())
+	return remaining, remaining > 0
+}
+
+// signMedia replaces the URLs of the assets a story element references with
+// signed ones. The element must not be shared, such as with the story cache.
+func (s *MediaSigner) signMedia(storyElement *models.StoryElement) {
+	if s == nil {
+		return
+	}
+	for _, reference := range assetReferences(storyElement) {
+		reference.setURL(s.Sign(reference.assetID, reference.kind))
+	}
+}
+
+// signWisdoms replaces the art URLs of the wisdoms a player holds with signed
+// ones, for the art of the wisdoms taken from assets.
+func (s *MediaSigner) signWisdoms(player *models.Player) {
+	if s == nil || player.StoryStates == nil {
+		return
+	}
+	for _, storyState := range *player.StoryStates {
+		if storyState.Wisdoms == nil {
+			continue
+		}
+		for i := range *storyState.Wisdoms {
+			wisdom := &(*storyState.Wisdoms)[i]
+			if wisdom.ArtAssetID != nil && *wisdom.ArtAssetID != "" {
+				url := s.Sign(*wisdom.ArtAssetID, models.AssetKindImage)
+				wisdom.ArtURL = &url
+			}
+		}
+	}
+}
+
+// signedCopy returns a story element with signed URLs, leaving the element it is
+// given, which may be shared with the story cache, unchanged.
+func (s *MediaSigner) signedCopy(storyElement models.StoryElement) models.StoryElement {
+	if s == nil {
+		return storyElement
+	}
+	if storyElement.Choices != nil {
+		choices := slices.Clone(*storyElement.Choices)
+		storyElement.Choices = &choices
+	}
+	if storyElement.Wisdoms != nil {
+		wisdoms := maps.Clone(*storyElement.Wisdoms)
+		storyElement.Wisdoms = &wisdoms
+	}
+	s.signMedia(&storyElement)
+	return storyElement
+}
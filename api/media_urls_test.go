@@ -0,0 +1,51 @@
+package api_test
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/okcthulhu/ChooseYourOwnAdventure/api"
+	"github.com/okcthulhu/ChooseYourOwnAdventure/api/models"
+	"github.com/stretchr/testify/assert"
+)
+
+// signedQuery returns the query of a signed URL.
+func signedQuery(t *testing.T, signed string) url.Values {
+	u, err := url.Parse(signed)
+	assert.NoError(t, err)
+	return u.Query()
+}
+
+func TestMediaSigner(t *testing.T) {
+	signer := api.NewMediaSigner("s3cret")
+	signer.TTLs = api.MediaTTLs{Image: time.Hour, Video: time.Minute}
+
+	signed := signer.Sign("a1", models.AssetKindVideo)
+	assert.True(t, strings.HasPrefix(signed, "/assets/a1/content?"))
+
+	remaining, ok := signer.Verify("a1", signedQuery(t, signed))
+	assert.True(t, ok)
+	assert.InDelta(t, time.Minute.Seconds(), remaining.Seconds(), 2, "videos get the video lifetime")
+
+	remaining, _ = signer.Verify("a1", signedQuery(t, signer.Sign("a1", models.AssetKindImage)))
+	assert.InDelta(t, time.Hour.Seconds(), remaining.Seconds(), 2, "images get the image lifetime")
+
+	_, ok = signer.Verify("a2", signedQuery(t, signed))
+	assert.False(t, ok, "a URL is only valid for its asset")
+
+	query := signedQuery(t, signed)
+	query.Set(api.ExpiresParam, "99999999999")
+	_, ok = signer.Verify("a1", query)
+	assert.False(t, ok, "the expiry cannot be extended")
+
+	_, ok = api.NewMediaSigner("other").Verify("a1", signedQuery(t, signed))
+	assert.False(t, ok, "URLs are only valid with the secret that signed them")
+
+	signer.TTLs.Video = -time.Minute
+	_, ok = signer.Verify("a1", signedQuery(t, signer.Sign("a1", models.AssetKindVideo)))
+	assert.False(t, ok, "expired URLs are not valid")
+
+	assert.Nil(t, api.NewMediaSigner(""), "without a secret nothing is signed")
+}
@@ -0,0 +1,372 @@
+package api
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/okcthulhu/ChooseYourOwnAdventure/api/events"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Server error codes the migrations tolerate.
+const (
+	namespaceNotFound = 26
+	indexNotFound     = 27
+)
+
+// MigrationsCollection is the collection that records the applied migrations.
+const MigrationsCollection = "migrations"
+
+// Migration is a versioned change to the database. Up must be safe to run again
+// after a partial failure, because a migration is only recorded once it succeeded.
+type Migration struct {
+	// Version orders the migrations and identifies them in the migrations collection.
+	Version int
+
+	// Description says what the migration does.
+	Description string
+
+	// Checksum identifies the content of a migration derived from elsewhere, such as
+	// the validators generated from the API document. An applied migration is run
+	// again when its checksum changes. It may be empty.
+	Checksum string
+
+	// Up applies the migration.
+	Up func(ctx context.Context, db *mongo.Database) error
+}
+
+// MigrationRecord is the entry of an applied migration in the migrations collection.
+type MigrationRecord struct {
+	Version     int       `bson:"_id" json:"version"`
+	Description string    `bson:"description" json:"description"`
+	Checksum    string    `bson:"checksum,omitempty" json:"checksum,omitempty"`
+	AppliedAt   time.Time `bson:"appliedAt" json:"appliedAt"`
+}
+
+// Migrator applies the migrations that have not been applied to a database yet,
+// in the order of their versions.
+type Migrator struct {
+	// DB is the database the migrations are applied to and recorded in.
+	DB *mongo.Database
+
+	// Migrations are the known migrations.
+	Migrations []Migration
+
+	now func() time.Time
+}
+
+// NewMigrator creates a Migrator for the given database and migrations.
+func NewMigrator(db *mongo.Database, migrations []Migration) *Migrator {
+	return &Migrator{
+		DB:         db,
+		Migrations: migrations,
+		now:        time.Now,
+	}
+}
+
+// Applied returns the records of the migrations applied so far, keyed by version.
+func (m *Migrator) Applied(ctx context.Context) (map[int]MigrationRecord, error) {
+	cursor, err := m.DB.Collection(MigrationsCollection).Find(ctx, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	var records []MigrationRecord
+	if err := cursor.All(ctx, &records); err != nil {
+		return nil, err
+	}
+	applied := make(map[int]MigrationRecord, len(records))
+	for _, record := range records {
+		applied[record.Version] = record
+	}
+	return applied, nil
+}
+
+// Run applies the pending migrations and returns the records of those it applied.
+// It stops at the first migration that fails; the ones before it stay applied.
+func (m *Migrator) Run(ctx context.Context) ([]MigrationRecord, error) {
+	applied, err := m.Applied(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the applied migrations: %w", err)
+	}
+
+	migrations := append([]Migration(nil), m.Migrations...)
+	sort.SliceStable(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+
+	records := []MigrationRecord{}
+	for _, migration := range migrations {
+		if record, ok := applied[migration.Version]; ok && record.Checksum == migration.Checksum {
+			continue
+		}
+		if err := migration.Up(ctx, m.DB); err != nil {
+			return records, fmt.Errorf("migration %d (%s) failed: %w", migration.Version, migration.Description, err)
+		}
+		record := MigrationRecord{
+			Version:     migration.Version,
+			Description: migration.Description,
+			Checksum:    migration.Checksum,
+			AppliedAt:   m.now(),
+		}
+		opts := options.Replace().SetUpsert(true)
+		if _, err := m.DB.Collection(MigrationsCollection).ReplaceOne(ctx, bson.M{"_id": record.Version}, record, opts); err != nil {
+			return records, fmt.Errorf("failed to record migration %d: %w", migration.Version, err)
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// Migrations returns the migrations of the application database, whose collections
+// are named by collections. spec is the OpenAPI document the collection validators
+// are generated from.
+func Migrations(spec []byte, collections Collections) ([]Migration, error) {
+	validators, err := JSONSchemas(spec, collections.Schemas())
+	if err != nil {
+		return nil, err
+	}
+	checksum, err := schemaChecksum(validators)
+	if err != nil {
+		return nil, err
+	}
+
+	return []Migration{
+		{
+			Version:     1,
+			Description: "Index story elements for listing, filtering and search",
+			Up:          createIndexes(collections.StoryElements, StoryElementIndexes),
+		},
+		{
+			Version:     2,
+			Description: "Enforce unique story element identities",
+			Up: func(ctx context.Context, db *mongo.Database) error {
+				collisions, err := EnsureStoryElementIdentity(ctx, db.Collection(collections.StoryElements))
+				if err != nil {
+					return err
+				}
+				if len(collisions) > 0 {
+					return &CollisionError{Collisions: collisions}
+				}
+				return nil
+			},
+		},
+		{
+			Version:     3,
+			Description: "Enforce unique player Wix IDs and index the player search",
+			Up: func(ctx context.Context, db *mongo.Database) error {
+				players := db.Collection(collections.Players)
+				if err := replaceIndex(ctx, players, "wixID_1", PlayerIdentityIndex); err != nil {
+					return err
+				}
+				return createIndexes(collections.Players, PlayerIndexes)(ctx, db)
+			},
+		},
+		{
+			Version:     4,
+			Description: "Index choice events, the event outbox and parties",
+			Up: func(ctx context.Context, db *mongo.Database) error {
+				if err := createIndexes(collections.ChoiceEvents, ChoiceEventIndexes)(ctx, db); err != nil {
+					return err
+				}
+				if err := createIndexes(collections.Outbox, events.OutboxIndexes)(ctx, db); err != nil {
+					return err
+				}
+				return createIndexes(collections.Parties, PartyIndexes)(ctx, db)
+			},
+		},
+		{
+			Version:     5,
+			Description: "Validate players and story elements against the API schemas",
+			Checksum:    checksum,
+			Up: func(ctx context.Context, db *mongo.Database) error {
+				for _, collection := range sortedKeys(validators) {
+					if err := installValidator(ctx, db, collection, validators[collection]); err != nil {
+						return fmt.Errorf("%s: %w", collection, err)
+					}
+				}
+				return nil
+			},
+		},
+		{
+			Version:     6,
+			Description: "Expire stored idempotent responses",
+			Up:          createIndexes(collections.IdempotencyKeys, IdempotencyIndexes),
+		},
+		{
+			Version:     7,
+			Description: "Index the audit log",
+			Up:          createIndexes(collections.AuditLog, AuditIndexes),
+		},
+		{
+			Version:     8,
+			Description: "Index assets by checksum",
+			Up:          createIndexes(collections.Assets, AssetIndexes),
+		},
+		{
+			Version:     9,
+			Description: "Index the events staged on players",
+			Up:          createIndexes(collections.Players, events.StagingIndexes),
+		},
+	}, nil
+}
+
+// CollisionError reports the story element identities that keep the identity
+// index from being built.
+type CollisionError struct {
+	Collisions []StoryElementCollision
+}
+
+func (e *CollisionError) Error() string {
+	message := fmt.Sprintf("%d story element identities are used more than once:", len(e.Collisions))
+	for _, collision := range e.Collisions {
+		message += fmt.Sprintf(" %s/%s (%d elements)", collision.StoryID, collision.NodeID, len(collision.IDs))
+	}
+	return message
+}
+
+// createIndexes returns a migration step that creates indexes on a collection.
+// Creating an index that already exists with the same options does nothing.
+func createIndexes(collection string, indexes []mongo.IndexModel) func(context.Context, *mongo.Database) error {
+	return func(ctx context.Context, db *mongo.Database) error {
+		_, err := db.Collection(collection).Indexes().CreateMany(ctx, indexes)
+		return err
+	}
+}
+
+// replaceIndex drops the index with the given name, if there is one, and creates index.
+// It is used where an index on the same keys has to change its options.
+func replaceIndex(ctx context.Context, col *mongo.Collection, name string, index mongo.IndexModel) error {
+	_, err := col.Indexes().DropOne(ctx, name)
+	var commandErr mongo.CommandError
+	if err != nil && !(errors.As(err, &commandErr) && (commandErr.Code == indexNotFound || commandErr.Code == namespaceNotFound)) {
+		return err
+	}
+	_, err = col.Indexes().CreateOne(ctx, index)
+	return err
+}
+
+// installValidator makes documents written to a collection conform to schema. The
+// moderate level leaves existing documents that do not conform yet writable.
+func installValidator(ctx context.Context, db *mongo.Database, collection string, schema bson.M) error {
+	validator := bson.M{"$jsonSchema": schema}
+	err := db.RunCommand(ctx, bson.D{
+		{Key: "collMod", Value: collection},
+		{Key: "validator", Value: validator},
+		{Key: "validationLevel", Value: "moderate"},
+		{Key: "validationAction", Value: "error"},
+	}).Err()
+	var commandErr mongo.CommandError
+	if errors.As(err, &commandErr) && commandErr.Code == namespaceNotFound {
+		return db.CreateCollection(ctx, collection, options.CreateCollection().
+			SetValidator(validator).
+			SetValidationLevel("moderate").
+			SetValidationAction("error"))
+	}
+	return err
+}
+
+// schemaChecksum fingerprints the generated validators so that the validator
+// migration runs again whenever the API document changes them.
+func schemaChecksum(validators map[string]bson.M) (string, error) {
+	hash := sha256.New()
+	for _, collection := range sortedKeys(validators) {
+		// Documents are marshalled with sorted keys so the checksum is stable.
+		data, err := bson.MarshalExtJSON(sortedDocument(validators[collection]), true, false)
+		if err != nil {
+			return "", err
+		}
+		hash.Write([]byte(collection))
+		hash.Write(data)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// sortedDocument turns a schema into an ordered document with sorted keys, recursively.
+func sortedDocument(value interface{}) interface{} {
+	switch v := value.(type) {
+	case bson.M:
+		doc := bson.D{}
+		for _, key := range sortedKeys(v) {
+			doc = append(doc, bson.E{Key: key, Value: sortedDocument(v[key])})
+		}
+		return doc
+	case bson.A:
+		arr := bson.A{}
+		for _, item := range v {
+			arr = append(arr, sortedDocument(item))
+		}
+		return arr
+	default:
+		return v
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// StoryElementCollision is a (storyID, nodeID) identity shared by more than one
+// story element. IDs holds the _id of every element involved.
+type StoryElementCollision struct {
+	StoryID string        `bson:"storyID"`
+	NodeID  string        `bson:"nodeID"`
+	IDs     []interface{} `bson:"ids"`
+}
+
+// Aggregator is the part of a MongoDB collection needed to run aggregation pipelines.
+type Aggregator interface {
+	Aggregate(ctx context.Context, pipeline interface{}, opts ...*options.AggregateOptions) (*mongo.Cursor, error)
+}
+
+// FindStoryElementCollisions reports every (storyID, nodeID) identity that is used
+// by more than one story element, ordered by story and node.
+func FindStoryElementCollisions(ctx context.Context, storyCol Aggregator) ([]StoryElementCollision, error) {
+	pipeline := mongo.Pipeline{
+		{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: bson.D{{Key: "storyID", Value: "$storyID"}, {Key: "nodeID", Value: "$nodeID"}}},
+			{Key: "ids", Value: bson.D{{Key: "$push", Value: "$_id"}}},
+			{Key: "count", Value: bson.D{{Key: "$sum", Value: 1}}},
+		}}},
+		{{Key: "$match", Value: bson.D{{Key: "count", Value: bson.D{{Key: "$gt", Value: 1}}}}}},
+		{{Key: "$project", Value: bson.D{
+			{Key: "_id", Value: 0},
+			{Key: "storyID", Value: "$_id.storyID"},
+			{Key: "nodeID", Value: "$_id.nodeID"},
+			{Key: "ids", Value: 1},
+		}}},
+		{{Key: "$sort", Value: bson.D{{Key: "storyID", Value: 1}, {Key: "nodeID", Value: 1}}}},
+	}
+	cursor, err := storyCol.Aggregate(ctx, pipeline, options.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		return nil, err
+	}
+	collisions := []StoryElementCollision{}
+	if err := cursor.All(ctx, &collisions); err != nil {
+		return nil, err
+	}
+	return collisions, nil
+}
+
+// EnsureStoryElementIdentity enforces the (storyID, nodeID) identity of story
+// elements with StoryElementIdentityIndex. Existing collisions would make the
+// index build fail, so they are looked for first; if there are any they are
+// returned and the index is left alone until they have been resolved.
+func EnsureStoryElementIdentity(ctx context.Context, storyCol *mongo.Collection) ([]StoryElementCollision, error) {
+	collisions, err := FindStoryElementCollisions(ctx, storyCol)
+	if err != nil || len(collisions) > 0 {
+		return collisions, err
+	}
+
+	// The non-unique index on the same keys predates the identity and conflicts with it.
+	return nil, replaceIndex(ctx, storyCol, "storyID_1_nodeID_1", StoryElementIdentityIndex)
+}
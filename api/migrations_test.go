@@ -0,0 +1,242 @@
+package api_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/okcthulhu/ChooseYourOwnAdventure/api"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestEnsureStoryElementIdentity_ReportsCollisions(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("collisions leave the index alone", func(mt *mtest.T) {
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, bson.D{
+			{Key: "storyID", Value: "s"},
+			{Key: "nodeID", Value: "start"},
+			{Key: "ids", Value: bson.A{"a", "b"}},
+		}))
+
+		collisions, err := api.EnsureStoryElementIdentity(context.Background(), mt.Coll)
+
+		assert.NoError(t, err)
+		if assert.Len(t, collisions, 1) {
+			assert.Equal(t, "s", collisions[0].StoryID)
+			assert.Equal(t, "start", collisions[0].NodeID)
+			assert.Len(t, collisions[0].IDs, 2)
+		}
+		assert.Len(t, mt.GetAllStartedEvents(), 1, "no index is created")
+	})
+}
+
+func TestEnsureStoryElementIdentity_CreatesIndex(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("unique index created", func(mt *mtest.T) {
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch),
+			mtest.CreateCommandErrorResponse(mtest.CommandError{Code: 27, Name: "IndexNotFound", Message: "index not found"}),
+			mtest.CreateSuccessResponse(),
+		)
+
+		collisions, err := api.EnsureStoryElementIdentity(context.Background(), mt.Coll)
+
+		assert.NoError(t, err)
+		assert.Empty(t, collisions)
+		create := mt.GetAllStartedEvents()[2].Command
+		index := create.Lookup("indexes").Array().Index(0).Value().Document()
+		assert.True(t, index.Lookup("unique").Boolean())
+	})
+}
+
+func TestMigratorRun_SkipsAppliedMigrations(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("only pending migrations run", func(mt *mtest.T) {
+		var ran []int
+		migration := func(version int, checksum string) api.Migration {
+			return api.Migration{
+				Version:     version,
+				Description: "migration",
+				Checksum:    checksum,
+				Up: func(ctx context.Context, db *mongo.Database) error {
+					ran = append(ran, version)
+					return nil
+				},
+			}
+		}
+		migrator := api.NewMigrator(mt.DB, []api.Migration{
+			migration(3, "new"), migration(1, ""), migration(2, ""),
+		})
+
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch,
+				bson.D{{Key: "_id", Value: 1}, {Key: "description", Value: "migration"}, {Key: "appliedAt", Value: time.Now()}},
+				bson.D{{Key: "_id", Value: 3}, {Key: "checksum", Value: "old"}, {Key: "appliedAt", Value: time.Now()}}),
+			matchedResponse(),
+			matchedResponse(),
+		)
+
+		records, err := migrator.Run(context.Background())
+
+		assert.NoError(t, err)
+		assert.Equal(t, []int{2, 3}, ran, "migration 3 runs again because its checksum changed")
+		if assert.Len(t, records, 2) {
+			assert.Equal(t, "new", records[1].Checksum)
+		}
+		replace := mt.GetAllStartedEvents()[1].Command
+		update := replace.Lookup("updates").Array().Index(0).Value().Document()
+		assert.Equal(t, int32(2), update.Lookup("q", "_id").Int32())
+		assert.True(t, update.Lookup("upsert").Boolean())
+	})
+}
+
+func TestMigratorRun_StopsAtFailure(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("failed migration is not recorded", func(mt *mtest.T) {
+		ran := false
+		migrator := api.NewMigrator(mt.DB, []api.Migration{
+			{Version: 1, Description: "broken", Up: func(context.Context, *mongo.Database) error { return errors.New("boom") }},
+			{Version: 2, Description: "after", Up: func(context.Context, *mongo.Database) error { ran = true; return nil }},
+		})
+
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch))
+
+		records, err := migrator.Run(context.Background())
+
+		assert.ErrorContains(t, err, "migration 1 (broken) failed: boom")
+		assert.Empty(t, records)
+		assert.False(t, ran)
+		assert.Len(t, mt.GetAllStartedEvents(), 1)
+	})
+}
+
+func TestMigrations_StoryElementCollisions(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("collisions fail the identity migration", func(mt *mtest.T) {
+		spec, err := os.ReadFile("../cyoa.yaml")
+		assert.NoError(t, err)
+		migrations, err := api.Migrations(spec, api.DefaultCollections)
+		assert.NoError(t, err)
+
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, bson.D{
+			{Key: "storyID", Value: "s"},
+			{Key: "nodeID", Value: "start"},
+			{Key: "ids", Value: bson.A{"a", "b"}},
+		}))
+
+		err = migrations[1].Up(context.Background(), mt.DB)
+
+		var collisionErr *api.CollisionError
+		if assert.ErrorAs(t, err, &collisionErr) {
+			assert.Len(t, collisionErr.Collisions, 1)
+		}
+		assert.Contains(t, err.Error(), "s/start (2 elements)")
+	})
+}
+
+func TestMigrations_InstallsValidators(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("validators created with missing collections", func(mt *mtest.T) {
+		spec, err := os.ReadFile("../cyoa.yaml")
+		assert.NoError(t, err)
+		migrations, err := api.Migrations(spec, api.DefaultCollections)
+		assert.NoError(t, err)
+		var validators api.Migration
+		for _, migration := range migrations {
+			if migration.Checksum != "" {
+				validators = migration
+			}
+		}
+		if !assert.NotNil(t, validators.Up, "the validator migration has a checksum") {
+			return
+		}
+
+		mt.AddMockResponses(
+			mtest.CreateSuccessResponse(),
+			mtest.CreateCommandErrorResponse(mtest.CommandError{Code: 26, Name: "NamespaceNotFound", Message: "ns does not exist"}),
+			mtest.CreateSuccessResponse(),
+		)
+
+		err = validators.Up(context.Background(), mt.DB)
+
+		assert.NoError(t, err)
+		started := mt.GetAllStartedEvents()
+		if assert.Len(t, started, 3) {
+			assert.Equal(t, "players", started[0].Command.Lookup("collMod").StringValue())
+			assert.Equal(t, "moderate", started[0].Command.Lookup("validationLevel").StringValue())
+			assert.Equal(t, "storyElements", started[2].Command.Lookup("create").StringValue())
+			assert.Equal(t, "binData", started[0].Command.Lookup("validator", "$jsonSchema", "properties", "wixID", "bsonType").StringValue())
+		}
+	})
+}
+
+// JSONSchemas
+
+func TestJSONSchemas(t *testing.T) {
+	spec := []byte(`
+components:
+  schemas:
+    Thing:
+      type: object
+      properties:
+        _id:
+          type: string
+        ownerID:
+          type: string
+          format: uuid
+        size:
+          type: integer
+        tags:
+          type: array
+          items:
+            $ref: '#/components/schemas/Tag'
+        seenAt:
+          type: string
+          format: date-time
+      required:
+        - _id
+        - ownerID
+    Tag:
+      type: object
+      properties:
+        kind:
+          type: string
+          enum: [a, b]
+`)
+
+	schemas, err := api.JSONSchemas(spec, map[string]string{"things": "Thing"})
+
+	assert.NoError(t, err)
+	thing := schemas["things"]
+	properties := thing["properties"].(bson.M)
+	assert.NotContains(t, properties, "_id")
+	assert.Equal(t, "binData", properties["ownerID"].(bson.M)["bsonType"])
+	assert.Equal(t, bson.A{"int", "long"}, properties["size"].(bson.M)["bsonType"])
+	assert.Equal(t, "date", properties["seenAt"].(bson.M)["bsonType"])
+	tag := properties["tags"].(bson.M)["items"].(bson.M)
+	assert.Equal(t, []interface{}{"a", "b"}, tag["properties"].(bson.M)["kind"].(bson.M)["enum"])
+	assert.Equal(t, bson.A{"ownerID"}, thing["required"])
+}
+
+func TestJSONSchemas_UnresolvedReference(t *testing.T) {
+	_, err := api.JSONSchemas([]byte("components:\n  schemas: {}\n"), map[string]string{"things": "Thing"})
+
+	assert.ErrorContains(t, err, "unresolved reference")
+}
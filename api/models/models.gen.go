@@ -4,35 +4,806 @@
 package models
 
 import (
+	"time"
+
 	openapi_types "github.com/oapi-codegen/runtime/types"
 )
 
+const (
+	AdminTokenScopes = "adminToken.Scopes"
+)
+
+// Defines values for AchievementRuleType.
+const (
+	CollectAllWisdoms         AchievementRuleType = "collectAllWisdoms"
+	CompleteStory             AchievementRuleType = "completeStory"
+	DistinctEndings           AchievementRuleType = "distinctEndings"
+	FinishWithoutGatedChoices AchievementRuleType = "finishWithoutGatedChoices"
+)
+
+// Defines values for AssetKind.
+const (
+	AssetKindImage AssetKind = "image"
+	AssetKindVideo AssetKind = "video"
+)
+
+// Defines values for AuditAction.
+const (
+	AuditActionPlayerAchievementUnlocked AuditAction = "player.achievementUnlocked"
+	AuditActionPlayerChoiceTaken         AuditAction = "player.choiceTaken"
+	AuditActionPlayerCreated             AuditAction = "player.created"
+	AuditActionPlayerCreatedParty        AuditAction = "player.createdParty"
+	AuditActionPlayerEntitlementGranted  AuditAction = "player.entitlementGranted"
+	AuditActionPlayerEntitlementRevoked  AuditAction = "player.entitlementRevoked"
+	AuditActionPlayerJoinedParty         AuditAction = "player.joinedParty"
+	AuditActionPlayerPartyDecision       AuditAction = "player.partyDecision"
+	AuditActionPlayerPatched             AuditAction = "player.patched"
+	AuditActionPlayerUpdated             AuditAction = "player.updated"
+	AuditActionStoryElementCreated       AuditAction = "storyElement.created"
+	AuditActionStoryElementDeleted       AuditAction = "storyElement.deleted"
+	AuditActionStoryElementPatched       AuditAction = "storyElement.patched"
+	AuditActionStoryElementUpdated       AuditAction = "storyElement.updated"
+)
+
+// Defines values for CreatePartyRequestTieBreak.
+const (
+	CreatePartyRequestTieBreakHost        CreatePartyRequestTieBreak = "host"
+	CreatePartyRequestTieBreakLowestIndex CreatePartyRequestTieBreak = "lowestIndex"
+	CreatePartyRequestTieBreakRandom      CreatePartyRequestTieBreak = "random"
+)
+
+// Defines values for DomainEventType.
+const (
+	ChoiceTaken         DomainEventType = "ChoiceTaken"
+	NodeEntered         DomainEventType = "NodeEntered"
+	PlayerCreated       DomainEventType = "PlayerCreated"
+	StoryCompleted      DomainEventType = "StoryCompleted"
+	StoryElementCreated DomainEventType = "StoryElementCreated"
+	StoryElementDeleted DomainEventType = "StoryElementDeleted"
+	StoryElementUpdated DomainEventType = "StoryElementUpdated"
+	WisdomGranted       DomainEventType = "WisdomGranted"
+)
+
+// Defines values for DiscoveredEndingOutcome.
+const (
+	DiscoveredEndingOutcomeBad     DiscoveredEndingOutcome = "bad"
+	DiscoveredEndingOutcomeGood    DiscoveredEndingOutcome = "good"
+	DiscoveredEndingOutcomeNeutral DiscoveredEndingOutcome = "neutral"
+)
+
+// Defines values for EndingOutcome.
+const (
+	EndingOutcomeBad     EndingOutcome = "bad"
+	EndingOutcomeGood    EndingOutcome = "good"
+	EndingOutcomeNeutral EndingOutcome = "neutral"
+)
+
+// Defines values for MediaPreloadKind.
+const (
+	MediaPreloadKindArt         MediaPreloadKind = "art"
+	MediaPreloadKindChoiceImage MediaPreloadKind = "choiceImage"
+	MediaPreloadKindVideo       MediaPreloadKind = "video"
+)
+
+// Defines values for PartyStatus.
+const (
+	PartyStatusActive   PartyStatus = "active"
+	PartyStatusFinished PartyStatus = "finished"
+)
+
+// Defines values for PartyTieBreak.
+const (
+	PartyTieBreakHost        PartyTieBreak = "host"
+	PartyTieBreakLowestIndex PartyTieBreak = "lowestIndex"
+	PartyTieBreakRandom      PartyTieBreak = "random"
+)
+
+// Defines values for PatchOperationOp.
+const (
+	Add     PatchOperationOp = "add"
+	Copy    PatchOperationOp = "copy"
+	Move    PatchOperationOp = "move"
+	Remove  PatchOperationOp = "remove"
+	Replace PatchOperationOp = "replace"
+	Test    PatchOperationOp = "test"
+)
+
+// Achievement defines model for Achievement.
+type Achievement struct {
+	// AchievementID Unique identifier for the achievement.
+	AchievementID string `json:"achievementID" bson:"achievementID"`
+
+	// Description What the player has to do to unlock the achievement.
+	Description *string `json:"description,omitempty" bson:"description,omitempty"`
+
+	// Name Name of the achievement.
+	Name string          `json:"name" bson:"name"`
+	Rule AchievementRule `json:"rule" bson:"rule"`
+}
+
+// AchievementRule defines model for AchievementRule.
+type AchievementRule struct {
+	// Count Number of distinct endings required by distinctEndings.
+	Count *int `json:"count,omitempty" bson:"count,omitempty"`
+
+	// StoryID Story the condition is limited to. Required for collectAllWisdoms and completeStory.
+	StoryID *string `json:"storyID,omitempty" bson:"storyID,omitempty"`
+
+	// Type The condition to evaluate.
+	Type AchievementRuleType `json:"type" bson:"type"`
+}
+
+// AchievementRuleType The condition to evaluate.
+type AchievementRuleType string
+
+// Asset defines model for Asset.
+type Asset struct {
+	// AssetID Unique identifier for the asset.
+	AssetID string `json:"assetID" bson:"_id"`
+
+	// Checksum Hex-encoded SHA-256 of the content.
+	Checksum string `json:"checksum" bson:"checksum"`
+
+	// ContentType Media type of the content, as sniffed from it.
+	ContentType string `json:"contentType" bson:"contentType"`
+
+	// CreatedAt When the asset was uploaded.
+	CreatedAt time.Time `json:"createdAt" bson:"createdAt"`
+
+	// Duration Length of a video in seconds, when it could be read.
+	Duration *float64 `json:"duration,omitempty" bson:"duration,omitempty"`
+
+	// Filename Name of the uploaded file.
+	Filename *string `json:"filename,omitempty" bson:"filename,omitempty"`
+
+	// Height Height of an image in pixels, when it could be read.
+	Height *int `json:"height,omitempty" bson:"height,omitempty"`
+
+	// Kind Whether the asset is an image or a video.
+	Kind AssetKind `json:"kind" bson:"kind"`
+
+	// Size Size of the content in bytes.
+	Size int64 `json:"size" bson:"size"`
+
+	// Url Where the content is served.
+	Url string `json:"url" bson:"url"`
+
+	// Width Width of an image in pixels, when it could be read.
+	Width *int `json:"width,omitempty" bson:"width,omitempty"`
+}
+
+// AssetKind Whether the asset is an image or a video.
+type AssetKind string
+
+// AuditAction Kind of change recorded in the audit log.
+type AuditAction string
+
+// AuditEntry defines model for AuditEntry.
+type AuditEntry struct {
+	// Action Kind of change recorded in the audit log.
+	Action AuditAction `json:"action" bson:"action"`
+
+	// Actor Who made the change: admin for requests carrying the admin token, anonymous for other requests and system for changes made in the background, such as unlocked achievements.
+	Actor string `json:"actor" bson:"actor"`
+
+	// After Summary of the changed player or story element. Absent before a creation and after a deletion.
+	After *AuditSnapshot `json:"after,omitempty" bson:"after,omitempty"`
+
+	// AuditID Identifier of the entry. Later entries have greater identifiers.
+	AuditID string `json:"auditID" bson:"_id"`
+
+	// Before Summary of the changed player or story element. Absent before a creation and after a deletion.
+	Before *AuditSnapshot `json:"before,omitempty" bson:"before,omitempty"`
+
+	// NodeID Story element changed, or the node the player moved to.
+	NodeID *string `json:"nodeID,omitempty" bson:"nodeID,omitempty"`
+
+	// OccurredAt When the change was made.
+	OccurredAt time.Time `json:"occurredAt" bson:"occurredAt"`
+
+	// RemoteIP Address of the client that made the change.
+	RemoteIP *string `json:"remoteIP,omitempty" bson:"remoteIP,omitempty"`
+
+	// RequestID ID of the request that made the change, as in its X-Request-ID header.
+	RequestID *string `json:"requestID,omitempty" bson:"requestID,omitempty"`
+
+	// StoryID Story the change belongs to.
+	StoryID *string `json:"storyID,omitempty" bson:"storyID,omitempty"`
+
+	// WixID Player changed.
+	WixID *openapi_types.UUID `json:"wixID,omitempty" bson:"wixID,omitempty"`
+}
+
+// AuditPage defines model for AuditPage.
+type AuditPage struct {
+	// Items Audit entries of this page, newest first.
+	Items []AuditEntry `json:"items" bson:"items"`
+
+	// NextCursor Cursor of the next page. Absent on the last page.
+	NextCursor *string `json:"nextCursor,omitempty" bson:"nextCursor,omitempty"`
+}
+
+// AuditSnapshot Summary of the changed player or story element. Absent before a creation and after a deletion.
+type AuditSnapshot struct {
+	Player       *PlayerSummary       `json:"player,omitempty" bson:"player,omitempty"`
+	StoryElement *StoryElementSummary `json:"storyElement,omitempty" bson:"storyElement,omitempty"`
+}
+
+// CastVoteRequest defines model for CastVoteRequest.
+type CastVoteRequest struct {
+	// ChoiceIndex Index of the choice voted for.
+	ChoiceIndex int `json:"choiceIndex" bson:"choiceIndex"`
+
+	// WixID Wix identifier of the voting member.
+	WixID openapi_types.UUID `json:"wixID" bson:"wixID"`
+}
+
+// ChapterDropOff defines model for ChapterDropOff.
+type ChapterDropOff struct {
+	// ChapterName Name of the chapter.
+	ChapterName string `json:"chapterName" bson:"chapterName"`
+
+	// Continued Number of players who moved past the chapter or finished the story in it.
+	Continued int `json:"continued" bson:"continued"`
+
+	// DropOffRate Share of players who reached the chapter and went no further.
+	DropOffRate float32 `json:"dropOffRate" bson:"dropOffRate"`
+
+	// Reached Number of players who reached the chapter.
+	Reached int `json:"reached" bson:"reached"`
+}
+
 // Choice defines model for Choice.
 type Choice struct {
 	// Description Description of the choice.
 	Description string `json:"description" bson:"description"`
 
+	// ImageAssetID Optional asset of the image for the choice. Takes the place of imageUrl.
+	ImageAssetID *string `json:"imageAssetID,omitempty" bson:"imageAssetID,omitempty"`
+
 	// ImageUrl Optional URL to an image for the choice.
 	ImageUrl *string `json:"imageUrl,omitempty" bson:"imageUrl,omitempty"`
 
-	// NextNodeID Node identifier for the subsequent story element.
+	// NextNodeID Node identifier for the subsequent story element. For a choice with outcomes, the node it leads to when no outcome has a positive weight.
 	NextNodeID string `json:"nextNodeID" bson:"nextNodeID"`
 
+	// Outcomes Chance outcomes of the choice. When given, the node the choice leads to is rolled among them by weight.
+	Outcomes *[]ChoiceOutcome `json:"outcomes,omitempty" bson:"outcomes,omitempty"`
+
 	// WisdomID Optional wisdom identifier required for the choice.
 	WisdomID *string `json:"wisdomID,omitempty" bson:"wisdomID,omitempty"`
 }
 
+// ChoiceEvent defines model for ChoiceEvent.
+type ChoiceEvent struct {
+	// ChapterName Chapter of the node the choice was taken at.
+	ChapterName *string `json:"chapterName,omitempty" bson:"chapterName,omitempty"`
+
+	// ChoiceIndex Index of the choice taken.
+	ChoiceIndex int `json:"choiceIndex" bson:"choiceIndex"`
+
+	// Completed Whether the choice led to a node without further choices.
+	Completed *bool `json:"completed,omitempty" bson:"completed,omitempty"`
+
+	// FromNodeID Node the player was at when taking the choice.
+	FromNodeID string `json:"fromNodeID" bson:"fromNodeID"`
+
+	// Gated Whether the choice required a wisdom.
+	Gated *bool `json:"gated,omitempty" bson:"gated,omitempty"`
+
+	// Id Unique identifier of the choice event.
+	Id *string `json:"_id,omitempty" bson:"_id,omitempty"`
+
+	// NextChapterName Chapter of the node the choice led to.
+	NextChapterName *string `json:"nextChapterName,omitempty" bson:"nextChapterName,omitempty"`
+
+	// OccurredAt When the choice was taken.
+	OccurredAt time.Time `json:"occurredAt" bson:"occurredAt"`
+
+	// StoryID Identifier for the story the choice was taken in.
+	StoryID string `json:"storyID" bson:"storyID"`
+
+	// TimedOut Whether the choice is the default taken because the time limit had passed.
+	TimedOut *bool `json:"timedOut,omitempty" bson:"timedOut,omitempty"`
+
+	// ToNodeID Node the choice led to.
+	ToNodeID string `json:"toNodeID" bson:"toNodeID"`
+
+	// WixID Wix identifier of the player who took the choice.
+	WixID openapi_types.UUID `json:"wixID" bson:"wixID"`
+}
+
+// ChoiceOutcome defines model for ChoiceOutcome.
+type ChoiceOutcome struct {
+	// Modifiers Changes to the weight for players holding wisdoms.
+	Modifiers *[]OutcomeModifier `json:"modifiers,omitempty" bson:"modifiers,omitempty"`
+
+	// NextNodeID Node identifier of the story element the outcome leads to.
+	NextNodeID string `json:"nextNodeID" bson:"nextNodeID"`
+
+	// Weight Relative chance of the outcome.
+	Weight int `json:"weight" bson:"weight"`
+}
+
+// ChoiceRate defines model for ChoiceRate.
+type ChoiceRate struct {
+	// ChoiceIndex Index of the choice.
+	ChoiceIndex int `json:"choiceIndex" bson:"choiceIndex"`
+
+	// NextNodeID Node the choice led to. Absent when it led to several nodes, as a choice with outcomes can.
+	NextNodeID *string `json:"nextNodeID,omitempty" bson:"nextNodeID,omitempty"`
+
+	// NodeID Node the choice belongs to.
+	NodeID string `json:"nodeID" bson:"nodeID"`
+
+	// Rate Share of all choices taken at the node.
+	Rate float32 `json:"rate" bson:"rate"`
+
+	// Taken Number of times the choice was taken.
+	Taken int `json:"taken" bson:"taken"`
+
+	// Targets How often the choice led to each node, by node. Only present when it led to several nodes.
+	Targets *[]ChoiceTarget `json:"targets,omitempty" bson:"targets,omitempty"`
+}
+
+// ChoiceTarget defines model for ChoiceTarget.
+type ChoiceTarget struct {
+	// NextNodeID Node the choice led to.
+	NextNodeID string `json:"nextNodeID" bson:"nextNodeID"`
+
+	// Taken Number of times the choice led to the node.
+	Taken int `json:"taken" bson:"taken"`
+}
+
+// CompletionStats defines model for CompletionStats.
+type CompletionStats struct {
+	// Completed Number of players who reached a node without further choices.
+	Completed int `json:"completed" bson:"completed"`
+
+	// Rate Share of started players who completed the story.
+	Rate float32 `json:"rate" bson:"rate"`
+
+	// Started Number of players who took at least one choice.
+	Started int `json:"started" bson:"started"`
+}
+
+// CreatePartyRequest defines model for CreatePartyRequest.
+type CreatePartyRequest struct {
+	// HostWixID Wix identifier of the creating player.
+	HostWixID openapi_types.UUID `json:"hostWixID" bson:"hostWixID"`
+
+	// StartNodeID Node the party starts at.
+	StartNodeID string `json:"startNodeID" bson:"startNodeID"`
+
+	// StoryID Story to play.
+	StoryID string `json:"storyID" bson:"storyID"`
+
+	// TieBreak How a tied vote is decided. Defaults to lowestIndex.
+	TieBreak *CreatePartyRequestTieBreak `json:"tieBreak,omitempty" bson:"tieBreak,omitempty"`
+
+	// VoteTimeoutSeconds Seconds a vote stays open after the first ballot. Defaults to 60.
+	VoteTimeoutSeconds *int `json:"voteTimeoutSeconds,omitempty" bson:"voteTimeoutSeconds,omitempty"`
+}
+
+// CreatePartyRequestTieBreak How a tied vote is decided. Defaults to lowestIndex.
+type CreatePartyRequestTieBreak string
+
+// DiscoveredEnding defines model for DiscoveredEnding.
+type DiscoveredEnding struct {
+	// DiscoveredAt When the player first reached the ending.
+	DiscoveredAt time.Time `json:"discoveredAt" bson:"discoveredAt"`
+
+	// EndingID Identifier of the ending.
+	EndingID string `json:"endingID" bson:"endingID"`
+
+	// NodeID Node the ending is at.
+	NodeID string `json:"nodeID" bson:"nodeID"`
+
+	// Outcome How the ending turned out for the player.
+	Outcome DiscoveredEndingOutcome `json:"outcome" bson:"outcome"`
+
+	// Title Title of the ending.
+	Title string `json:"title" bson:"title"`
+}
+
+// DiscoveredEndingOutcome How the ending turned out for the player.
+type DiscoveredEndingOutcome string
+
+// DomainEvent A domain event delivered to event sinks and webhooks.
+type DomainEvent struct {
+	Choice  *ChoiceEvent  `json:"choice,omitempty" bson:"choice,omitempty"`
+	Element *StoryElement `json:"element,omitempty" bson:"element,omitempty"`
+
+	// Ending Marks a story element as a deliberate ending of the story.
+	Ending *Ending `json:"ending,omitempty" bson:"ending,omitempty"`
+
+	// Id Unique identifier of the event, stable across redeliveries.
+	Id string `json:"id" bson:"id"`
+
+	// NodeID Node entered or the story was completed at, if any.
+	NodeID *string `json:"nodeID,omitempty" bson:"nodeID,omitempty"`
+
+	// OccurredAt When the event happened.
+	OccurredAt time.Time `json:"occurredAt" bson:"occurredAt"`
+
+	// StoryID Story the event happened in, if any.
+	StoryID *string `json:"storyID,omitempty" bson:"storyID,omitempty"`
+
+	// Type Kind of event.
+	Type   DomainEventType `json:"type" bson:"type"`
+	Wisdom *Wisdom         `json:"wisdom,omitempty" bson:"wisdom,omitempty"`
+
+	// WixID Wix identifier of the player the event concerns, if any.
+	WixID *openapi_types.UUID `json:"wixID,omitempty" bson:"wixID,omitempty"`
+}
+
+// DomainEventType Kind of event.
+type DomainEventType string
+
+// Ending Marks a story element as a deliberate ending of the story.
+type Ending struct {
+	// EndingID Identifier of the ending, unique within the story.
+	EndingID string `json:"endingID" bson:"endingID"`
+
+	// Outcome How the ending turned out for the player.
+	Outcome EndingOutcome `json:"outcome" bson:"outcome"`
+
+	// Title Title of the ending shown to the player.
+	Title string `json:"title" bson:"title"`
+}
+
+// EndingOutcome How the ending turned out for the player.
+type EndingOutcome string
+
+// Entitlement defines model for Entitlement.
+type Entitlement struct {
+	// ExpiresAt When the entitlement lapses. Absent for entitlements that do not expire.
+	ExpiresAt *time.Time `json:"expiresAt,omitempty" bson:"expiresAt,omitempty"`
+
+	// GrantedAt When the product was granted.
+	GrantedAt time.Time `json:"grantedAt" bson:"grantedAt"`
+
+	// ProductID The product granted.
+	ProductID string `json:"productID" bson:"productID"`
+}
+
+// GrantEntitlementRequest defines model for GrantEntitlementRequest.
+type GrantEntitlementRequest struct {
+	// ExpiresAt When the entitlement lapses. Absent for entitlements that do not expire.
+	ExpiresAt *time.Time `json:"expiresAt,omitempty" bson:"expiresAt,omitempty"`
+
+	// ProductID The product to grant.
+	ProductID string `json:"productID" bson:"productID"`
+}
+
+// GroupDecision defines model for GroupDecision.
+type GroupDecision struct {
+	// Ballots Choice index voted for, keyed by member Wix identifier.
+	Ballots map[string]int `json:"ballots" bson:"ballots"`
+
+	// ChoiceIndex Index of the winning choice.
+	ChoiceIndex int `json:"choiceIndex" bson:"choiceIndex"`
+
+	// DecidedAt When the vote was decided.
+	DecidedAt time.Time `json:"decidedAt" bson:"decidedAt"`
+
+	// GrantedWisdoms Wisdoms granted to every member on entering the next node.
+	GrantedWisdoms *[]Wisdom `json:"grantedWisdoms,omitempty" bson:"grantedWisdoms,omitempty"`
+
+	// NextNodeID Node the winning choice led to.
+	NextNodeID string `json:"nextNodeID" bson:"nextNodeID"`
+
+	// NodeID Node the decision was taken at.
+	NodeID string `json:"nodeID" bson:"nodeID"`
+
+	// OutcomeIndex Index of the outcome rolled for the winning choice. Absent for choices without outcomes.
+	OutcomeIndex *int `json:"outcomeIndex,omitempty" bson:"outcomeIndex,omitempty"`
+
+	// PartyID Party that took the decision.
+	PartyID string `json:"partyID" bson:"partyID"`
+
+	// TieBroken Whether the tie-break rule decided the vote.
+	TieBroken *bool `json:"tieBroken,omitempty" bson:"tieBroken,omitempty"`
+}
+
+// JoinPartyRequest defines model for JoinPartyRequest.
+type JoinPartyRequest struct {
+	// WixID Wix identifier of the joining player.
+	WixID openapi_types.UUID `json:"wixID" bson:"wixID"`
+}
+
+// JSONPatch defines model for JSONPatch.
+type JSONPatch = []PatchOperation
+
+// LockedContent defines model for LockedContent.
+type LockedContent struct {
+	// ChapterName Chapter of the locked story element.
+	ChapterName *string `json:"chapterName,omitempty" bson:"chapterName,omitempty"`
+
+	// Message Why the story element is not returned.
+	Message string `json:"message" bson:"message"`
+
+	// NodeID Node identifier of the locked story element.
+	NodeID string `json:"nodeID" bson:"nodeID"`
+
+	// ProductID The product that unlocks the story element.
+	ProductID string `json:"productID" bson:"productID"`
+
+	// StoryID Identifier of the story.
+	StoryID string `json:"storyID" bson:"storyID"`
+}
+
+// MediaPreload defines model for MediaPreload.
+type MediaPreload struct {
+	// Distance Choices between the requested node and the node using the media.
+	Distance int `json:"distance" bson:"distance"`
+
+	// Kind What the media is used as.
+	Kind MediaPreloadKind `json:"kind" bson:"kind"`
+
+	// NodeID Node using the media.
+	NodeID string `json:"nodeID" bson:"nodeID"`
+
+	// Url URL of the media.
+	Url string `json:"url" bson:"url"`
+}
+
+// MediaPreloadKind What the media is used as.
+type MediaPreloadKind string
+
+// MissingAssetReference defines model for MissingAssetReference.
+type MissingAssetReference struct {
+	// AssetID The asset that does not exist.
+	AssetID string `json:"assetID" bson:"assetID"`
+
+	// Field Path of the field referencing the asset.
+	Field string `json:"field" bson:"field"`
+
+	// NodeID Node identifier of the element.
+	NodeID string `json:"nodeID" bson:"nodeID"`
+
+	// StoryID Identifier of the story.
+	StoryID string `json:"storyID" bson:"storyID"`
+}
+
+// MissingAssetReport defines model for MissingAssetReport.
+type MissingAssetReport struct {
+	// Items References to missing assets, ordered by story, node and field.
+	Items []MissingAssetReference `json:"items" bson:"items"`
+}
+
+// NodeDwellTime defines model for NodeDwellTime.
+type NodeDwellTime struct {
+	// MedianSeconds Median seconds spent at the node before taking a choice.
+	MedianSeconds float32 `json:"medianSeconds" bson:"medianSeconds"`
+
+	// NodeID Node identifier.
+	NodeID string `json:"nodeID" bson:"nodeID"`
+
+	// Samples Number of visits with a measured duration.
+	Samples int `json:"samples" bson:"samples"`
+}
+
+// NodePopulation defines model for NodePopulation.
+type NodePopulation struct {
+	// NodeID Node identifier.
+	NodeID string `json:"nodeID" bson:"nodeID"`
+
+	// Players Number of players whose latest choice left them at this node.
+	Players int `json:"players" bson:"players"`
+}
+
+// OutcomeModifier defines model for OutcomeModifier.
+type OutcomeModifier struct {
+	// Weight Added to the weight of the outcome, or taken from it when negative. Weights below zero count as zero.
+	Weight int `json:"weight" bson:"weight"`
+
+	// WisdomID The wisdom the player must hold for the modifier to apply.
+	WisdomID string `json:"wisdomID" bson:"wisdomID"`
+}
+
+// OutcomeRoll defines model for OutcomeRoll.
+type OutcomeRoll struct {
+	// ChoiceIndex Index of the choice taken.
+	ChoiceIndex int `json:"choiceIndex" bson:"choiceIndex"`
+
+	// NextNodeID Node the rolled outcome led to.
+	NextNodeID string `json:"nextNodeID" bson:"nextNodeID"`
+
+	// NodeID Node the choice was taken at.
+	NodeID string `json:"nodeID" bson:"nodeID"`
+
+	// OutcomeIndex Index of the rolled outcome. Absent when no outcome had a positive weight and the choice's nextNodeID was taken.
+	OutcomeIndex *int `json:"outcomeIndex,omitempty" bson:"outcomeIndex,omitempty"`
+
+	// Roll Value rolled, from zero to below the total weight.
+	Roll int `json:"roll" bson:"roll"`
+
+	// RolledAt When the outcome was rolled.
+	RolledAt time.Time `json:"rolledAt" bson:"rolledAt"`
+
+	// Sequence Position of the roll among the rolls of the story state, from zero.
+	Sequence int `json:"sequence" bson:"sequence"`
+
+	// Weights Weight of each outcome after the modifiers of the player's wisdoms.
+	Weights []int `json:"weights" bson:"weights"`
+}
+
+// Party defines model for Party.
+type Party struct {
+	// CreatedAt When the party was created.
+	CreatedAt time.Time `json:"createdAt" bson:"createdAt"`
+
+	// CurrentNodeID The party's shared position in the story.
+	CurrentNodeID string           `json:"currentNodeID" bson:"currentNodeID"`
+	Decisions     *[]GroupDecision `json:"decisions,omitempty" bson:"decisions,omitempty"`
+
+	// HostWixID Wix identifier of the player who created the party.
+	HostWixID openapi_types.UUID `json:"hostWixID" bson:"hostWixID"`
+
+	// Id Unique identifier for the party document.
+	Id *string `json:"_id,omitempty" bson:"_id,omitempty"`
+
+	// Members Wix identifiers of the party's members.
+	Members []openapi_types.UUID `json:"members" bson:"members"`
+
+	// PartyID Public identifier of the party.
+	PartyID string `json:"partyID" bson:"partyID"`
+
+	// Round Number of decisions taken so far.
+	Round int `json:"round" bson:"round"`
+
+	// Status Whether the party is still playing.
+	Status PartyStatus `json:"status" bson:"status"`
+
+	// StoryID Story the party is playing.
+	StoryID string `json:"storyID" bson:"storyID"`
+
+	// TieBreak How a tied vote is decided.
+	TieBreak PartyTieBreak `json:"tieBreak" bson:"tieBreak"`
+	Vote     *PartyVote    `json:"vote,omitempty" bson:"vote,omitempty"`
+
+	// VoteTimeoutSeconds Seconds a vote stays open after the first ballot.
+	VoteTimeoutSeconds int `json:"voteTimeoutSeconds" bson:"voteTimeoutSeconds"`
+}
+
+// PartyStatus Whether the party is still playing.
+type PartyStatus string
+
+// PartyTieBreak How a tied vote is decided.
+type PartyTieBreak string
+
+// PartyVote defines model for PartyVote.
+type PartyVote struct {
+	// Ballots Choice index voted for, keyed by member Wix identifier.
+	Ballots map[string]int `json:"ballots" bson:"ballots"`
+
+	// Deadline When the vote is decided even if members have not voted.
+	Deadline time.Time `json:"deadline" bson:"deadline"`
+
+	// NodeID Node whose choices are being voted on.
+	NodeID string `json:"nodeID" bson:"nodeID"`
+
+	// OpenedAt When the first ballot was cast.
+	OpenedAt time.Time `json:"openedAt" bson:"openedAt"`
+}
+
+// PatchOperation An operation of a JSON Patch (RFC 6902).
+type PatchOperation struct {
+	// From JSON Pointer to the source location of a move or copy.
+	From *string `json:"from,omitempty" bson:"from,omitempty"`
+
+	// Op
+	Op PatchOperationOp `json:"op" bson:"op"`
+
+	// Path JSON Pointer to the target location.
+	Path string `json:"path" bson:"path"`
+
+	// Value Value to add, replace or test with.
+	Value *interface{} `json:"value,omitempty" bson:"value,omitempty"`
+}
+
+// PatchOperationOp defines model for PatchOperation.Op.
+type PatchOperationOp string
+
 // Player defines model for Player.
 type Player struct {
+	// Achievements Achievements the player has unlocked.
+	Achievements *[]UnlockedAchievement `json:"achievements,omitempty" bson:"achievements,omitempty"`
+
+	// CreatedAt When the player was created.
+	CreatedAt *time.Time `json:"createdAt,omitempty" bson:"createdAt,omitempty"`
+
 	// Id The player's unique identifier.
 	Id *string `json:"_id,omitempty" bson:"_id,omitempty"`
 
 	// Email Player's email address.
 	Email openapi_types.Email `json:"email" bson:"email"`
 
+	// Entitlements Products granted to the player, such as chapters sold separately.
+	Entitlements *[]Entitlement `json:"entitlements,omitempty" bson:"entitlements,omitempty"`
+
 	// StoryStates Player's story states.
 	StoryStates *[]StoryState `json:"storyStates,omitempty" bson:"storyStates,omitempty"`
 
+	// UpdatedAt When the player's state last changed.
+	UpdatedAt *time.Time `json:"updatedAt,omitempty" bson:"updatedAt,omitempty"`
+
+	// WixID Unique Wix identifier for the player.
+	WixID openapi_types.UUID `json:"wixID" bson:"wixID"`
+}
+
+// Paywall defines model for Paywall.
+type Paywall struct {
+	// ChapterName Chapter sold separately. Absent when the whole story is sold.
+	ChapterName *string `json:"chapterName,omitempty" bson:"chapterName,omitempty"`
+
+	// ProductID The product required to read the story or chapter.
+	ProductID string `json:"productID" bson:"productID"`
+
+	// StoryID Identifier of the story.
+	StoryID string `json:"storyID" bson:"storyID"`
+}
+
+// PlayerAchievement defines model for PlayerAchievement.
+type PlayerAchievement struct {
+	// AchievementID Identifier of the unlocked achievement.
+	AchievementID string `json:"achievementID" bson:"achievementID"`
+
+	// Description What the player did to unlock the achievement.
+	Description *string `json:"description,omitempty" bson:"description,omitempty"`
+
+	// Name Name of the achievement.
+	Name string `json:"name" bson:"name"`
+
+	// UnlockedAt When the achievement was unlocked.
+	UnlockedAt time.Time `json:"unlockedAt" bson:"unlockedAt"`
+}
+
+// PlayerPage defines model for PlayerPage.
+type PlayerPage struct {
+	// Items Players of this page.
+	Items []PlayerSummary `json:"items" bson:"items"`
+
+	// NextCursor Cursor of the next page. Absent on the last page.
+	NextCursor *string `json:"nextCursor,omitempty" bson:"nextCursor,omitempty"`
+}
+
+// PlayerStorySummary defines model for PlayerStorySummary.
+type PlayerStorySummary struct {
+	// Completed Whether the player has reached an ending.
+	Completed bool `json:"completed" bson:"completed"`
+
+	// CurrentStoryNodeID Node the player is at.
+	CurrentStoryNodeID string `json:"currentStoryNodeID" bson:"currentStoryNodeID"`
+
+	// StoryID Identifier of the story.
+	StoryID string `json:"storyID" bson:"storyID"`
+
+	// WisdomIDs Wisdoms the player holds in the story.
+	WisdomIDs *[]string `json:"wisdomIDs,omitempty" bson:"wisdomIDs,omitempty"`
+}
+
+// PlayerSummary defines model for PlayerSummary.
+type PlayerSummary struct {
+	// AchievementCount Number of achievements the player has unlocked.
+	AchievementCount int `json:"achievementCount" bson:"achievementCount"`
+
+	// CreatedAt When the player was created.
+	CreatedAt *time.Time `json:"createdAt,omitempty" bson:"createdAt,omitempty"`
+
+	// Email Player's email address.
+	Email openapi_types.Email `json:"email" bson:"email"`
+
+	// ProductIDs Products the player holds, expired or not.
+	ProductIDs *[]string `json:"productIDs,omitempty" bson:"productIDs,omitempty"`
+
+	// Stories Where the player stands in each story they started.
+	Stories []PlayerStorySummary `json:"stories" bson:"stories"`
+
+	// UpdatedAt When the player's state last changed.
+	UpdatedAt *time.Time `json:"updatedAt,omitempty" bson:"updatedAt,omitempty"`
+
 	// WixID Unique Wix identifier for the player.
 	WixID openapi_types.UUID `json:"wixID" bson:"wixID"`
 }
@@ -42,6 +813,9 @@ type StoryElement struct {
 	// Id Unique identifier for the story element.
 	Id *string `json:"_id,omitempty" bson:"_id,omitempty"`
 
+	// ArtAssetID Asset of the chapter art. Takes the place of artURL.
+	ArtAssetID *string `json:"artAssetID,omitempty" bson:"artAssetID,omitempty"`
+
 	// ArtURL URL to the chapter art.
 	ArtURL *string `json:"artURL,omitempty" bson:"artURL,omitempty"`
 
@@ -54,12 +828,24 @@ type StoryElement struct {
 	// Content Content of the story element.
 	Content string `json:"content" bson:"content"`
 
+	// DefaultChoiceIndex Index of the choice taken for the player once the time limit has passed. The choice cannot require a wisdom.
+	DefaultChoiceIndex *int `json:"defaultChoiceIndex,omitempty" bson:"defaultChoiceIndex,omitempty"`
+
+	// Ending Marks a story element as a deliberate ending of the story.
+	Ending *Ending `json:"ending,omitempty" bson:"ending,omitempty"`
+
 	// NodeID Node identifier for this story element.
 	NodeID string `json:"nodeID" bson:"nodeID"`
 
 	// StoryID Identifier for the story this element belongs to.
 	StoryID string `json:"storyID" bson:"storyID"`
 
+	// TimeLimitSeconds Seconds the player has to choose, from when the element was presented to them. Requires defaultChoiceIndex.
+	TimeLimitSeconds *int `json:"timeLimitSeconds,omitempty" bson:"timeLimitSeconds,omitempty"`
+
+	// VideoAssetID Asset of the chapter video. Takes the place of videoURL.
+	VideoAssetID *string `json:"videoAssetID,omitempty" bson:"videoAssetID,omitempty"`
+
 	// VideoURL URL to the chapter video.
 	VideoURL *string `json:"videoURL,omitempty" bson:"videoURL,omitempty"`
 
@@ -67,11 +853,125 @@ type StoryElement struct {
 	Wisdoms *map[string]Wisdom `json:"wisdoms,omitempty" bson:"wisdoms,omitempty"`
 }
 
+// StoryElementSummary defines model for StoryElementSummary.
+type StoryElementSummary struct {
+	// ChapterName Chapter the element is part of.
+	ChapterName *string `json:"chapterName,omitempty" bson:"chapterName,omitempty"`
+
+	// ContentLength Length of the content in bytes.
+	ContentLength int `json:"contentLength" bson:"contentLength"`
+
+	// EndingID Ending the element marks, if it is one.
+	EndingID *string `json:"endingID,omitempty" bson:"endingID,omitempty"`
+
+	// HasArt Whether the element has art.
+	HasArt bool `json:"hasArt" bson:"hasArt"`
+
+	// HasVideo Whether the element has a video.
+	HasVideo bool `json:"hasVideo" bson:"hasVideo"`
+
+	// NextNodeIDs Nodes the element's choices lead to, in the order of the choices, each followed by the nodes of its outcomes.
+	NextNodeIDs []string `json:"nextNodeIDs" bson:"nextNodeIDs"`
+
+	// NodeID Node identifier of the element.
+	NodeID string `json:"nodeID" bson:"nodeID"`
+
+	// StoryID Identifier of the story.
+	StoryID string `json:"storyID" bson:"storyID"`
+
+	// WisdomIDs Wisdoms the element grants.
+	WisdomIDs *[]string `json:"wisdomIDs,omitempty" bson:"wisdomIDs,omitempty"`
+}
+
+// StoryElementPage defines model for StoryElementPage.
+type StoryElementPage struct {
+	// Items Story elements of this page.
+	Items []StoryElement `json:"items" bson:"items"`
+
+	// NextCursor Cursor of the next page. Absent on the last page.
+	NextCursor *string `json:"nextCursor,omitempty" bson:"nextCursor,omitempty"`
+}
+
+// StoryEndings defines model for StoryEndings.
+type StoryEndings struct {
+	// Discovered Endings the player has discovered.
+	Discovered []DiscoveredEnding `json:"discovered" bson:"discovered"`
+
+	// StoryID Identifier of the story.
+	StoryID string `json:"storyID" bson:"storyID"`
+
+	// Total Number of endings the story has.
+	Total int `json:"total" bson:"total"`
+}
+
+// StoryFunnelReport defines model for StoryFunnelReport.
+type StoryFunnelReport struct {
+	ChapterDropOff []ChapterDropOff `json:"chapterDropOff" bson:"chapterDropOff"`
+	ChoiceRates    []ChoiceRate     `json:"choiceRates" bson:"choiceRates"`
+	Completion     CompletionStats  `json:"completion" bson:"completion"`
+
+	// From Start of the reporting window.
+	From           *time.Time       `json:"from,omitempty" bson:"from,omitempty"`
+	NodeDwellTimes []NodeDwellTime  `json:"nodeDwellTimes" bson:"nodeDwellTimes"`
+	NodePopulation []NodePopulation `json:"nodePopulation" bson:"nodePopulation"`
+
+	// StoryID Identifier for the story the report covers.
+	StoryID string `json:"storyID" bson:"storyID"`
+
+	// To End of the reporting window.
+	To *time.Time `json:"to,omitempty" bson:"to,omitempty"`
+}
+
+// StoryNeighborhood defines model for StoryNeighborhood.
+type StoryNeighborhood struct {
+	// Depth Most choices followed from the requested node.
+	Depth int `json:"depth" bson:"depth"`
+
+	// Elements The requested node, then the nodes reachable from it ordered by distance and node ID.
+	Elements []StoryElement `json:"elements" bson:"elements"`
+
+	// NodeID Identifier of the requested node.
+	NodeID string `json:"nodeID" bson:"nodeID"`
+
+	// Preload Media of the elements, nearest first, each URL once.
+	Preload []MediaPreload `json:"preload" bson:"preload"`
+
+	// StoryID Identifier of the story.
+	StoryID string `json:"storyID" bson:"storyID"`
+
+	// Truncated Whether nodes within the depth were left out to bound the response.
+	Truncated bool `json:"truncated" bson:"truncated"`
+}
+
 // StoryState defines model for StoryState.
 type StoryState struct {
+	// Completed Whether the player has reached an ending of the story.
+	Completed *bool `json:"completed,omitempty" bson:"completed,omitempty"`
+
+	// CompletedAt When the player reached the ending.
+	CompletedAt *time.Time `json:"completedAt,omitempty" bson:"completedAt,omitempty"`
+
 	// CurrentStoryNodeID Identifier of the current position in the story.
 	CurrentStoryNodeID string `json:"currentStoryNodeID" bson:"currentStoryNodeID"`
 
+	// Ending Marks a story element as a deliberate ending of the story.
+	Ending *Ending `json:"ending,omitempty" bson:"ending,omitempty"`
+
+	// EndingsDiscovered Every distinct ending the player has reached in the story.
+	EndingsDiscovered *[]DiscoveredEnding `json:"endingsDiscovered,omitempty" bson:"endingsDiscovered,omitempty"`
+
+	// GroupDecisions Choices made for the player by a party vote.
+	GroupDecisions *[]GroupDecision `json:"groupDecisions,omitempty" bson:"groupDecisions,omitempty"`
+
+	// PresentedAt When the player arrived at their current node, as recorded by the server. Starts the clock of a timed story element.
+	PresentedAt *time.Time `json:"presentedAt,omitempty" bson:"presentedAt,omitempty"`
+
+	// RngSeed Seed of the outcomes rolled in the story. Set by the server on the first roll so that a playthrough can be replayed, and never returned to players.
+	RngSeed *int64 `json:"rngSeed,omitempty" bson:"rngSeed,omitempty"`
+
+	// Rolls Outcomes rolled for the player's choices, in order. Recorded by the server.
+	Rolls *[]OutcomeRoll `json:"rolls,omitempty" bson:"rolls,omitempty"`
+
 	// StoryID Unique identifier for the story.
 	StoryID string `json:"storyID" bson:"storyID"`
 
@@ -79,8 +979,26 @@ type StoryState struct {
 	Wisdoms *[]Wisdom `json:"wisdoms,omitempty" bson:"wisdoms,omitempty"`
 }
 
+// TakeChoiceRequest defines model for TakeChoiceRequest.
+type TakeChoiceRequest struct {
+	// ChoiceIndex Index of the choice in the current story element's choices.
+	ChoiceIndex int `json:"choiceIndex" bson:"choiceIndex"`
+}
+
+// UnlockedAchievement defines model for UnlockedAchievement.
+type UnlockedAchievement struct {
+	// AchievementID Identifier of the unlocked achievement.
+	AchievementID string `json:"achievementID" bson:"achievementID"`
+
+	// UnlockedAt When the achievement was unlocked.
+	UnlockedAt time.Time `json:"unlockedAt" bson:"unlockedAt"`
+}
+
 // Wisdom defines model for Wisdom.
 type Wisdom struct {
+	// ArtAssetID Asset of the wisdom art. Takes the place of artURL.
+	ArtAssetID *string `json:"artAssetID,omitempty" bson:"artAssetID,omitempty"`
+
 	// Description Description of the wisdom.
 	Description *string `json:"description,omitempty" bson:"description,omitempty"`
 
@@ -100,8 +1018,35 @@ type PostPlayersJSONRequestBody = Player
 // PatchPlayersPlayerIdJSONRequestBody defines body for PatchPlayersPlayerId for application/json ContentType.
 type PatchPlayersPlayerIdJSONRequestBody = Player
 
+// PatchPlayersPlayerIdApplicationJSONPatchPlusJSONRequestBody defines body for PatchPlayersPlayerId for application/json-patch+json ContentType.
+type PatchPlayersPlayerIdApplicationJSONPatchPlusJSONRequestBody = JSONPatch
+
+// PatchPlayersPlayerIdApplicationMergePatchPlusJSONRequestBody defines body for PatchPlayersPlayerId for application/merge-patch+json ContentType.
+type PatchPlayersPlayerIdApplicationMergePatchPlusJSONRequestBody = Player
+
+// PostPlayersPlayerIdEntitlementsJSONRequestBody defines body for PostPlayersPlayerIdEntitlements for application/json ContentType.
+type PostPlayersPlayerIdEntitlementsJSONRequestBody = GrantEntitlementRequest
+
 // PostStoryElementsJSONRequestBody defines body for PostStoryElements for application/json ContentType.
 type PostStoryElementsJSONRequestBody = StoryElement
 
 // PatchStoryElementsNodeIdJSONRequestBody defines body for PatchStoryElementsNodeId for application/json ContentType.
 type PatchStoryElementsNodeIdJSONRequestBody = StoryElement
+
+// PatchStoryElementsNodeIdApplicationJSONPatchPlusJSONRequestBody defines body for PatchStoryElementsNodeId for application/json-patch+json ContentType.
+type PatchStoryElementsNodeIdApplicationJSONPatchPlusJSONRequestBody = JSONPatch
+
+// PatchStoryElementsNodeIdApplicationMergePatchPlusJSONRequestBody defines body for PatchStoryElementsNodeId for application/merge-patch+json ContentType.
+type PatchStoryElementsNodeIdApplicationMergePatchPlusJSONRequestBody = StoryElement
+
+// PostPlayersPlayerIdStoriesStoryIdChoicesJSONRequestBody defines body for PostPlayersPlayerIdStoriesStoryIdChoices for application/json ContentType.
+type PostPlayersPlayerIdStoriesStoryIdChoicesJSONRequestBody = TakeChoiceRequest
+
+// PostPartiesJSONRequestBody defines body for PostParties for application/json ContentType.
+type PostPartiesJSONRequestBody = CreatePartyRequest
+
+// PostPartiesPartyIdMembersJSONRequestBody defines body for PostPartiesPartyIdMembers for application/json ContentType.
+type PostPartiesPartyIdMembersJSONRequestBody = JoinPartyRequest
+
+// PostPartiesPartyIdVotesJSONRequestBody defines body for PostPartiesPartyIdVotes for application/json ContentType.
+type PostPartiesPartyIdVotesJSONRequestBody = CastVoteRequest
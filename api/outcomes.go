@@ -0,0 +1,124 @@
+package api
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"slices"
+
+	"github.com/okcthulhu/ChooseYourOwnAdventure/api/models"
+)
+
+// outcomeWeights returns the weight of each outcome of a choice after the
+// modifiers of the wisdoms held. Weights below zero count as zero. A nil holds
+// applies no modifiers.
+func outcomeWeights(outcomes []models.ChoiceOutcome, holds func(wisdomID string) bool) []int {
+	weights := make([]int, len(outcomes))
+	for i, outcome := range outcomes {
+		weight := outcome.Weight
+		if outcome.Modifiers != nil && holds != nil {
+			for _, modifier := range *outcome.Modifiers {
+				if holds(modifier.WisdomID) {
+					weight += modifier.Weight
+				}
+			}
+		}
+		weights[i] = max(weight, 0)
+	}
+	return weights
+}
+
+// rollOutcome rolls the outcome of a choice. The roll is the sequence-th of a
+// story state seeded with seed, and draws from a source seeded with both, so
+// that a playthrough is replayed by its seed and its choices alone. When no
+// outcome has a positive weight, the choice's own next node is taken. The node
+// and choice index of the returned roll are left for the caller to fill in.
+func rollOutcome(choice models.Choice, holds func(wisdomID string) bool, seed int64, sequence int) models.OutcomeRoll {
+	roll := models.OutcomeRoll{Sequence: sequence, NextNodeID: choice.NextNodeID, Weights: []int{}}
+	if choice.Outcomes == nil {
+		return roll
+	}
+	roll.Weights = outcomeWeights(*choice.Outcomes, holds)
+	total := 0
+	for _, weight := range roll.Weights {
+		total += weight
+	}
+	if total == 0 {
+		return roll
+	}
+
+	roll.Roll = rand.New(rand.NewSource(rollSeed(seed, sequence))).Intn(total)
+	for i, remaining := 0, roll.Roll; i < len(roll.Weights); i++ {
+		if remaining < roll.Weights[i] {
+			index := i
+			roll.OutcomeIndex = &index
+			roll.NextNodeID = (*choice.Outcomes)[i].NextNodeID
+			break
+		}
+		remaining -= roll.Weights[i]
+	}
+	return roll
+}
+
+// rollSeed mixes a seed with the sequence number of a roll with the SplitMix64
+// finalizer, so that consecutive rolls draw from unrelated sources.
+func rollSeed(seed int64, sequence int) int64 {
+	z := uint64(seed) + uint64(sequence+1)*0x9e3779b97f4a7c15
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	return int64(z ^ (z >> 31))
+}
+
+// choiceTargets returns the nodes a choice may lead to: its next node followed by
+// the nodes of its outcomes, without repeats.
+func choiceTargets(choice models.Choice) []string {
+	targets := []string{choice.NextNodeID}
+	if choice.Outcomes == nil {
+		return targets
+	}
+	for _, outcome := range *choice.Outcomes {
+		if !slices.Contains(targets, outcome.NextNodeID) {
+			targets = append(targets, outcome.NextNodeID)
+		}
+	}
+	return targets
+}
+
+// partySeed derives the seed of the outcomes rolled for a party from its ID.
+func partySeed(partyID string) int64 {
+	hash := fnv.New64a()
+	hash.Write([]byte(partyID))
+	return int64(hash.Sum64())
+}
+
+// validateOutcomes checks the chance outcomes of the choices of a story element:
+// a choice with outcomes needs at least one, each leading somewhere with a weight
+// of zero or more, and every modifier names a wisdom. The returned message is
+// empty when the element is valid.
+func validateOutcomes(storyElement *models.StoryElement) string {
+	if storyElement.Choices == nil {
+		return ""
+	}
+	for i, choice := range *storyElement.Choices {
+		if choice.Outcomes == nil {
+			continue
+		}
+		if len(*choice.Outcomes) == 0 {
+			return fmt.Sprintf("Choice %d has an empty list of outcomes", i)
+		}
+		for j, outcome := range *choice.Outcomes {
+			if outcome.NextNodeID == "" || outcome.Weight < 0 {
+				return fmt.Sprintf("Outcome %d of choice %d requires a nextNodeID and a weight of zero or more", j, i)
+			}
+			if outcome.Modifiers == nil {
+				continue
+			}
+			for _, modifier := range *outcome.Modifiers {
+				if modifier.WisdomID == "" {
+					return fmt.Sprintf("A modifier of outcome %d of choice %d has no wisdomID", j, i)
+				}
+			}
+		}
+	}
+	return ""
+}
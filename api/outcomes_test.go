@@ -0,0 +1,288 @@
+package api_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"github.com/okcthulhu/ChooseYourOwnAdventure/api"
+	"github.com/okcthulhu/ChooseYourOwnAdventure/api/models"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+// chanceChoice is a choice leading to "fallback" unless one of its outcomes is rolled.
+func chanceChoice(outcomes ...bson.D) bson.D {
+	docs := bson.A{}
+	for _, outcome := range outcomes {
+		docs = append(docs, outcome)
+	}
+	return bson.D{{Key: "description", Value: "Roll"}, {Key: "nextNodeID", Value: "fallback"}, {Key: "outcomes", Value: docs}}
+}
+
+func outcome(nextNodeID string, weight int, modifiers ...bson.D) bson.D {
+	document := bson.D{{Key: "nextNodeID", Value: nextNodeID}, {Key: "weight", Value: weight}}
+	if len(modifiers) > 0 {
+		docs := bson.A{}
+		for _, modifier := range modifiers {
+			docs = append(docs, modifier)
+		}
+		document = append(document, bson.E{Key: "modifiers", Value: docs})
+	}
+	return document
+}
+
+// withSeed sets the seed of the only story state of a player document.
+func withSeed(player bson.D, seed int64) bson.D {
+	for i, field := range player {
+		if field.Key == "storyStates" {
+			storyState := field.Value.(bson.A)[0].(bson.D)
+			player[i].Value = bson.A{append(storyState, bson.E{Key: "rngSeed", Value: seed})}
+		}
+	}
+	return player
+}
+
+// takeChanceChoice takes the first choice of the current element of a player,
+// answering the lookup of whichever node is rolled, and returns the response,
+// the node looked up and the update of the player.
+func takeChanceChoice(t *testing.T, mt *mtest.T, h *api.PlayerHandler, player bson.D, choice bson.D) (*httptest.ResponseRecorder, string, bson.Raw) {
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(choiceRequest(0), rec)
+	mt.AddMockResponses(
+		mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, player),
+		mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, storyElementDocument("s", "start", choice)),
+		mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, storyElementDocument("s", "next", bson.D{{Key: "description", Value: "On"}, {Key: "nextNodeID", Value: "x"}})),
+		matchedResponse(),
+	)
+
+	assert.NoError(t, h.TakeChoice(c, player[0].Value.(uuid.UUID).String(), "s"))
+
+	var lookedUp string
+	var update bson.Raw
+	finds := 0
+	for _, event := range mt.GetAllStartedEvents() {
+		switch event.CommandName {
+		case "find":
+			if finds++; finds == 3 {
+				lookedUp = event.Command.Lookup("filter", "nodeID").StringValue()
+			}
+		case "update":
+			update = event.Command.Lookup("updates").Array().Index(0).Value().Document().Lookup("u").Document()
+		}
+	}
+	return rec, lookedUp, update
+}
+
+func TestTakeChoice_Outcomes(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	// The outcome rolled with each seed, to compare across runs.
+	rolled := map[int64]string{}
+	for _, run := range []string{"first run", "replay"} {
+		mt.Run(run+" rolls the same outcomes", func(mt *mtest.T) {
+			h := api.NewPlayerHandler(mt.Coll, mt.Coll)
+			for seed := int64(1); seed <= 8; seed++ {
+				mt.ClearEvents()
+				player := withSeed(playerDocument(uuid.New(), "s", "start"), seed)
+				choice := chanceChoice(outcome("heads", 1), outcome("tails", 1))
+
+				rec, lookedUp, update := takeChanceChoice(t, mt, h, player, choice)
+
+				assert.Equal(t, http.StatusOK, rec.Code)
+				assert.Contains(t, []string{"heads", "tails"}, lookedUp)
+				assert.Equal(t, lookedUp, update.Lookup("$set", "storyStates.$.currentStoryNodeID").StringValue())
+				if previous, ok := rolled[seed]; ok {
+					assert.Equal(t, previous, lookedUp, "seed %d", seed)
+				}
+				rolled[seed] = lookedUp
+
+				roll := update.Lookup("$push", "storyStates.$.rolls").Document()
+				assert.Equal(t, lookedUp, roll.Lookup("nextNodeID").StringValue())
+				assert.Equal(t, "start", roll.Lookup("nodeID").StringValue())
+				assert.EqualValues(t, 0, roll.Lookup("sequence").AsInt64())
+				assert.Equal(t, seed, update.Lookup("$set", "storyStates.$.rngSeed").Int64())
+			}
+		})
+	}
+	assert.Contains(t, rolled, int64(1))
+	seen := map[string]bool{}
+	for _, nodeID := range rolled {
+		seen[nodeID] = true
+	}
+	assert.Len(t, seen, 2, "both outcomes come up across seeds")
+
+	mt.Run("wisdoms modify the weights", func(mt *mtest.T) {
+		h := api.NewPlayerHandler(mt.Coll, mt.Coll)
+		choice := chanceChoice(
+			outcome("lucky", 0, bson.D{{Key: "wisdomID", Value: "clover"}, {Key: "weight", Value: 5}}),
+			outcome("unlucky", 1, bson.D{{Key: "wisdomID", Value: "clover"}, {Key: "weight", Value: -3}}),
+		)
+
+		_, lookedUp, update := takeChanceChoice(t, mt, h, playerDocument(uuid.New(), "s", "start", "clover"), choice)
+
+		assert.Equal(t, "lucky", lookedUp)
+		roll := update.Lookup("$push", "storyStates.$.rolls").Document()
+		weights, _ := roll.Lookup("weights").Array().Values()
+		if assert.Len(t, weights, 2) {
+			assert.EqualValues(t, 5, weights[0].AsInt64())
+			assert.EqualValues(t, 0, weights[1].AsInt64(), "weights do not go below zero")
+		}
+		assert.EqualValues(t, 0, roll.Lookup("outcomeIndex").AsInt64())
+	})
+
+	mt.Run("no outcome possible", func(mt *mtest.T) {
+		h := api.NewPlayerHandler(mt.Coll, mt.Coll)
+		choice := chanceChoice(outcome("lucky", 0, bson.D{{Key: "wisdomID", Value: "clover"}, {Key: "weight", Value: 5}}))
+
+		_, lookedUp, update := takeChanceChoice(t, mt, h, playerDocument(uuid.New(), "s", "start"), choice)
+
+		assert.Equal(t, "fallback", lookedUp, "the choice's own next node is taken")
+		_, err := update.LookupErr("$push", "storyStates.$.rolls", "outcomeIndex")
+		assert.Error(t, err)
+	})
+
+	mt.Run("seed picked on the first roll", func(mt *mtest.T) {
+		h := api.NewPlayerHandler(mt.Coll, mt.Coll)
+		h.Seed = func() int64 { return 1234 }
+
+		_, _, update := takeChanceChoice(t, mt, h, playerDocument(uuid.New(), "s", "start"), chanceChoice(outcome("heads", 1)))
+
+		assert.Equal(t, int64(1234), update.Lookup("$set", "storyStates.$.rngSeed").Int64())
+	})
+
+	mt.Run("plain choices roll nothing", func(mt *mtest.T) {
+		h := api.NewPlayerHandler(mt.Coll, mt.Coll)
+
+		_, lookedUp, update := takeChanceChoice(t, mt, h, playerDocument(uuid.New(), "s", "start"),
+			bson.D{{Key: "description", Value: "On"}, {Key: "nextNodeID", Value: "next"}})
+
+		assert.Equal(t, "next", lookedUp)
+		_, err := update.LookupErr("$push", "storyStates.$.rolls")
+		assert.Error(t, err)
+		_, err = update.LookupErr("$set", "storyStates.$.rngSeed")
+		assert.Error(t, err)
+	})
+}
+
+func TestCreateStoryElement_InvalidOutcomes(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	cases := map[string]string{
+		"no outcomes":      `[]`,
+		"negative weight":  `[{"nextNodeID":"a","weight":-1}]`,
+		"nowhere to go":    `[{"weight":1}]`,
+		"anonymous wisdom": `[{"nextNodeID":"a","weight":1,"modifiers":[{"weight":2}]}]`,
+	}
+	for name, outcomes := range cases {
+		mt.Run(name, func(mt *mtest.T) {
+			body := `{"storyID":"s","nodeID":"n","content":"c","choices":[{"description":"Roll","nextNodeID":"b","outcomes":` + outcomes + `}]}`
+			req := httptest.NewRequest(http.MethodPost, "/", bytes.NewBufferString(body))
+			req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+			rec := httptest.NewRecorder()
+
+			api.NewStoryHandler(mt.Coll).CreateStoryElement(echo.New().NewContext(req, rec))
+
+			assert.Equal(t, http.StatusBadRequest, rec.Code)
+			assert.Empty(t, mt.GetAllStartedEvents())
+		})
+	}
+}
+
+func TestCastVote_Outcomes(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("outcome rolled for the party", func(mt *mtest.T) {
+		host := uuid.New()
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(jsonRequest(http.MethodPost, models.CastVoteRequest{WixID: host, ChoiceIndex: 0}), rec)
+
+		h := api.NewPartyHandler(mt.Coll, mt.Coll, mt.Coll)
+		node := storyElementDocument("s", "start", chanceChoice(outcome("fallback", 0), outcome("rolled", 1)))
+
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch,
+				partyDocument(host, []uuid.UUID{host}, models.PartyTieBreakLowestIndex, nil)),
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, node),
+			matchedResponse(),
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, node),
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, storyElementDocument("s", "rolled")),
+			matchedResponse(),
+			matchedResponse(),
+		)
+
+		h.CastVote(c, "p1")
+
+		assert.Equal(t, http.StatusOK, rec.Code)
+		var party models.Party
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &party))
+		assert.Equal(t, "rolled", party.CurrentNodeID)
+		if assert.NotNil(t, party.Decisions) && assert.Len(t, *party.Decisions, 1) {
+			decision := (*party.Decisions)[0]
+			assert.Equal(t, "rolled", decision.NextNodeID)
+			if assert.NotNil(t, decision.OutcomeIndex) {
+				assert.Equal(t, 1, *decision.OutcomeIndex)
+			}
+		}
+	})
+}
+
+func TestPlayerState_SeedsHidden(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("seed left out of the player", func(mt *mtest.T) {
+		wixID := uuid.New()
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/", nil), rec)
+
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, withSeed(playerDocument(wixID, "s", "start"), 7)))
+
+		api.NewPlayerHandler(mt.Coll, mt.Coll).GetPlayerStateByWixID(c, wixID.String())
+
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.NotContains(t, rec.Body.String(), "rngSeed")
+	})
+
+	mt.Run("seed cannot be set by a patch", func(mt *mtest.T) {
+		wixID := uuid.New()
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(patchRequest(api.MIMEJSONPatch,
+			`[{"op":"add","path":"/storyStates/0/rngSeed","value":8}]`), rec)
+
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, withSeed(playerDocument(wixID, "s", "start"), 7)))
+
+		api.NewPlayerHandler(mt.Coll, mt.Coll).PatchPlayerState(c, wixID.String())
+
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+		assert.Contains(t, rec.Body.String(), "rngSeed")
+		assert.Nil(t, playerUpdate(mt))
+	})
+
+	mt.Run("seed kept by a patch that leaves it out", func(mt *mtest.T) {
+		wixID := uuid.New()
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(patchRequest(api.MIMEMergePatch,
+			`{"storyStates":[{"storyID":"s","currentStoryNodeID":"start","wisdoms":[{"wisdomID":"w","name":"w"}]}]}`), rec)
+
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, withSeed(playerDocument(wixID, "s", "start"), 7)),
+			matchedResponse(),
+		)
+
+		api.NewPlayerHandler(mt.Coll, mt.Coll).PatchPlayerState(c, wixID.String())
+
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.NotContains(t, rec.Body.String(), "rngSeed")
+		update := playerUpdate(mt)
+		assert.NotContains(t, update.String(), "rngSeed")
+	})
+}
@@ -0,0 +1,39 @@
+package api
+
+import (
+	"encoding/base64"
+	"strconv"
+)
+
+const (
+	// defaultPageSize is the number of items a list endpoint returns when no limit is given.
+	defaultPageSize = 20
+
+	// maxPageSize is the largest limit a list endpoint accepts.
+	maxPageSize = 100
+)
+
+// parsePageLimit parses the limit query parameter of a list endpoint. An empty
+// value yields the default page size; anything outside 1..maxPageSize is rejected.
+func parsePageLimit(value string) (int, bool) {
+	if value == "" {
+		return defaultPageSize, true
+	}
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit < 1 || limit > maxPageSize {
+		return 0, false
+	}
+	return limit, true
+}
+
+// encodeCursor turns the sort key of the last item of a page into the opaque
+// cursor clients send back to fetch the next page.
+func encodeCursor(key string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(key))
+}
+
+// decodeCursor recovers the sort key from a cursor produced by encodeCursor.
+func decodeCursor(cursor string) (string, error) {
+	key, err := base64.RawURLEncoding.DecodeString(cursor)
+	return string(key), err
+}
@@ -0,0 +1,690 @@
+package api
+
+import (
+	"context"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"github.com/okcthulhu/ChooseYourOwnAdventure/api/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// defaultVoteTimeout applies when a party is created without a vote timeout.
+const defaultVoteTimeout = 60
+
+// PartyCollection defines the required behavior for interacting with
+// the party data in MongoDB. By isolating these methods, we can
+// easily swap out the actual MongoDB collection with a mock for testing.
+type PartyCollection interface {
+	// InsertOne adds a new party document.
+	InsertOne(ctx context.Context, document interface{}, opts ...*options.InsertOneOptions) (*mongo.InsertOneResult, error)
+
+	// FindOne looks up a single party matching the filter.
+	FindOne(ctx context.Context, filter interface{}, opts ...*options.FindOneOptions) *mongo.SingleResult
+
+	// UpdateOne applies membership, ballot and decision changes to a party.
+	UpdateOne(ctx context.Context, filter interface{}, update interface{},
+		opts ...*options.UpdateOptions) (*mongo.UpdateResult, error)
+}
+
+// PartyIndexes are the indexes the parties collection needs. Every request addresses
+// a party by its ID, which is unique.
+var PartyIndexes = []mongo.IndexModel{
+	{Keys: bson.D{{Key: "partyID", Value: 1}}, Options: options.Index().SetUnique(true)},
+}
+
+// PartyHandler serves the multiplayer "party" mode, in which several players
+// share one position in a story and vote on every choice.
+type PartyHandler struct {
+	// PartyCol is an abstraction for the MongoDB collection containing parties.
+	PartyCol PartyCollection
+
+	// PlayerCol is used to move every member's story state along with the party.
+	PlayerCol PlayerCollection
+
+	// StoryCol is used to look up the story elements the party moves between.
+	StoryCol StoryCollection
+
+	// Audit records every change to a party member's player. It may be nil.
+	Audit AuditRecorder
+
+	// Paywalls keep members who are not entitled to a story element from being
+	// moved into it. It may be nil, in which case nothing is locked.
+	Paywalls *Paywalls
+
+	// Intn picks the winner of a tie under the random tie-break rule.
+	Intn func(n int) int
+
+	// Timeouts bounds the storage calls of each operation.
+	Timeouts Timeouts
+
+	now func() time.Time
+}
+
+// NewPartyHandler creates a new PartyHandler backed by the given collections.
+func NewPartyHandler(partyCol PartyCollection, playerCol PlayerCollection, storyCol StoryCollection) *PartyHandler {
+	return &PartyHandler{
+		PartyCol:  partyCol,
+		PlayerCol: playerCol,
+		StoryCol:  storyCol,
+		Timeouts:  DefaultTimeouts,
+		Intn:      rand.Intn,
+		now:       time.Now,
+	}
+}
+
+// CreateParty starts a new party at the given node of a story with the host as its
+// only member. A host who has started the story must start the party at their current
+// node; one who has not starts the story at the party's node, which must be the
+// beginning of the story. A 409 status code is returned for any other node, and a 402
+// status code with the product that unlocks it if the host is not entitled to the node.
+func (h *PartyHandler) CreateParty(c echo.Context) error {
+	partyRequest := new(models.PostPartiesJSONRequestBody)
+	if err := c.Bind(partyRequest); err != nil {
+		return c.JSON(http.StatusBadRequest, "Failed to bind the request to the party")
+	}
+	if partyRequest.StoryID == "" || partyRequest.StartNodeID == "" {
+		return c.JSON(http.StatusBadRequest, "Story ID and start node ID are required")
+	}
+
+	party := models.Party{
+		PartyID:            uuid.NewString(),
+		StoryID:            partyRequest.StoryID,
+		HostWixID:          partyRequest.HostWixID,
+		Members:            []uuid.UUID{partyRequest.HostWixID},
+		CurrentNodeID:      partyRequest.StartNodeID,
+		Status:             models.PartyStatusActive,
+		VoteTimeoutSeconds: defaultVoteTimeout,
+		TieBreak:           models.PartyTieBreakLowestIndex,
+		CreatedAt:          h.now().UTC(),
+	}
+	if partyRequest.VoteTimeoutSeconds != nil {
+		if *partyRequest.VoteTimeoutSeconds <= 0 {
+			return c.JSON(http.StatusBadRequest, "Vote timeout must be positive")
+		}
+		party.VoteTimeoutSeconds = *partyRequest.VoteTimeoutSeconds
+	}
+	if partyRequest.TieBreak != nil {
+		party.TieBreak = models.PartyTieBreak(*partyRequest.TieBreak)
+		switch party.TieBreak {
+		case models.PartyTieBreakLowestIndex, models.PartyTieBreakRandom, models.PartyTieBreakHost:
+		default:
+			return c.JSON(http.StatusBadRequest, "Unknown tie-break rule")
+		}
+	}
+
+	ctx, cancel := h.Timeouts.context(c, "CreateParty")
+	defer cancel()
+
+	var start models.StoryElement
+	err := h.StoryCol.FindOne(ctx, bson.M{"storyID": party.StoryID, "nodeID": party.CurrentNodeID}).Decode(&start)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return c.JSON(http.StatusNotFound, "Story Element not found")
+		}
+		return storageError(c, err, "to load party start node", "Failed to create party")
+	}
+
+	var host models.Player
+	if err := h.PlayerCol.FindOne(ctx, bson.M{"wixID": binaryWixID(party.HostWixID)}).Decode(&host); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return c.JSON(http.StatusNotFound, "Player not found")
+		}
+		return storageError(c, err, "to load party host", "Failed to create party")
+	}
+	if status, message := h.checkEntry(ctx, &host, &start); status != 0 {
+		return c.JSON(status, message)
+	}
+	if locked := h.Paywalls.lockFor(&start, &host, h.now()); locked != nil {
+		return c.JSON(http.StatusPaymentRequired, locked)
+	}
+
+	if err := h.enterParty(ctx, models.AuditActionPlayerCreatedParty, &host, &start); err != nil {
+		return storageError(c, err, "to move host into party", "Failed to create party")
+	}
+
+	if _, err := h.PartyCol.InsertOne(ctx, party); err != nil {
+		return storageError(c, err, "to insert party", "Failed to create party")
+	}
+
+	return c.JSON(http.StatusCreated, party)
+}
+
+// GetParty returns a party. If the open vote's deadline has passed it is decided
+// first, so the party is always returned in its current state. A vote leading to a
+// story element that a member is not entitled to stays open.
+func (h *PartyHandler) GetParty(c echo.Context, partyID string) error {
+	ctx, cancel := h.Timeouts.context(c, "GetParty")
+	defer cancel()
+
+	party, status, message := h.loadParty(ctx, partyID)
+	if party == nil {
+		return c.JSON(status, message)
+	}
+
+	if party.Vote != nil && !h.now().Before(party.Vote.Deadline) {
+		resolved, status, body := h.resolveVote(ctx, party)
+		if resolved == nil && status != http.StatusPaymentRequired && status != http.StatusConflict {
+			return c.JSON(status, body)
+		}
+		// A vote leading where a member may not go stays open, and one left without
+		// ballots for the node's choices is cleared.
+		if resolved != nil {
+			party = resolved
+		}
+	}
+
+	return c.JSON(http.StatusOK, party)
+}
+
+// JoinParty adds a player to an active party. The player must be at the party's node, or
+// have not started the story while the party is still at its beginning; a 409 status code
+// is returned otherwise. A player not entitled to the node gets a 402 status code with the
+// product that unlocks it.
+func (h *PartyHandler) JoinParty(c echo.Context, partyID string) error {
+	joinRequest := new(models.PostPartiesPartyIdMembersJSONRequestBody)
+	if err := c.Bind(joinRequest); err != nil {
+		return c.JSON(http.StatusBadRequest, "Failed to bind the request to the party member")
+	}
+
+	ctx, cancel := h.Timeouts.context(c, "JoinParty")
+	defer cancel()
+
+	party, status, message := h.loadParty(ctx, partyID)
+	if party == nil {
+		return c.JSON(status, message)
+	}
+	if party.Status != models.PartyStatusActive {
+		return c.JSON(http.StatusConflict, "Party has finished")
+	}
+
+	var current models.StoryElement
+	err := h.StoryCol.FindOne(ctx, bson.M{"storyID": party.StoryID, "nodeID": party.CurrentNodeID}).Decode(&current)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return c.JSON(http.StatusNotFound, "Story Element not found")
+		}
+		return storageError(c, err, "to load party node", "Failed to join party")
+	}
+
+	var member models.Player
+	if err := h.PlayerCol.FindOne(ctx, bson.M{"wixID": binaryWixID(joinRequest.WixID)}).Decode(&member); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return c.JSON(http.StatusNotFound, "Player not found")
+		}
+		return storageError(c, err, "to load party member", "Failed to join party")
+	}
+	if status, message := h.checkEntry(ctx, &member, &current); status != 0 {
+		return c.JSON(status, message)
+	}
+	if locked := h.Paywalls.lockFor(&current, &member, h.now()); locked != nil {
+		return c.JSON(http.StatusPaymentRequired, locked)
+	}
+
+	if err := h.enterParty(ctx, models.AuditActionPlayerJoinedParty, &member, &current); err != nil {
+		return storageError(c, err, "to move member into party", "Failed to join party")
+	}
+
+	update := bson.M{"$addToSet": bson.M{"members": joinRequest.WixID}}
+	if _, err := h.PartyCol.UpdateOne(ctx, bson.M{"partyID": partyID}, update); err != nil {
+		return storageError(c, err, "to add party member", "Failed to join party")
+	}
+
+	if !isMember(party, joinRequest.WixID) {
+		party.Members = append(party.Members, joinRequest.WixID)
+	}
+	return c.JSON(http.StatusOK, party)
+}
+
+// CastVote records a member's ballot for one of the choices at the party's current node.
+// The first ballot opens the vote and starts its timeout. The vote is decided as soon as
+// every member has voted, or on the first interaction after the deadline; the winning
+// choice then advances the party and every member's story state, and is recorded as
+// taken by each of them. Ballots for choices the node no longer offers are discarded,
+// and a vote left without any gets a 409 status code.
+func (h *PartyHandler) CastVote(c echo.Context, partyID string) error {
+	voteRequest := new(models.PostPartiesPartyIdVotesJSONRequestBody)
+	if err := c.Bind(voteRequest); err != nil {
+		return c.JSON(http.StatusBadRequest, "Failed to bind the request to the vote")
+	}
+
+	ctx, cancel := h.Timeouts.context(c, "CastVote")
+	defer cancel()
+
+	party, status, message := h.loadParty(ctx, partyID)
+	if party == nil {
+		return c.JSON(status, message)
+	}
+
+	// A vote whose deadline passed is decided before this ballot is considered.
+	if party.Vote != nil && !h.now().Before(party.Vote.Deadline) {
+		if resolved, status, body := h.resolveVote(ctx, party); resolved == nil {
+			return c.JSON(status, body)
+		}
+		return c.JSON(http.StatusConflict, "The vote closed before this ballot was cast")
+	}
+
+	if party.Status != models.PartyStatusActive {
+		return c.JSON(http.StatusConflict, "Party has finished")
+	}
+	if !isMember(party, voteRequest.WixID) {
+		return c.JSON(http.StatusForbidden, "Player is not a member of the party")
+	}
+
+	var current models.StoryElement
+	err := h.StoryCol.FindOne(ctx, bson.M{"storyID": party.StoryID, "nodeID": party.CurrentNodeID}).Decode(&current)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return c.JSON(http.StatusNotFound, "Story Element not found")
+		}
+		return storageError(c, err, "to load party node", "An error occurred")
+	}
+	if current.Choices == nil || voteRequest.ChoiceIndex < 0 || voteRequest.ChoiceIndex >= len(*current.Choices) {
+		return c.JSON(http.StatusBadRequest, "Invalid choice index")
+	}
+
+	choice := (*current.Choices)[voteRequest.ChoiceIndex]
+	if choice.WisdomID != nil {
+		var voter models.Player
+		if err := h.PlayerCol.FindOne(ctx, bson.M{"wixID": binaryWixID(voteRequest.WixID)}).Decode(&voter); err != nil {
+			return c.JSON(http.StatusNotFound, "Player not found")
+		}
+		storyState := findStoryState(&voter, party.StoryID)
+		if storyState == nil || !holdsWisdom(storyState, *choice.WisdomID) {
+			return c.JSON(http.StatusForbidden, "Choice requires a wisdom the player does not hold")
+		}
+	}
+
+	// The round guards against the vote having been decided since the party was loaded.
+	now := h.now().UTC()
+	filter := bson.M{"partyID": partyID, "round": party.Round}
+	var update bson.M
+	if party.Vote == nil {
+		party.Vote = &models.PartyVote{
+			NodeID:   party.CurrentNodeID,
+			OpenedAt: now,
+			Deadline: now.Add(time.Duration(party.VoteTimeoutSeconds) * time.Second),
+			Ballots:  map[string]int{},
+		}
+		party.Vote.Ballots[voteRequest.WixID.String()] = voteRequest.ChoiceIndex
+		filter["vote"] = nil
+		update = bson.M{"$set": bson.M{"vote": party.Vote}}
+	} else {
+		party.Vote.Ballots[voteRequest.WixID.String()] = voteRequest.ChoiceIndex
+		update = bson.M{"$set": bson.M{"vote.ballots." + voteRequest.WixID.String(): voteRequest.ChoiceIndex}}
+	}
+
+	result, err := h.PartyCol.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return storageError(c, err, "to record ballot", "Failed to cast vote")
+	}
+	if result.MatchedCount == 0 {
+		return c.JSON(http.StatusConflict, "The vote changed while this ballot was cast, please retry")
+	}
+
+	if len(party.Vote.Ballots) >= len(party.Members) {
+		resolved, status, body := h.resolveVote(ctx, party)
+		if resolved == nil {
+			return c.JSON(status, body)
+		}
+		party = resolved
+	}
+
+	return c.JSON(http.StatusOK, party)
+}
+
+// resolveVote decides the party's open vote, advances the party and every member,
+// and returns the updated party. The vote stays open while a member is not entitled
+// to the node it leads to, and the locked response names the product that unlocks it.
+// A vote without ballots for the choices the node still offers is cleared with a 409.
+// On failure the party is nil and the status code and body describe the error.
+func (h *PartyHandler) resolveVote(ctx context.Context, party *models.Party) (*models.Party, int, interface{}) {
+	var current models.StoryElement
+	err := h.StoryCol.FindOne(ctx, bson.M{"storyID": party.StoryID, "nodeID": party.Vote.NodeID}).Decode(&current)
+	if err != nil {
+		status, message := storageFailure(ctx, err, "to load party node for vote resolution", "Failed to resolve vote")
+		return nil, status, message
+	}
+	if current.Choices == nil {
+		slog.WarnContext(ctx, "Party node offers no choices to resolve the vote with", "storyID", party.StoryID, "nodeID", party.Vote.NodeID)
+		return nil, http.StatusInternalServerError, "Failed to resolve vote"
+	}
+
+	choiceIndex, tieBroken := h.tally(party, len(*current.Choices))
+	if choiceIndex < 0 {
+		// No ballot names a choice the node still offers; the next ballot opens a new vote.
+		filter := bson.M{"partyID": party.PartyID, "round": party.Round, "vote.openedAt": party.Vote.OpenedAt}
+		if _, err := h.PartyCol.UpdateOne(ctx, filter, bson.M{"$set": bson.M{"vote": nil}}); err != nil {
+			status, message := storageFailure(ctx, err, "to clear party vote", "Failed to resolve vote")
+			return nil, status, message
+		}
+		party.Vote = nil
+		return nil, http.StatusConflict, "The choices of the node changed since the ballots were cast, please vote again"
+	}
+	choice := (*current.Choices)[choiceIndex]
+
+	// Members hold different wisdoms, so the outcomes of a party's choices are rolled unmodified.
+	nextNodeID := choice.NextNodeID
+	var outcomeIndex *int
+	if choice.Outcomes != nil {
+		rolled := rollOutcome(choice, nil, partySeed(party.PartyID), party.Round)
+		nextNodeID, outcomeIndex = rolled.NextNodeID, rolled.OutcomeIndex
+	}
+
+	var next models.StoryElement
+	err = h.StoryCol.FindOne(ctx, bson.M{"storyID": party.StoryID, "nodeID": nextNodeID}).Decode(&next)
+	if err != nil {
+		status, message := storageFailure(ctx, err, "to load next party node", "Failed to resolve vote")
+		return nil, status, message
+	}
+	locked, err := h.lockedFor(ctx, &next, party.Members)
+	if err != nil {
+		status, message := storageFailure(ctx, err, "to check the members' entitlements", "Failed to resolve vote")
+		return nil, status, message
+	}
+	if locked != nil {
+		return nil, http.StatusPaymentRequired, locked
+	}
+
+	var granted []models.Wisdom
+	if next.Wisdoms != nil {
+		for _, wisdom := range *next.Wisdoms {
+			granted = append(granted, wisdom)
+		}
+		sort.Slice(granted, func(i, j int) bool { return granted[i].WisdomID < granted[j].WisdomID })
+	}
+
+	decision := models.GroupDecision{
+		PartyID:      party.PartyID,
+		NodeID:       current.NodeID,
+		ChoiceIndex:  choiceIndex,
+		NextNodeID:   next.NodeID,
+		OutcomeIndex: outcomeIndex,
+		Ballots:      party.Vote.Ballots,
+		TieBroken:    &tieBroken,
+		DecidedAt:    h.now().UTC(),
+	}
+	if len(granted) > 0 {
+		decision.GrantedWisdoms = &granted
+	}
+
+	completed := next.Ending != nil
+	status := models.PartyStatusActive
+	if completed || next.Choices == nil || len(*next.Choices) == 0 {
+		status = models.PartyStatusFinished
+	}
+
+	// Only the first resolver of a round advances the party.
+	filter := bson.M{"partyID": party.PartyID, "round": party.Round}
+	update := bson.M{
+		"$set": bson.M{
+			"currentNodeID": next.NodeID,
+			"status":        status,
+			"vote":          nil,
+		},
+		"$inc":  bson.M{"round": 1},
+		"$push": bson.M{"decisions": decision},
+	}
+	result, err := h.PartyCol.UpdateOne(ctx, filter, update)
+	if err != nil {
+		status, message := storageFailure(ctx, err, "to store party decision", "Failed to resolve vote")
+		return nil, status, message
+	}
+	if result.MatchedCount == 0 {
+		reloaded, status, message := h.loadParty(ctx, party.PartyID)
+		return reloaded, status, message
+	}
+
+	// The decision is stored; every member follows it even if the client has gone away.
+	ctx, cancel := h.Timeouts.detached(ctx)
+	defer cancel()
+	for _, member := range party.Members {
+		if err := h.applyDecision(ctx, member, decision, &current, &next, granted); err != nil {
+			slog.ErrorContext(ctx, "Failed to apply party decision to member", "partyID", party.PartyID, "wixID", member, "error", err)
+		}
+	}
+
+	party.CurrentNodeID = next.NodeID
+	party.Status = status
+	party.Vote = nil
+	party.Round++
+	decisions := []models.GroupDecision{}
+	if party.Decisions != nil {
+		decisions = *party.Decisions
+	}
+	decisions = append(decisions, decision)
+	party.Decisions = &decisions
+
+	return party, http.StatusOK, ""
+}
+
+// tally returns the winning choice of the party's vote and whether the tie-break rule
+// decided it. Ballots for choices the node no longer offers are discarded; when none
+// remain, the returned choice is -1.
+func (h *PartyHandler) tally(party *models.Party, choices int) (int, bool) {
+	counts := map[int]int{}
+	for _, choiceIndex := range party.Vote.Ballots {
+		if choiceIndex >= 0 && choiceIndex < choices {
+			counts[choiceIndex]++
+		}
+	}
+	if len(counts) == 0 {
+		return -1, false
+	}
+
+	best := 0
+	var leaders []int
+	for choiceIndex, count := range counts {
+		switch {
+		case count > best:
+			best = count
+			leaders = []int{choiceIndex}
+		case count == best:
+			leaders = append(leaders, choiceIndex)
+		}
+	}
+	sort.Ints(leaders)
+	if len(leaders) == 1 {
+		return leaders[0], false
+	}
+
+	switch party.TieBreak {
+	case models.PartyTieBreakRandom:
+		return leaders[h.Intn(len(leaders))], true
+	case models.PartyTieBreakHost:
+		if hostChoice, voted := party.Vote.Ballots[party.HostWixID.String()]; voted {
+			for _, leader := range leaders {
+				if leader == hostChoice {
+					return hostChoice, true
+				}
+			}
+		}
+	}
+	return leaders[0], true
+}
+
+// checkEntry checks that a player may enter a party at a story element: a player
+// who has started the story must be at the element, and one who has not may only
+// start at the beginning of the story, an element no choice leads to. It returns
+// the status code and message to refuse the player with, or 0 if they may enter.
+func (h *PartyHandler) checkEntry(ctx context.Context, player *models.Player, storyElement *models.StoryElement) (int, string) {
+	if storyState := findStoryState(player, storyElement.StoryID); storyState != nil {
+		if storyState.CurrentStoryNodeID != storyElement.NodeID {
+			return http.StatusConflict, "Player is at another node of the story"
+		}
+		return 0, ""
+	}
+
+	beginning, err := storyBeginning(ctx, h.StoryCol, storyElement.StoryID, storyElement.NodeID)
+	if err != nil {
+		return storageFailure(ctx, err, "to look up choices leading to the party node", "An error occurred")
+	}
+	if !beginning {
+		return http.StatusConflict, "Players who have not started the story can only enter it at its beginning"
+	}
+	return 0, ""
+}
+
+// enterParty starts the story for a player entering a party at its beginning; a
+// player who has started the story is already at the party's node, as checked by
+// checkEntry. The entry is recorded in the audit log under the given action.
+func (h *PartyHandler) enterParty(ctx context.Context, action models.AuditAction, player *models.Player, storyElement *models.StoryElement) error {
+	if findStoryState(player, storyElement.StoryID) == nil {
+		now := h.now().UTC()
+		storyState := models.StoryState{StoryID: storyElement.StoryID, CurrentStoryNodeID: storyElement.NodeID, PresentedAt: &now}
+		// The story must not have been started since the player was read.
+		filter := bson.M{"wixID": binaryWixID(player.WixID), "storyStates.storyID": bson.M{"$ne": storyElement.StoryID}}
+		update := bson.M{"$push": bson.M{"storyStates": storyState}, "$set": bson.M{"updatedAt": now}}
+		if _, err := h.PlayerCol.UpdateOne(ctx, filter, update); err != nil {
+			return err
+		}
+	}
+
+	h.auditMember(ctx, action, player.WixID, storyElement.StoryID, storyElement.NodeID, player)
+	return nil
+}
+
+// applyDecision moves a member from the current node to the next one, records the
+// decision in their story state and grants the wisdoms of the node they entered. If
+// the node is an ending, the story is marked as completed there. The events of the
+// move, the choice taken included, are staged on the member with it.
+func (h *PartyHandler) applyDecision(ctx context.Context, wixID uuid.UUID, decision models.GroupDecision, current, next *models.StoryElement, granted []models.Wisdom) error {
+	before := h.memberBefore(ctx, wixID)
+
+	storyID, ending := current.StoryID, next.Ending
+	filter := bson.M{"wixID": binaryWixID(wixID), "storyStates.storyID": storyID}
+	set := bson.M{
+		"storyStates.$.currentStoryNodeID": decision.NextNodeID,
+		"storyStates.$.presentedAt":        decision.DecidedAt,
+		"updatedAt":                        decision.DecidedAt,
+	}
+	if ending != nil {
+		markCompleted(set, ending, decision.DecidedAt)
+	}
+	update := bson.M{
+		"$set":  set,
+		"$push": bson.M{"storyStates.$.groupDecisions": decision},
+	}
+	if len(granted) > 0 {
+		update["$addToSet"] = bson.M{"storyStates.$.wisdoms": bson.M{"$each": granted}}
+	}
+	completed := ending != nil
+	gated := (*current.Choices)[decision.ChoiceIndex].WisdomID != nil
+	choiceEvent := models.ChoiceEvent{
+		StoryID:         storyID,
+		WixID:           wixID,
+		FromNodeID:      decision.NodeID,
+		ToNodeID:        decision.NextNodeID,
+		ChoiceIndex:     decision.ChoiceIndex,
+		ChapterName:     current.ChapterName,
+		NextChapterName: next.ChapterName,
+		Completed:       &completed,
+		Gated:           &gated,
+		OccurredAt:      decision.DecidedAt,
+	}
+	raised := []models.DomainEvent{
+		{Type: models.ChoiceTaken, WixID: &wixID, StoryID: &storyID, NodeID: &decision.NodeID, Choice: &choiceEvent},
+		{Type: models.NodeEntered, WixID: &wixID, StoryID: &storyID, NodeID: &decision.NextNodeID},
+	}
+	for i := range granted {
+		raised = append(raised, models.DomainEvent{Type: models.WisdomGranted, WixID: &wixID, StoryID: &storyID, Wisdom: &granted[i]})
+	}
+	if ending != nil {
+		raised = append(raised, models.DomainEvent{Type: models.StoryCompleted, WixID: &wixID, StoryID: &storyID, NodeID: &decision.NextNodeID, Ending: ending})
+	}
+	stageEvents(update, raised...)
+	if _, err := h.PlayerCol.UpdateOne(ctx, filter, update); err != nil {
+		return err
+	}
+	if ending != nil {
+		if _, err := discoverEnding(ctx, h.PlayerCol, wixID, storyID, decision.NextNodeID, *ending, decision.DecidedAt); err != nil {
+			return err
+		}
+	}
+
+	h.auditMember(ctx, models.AuditActionPlayerPartyDecision, wixID, storyID, decision.NextNodeID, before)
+	return nil
+}
+
+// loadParty fetches a party by its public ID. On failure the party is nil and the
+// status code and message describe the error.
+func (h *PartyHandler) loadParty(ctx context.Context, partyID string) (*models.Party, int, string) {
+	var party models.Party
+	if err := h.PartyCol.FindOne(ctx, bson.M{"partyID": partyID}).Decode(&party); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, http.StatusNotFound, "Party not found"
+		}
+		status, message := storageFailure(ctx, err, "to load party", "An error occurred")
+		return nil, status, message
+	}
+	return &party, http.StatusOK, ""
+}
+
+// lockedFor returns the locked response of a story element for the first of the
+// players not entitled to it, or nil if they all are. Players who do not exist are
+// left to the caller.
+func (h *PartyHandler) lockedFor(ctx context.Context, storyElement *models.StoryElement, wixIDs []uuid.UUID) (*models.LockedContent, error) {
+	if h.Paywalls.productFor(storyElement) == "" {
+		return nil, nil
+	}
+	now := h.now()
+	for _, wixID := range wixIDs {
+		var player models.Player
+		err := h.PlayerCol.FindOne(ctx, bson.M{"wixID": binaryWixID(wixID)}).Decode(&player)
+		if err == mongo.ErrNoDocuments {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if locked := h.Paywalls.lockFor(storyElement, &player, now); locked != nil {
+			return locked, nil
+		}
+	}
+	return nil, nil
+}
+
+// memberBefore reads a party member about to be changed, so that the audit log can
+// summarize them as they were. It is nil if there is no audit log.
+func (h *PartyHandler) memberBefore(ctx context.Context, wixID uuid.UUID) *models.Player {
+	if h.Audit == nil {
+		return nil
+	}
+	return loadAudited(ctx, h.PlayerCol, h.Timeouts, wixID)
+}
+
+// auditMember records a change to a party member in the audit log, if there is
+// one, reading the member back to summarize the state the change left them in.
+func (h *PartyHandler) auditMember(ctx context.Context, action models.AuditAction, wixID uuid.UUID, storyID string, nodeID string, before *models.Player) {
+	if h.Audit == nil {
+		return
+	}
+	entry := playerChange(action, wixID, before, loadAudited(ctx, h.PlayerCol, h.Timeouts, wixID))
+	entry.StoryID, entry.NodeID = &storyID, &nodeID
+	h.Audit.Record(ctx, entry)
+}
+
+func isMember(party *models.Party, wixID uuid.UUID) bool {
+	for _, member := range party.Members {
+		if member == wixID {
+			return true
+		}
+	}
+	return false
+}
+
+// binaryWixID converts a WixID into the BSON binary form players are stored with.
+func binaryWixID(wixID uuid.UUID) primitive.Binary {
+	return primitive.Binary{
+		Subtype: 0x04,
+		Data:    wixID[:],
+	}
+}
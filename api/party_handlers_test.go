@@ -0,0 +1,438 @@
+package api_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"github.com/okcthulhu/ChooseYourOwnAdventure/api"
+	"github.com/okcthulhu/ChooseYourOwnAdventure/api/models"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func jsonRequest(method string, body interface{}) *http.Request {
+	payload, _ := json.Marshal(body)
+	req := httptest.NewRequest(method, "/", bytes.NewBuffer(payload))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	return req
+}
+
+func matchedResponse() bson.D {
+	return mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}, bson.E{Key: "nModified", Value: 1})
+}
+
+func partyDocument(host uuid.UUID, members []uuid.UUID, tieBreak models.PartyTieBreak, ballots bson.D) bson.D {
+	memberValues := bson.A{}
+	for _, member := range members {
+		memberValues = append(memberValues, member)
+	}
+	doc := bson.D{
+		{Key: "partyID", Value: "p1"},
+		{Key: "storyID", Value: "s"},
+		{Key: "hostWixID", Value: host},
+		{Key: "members", Value: memberValues},
+		{Key: "currentNodeID", Value: "start"},
+		{Key: "status", Value: string(models.PartyStatusActive)},
+		{Key: "voteTimeoutSeconds", Value: 60},
+		{Key: "tieBreak", Value: string(tieBreak)},
+		{Key: "round", Value: 0},
+		{Key: "createdAt", Value: time.Now()},
+	}
+	if ballots != nil {
+		doc = append(doc, bson.E{Key: "vote", Value: bson.D{
+			{Key: "nodeID", Value: "start"},
+			{Key: "openedAt", Value: time.Now()},
+			{Key: "deadline", Value: time.Now().Add(time.Minute)},
+			{Key: "ballots", Value: ballots},
+		}})
+	}
+	return doc
+}
+
+func twoWayNode() bson.D {
+	return storyElementDocument("s", "start",
+		bson.D{{Key: "description", Value: "Left"}, {Key: "nextNodeID", Value: "left"}},
+		bson.D{{Key: "description", Value: "Right"}, {Key: "nextNodeID", Value: "right"}},
+	)
+}
+
+// CreateParty
+
+func TestCreateParty_Created(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("party created", func(mt *mtest.T) {
+		host := uuid.New()
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(jsonRequest(http.MethodPost, models.CreatePartyRequest{
+			StoryID:     "s",
+			StartNodeID: "start",
+			HostWixID:   host,
+		}), rec)
+
+		h := api.NewPartyHandler(mt.Coll, mt.Coll, mt.Coll)
+
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, twoWayNode()),
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, playerDocument(host, "s", "start")),
+			mtest.CreateSuccessResponse(),
+		)
+
+		err := h.CreateParty(c)
+
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusCreated, rec.Code)
+		var party models.Party
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &party))
+		assert.Equal(t, []uuid.UUID{host}, party.Members)
+		assert.Equal(t, models.PartyTieBreakLowestIndex, party.TieBreak)
+		assert.Equal(t, 60, party.VoteTimeoutSeconds)
+	})
+}
+
+func TestCreateParty_Entry(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	createRequest := func(host uuid.UUID) *http.Request {
+		return jsonRequest(http.MethodPost, models.CreatePartyRequest{StoryID: "s", StartNodeID: "start", HostWixID: host})
+	}
+
+	mt.Run("host elsewhere in the story", func(mt *mtest.T) {
+		host := uuid.New()
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(createRequest(host), rec)
+
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, twoWayNode()),
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, playerDocument(host, "s", "left")),
+		)
+
+		api.NewPartyHandler(mt.Coll, mt.Coll, mt.Coll).CreateParty(c)
+
+		assert.Equal(t, http.StatusConflict, rec.Code)
+		for _, event := range mt.GetAllStartedEvents() {
+			assert.NotEqual(t, "insert", event.CommandName)
+		}
+	})
+
+	mt.Run("new player starts at the beginning", func(mt *mtest.T) {
+		host := uuid.New()
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(createRequest(host), rec)
+
+		audit := &recordedAudit{}
+		h := api.NewPartyHandler(mt.Coll, mt.Coll, mt.Coll)
+		h.Audit = audit
+
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, twoWayNode()),
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, playerDocument(host, "other", "start")),
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch),
+			matchedResponse(),
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, playerDocument(host, "s", "start")),
+			mtest.CreateSuccessResponse(),
+		)
+
+		h.CreateParty(c)
+
+		assert.Equal(t, http.StatusCreated, rec.Code)
+		var update bson.Raw
+		for _, event := range mt.GetAllStartedEvents() {
+			if event.CommandName == "update" {
+				update = event.Command.Lookup("updates").Array().Index(0).Value().Document().Lookup("u").Document()
+			}
+		}
+		if assert.NotNil(t, update) {
+			assert.Equal(t, "start", update.Lookup("$push", "storyStates", "currentStoryNodeID").StringValue())
+		}
+		if assert.Len(t, audit.entries, 1) {
+			assert.Equal(t, models.AuditActionPlayerCreatedParty, audit.entries[0].Action)
+		}
+	})
+
+	mt.Run("new player in the middle of the story", func(mt *mtest.T) {
+		host := uuid.New()
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(createRequest(host), rec)
+
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, twoWayNode()),
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, playerDocument(host, "other", "start")),
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, storyElementDocument("s", "prologue",
+				bson.D{{Key: "description", Value: "On"}, {Key: "nextNodeID", Value: "start"}})),
+		)
+
+		api.NewPartyHandler(mt.Coll, mt.Coll, mt.Coll).CreateParty(c)
+
+		assert.Equal(t, http.StatusConflict, rec.Code)
+	})
+}
+
+// JoinParty
+
+func TestJoinParty_Entry(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("member at the party's node", func(mt *mtest.T) {
+		host, guest := uuid.New(), uuid.New()
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(jsonRequest(http.MethodPost, models.JoinPartyRequest{WixID: guest}), rec)
+
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, partyDocument(host, []uuid.UUID{host}, models.PartyTieBreakLowestIndex, nil)),
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, twoWayNode()),
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, playerDocument(guest, "s", "start")),
+			matchedResponse(),
+		)
+
+		api.NewPartyHandler(mt.Coll, mt.Coll, mt.Coll).JoinParty(c, "p1")
+
+		assert.Equal(t, http.StatusOK, rec.Code)
+		var party models.Party
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &party))
+		assert.Equal(t, []uuid.UUID{host, guest}, party.Members)
+	})
+
+	mt.Run("member elsewhere in the story", func(mt *mtest.T) {
+		host, guest := uuid.New(), uuid.New()
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(jsonRequest(http.MethodPost, models.JoinPartyRequest{WixID: guest}), rec)
+
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, partyDocument(host, []uuid.UUID{host}, models.PartyTieBreakLowestIndex, nil)),
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, twoWayNode()),
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, playerDocument(guest, "s", "prologue")),
+		)
+
+		api.NewPartyHandler(mt.Coll, mt.Coll, mt.Coll).JoinParty(c, "p1")
+
+		assert.Equal(t, http.StatusConflict, rec.Code)
+		for _, event := range mt.GetAllStartedEvents() {
+			assert.NotEqual(t, "update", event.CommandName)
+		}
+	})
+}
+
+func TestCreateParty_UnknownTieBreak(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("unknown tie-break rule", func(mt *mtest.T) {
+		tieBreak := models.CreatePartyRequestTieBreak("coinToss")
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(jsonRequest(http.MethodPost, models.CreatePartyRequest{
+			StoryID:     "s",
+			StartNodeID: "start",
+			HostWixID:   uuid.New(),
+			TieBreak:    &tieBreak,
+		}), rec)
+
+		h := api.NewPartyHandler(mt.Coll, mt.Coll, mt.Coll)
+		h.CreateParty(c)
+
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+		assert.Contains(t, rec.Body.String(), "Unknown tie-break rule")
+	})
+}
+
+// CastVote
+
+func TestCastVote_OpensVote(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("first ballot opens the vote", func(mt *mtest.T) {
+		host, guest := uuid.New(), uuid.New()
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(jsonRequest(http.MethodPost, models.CastVoteRequest{WixID: guest, ChoiceIndex: 1}), rec)
+
+		h := api.NewPartyHandler(mt.Coll, mt.Coll, mt.Coll)
+
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, partyDocument(host, []uuid.UUID{host, guest}, models.PartyTieBreakLowestIndex, nil)),
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, twoWayNode()),
+			matchedResponse(),
+		)
+
+		err := h.CastVote(c, "p1")
+
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, rec.Code)
+		var party models.Party
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &party))
+		if assert.NotNil(t, party.Vote) {
+			assert.Equal(t, map[string]int{guest.String(): 1}, party.Vote.Ballots)
+			assert.Equal(t, time.Minute, party.Vote.Deadline.Sub(party.Vote.OpenedAt))
+		}
+		assert.Equal(t, 0, party.Round)
+	})
+}
+
+func TestCastVote_LastBallotDecidesVote(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("host breaks the tie", func(mt *mtest.T) {
+		host, guest := uuid.New(), uuid.New()
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(jsonRequest(http.MethodPost, models.CastVoteRequest{WixID: guest, ChoiceIndex: 0}), rec)
+
+		h := api.NewPartyHandler(mt.Coll, mt.Coll, mt.Coll)
+
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch,
+				partyDocument(host, []uuid.UUID{host, guest}, models.PartyTieBreakHost, bson.D{{Key: host.String(), Value: 1}})),
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, twoWayNode()),
+			matchedResponse(),
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, twoWayNode()),
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, endingDocument("s", "right", "home", models.EndingOutcomeGood)),
+			matchedResponse(),
+			matchedResponse(),
+			matchedResponse(),
+			matchedResponse(),
+			matchedResponse(),
+		)
+
+		err := h.CastVote(c, "p1")
+
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, rec.Code)
+		var party models.Party
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &party))
+		assert.Equal(t, "right", party.CurrentNodeID)
+		assert.Equal(t, 1, party.Round)
+		assert.Equal(t, models.PartyStatusFinished, party.Status)
+		assert.Nil(t, party.Vote)
+		if assert.NotNil(t, party.Decisions) && assert.Len(t, *party.Decisions, 1) {
+			decision := (*party.Decisions)[0]
+			assert.Equal(t, 1, decision.ChoiceIndex)
+			assert.True(t, *decision.TieBroken)
+		}
+		// ChoiceTaken, NodeEntered and StoryCompleted for each of the two members.
+		staged := stagedEvents(mt)
+		if assert.Len(t, staged, 6) {
+			assert.Equal(t, models.ChoiceTaken, staged[0].Type)
+			if assert.NotNil(t, staged[0].Choice) {
+				assert.Equal(t, "start", staged[0].Choice.FromNodeID)
+				assert.Equal(t, "right", staged[0].Choice.ToNodeID)
+				assert.Equal(t, 1, staged[0].Choice.ChoiceIndex)
+				assert.True(t, *staged[0].Choice.Completed)
+			}
+		}
+	})
+}
+
+func TestCastVote_StaleBallots(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("ballots for removed choices discarded", func(mt *mtest.T) {
+		host, guest := uuid.New(), uuid.New()
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(jsonRequest(http.MethodPost, models.CastVoteRequest{WixID: guest, ChoiceIndex: 0}), rec)
+
+		h := api.NewPartyHandler(mt.Coll, mt.Coll, mt.Coll)
+
+		// The host voted for the second choice; by the time the guest casts the last
+		// ballot, the author has removed every choice of the node.
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch,
+				partyDocument(host, []uuid.UUID{host, guest}, models.PartyTieBreakHost, bson.D{{Key: host.String(), Value: 1}})),
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, twoWayNode()),
+			matchedResponse(),
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, storyElementDocument("s", "start")),
+			matchedResponse(),
+		)
+
+		assert.NotPanics(t, func() { h.CastVote(c, "p1") })
+
+		assert.Equal(t, http.StatusConflict, rec.Code)
+		assert.Contains(t, rec.Body.String(), "please vote again")
+		started := mt.GetAllStartedEvents()
+		cleared := started[len(started)-1].Command.Lookup("updates").Array().Index(0).Value().Document()
+		assert.Equal(t, bson.TypeNull, cleared.Lookup("u", "$set", "vote").Type, "the next ballot opens a new vote")
+	})
+}
+
+func TestCastVote_NotAMember(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("outsider cannot vote", func(mt *mtest.T) {
+		host := uuid.New()
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(jsonRequest(http.MethodPost, models.CastVoteRequest{WixID: uuid.New(), ChoiceIndex: 0}), rec)
+
+		h := api.NewPartyHandler(mt.Coll, mt.Coll, mt.Coll)
+
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch,
+			partyDocument(host, []uuid.UUID{host}, models.PartyTieBreakLowestIndex, nil)))
+
+		h.CastVote(c, "p1")
+
+		assert.Equal(t, http.StatusForbidden, rec.Code)
+		assert.Contains(t, rec.Body.String(), "Player is not a member of the party")
+	})
+}
+
+func TestCastVote_RandomTieBreak(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("random tie-break uses Intn", func(mt *mtest.T) {
+		host, guest := uuid.New(), uuid.New()
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(jsonRequest(http.MethodPost, models.CastVoteRequest{WixID: guest, ChoiceIndex: 0}), rec)
+
+		h := api.NewPartyHandler(mt.Coll, mt.Coll, mt.Coll)
+		h.Intn = func(n int) int { return n - 1 }
+
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch,
+				partyDocument(host, []uuid.UUID{host, guest}, models.PartyTieBreakRandom, bson.D{{Key: host.String(), Value: 1}})),
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, twoWayNode()),
+			matchedResponse(),
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, twoWayNode()),
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, storyElementDocument("s", "right")),
+			matchedResponse(),
+			matchedResponse(),
+			matchedResponse(),
+		)
+
+		h.CastVote(c, "p1")
+
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Contains(t, rec.Body.String(), `"currentNodeID":"right"`)
+	})
+}
+
+// GetParty
+
+func TestGetParty_NotFound(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("party not found", func(mt *mtest.T) {
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/", nil), rec)
+
+		h := api.NewPartyHandler(mt.Coll, mt.Coll, mt.Coll)
+
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch))
+
+		h.GetParty(c, "missing")
+
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+		assert.Contains(t, rec.Body.String(), "Party not found")
+	})
+}
@@ -0,0 +1,184 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+
+	jsonpatch "github.com/evanphx/json-patch/v5"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Media types of the PATCH request bodies. The media type selects how the body is applied.
+const (
+	// MIMEMergePatch is a JSON Merge Patch (RFC 7396).
+	MIMEMergePatch = "application/merge-patch+json"
+
+	// MIMEJSONPatch is a JSON Patch (RFC 6902).
+	MIMEJSONPatch = "application/json-patch+json"
+)
+
+// IsPatchDocument reports whether the request body is a merge patch or a JSON Patch
+// rather than a plain JSON document.
+func IsPatchDocument(c echo.Context) bool {
+	mediaType := patchMediaType(c)
+	return mediaType == MIMEMergePatch || mediaType == MIMEJSONPatch
+}
+
+func patchMediaType(c echo.Context) string {
+	mediaType, _, _ := mime.ParseMediaType(c.Request().Header.Get(echo.HeaderContentType))
+	return mediaType
+}
+
+// applyPatch applies the patch in the request body to the JSON representation of
+// original and decodes the result into patched. A plain JSON body is applied as a
+// merge patch. On failure it returns the status code and message to respond with.
+func applyPatch(c echo.Context, original, patched interface{}) (int, string) {
+	patch, err := io.ReadAll(c.Request().Body)
+	if err != nil {
+		return http.StatusBadRequest, "Failed to read the patch"
+	}
+	document, err := json.Marshal(original)
+	if err != nil {
+		slog.ErrorContext(c.Request().Context(), "Failed to encode the document to patch", "error", err)
+		return http.StatusInternalServerError, "Failed to apply the patch"
+	}
+
+	switch patchMediaType(c) {
+	case MIMEMergePatch, echo.MIMEApplicationJSON:
+		if !json.Valid(patch) {
+			return http.StatusBadRequest, "Invalid patch document"
+		}
+		if document, err = jsonpatch.MergePatch(document, patch); err != nil {
+			return http.StatusBadRequest, "Invalid patch document"
+		}
+	case MIMEJSONPatch:
+		operations, err := jsonpatch.DecodePatch(patch)
+		if err != nil {
+			return http.StatusBadRequest, "Invalid patch document"
+		}
+		document, err = operations.Apply(document)
+		if errors.Is(err, jsonpatch.ErrTestFailed) {
+			return http.StatusConflict, "Patch test failed"
+		}
+		if err != nil {
+			return http.StatusUnprocessableEntity, "Patch could not be applied: " + err.Error()
+		}
+	default:
+		return http.StatusUnsupportedMediaType, "Unsupported patch media type"
+	}
+
+	if err := json.Unmarshal(document, patched); err != nil {
+		return http.StatusUnprocessableEntity, "Patched document is invalid: " + err.Error()
+	}
+	return 0, ""
+}
+
+// patchUpdate translates the change from original to patched into an update that
+// sets and unsets only the fields that changed, down to single array elements and
+// map entries, so that concurrent changes to other fields are not overwritten.
+// Arrays that changed length are set as a whole. The returned update is empty if
+// nothing changed.
+func patchUpdate(original, patched interface{}) (bson.M, error) {
+	before, err := toDocument(original)
+	if err != nil {
+		return nil, err
+	}
+	after, err := toDocument(patched)
+	if err != nil {
+		return nil, err
+	}
+
+	set, unset := bson.M{}, bson.M{}
+	diffDocuments("", before, after, set, unset)
+
+	update := bson.M{}
+	if len(set) > 0 {
+		update["$set"] = set
+	}
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
+	return update, nil
+}
+
+// updatesField reports whether update changes field or anything nested in it.
+func updatesField(update bson.M, field string) bool {
+	for _, operator := range []string{"$set", "$unset"} {
+		fields, _ := update[operator].(bson.M)
+		for path := range fields {
+			if path == field || strings.HasPrefix(path, field+".") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// toDocument encodes v the way it is stored, so that the values set by an update
+// have their storage types.
+func toDocument(v interface{}) (bson.M, error) {
+	data, err := bson.MarshalWithRegistry(MongoRegistry, v)
+	if err != nil {
+		return nil, err
+	}
+	var document bson.M
+	err = bson.Unmarshal(data, &document)
+	return document, err
+}
+
+func diffDocuments(prefix string, before, after bson.M, set, unset bson.M) {
+	for key, value := range after {
+		old, ok := before[key]
+		if !ok {
+			set[prefix+key] = value
+			continue
+		}
+		diffValues(prefix+key, old, value, set, unset)
+	}
+	for key := range before {
+		if _, ok := after[key]; !ok {
+			unset[prefix+key] = ""
+		}
+	}
+}
+
+func diffValues(path string, before, after interface{}, set, unset bson.M) {
+	switch afterValue := after.(type) {
+	case bson.M:
+		beforeValue, ok := before.(bson.M)
+		if ok && addressableKeys(beforeValue) && addressableKeys(afterValue) {
+			diffDocuments(path+".", beforeValue, afterValue, set, unset)
+			return
+		}
+	case bson.A:
+		beforeValue, ok := before.(bson.A)
+		if ok && len(beforeValue) == len(afterValue) {
+			for i := range afterValue {
+				diffValues(path+"."+strconv.Itoa(i), beforeValue[i], afterValue[i], set, unset)
+			}
+			return
+		}
+	}
+	if !reflect.DeepEqual(before, after) {
+		set[path] = after
+	}
+}
+
+// addressableKeys reports whether every key of a document can be used in an update
+// path. Map entries keyed by IDs containing dots or dollars are set as a whole.
+func addressableKeys(document bson.M) bool {
+	for key := range document {
+		if key == "" || strings.ContainsAny(key, ".$") {
+			return false
+		}
+	}
+	return true
+}
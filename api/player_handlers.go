@@ -1,13 +1,19 @@
 package api
 
 import (
+	"bytes"
 	"context"
-	"log"
+	"encoding/json"
+	"log/slog"
+	"math/rand"
 	"net/http"
+	"regexp"
+	"strconv"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/labstack/echo/v4"
+	"github.com/okcthulhu/ChooseYourOwnAdventure/api/events"
 	"github.com/okcthulhu/ChooseYourOwnAdventure/api/models"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
@@ -28,10 +34,36 @@ type PlayerCollection interface {
 	// the filter. The method returns a single result which can be decoded to
 	// obtain the document's data.
 	FindOne(ctx context.Context, filter interface{}, opts ...*options.FindOneOptions) *mongo.SingleResult
+
+	// Find returns a cursor over all players matching the filter.
+	Find(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (*mongo.Cursor, error)
 	UpdateOne(ctx context.Context, filter interface{}, update interface{},
 		opts ...*options.UpdateOptions) (*mongo.UpdateResult, error)
 }
 
+// EventPublisher accepts the domain events of changes outside the player documents,
+// such as those to story elements. The events of changes to players are staged on
+// the players instead; see stageEvents.
+type EventPublisher interface {
+	Publish(ctx context.Context, event models.DomainEvent) error
+}
+
+// PlayerIdentityIndex makes the Wix ID the identity of a player; it serves every
+// lookup by Wix ID and keeps a player from being created twice.
+var PlayerIdentityIndex = mongo.IndexModel{
+	Keys:    bson.D{{Key: "wixID", Value: 1}},
+	Options: options.Index().SetName("playerIdentity").SetUnique(true),
+}
+
+// PlayerIndexes are the indexes the players collection needs for the admin player search.
+// The lookup by Wix ID is served by PlayerIdentityIndex.
+var PlayerIndexes = []mongo.IndexModel{
+	{Keys: bson.D{{Key: "email", Value: 1}}},
+	{Keys: bson.D{{Key: "createdAt", Value: 1}}},
+	{Keys: bson.D{{Key: "updatedAt", Value: 1}}},
+	{Keys: bson.D{{Key: "storyStates.storyID", Value: 1}, {Key: "storyStates.currentStoryNodeID", Value: 1}}},
+}
+
 // PlayerHandler is the main orchestrator for the application's HTTP API. It aggregates
 // various dependencies needed to process incoming HTTP requests and produce
 // appropriate responses. The fields in this struct adhere to interfaces, thus
@@ -39,6 +71,26 @@ type PlayerCollection interface {
 type PlayerHandler struct {
 	// PlayerCol is an abstraction for the MongoDB collection containing player data.
 	PlayerCol PlayerCollection
+
+	// StoryCol is used to look up the story elements a player moves between.
+	StoryCol StoryCollection
+
+	// Audit records every change to a player. It may be nil.
+	Audit AuditRecorder
+
+	// Timeouts bounds the storage calls of each operation.
+	Timeouts Timeouts
+
+	// Media signs the URLs of the assets in the story elements returned to
+	// players. It may be nil, in which case the URLs are returned as stored.
+	Media *MediaSigner
+
+	// Paywalls lock the story elements sold separately away from the players
+	// not entitled to them. It may be nil, in which case nothing is locked.
+	Paywalls *Paywalls
+
+	// Seed picks the seed of the outcomes rolled in a story state that has none.
+	Seed func() int64
 }
 
 // NewPlayerHandler serves as a factory function for creating a new instance of the PlayerHandler struct.
@@ -47,16 +99,22 @@ type PlayerHandler struct {
 // and testability. For example, you can provide mock implementations when you're writing tests.
 // The function returns a pointer to the newly created PlayerHandler instance, fully equipped with
 // the necessary dependencies for database interactions related to both player and story elements.
-func NewPlayerHandler(playerCol PlayerCollection) *PlayerHandler {
+func NewPlayerHandler(playerCol PlayerCollection, storyCol StoryCollection) *PlayerHandler {
 	return &PlayerHandler{
 		PlayerCol: playerCol,
+		StoryCol:  storyCol,
+		Timeouts:  DefaultTimeouts,
+		Seed:      rand.Int63,
 	}
 }
 
 // CreatePlayerState initializes a new player state in the database with the given details.
 // It takes a JSON-formatted request body containing the attributes of the new player state.
 // After successful creation, the function returns a JSON-formatted response containing the newly created player state.
-// If the operation fails, an appropriate HTTP status code is returned, along with an error message.
+// Creation is idempotent on the Wix ID: if the player already exists, it is returned with
+// a 200 status code instead, or a 409 status code when the onConflict query parameter is "error".
+// The player's stories start at their beginning with no progress, and a 400 status code is
+// returned for a story state at another node. If the operation fails, an appropriate HTTP status code is returned, along with an error message.
 func (h *PlayerHandler) CreatePlayerState(c echo.Context) error {
 	playerState := new(models.PostPlayersJSONRequestBody)
 	if err := c.Bind(playerState); err != nil {
@@ -68,13 +126,59 @@ func (h *PlayerHandler) CreatePlayerState(c echo.Context) error {
 		return c.JSON(http.StatusBadRequest, "Empty request body")
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := h.Timeouts.context(c, "CreatePlayerState")
 	defer cancel()
 
-	_, err := h.PlayerCol.InsertOne(ctx, playerState)
+	now := time.Now().UTC()
+	playerState.CreatedAt = &now
+	playerState.UpdatedAt = &now
+	// Entitlements are only granted by the admin.
+	playerState.Entitlements = nil
+	// A new player starts their stories at the beginning, whatever the client says: they
+	// are presented with those nodes now, have made no progress yet, and the outcomes of
+	// their chance choices are rolled by the server.
+	var started []*models.StoryState
+	if playerState.StoryStates != nil {
+		for i := range *playerState.StoryStates {
+			storyState := &(*playerState.StoryStates)[i]
+			storyState.PresentedAt = &now
+			storyState.Completed = nil
+			storyState.CompletedAt = nil
+			storyState.Ending = nil
+			storyState.EndingsDiscovered = nil
+			storyState.GroupDecisions = nil
+			storyState.RngSeed = nil
+			storyState.Rolls = nil
+			started = append(started, storyState)
+		}
+	}
+	if status, message := h.checkStarted(ctx, started, "Failed to create player state"); status != 0 {
+		return c.JSON(status, message)
+	}
+
+	// The event is staged on the player, so that it is stored if and only if the player is.
+	_, err := h.PlayerCol.InsertOne(ctx, stagedPlayer{
+		Player: *playerState,
+		Events: events.Stage(now, models.DomainEvent{Type: models.PlayerCreated, WixID: &playerState.WixID}),
+	})
+	if mongo.IsDuplicateKeyError(err) {
+		// A retried signup finds the player created by the first attempt.
+		if c.QueryParam("onConflict") == "error" {
+			return c.JSON(http.StatusConflict, "Player already exists")
+		}
+		var existing models.Player
+		if err := h.PlayerCol.FindOne(ctx, bson.M{"wixID": binaryWixID(playerState.WixID)}).Decode(&existing); err != nil {
+			return storageError(c, err, "to load existing player", "Failed to create player state")
+		}
+		h.present(&existing)
+		return c.JSON(http.StatusOK, existing)
+	}
 	if err != nil {
-		log.Println("Failed to insert player state:", err)
-		return c.JSON(http.StatusInternalServerError, "Failed to create player state")
+		return storageError(c, err, "to insert player state", "Failed to create player state")
+	}
+
+	if h.Audit != nil {
+		h.Audit.Record(ctx, playerChange(models.AuditActionPlayerCreated, playerState.WixID, nil, playerState))
 	}
 
 	return c.JSON(http.StatusCreated, playerState)
@@ -94,20 +198,28 @@ func (h *PlayerHandler) GetPlayerStateByWixID(c echo.Context, wixID string) erro
 		Data:    parsedUUID[:],
 	}
 
+	ctx, cancel := h.Timeouts.context(c, "GetPlayerStateByWixID")
+	defer cancel()
+
 	filter := bson.M{"wixID": binaryUUID}
-	singleResult := h.PlayerCol.FindOne(context.Background(), filter)
+	singleResult := h.PlayerCol.FindOne(ctx, filter)
 	var playerState models.Player
 	err = singleResult.Decode(&playerState)
-	if err != nil {
+	if err == mongo.ErrNoDocuments {
 		return c.JSON(http.StatusNotFound, "Player not found")
 	}
+	if err != nil {
+		return storageError(c, err, "to load player state", "An error occurred")
+	}
 
+	h.present(&playerState)
 	return c.JSON(http.StatusOK, playerState)
 }
 
 // UpdatePlayerState modifies an existing player's state in the database based on the provided updates.
 // The function expects a JSON-formatted request body containing the updated attributes of the player state,
-// as well as the player's Wix ID to identify which record to update.
+// as well as the player's Wix ID to identify which record to update. The email is replaced
+// if the body carries one, and the wisdoms of the story states are added or updated.
 // Upon successful update, the function returns a JSON-formatted response reflecting the modified player state.
 // If the update operation fails or if the specified Wix ID does not exist,
 // an appropriate HTTP status code and an error message are returned.
@@ -122,15 +234,44 @@ func (h *PlayerHandler) UpdatePlayerState(c echo.Context, wixID string, playerUp
 		Data:    parsedUUID[:],
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := h.Timeouts.context(c, "UpdatePlayerState")
 	defer cancel()
 
-	if playerUpdate.StoryStates == nil {
+	if playerUpdate.StoryStates == nil && playerUpdate.Email == "" {
 		return c.JSON(http.StatusBadRequest, "No story states provided")
 	}
 
+	// The wisdom updates below match nothing for an unknown player, which must not pass as success.
+	// The audit log needs the whole player to summarize it as it was before the update.
+	opts := options.FindOne().SetProjection(bson.M{"_id": 1})
+	if h.Audit != nil {
+		opts = options.FindOne()
+	}
+	var before models.Player
+	if err := h.PlayerCol.FindOne(ctx, bson.M{"wixID": binaryUUID}, opts).Decode(&before); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return c.JSON(http.StatusNotFound, "Player not found or update failed")
+		}
+		return storageError(c, err, "to look up player", "Failed to update player state")
+	}
+	now := time.Now().UTC()
+	updated := false
+
+	if playerUpdate.Email != "" {
+		update := bson.M{"$set": bson.M{"email": playerUpdate.Email, "updatedAt": now}}
+		result, err := h.PlayerCol.UpdateOne(ctx, bson.M{"wixID": binaryUUID}, update)
+		if err != nil {
+			return storageError(c, err, "to update player email", "Failed to update player state")
+		}
+		updated = result.ModifiedCount > 0
+	}
+
+	var storyStates []models.StoryState
+	if playerUpdate.StoryStates != nil {
+		storyStates = *playerUpdate.StoryStates
+	}
 	// Loop through the story states provided in the update.
-	for _, storyState := range *playerUpdate.StoryStates {
+	for _, storyState := range storyStates {
 		// Check if the wisdoms array is provided for the story state.
 		if storyState.Wisdoms == nil {
 			continue // No wisdoms to update for this story state.
@@ -146,6 +287,17 @@ func (h *PlayerHandler) UpdatePlayerState(c echo.Context, wixID string, playerUp
 					},
 				},
 			}
+			// The update of an existing wisdom only matches when the story state holds it,
+			// since bumping updatedAt modifies the player either way.
+			wisdomFilter := bson.M{
+				"wixID": binaryUUID,
+				"storyStates": bson.M{
+					"$elemMatch": bson.M{
+						"storyID":          storyState.StoryID,
+						"wisdoms.wisdomID": wisdomToUpdate.WisdomID,
+					},
+				},
+			}
 
 			// Attempt to update an existing wisdom within the story state.
 			update := bson.M{
@@ -153,6 +305,7 @@ func (h *PlayerHandler) UpdatePlayerState(c echo.Context, wixID string, playerUp
 					"storyStates.$[story].wisdoms.$[wis].description": wisdomToUpdate.Description,
 					"storyStates.$[story].wisdoms.$[wis].artURL":      wisdomToUpdate.ArtURL,
 					// Include other fields of wisdom as necessary.
+					"updatedAt": now,
 				},
 			}
 
@@ -165,33 +318,845 @@ func (h *PlayerHandler) UpdatePlayerState(c echo.Context, wixID string, playerUp
 			updateOptions := options.Update().SetArrayFilters(arrayFilters)
 
 			// Execute the update.
-			result, err := h.PlayerCol.UpdateOne(ctx, filter, update, updateOptions)
+			result, err := h.PlayerCol.UpdateOne(ctx, wisdomFilter, update, updateOptions)
 			if err != nil {
-				log.Println("Failed to update wisdom in player state:", err)
-				return c.JSON(http.StatusInternalServerError, "Internal server error during wisdom update")
+				return storageError(c, err, "to update wisdom in player state", "Internal server error during wisdom update")
 			}
+			updated = updated || result.ModifiedCount > 0
 
 			// If the wisdom doesn't exist (matched count is 0), add it to the wisdoms array.
-			if result.MatchedCount == 0 || result.ModifiedCount == 0 {
+			if result.MatchedCount == 0 {
 				pushUpdate := bson.M{
 					"$push": bson.M{
 						"storyStates.$.wisdoms": wisdomToUpdate,
 					},
+					"$set": bson.M{"updatedAt": now},
 				}
+				grantedWisdom := wisdomToUpdate
+				stageEvents(pushUpdate, models.DomainEvent{
+					Type:    models.WisdomGranted,
+					WixID:   &parsedUUID,
+					StoryID: &storyState.StoryID,
+					Wisdom:  &grantedWisdom,
+				})
 
 				// Execute the push update.
 				_, err = h.PlayerCol.UpdateOne(ctx, filter, pushUpdate)
 				if err != nil {
-					log.Println("Failed to add new wisdom to player state:", err)
-					return c.JSON(http.StatusInternalServerError, "Internal server error during wisdom addition")
+					return storageError(c, err, "to add new wisdom to player state", "Internal server error during wisdom addition")
 				}
+				updated = true
 			}
 		}
 	}
 
+	if updated && h.Audit != nil {
+		h.Audit.Record(ctx, playerChange(models.AuditActionPlayerUpdated, parsedUUID, &before, loadAudited(ctx, h.PlayerCol, h.Timeouts, parsedUUID)))
+	}
+
 	return c.JSON(http.StatusOK, "Player state updated successfully")
 }
 
+// PatchPlayerState applies a JSON Merge Patch (RFC 7396) or a JSON Patch (RFC 6902) to a
+// player, selected by the Content-Type of the request. Only the fields the patch changes
+// are written, so a concurrent choice in another story is not overwritten. The Wix ID, the
+// timestamps, the unlocked achievements and the entitlements are managed by the server and
+// cannot be patched, nor can the player's progress through a story: their current node,
+// the endings they reached, their party's decisions, their rolls and when they were
+// presented with their node. A patch may start a new story only at its beginning, and
+// cannot remove a story state; a 400 status code is returned otherwise.
+// Wisdoms the patch adds are announced like wisdoms granted by any other update.
+// On success the patched player is returned. A 404 status code is returned if the player
+// does not exist and a 409 status code if a test operation failed or the player changed
+// while the patch was applied.
+func (h *PlayerHandler) PatchPlayerState(c echo.Context, wixID string) error {
+	parsedUUID, err := uuid.Parse(wixID)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, "Invalid WixID format")
+	}
+
+	ctx, cancel := h.Timeouts.context(c, "PatchPlayerState")
+	defer cancel()
+
+	var player models.Player
+	if err := h.PlayerCol.FindOne(ctx, bson.M{"wixID": binaryWixID(parsedUUID)}).Decode(&player); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return c.JSON(http.StatusNotFound, "Player not found")
+		}
+		return storageError(c, err, "to load player", "Failed to load player")
+	}
+
+	var patched models.Player
+	if status, message := applyPatch(c, player, &patched); status != 0 {
+		return c.JSON(status, message)
+	}
+	started, message := checkStoryStates(&player, &patched, time.Now().UTC())
+	if message != "" {
+		return c.JSON(http.StatusBadRequest, message)
+	}
+	if status, message := h.checkStarted(ctx, started, "Failed to update player state"); status != 0 {
+		return c.JSON(status, message)
+	}
+	update, err := patchUpdate(player, patched)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to translate player patch", "error", err)
+		return c.JSON(http.StatusInternalServerError, "Failed to update player state")
+	}
+	for _, field := range []string{"_id", "wixID", "createdAt", "updatedAt", "achievements", "entitlements"} {
+		if updatesField(update, field) {
+			return c.JSON(http.StatusBadRequest, "The "+field+" of a player cannot be changed")
+		}
+	}
+	if len(update) == 0 {
+		h.present(&player)
+		return c.JSON(http.StatusOK, player)
+	}
+
+	now := time.Now().UTC()
+	set, _ := update["$set"].(bson.M)
+	if set == nil {
+		set = bson.M{}
+		update["$set"] = set
+	}
+	set["updatedAt"] = now
+	patched.UpdatedAt = &now
+	stageEvents(update, grantedWisdoms(parsedUUID, &player, &patched)...)
+
+	// Array elements are addressed by position, so the player must not have changed since it was read.
+	filter := bson.M{"wixID": binaryWixID(parsedUUID), "updatedAt": player.UpdatedAt}
+	if player.UpdatedAt == nil {
+		filter["updatedAt"] = bson.M{"$exists": false}
+	}
+	result, err := h.PlayerCol.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return storageError(c, err, "to patch player state", "Failed to update player state")
+	}
+	if result.MatchedCount == 0 {
+		return c.JSON(http.StatusConflict, "Player changed while the patch was applied")
+	}
+
+	if h.Audit != nil {
+		h.Audit.Record(ctx, playerChange(models.AuditActionPlayerPatched, parsedUUID, &player, &patched))
+	}
+
+	h.present(&patched)
+	return c.JSON(http.StatusOK, patched)
+}
+
+// checkStoryStates carries the fields of the story states that only the server sets
+// over from the original player to the patched one where the patch leaves them out,
+// as it must for the seeds that players are never shown. A player's progress through
+// a story is only changed by their choices, so that timed story elements cannot be
+// skipped: the returned message is not empty if the patch changes such a field,
+// removes a story state, or starts a story with any progress. The stories started by
+// the patch are returned, for their current nodes to be checked.
+func checkStoryStates(original, patched *models.Player, now time.Time) ([]*models.StoryState, string) {
+	var patchedStates []models.StoryState
+	if patched.StoryStates != nil {
+		patchedStates = *patched.StoryStates
+	}
+	if original.StoryStates != nil {
+		for _, storyState := range *original.StoryStates {
+			if findStoryState(patched, storyState.StoryID) == nil {
+				return nil, "A story state cannot be removed"
+			}
+		}
+	}
+
+	var started []*models.StoryState
+	for i := range patchedStates {
+		storyState := &patchedStates[i]
+		previous := findStoryState(original, storyState.StoryID)
+		if previous == nil {
+			// A story is started at the node the patch gives, now.
+			previous = &models.StoryState{CurrentStoryNodeID: storyState.CurrentStoryNodeID, PresentedAt: &now}
+			started = append(started, storyState)
+		}
+
+		for _, field := range []string{
+			keepManaged("currentStoryNodeID", previous.CurrentStoryNodeID, &storyState.CurrentStoryNodeID, storyState.CurrentStoryNodeID == ""),
+			keepManaged("presentedAt", previous.PresentedAt, &storyState.PresentedAt, storyState.PresentedAt == nil),
+			keepManaged("completed", previous.Completed, &storyState.Completed, storyState.Completed == nil),
+			keepManaged("completedAt", previous.CompletedAt, &storyState.CompletedAt, storyState.CompletedAt == nil),
+			keepManaged("ending", previous.Ending, &storyState.Ending, storyState.Ending == nil),
+			keepManaged("endingsDiscovered", previous.EndingsDiscovered, &storyState.EndingsDiscovered, storyState.EndingsDiscovered == nil),
+			keepManaged("groupDecisions", previous.GroupDecisions, &storyState.GroupDecisions, storyState.GroupDecisions == nil),
+			keepManaged("rngSeed", previous.RngSeed, &storyState.RngSeed, storyState.RngSeed == nil),
+			keepManaged("rolls", previous.Rolls, &storyState.Rolls, storyState.Rolls == nil),
+		} {
+			if field != "" {
+				return nil, "The " + field + " of a story state cannot be changed"
+			}
+		}
+	}
+	return started, ""
+}
+
+// keepManaged sets a field of a patched story state to its previous value if the
+// patch leaves it out, and returns the name of the field if the patch changes it.
+func keepManaged[T any](name string, previous T, patched *T, omitted bool) string {
+	if omitted {
+		*patched = previous
+		return ""
+	}
+	if !sameJSON(previous, *patched) {
+		return name
+	}
+	return ""
+}
+
+// sameJSON reports whether two values have the same JSON encoding.
+func sameJSON(a, b interface{}) bool {
+	encodedA, errA := json.Marshal(a)
+	encodedB, errB := json.Marshal(b)
+	return errA == nil && errB == nil && bytes.Equal(encodedA, encodedB)
+}
+
+// present prepares a player to be returned: the seeds of their story states are
+// removed, so that the outcomes of their choices cannot be predicted, and the art
+// URLs of their wisdoms are signed.
+func (h *PlayerHandler) present(player *models.Player) {
+	if player.StoryStates == nil {
+		return
+	}
+	for i := range *player.StoryStates {
+		(*player.StoryStates)[i].RngSeed = nil
+	}
+	h.Media.signWisdoms(player)
+}
+
+// grantedWisdoms returns a WisdomGranted event for every wisdom the patched player
+// holds in a story that the original did not.
+func grantedWisdoms(wixID uuid.UUID, original, patched *models.Player) []models.DomainEvent {
+	if patched.StoryStates == nil {
+		return nil
+	}
+	var events []models.DomainEvent
+	for _, storyState := range *patched.StoryStates {
+		if storyState.Wisdoms == nil {
+			continue
+		}
+		storyID := storyState.StoryID
+		previous := findStoryState(original, storyID)
+		for _, wisdom := range *storyState.Wisdoms {
+			if previous != nil && holdsWisdom(previous, wisdom.WisdomID) {
+				continue
+			}
+			granted := wisdom
+			events = append(events, models.DomainEvent{
+				Type:    models.WisdomGranted,
+				WixID:   &wixID,
+				StoryID: &storyID,
+				Wisdom:  &granted,
+			})
+		}
+	}
+	return events
+}
+
+// TakeChoice advances a player through a story by taking one of the choices offered at
+// their current story element. The request body names the index of the choice. Choices gated
+// behind a wisdom are only available if the player's story state holds that wisdom. A choice with
+// chance outcomes leads to the outcome rolled from the story state's seed, weighted by the wisdoms
+// the player holds, and the roll is recorded in the story state. At a timed story element whose
+// deadline has passed, the element's default choice is taken instead of the requested one and the
+// response carries the Choice-Timed-Out header.
+// On success the player's current node is moved and the story element they arrived at is returned.
+// A player not entitled to the story element the choice leads to stays where they are and gets
+// a 402 status code with the product that unlocks it. A 404 status code is returned if the player,
+// their state for the story, or either story element cannot be found, and a 409 status code if
+// another choice moved the player on in the meantime.
+func (h *PlayerHandler) TakeChoice(c echo.Context, wixID string, storyID string) error {
+	parsedUUID, err := uuid.Parse(wixID)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, "Invalid WixID format")
+	}
+
+	choiceRequest := new(models.PostPlayersPlayerIdStoriesStoryIdChoicesJSONRequestBody)
+	if err := c.Bind(choiceRequest); err != nil {
+		return c.JSON(http.StatusBadRequest, "Failed to bind the request to the choice")
+	}
+
+	binaryUUID := primitive.Binary{
+		Subtype: 0x04,
+		Data:    parsedUUID[:],
+	}
+
+	ctx, cancel := h.Timeouts.context(c, "TakeChoice")
+	defer cancel()
+
+	var player models.Player
+	err = h.PlayerCol.FindOne(ctx, bson.M{"wixID": binaryUUID}).Decode(&player)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return c.JSON(http.StatusNotFound, "Player not found")
+		}
+		return storageError(c, err, "to load player state", "An error occurred")
+	}
+
+	storyState := findStoryState(&player, storyID)
+	if storyState == nil {
+		return c.JSON(http.StatusNotFound, "Story state not found")
+	}
+
+	var current models.StoryElement
+	err = h.StoryCol.FindOne(ctx, bson.M{"storyID": storyID, "nodeID": storyState.CurrentStoryNodeID}).Decode(&current)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return c.JSON(http.StatusNotFound, "Story Element not found")
+		}
+		return storageError(c, err, "to load current story element", "An error occurred")
+	}
+
+	now := time.Now().UTC()
+	choiceIndex, timedOut := expiredDefault(&current, storyState, now)
+	if !timedOut {
+		choiceIndex = choiceRequest.ChoiceIndex
+		if current.Choices == nil || choiceIndex < 0 || choiceIndex >= len(*current.Choices) {
+			return c.JSON(http.StatusBadRequest, "Invalid choice index")
+		}
+		choice := (*current.Choices)[choiceIndex]
+		if choice.WisdomID != nil && !holdsWisdom(storyState, *choice.WisdomID) {
+			return c.JSON(http.StatusForbidden, "Choice requires a wisdom the player does not hold")
+		}
+	}
+
+	next, status, body := h.advance(ctx, parsedUUID, &player, storyState, &current, choiceIndex, timedOut, now)
+	if next == nil {
+		return c.JSON(status, body)
+	}
+
+	if timedOut {
+		c.Response().Header().Set(ChoiceTimedOutHeader, "true")
+	}
+	setChoiceDeadline(c, next, &models.StoryState{PresentedAt: &now})
+	h.Media.signMedia(next)
+	return c.JSON(http.StatusOK, next)
+}
+
+// advance moves a player from their current story element through the choice at
+// the given index, which the caller has checked the player may take. It rolls
+// the choice's outcomes, records the move, the ending reached and the time the
+// player is presented with the next element, and raises the events and audit
+// entry of the move. It returns the story element arrived at, or nil with the
+// status code and body to respond with.
+func (h *PlayerHandler) advance(ctx context.Context, wixID uuid.UUID, player *models.Player, storyState *models.StoryState, current *models.StoryElement, choiceIndex int, timedOut bool, now time.Time) (*models.StoryElement, int, interface{}) {
+	storyID := storyState.StoryID
+	choice := (*current.Choices)[choiceIndex]
+
+	nextNodeID := choice.NextNodeID
+	var roll *models.OutcomeRoll
+	seed := storyState.RngSeed
+	if choice.Outcomes != nil {
+		if seed == nil {
+			picked := h.Seed()
+			seed = &picked
+		}
+		sequence := 0
+		if storyState.Rolls != nil {
+			sequence = len(*storyState.Rolls)
+		}
+		holds := func(wisdomID string) bool { return holdsWisdom(storyState, wisdomID) }
+		rolled := rollOutcome(choice, holds, *seed, sequence)
+		rolled.NodeID, rolled.ChoiceIndex = current.NodeID, choiceIndex
+		roll, nextNodeID = &rolled, rolled.NextNodeID
+	}
+
+	var next models.StoryElement
+	err := h.StoryCol.FindOne(ctx, bson.M{"storyID": storyID, "nodeID": nextNodeID}).Decode(&next)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, http.StatusNotFound, "Next story element not found"
+		}
+		status, message := storageFailure(ctx, err, "to load next story element", "An error occurred")
+		return nil, status, message
+	}
+
+	if locked := h.Paywalls.lockFor(&next, player, now); locked != nil {
+		return nil, http.StatusPaymentRequired, locked
+	}
+	completed := next.Ending != nil
+	if !completed && (next.Choices == nil || len(*next.Choices) == 0) {
+		slog.WarnContext(ctx, "Story element has no choices and is not marked as an ending", "storyID", storyID, "nodeID", next.NodeID)
+	}
+
+	// The player must still be where the choice was taken, so that concurrent choices
+	// neither both move them nor roll the same outcome twice.
+	filter := bson.M{
+		"wixID": binaryWixID(wixID),
+		"storyStates": bson.M{"$elemMatch": bson.M{
+			"storyID":            storyID,
+			"currentStoryNodeID": current.NodeID,
+		}},
+	}
+	set := bson.M{
+		"storyStates.$.currentStoryNodeID": nextNodeID,
+		"storyStates.$.presentedAt":        now,
+		"updatedAt":                        now,
+	}
+	if completed {
+		markCompleted(set, next.Ending, now)
+	}
+	update := bson.M{"$set": set}
+	if roll != nil {
+		roll.RolledAt = now
+		set["storyStates.$.rngSeed"] = *seed
+		update["$push"] = bson.M{"storyStates.$.rolls": roll}
+	}
+
+	gated := choice.WisdomID != nil
+	choiceEvent := models.ChoiceEvent{
+		StoryID:         storyID,
+		WixID:           wixID,
+		FromNodeID:      current.NodeID,
+		ToNodeID:        next.NodeID,
+		ChoiceIndex:     choiceIndex,
+		ChapterName:     current.ChapterName,
+		NextChapterName: next.ChapterName,
+		Completed:       &completed,
+		Gated:           &gated,
+		OccurredAt:      now,
+	}
+	if timedOut {
+		choiceEvent.TimedOut = &timedOut
+	}
+	raised := []models.DomainEvent{
+		{Type: models.ChoiceTaken, WixID: &wixID, StoryID: &storyID, NodeID: &current.NodeID, Choice: &choiceEvent},
+		{Type: models.NodeEntered, WixID: &wixID, StoryID: &storyID, NodeID: &next.NodeID},
+	}
+	if completed {
+		raised = append(raised, models.DomainEvent{Type: models.StoryCompleted, WixID: &wixID, StoryID: &storyID, NodeID: &next.NodeID, Ending: next.Ending})
+	}
+	stageEvents(update, raised...)
+	result, err := h.PlayerCol.UpdateOne(ctx, filter, update)
+	if err != nil {
+		status, message := storageFailure(ctx, err, "to move player to the next story element", "Failed to take choice")
+		return nil, status, message
+	}
+	if result.MatchedCount == 0 {
+		return nil, http.StatusConflict, "The player moved on while the choice was taken, please retry"
+	}
+	if completed {
+		// The player has moved; the ending belongs to the move even if the client has gone away.
+		endingCtx, cancelEnding := h.Timeouts.detached(ctx)
+		_, err := discoverEnding(endingCtx, h.PlayerCol, wixID, storyID, next.NodeID, *next.Ending, now)
+		cancelEnding()
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to record discovered ending", "wixID", wixID, "storyID", storyID, "error", err)
+		}
+	}
+
+	if h.Audit != nil {
+		entry := playerChange(models.AuditActionPlayerChoiceTaken, wixID, player, loadAudited(ctx, h.PlayerCol, h.Timeouts, wixID))
+		entry.StoryID, entry.NodeID = &storyID, &next.NodeID
+		h.Audit.Record(ctx, entry)
+	}
+
+	return &next, http.StatusOK, nil
+}
+
+// GetCurrentStoryElement returns the story element a player is at in a story, with
+// the URLs of its media signed for the player. At a timed story element the time the
+// player was presented with it is recorded if it was not already, and the response
+// carries the Choice-Deadline header. Once the deadline has passed the element's default
+// choice is taken, and the element it leads to is returned with the Choice-Timed-Out
+// header. A 402 status code is returned with the product that unlocks the element if
+// the player is not entitled to it, and a 404 status code if the player, their state
+// for the story or the story element cannot be found.
+func (h *PlayerHandler) GetCurrentStoryElement(c echo.Context, wixID string, storyID string) error {
+	parsedUUID, err := uuid.Parse(wixID)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, "Invalid WixID format")
+	}
+
+	ctx, cancel := h.Timeouts.context(c, "GetCurrentStoryElement")
+	defer cancel()
+
+	var player models.Player
+	if err := h.PlayerCol.FindOne(ctx, bson.M{"wixID": binaryWixID(parsedUUID)}).Decode(&player); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return c.JSON(http.StatusNotFound, "Player not found")
+		}
+		return storageError(c, err, "to load player state", "An error occurred")
+	}
+	storyState := findStoryState(&player, storyID)
+	if storyState == nil {
+		return c.JSON(http.StatusNotFound, "Story state not found")
+	}
+
+	var current models.StoryElement
+	err = h.StoryCol.FindOne(ctx, bson.M{"storyID": storyID, "nodeID": storyState.CurrentStoryNodeID}).Decode(&current)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return c.JSON(http.StatusNotFound, "Story Element not found")
+		}
+		return storageError(c, err, "to load current story element", "An error occurred")
+	}
+	now := time.Now().UTC()
+	if locked := h.Paywalls.lockFor(&current, &player, now); locked != nil {
+		return c.JSON(http.StatusPaymentRequired, locked)
+	}
+
+	// Signed URLs expire, so the response must not outlive them.
+	c.Response().Header().Set(echo.HeaderCacheControl, "private, no-store")
+
+	if choiceIndex, timedOut := expiredDefault(&current, storyState, now); timedOut {
+		next, status, body := h.advance(ctx, parsedUUID, &player, storyState, &current, choiceIndex, true, now)
+		if next == nil {
+			return c.JSON(status, body)
+		}
+		c.Response().Header().Set(ChoiceTimedOutHeader, "true")
+		setChoiceDeadline(c, next, &models.StoryState{PresentedAt: &now})
+		h.Media.signMedia(next)
+		return c.JSON(http.StatusOK, next)
+	}
+
+	if current.TimeLimitSeconds != nil && storyState.PresentedAt == nil {
+		// The player reached the node before it was timed, or before presentation was
+		// recorded; the clock starts now. Only an unset time is filled in, so that a
+		// concurrent request cannot restart it.
+		filter := bson.M{
+			"wixID": binaryWixID(parsedUUID),
+			"storyStates": bson.M{"$elemMatch": bson.M{
+				"storyID":            storyID,
+				"currentStoryNodeID": current.NodeID,
+				"presentedAt":        bson.M{"$exists": false},
+			}},
+		}
+		if _, err := h.PlayerCol.UpdateOne(ctx, filter, bson.M{"$set": bson.M{"storyStates.$.presentedAt": now}}); err != nil {
+			return storageError(c, err, "to record when the story element was presented", "An error occurred")
+		}
+		storyState.PresentedAt = &now
+	}
+	setChoiceDeadline(c, &current, storyState)
+
+	h.Media.signMedia(&current)
+	return c.JSON(http.StatusOK, current)
+}
+
+// ListPlayers is the admin player search. It returns a page of player summaries
+// ordered by Wix ID, narrowed by the email, emailPrefix, storyID, currentNodeID,
+// completed, createdFrom, createdTo, updatedFrom and updatedTo query parameters.
+// The story-related filters apply to a single story state together. Pages are
+// walked by passing the returned nextCursor as the cursor parameter. Malformed
+// parameters result in a 400 status code.
+func (h *PlayerHandler) ListPlayers(c echo.Context) error {
+	limit, ok := parsePageLimit(c.QueryParam("limit"))
+	if !ok {
+		return c.JSON(http.StatusBadRequest, "Invalid limit")
+	}
+
+	filter := bson.M{}
+	if cursor := c.QueryParam("cursor"); cursor != "" {
+		key, err := decodeCursor(cursor)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, "Invalid cursor")
+		}
+		after, err := uuid.Parse(key)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, "Invalid cursor")
+		}
+		filter["wixID"] = bson.M{"$gt": binaryWixID(after)}
+	}
+
+	if email := c.QueryParam("email"); email != "" {
+		filter["email"] = email
+	} else if prefix := c.QueryParam("emailPrefix"); prefix != "" {
+		// An anchored, case-sensitive prefix match can use the email index.
+		filter["email"] = primitive.Regex{Pattern: "^" + regexp.QuoteMeta(prefix)}
+	}
+
+	storyState := bson.M{}
+	if storyID := c.QueryParam("storyID"); storyID != "" {
+		storyState["storyID"] = storyID
+	}
+	if nodeID := c.QueryParam("currentNodeID"); nodeID != "" {
+		storyState["currentStoryNodeID"] = nodeID
+	}
+	if value := c.QueryParam("completed"); value != "" {
+		completed, err := strconv.ParseBool(value)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, "Invalid completed filter")
+		}
+		if completed {
+			storyState["completed"] = true
+		} else {
+			storyState["completed"] = bson.M{"$ne": true}
+		}
+	}
+	if len(storyState) > 0 {
+		filter["storyStates"] = bson.M{"$elemMatch": storyState}
+	}
+
+	for field, params := range map[string][2]string{
+		"createdAt": {"createdFrom", "createdTo"},
+		"updatedAt": {"updatedFrom", "updatedTo"},
+	} {
+		window := bson.M{}
+		for i, operator := range []string{"$gte", "$lte"} {
+			bound, err := parseTimeParam(c.QueryParam(params[i]))
+			if err != nil {
+				return c.JSON(http.StatusBadRequest, "Invalid "+params[i]+" timestamp")
+			}
+			if bound != nil {
+				window[operator] = *bound
+			}
+		}
+		if len(window) > 0 {
+			filter[field] = window
+		}
+	}
+
+	ctx, cancel := h.Timeouts.context(c, "ListPlayers")
+	defer cancel()
+
+	// Summaries only need a few fields, so the potentially large story states are
+	// not loaded in full. One extra player tells whether there is a next page.
+	opts := options.Find().
+		SetSort(bson.D{{Key: "wixID", Value: 1}}).
+		SetLimit(int64(limit + 1)).
+		SetProjection(bson.M{
+			"wixID":                          1,
+			"email":                          1,
+			"createdAt":                      1,
+			"updatedAt":                      1,
+			"storyStates.storyID":            1,
+			"storyStates.currentStoryNodeID": 1,
+			"storyStates.completed":          1,
+			"storyStates.wisdoms.wisdomID":   1,
+			"achievements.achievementID":     1,
+		})
+	cursor, err := h.PlayerCol.Find(ctx, filter, opts)
+	if err != nil {
+		return storageError(c, err, "to query players", "Failed to list players")
+	}
+	var players []models.Player
+	if err := cursor.All(ctx, &players); err != nil {
+		return storageError(c, err, "to decode players", "Failed to list players")
+	}
+
+	page := models.PlayerPage{Items: []models.PlayerSummary{}}
+	if len(players) > limit {
+		players = players[:limit]
+		next := encodeCursor(players[limit-1].WixID.String())
+		page.NextCursor = &next
+	}
+	for i := range players {
+		page.Items = append(page.Items, summarizePlayer(&players[i]))
+	}
+	return c.JSON(http.StatusOK, page)
+}
+
+// summarizePlayer condenses a player into the summary returned by the admin search.
+func summarizePlayer(player *models.Player) models.PlayerSummary {
+	summary := models.PlayerSummary{
+		WixID:     player.WixID,
+		Email:     player.Email,
+		CreatedAt: player.CreatedAt,
+		UpdatedAt: player.UpdatedAt,
+		Stories:   []models.PlayerStorySummary{},
+	}
+	if player.StoryStates != nil {
+		for _, storyState := range *player.StoryStates {
+			storySummary := models.PlayerStorySummary{
+				StoryID:            storyState.StoryID,
+				CurrentStoryNodeID: storyState.CurrentStoryNodeID,
+				Completed:          storyState.Completed != nil && *storyState.Completed,
+			}
+			if storyState.Wisdoms != nil && len(*storyState.Wisdoms) > 0 {
+				wisdomIDs := make([]string, 0, len(*storyState.Wisdoms))
+				for _, wisdom := range *storyState.Wisdoms {
+					wisdomIDs = append(wisdomIDs, wisdom.WisdomID)
+				}
+				storySummary.WisdomIDs = &wisdomIDs
+			}
+			summary.Stories = append(summary.Stories, storySummary)
+		}
+	}
+	if player.Achievements != nil {
+		summary.AchievementCount = len(*player.Achievements)
+	}
+	if player.Entitlements != nil && len(*player.Entitlements) > 0 {
+		productIDs := make([]string, 0, len(*player.Entitlements))
+		for _, entitlement := range *player.Entitlements {
+			productIDs = append(productIDs, entitlement.ProductID)
+		}
+		summary.ProductIDs = &productIDs
+	}
+	return summary
+}
+
+// GetStoryEndings lists the endings the player has discovered in a story, along
+// with the number of endings the story has in total.
+func (h *PlayerHandler) GetStoryEndings(c echo.Context, wixID string, storyID string) error {
+	parsedUUID, err := uuid.Parse(wixID)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, "Invalid WixID format")
+	}
+
+	ctx, cancel := h.Timeouts.context(c, "GetStoryEndings")
+	defer cancel()
+
+	var player models.Player
+	err = h.PlayerCol.FindOne(ctx, bson.M{"wixID": binaryWixID(parsedUUID)}).Decode(&player)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return c.JSON(http.StatusNotFound, "Player not found")
+		}
+		return storageError(c, err, "to load player state", "An error occurred")
+	}
+
+	storyState := findStoryState(&player, storyID)
+	if storyState == nil {
+		return c.JSON(http.StatusNotFound, "Story state not found")
+	}
+
+	opts := options.Find().SetProjection(bson.M{"ending": 1})
+	cursor, err := h.StoryCol.Find(ctx, bson.M{"storyID": storyID, "ending": bson.M{"$exists": true}}, opts)
+	if err != nil {
+		return storageError(c, err, "to query story endings", "An error occurred")
+	}
+	var endings []models.StoryElement
+	if err := cursor.All(ctx, &endings); err != nil {
+		return storageError(c, err, "to decode story endings", "An error occurred")
+	}
+	endingIDs := map[string]bool{}
+	for _, element := range endings {
+		if element.Ending != nil {
+			endingIDs[element.Ending.EndingID] = true
+		}
+	}
+
+	result := models.StoryEndings{
+		StoryID:    storyID,
+		Discovered: []models.DiscoveredEnding{},
+		Total:      len(endingIDs),
+	}
+	if storyState.EndingsDiscovered != nil {
+		result.Discovered = *storyState.EndingsDiscovered
+	}
+	return c.JSON(http.StatusOK, result)
+}
+
+// stagedPlayer is a new player together with the events its creation raised.
+type stagedPlayer struct {
+	models.Player `bson:",inline"`
+
+	Events []models.DomainEvent `bson:"pendingEvents"`
+}
+
+// stageEvents adds the domain events raised by an update of a player to the update,
+// so that they are stored together with the change they describe, or not at all. The
+// event bus relays them from the player to the event outbox.
+func stageEvents(update bson.M, raised ...models.DomainEvent) {
+	if len(raised) == 0 {
+		return
+	}
+	push, _ := update["$push"].(bson.M)
+	if push == nil {
+		push = bson.M{}
+		update["$push"] = push
+	}
+	push[events.StagedField] = bson.M{"$each": events.Stage(time.Now(), raised...)}
+}
+
+// findStoryState returns the player's state for the given story, or nil if the
+// player has not started it.
+func findStoryState(player *models.Player, storyID string) *models.StoryState {
+	if player.StoryStates == nil {
+		return nil
+	}
+	for i := range *player.StoryStates {
+		if (*player.StoryStates)[i].StoryID == storyID {
+			return &(*player.StoryStates)[i]
+		}
+	}
+	return nil
+}
+
+// checkStarted checks that the stories a player is created with or a patch starts
+// are started at one of their elements that no choice leads to. The returned status
+// is zero when they all are; failure is the message of a storage error.
+func (h *PlayerHandler) checkStarted(ctx context.Context, started []*models.StoryState, failure string) (int, string) {
+	for _, storyState := range started {
+		filter := bson.M{"storyID": storyState.StoryID, "nodeID": storyState.CurrentStoryNodeID}
+		err := h.StoryCol.FindOne(ctx, filter, options.FindOne().SetProjection(bson.M{"_id": 1})).Err()
+		if err == mongo.ErrNoDocuments {
+			return http.StatusBadRequest, "A story can only be started at its beginning"
+		}
+		if err != nil {
+			return storageFailure(ctx, err, "to load the node a story is started at", failure)
+		}
+
+		beginning, err := storyBeginning(ctx, h.StoryCol, storyState.StoryID, storyState.CurrentStoryNodeID)
+		if err != nil {
+			return storageFailure(ctx, err, "to look up choices leading to the node a story is started at", failure)
+		}
+		if !beginning {
+			return http.StatusBadRequest, "A story can only be started at its beginning"
+		}
+	}
+	return 0, ""
+}
+
+// storyBeginning reports whether no choice of a story leads to the given node,
+// which players can then start the story at.
+func storyBeginning(ctx context.Context, storyCol StoryCollection, storyID, nodeID string) (bool, error) {
+	err := storyCol.FindOne(ctx, bson.M{
+		"storyID": storyID,
+		"$or":     bson.A{bson.M{"choices.nextNodeID": nodeID}, bson.M{"choices.outcomes.nextNodeID": nodeID}},
+	}, options.FindOne().SetProjection(bson.M{"_id": 1})).Err()
+	if err == mongo.ErrNoDocuments {
+		return true, nil
+	}
+	return false, err
+}
+
+// markCompleted adds the fields that mark a story state as completed at the given
+// ending to the $set document of a positional storyStates.$ update.
+func markCompleted(set bson.M, ending *models.Ending, at time.Time) {
+	set["storyStates.$.completed"] = true
+	set["storyStates.$.completedAt"] = at
+	set["storyStates.$.ending"] = ending
+}
+
+// discoverEnding adds the ending to the endings the player has discovered in the
+// story, unless they have reached it before. It reports whether the ending was new.
+func discoverEnding(ctx context.Context, playerCol PlayerCollection, wixID uuid.UUID, storyID string, nodeID string, ending models.Ending, at time.Time) (bool, error) {
+	filter := bson.M{
+		"wixID": binaryWixID(wixID),
+		"storyStates": bson.M{"$elemMatch": bson.M{
+			"storyID":                    storyID,
+			"endingsDiscovered.endingID": bson.M{"$ne": ending.EndingID},
+		}},
+	}
+	discovered := models.DiscoveredEnding{
+		EndingID:     ending.EndingID,
+		Title:        ending.Title,
+		Outcome:      models.DiscoveredEndingOutcome(ending.Outcome),
+		NodeID:       nodeID,
+		DiscoveredAt: at,
+	}
+	result, err := playerCol.UpdateOne(ctx, filter, bson.M{"$push": bson.M{"storyStates.$.endingsDiscovered": discovered}})
+	if err != nil {
+		return false, err
+	}
+	return result.MatchedCount > 0, nil
+}
+
+// holdsWisdom reports whether the story state contains the given wisdom.
+func holdsWisdom(storyState *models.StoryState, wisdomID string) bool {
+	if storyState.Wisdoms == nil {
+		return false
+	}
+	for _, wisdom := range *storyState.Wisdoms {
+		if wisdom.WisdomID == wisdomID {
+			return true
+		}
+	}
+	return false
+}
+
 // func (h *PlayerHandler) UpdatePlayerState(c echo.Context, wixID string, playerUpdate models.PatchPlayersPlayerIdJSONRequestBody) error {
 // 	parsedUUID, err := uuid.Parse(wixID)
 // 	if err != nil {
@@ -2,6 +2,7 @@ package api_test
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
@@ -9,6 +10,7 @@ import (
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/labstack/echo/v4"
@@ -68,17 +70,87 @@ func TestCreatePlayerState_PlayerCreated(t *testing.T) {
 		e := echo.New()
 		c := e.NewContext(req, rec)
 
-		h := api.NewPlayerHandler(mt.Coll)
+		h := api.NewPlayerHandler(mt.Coll, mt.Coll)
 
-		mt.AddMockResponses(mtest.CreateCursorResponse(1, "foo.bar", mtest.FirstBatch, bson.D{
-			{"wixID", playerState.WixID},
-			{"email", playerState.Email},
-		}))
+		// Mock the lookup of the start node, finding no choice leading to it, and the insert
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, storyElementDocument(storyID, currentStoryNodeID)),
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch),
+			mtest.CreateSuccessResponse(),
+		)
 
 		h.CreatePlayerState(c)
 
 		assert.Nil(t, err)
 		assert.Equal(t, http.StatusCreated, rec.Code)
+		staged := stagedEvents(mt)
+		if assert.Len(t, staged, 1, "the event is staged on the inserted player") {
+			assert.Equal(t, models.PlayerCreated, staged[0].Type)
+			assert.NotEmpty(t, staged[0].Id)
+		}
+		assert.NotContains(t, rec.Body.String(), "pendingEvents")
+	})
+}
+
+func TestCreatePlayerState_ForgedProgress(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	forged := `{"wixID":"%s","email":"new@example.com","storyStates":[{"storyID":"s","currentStoryNodeID":"%s",` +
+		`"completed":true,"completedAt":"2023-11-01T12:00:00Z","ending":{"endingID":"e","title":"The End","outcome":"good"},` +
+		`"endingsDiscovered":[{"endingID":"e","title":"The End","outcome":"good","nodeID":"end","discoveredAt":"2023-11-01T12:00:00Z"}],` +
+		`"groupDecisions":[{"nodeID":"start","choiceIndex":0,"nextNodeID":"end","ballots":{},"decidedAt":"2023-11-01T12:00:00Z"}]}]}`
+
+	mt.Run("progress ignored", func(mt *mtest.T) {
+		wixID := uuid.New()
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(fmt.Sprintf(forged, wixID, "start")))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, storyElementDocument("s", "start")),
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch),
+			mtest.CreateSuccessResponse(),
+		)
+
+		err := api.NewPlayerHandler(mt.Coll, mt.Coll).CreatePlayerState(echo.New().NewContext(req, rec))
+
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusCreated, rec.Code)
+		var inserted bson.Raw
+		for _, event := range mt.GetAllStartedEvents() {
+			if event.CommandName == "insert" {
+				inserted = event.Command.Lookup("documents").Array().Index(0).Value().Document()
+			}
+		}
+		if assert.NotNil(t, inserted) {
+			storyState := inserted.Lookup("storyStates").Array().Index(0).Value().Document()
+			assert.Equal(t, "start", storyState.Lookup("currentStoryNodeID").StringValue())
+			for _, field := range []string{"completed", "completedAt", "ending", "endingsDiscovered", "groupDecisions"} {
+				_, err := storyState.LookupErr(field)
+				assert.Error(t, err, field)
+			}
+		}
+		assert.NotContains(t, rec.Body.String(), "endingsDiscovered")
+	})
+
+	mt.Run("story started past its beginning", func(mt *mtest.T) {
+		wixID := uuid.New()
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(fmt.Sprintf(forged, wixID, "end")))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+
+		// A choice of the start node leads to the end
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, storyElementDocument("s", "end")),
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, storyElementDocument("s", "start")),
+		)
+
+		api.NewPlayerHandler(mt.Coll, mt.Coll).CreatePlayerState(echo.New().NewContext(req, rec))
+
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+		assert.Contains(t, rec.Body.String(), "A story can only be started at its beginning")
+		assert.Empty(t, stagedEvents(mt), "the player is not inserted")
 	})
 }
 
@@ -112,10 +184,10 @@ func TestCreatePlayerState_InsertFailed(t *testing.T) {
 		e := echo.New()
 		c := e.NewContext(req, rec)
 
-		h := api.NewPlayerHandler(mt.Coll)
+		h := api.NewPlayerHandler(mt.Coll, mt.Coll)
 
 		// Simulate an insert failure
-		mt.AddMockResponses(bson.D{{"ok", 0}, {"errmsg", "insertion error"}})
+		mt.AddMockResponses(bson.D{{Key: "ok", Value: 0}, {Key: "errmsg", Value: "insertion error"}})
 
 		h.CreatePlayerState(c)
 
@@ -124,6 +196,61 @@ func TestCreatePlayerState_InsertFailed(t *testing.T) {
 	})
 }
 
+func TestCreatePlayerState_AlreadyExists(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("existing player returned", func(mt *mtest.T) {
+		wixID := uuid.New()
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(jsonRequest(http.MethodPost, models.PostPlayersJSONRequestBody{
+			Email: "retry@example.com",
+			WixID: wixID,
+		}), rec)
+
+		h := api.NewPlayerHandler(mt.Coll, mt.Coll)
+
+		mt.AddMockResponses(
+			mtest.CreateWriteErrorsResponse(mtest.WriteError{Index: 0, Code: 11000, Message: "duplicate key error"}),
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, bson.D{
+				{Key: "wixID", Value: wixID},
+				{Key: "email", Value: "first@example.com"},
+			}),
+		)
+
+		err := h.CreatePlayerState(c)
+
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, rec.Code)
+		var player models.Player
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &player))
+		assert.Equal(t, openapi_types.Email("first@example.com"), player.Email)
+		assert.Len(t, stagedEvents(mt), 1, "the PlayerCreated event is only staged on the insert that failed")
+		assert.Len(t, mt.GetAllStartedEvents(), 2, "the existing player is not written")
+	})
+}
+
+func TestCreatePlayerState_Conflict(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("conflict requested", func(mt *mtest.T) {
+		req := jsonRequest(http.MethodPost, models.PostPlayersJSONRequestBody{Email: "retry@example.com", WixID: uuid.New()})
+		req.URL.RawQuery = "onConflict=error"
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(req, rec)
+
+		h := api.NewPlayerHandler(mt.Coll, mt.Coll)
+
+		mt.AddMockResponses(mtest.CreateWriteErrorsResponse(mtest.WriteError{Index: 0, Code: 11000, Message: "duplicate key error"}))
+
+		h.CreatePlayerState(c)
+
+		assert.Equal(t, http.StatusConflict, rec.Code)
+		assert.Contains(t, rec.Body.String(), "Player already exists")
+	})
+}
+
 func TestCreatePlayerState_EmptyRequestBody(t *testing.T) {
 	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
 	defer mt.Close()
@@ -134,7 +261,7 @@ func TestCreatePlayerState_EmptyRequestBody(t *testing.T) {
 		rec := httptest.NewRecorder()
 		c := e.NewContext(req, rec)
 
-		h := api.NewPlayerHandler(mt.Coll)
+		h := api.NewPlayerHandler(mt.Coll, mt.Coll)
 
 		h.CreatePlayerState(c)
 
@@ -162,7 +289,7 @@ func TestCreatePlayerState_FieldTypeMismatch(t *testing.T) {
 		e := echo.New()
 		c := e.NewContext(req, rec)
 
-		h := api.NewPlayerHandler(mt.Coll)
+		h := api.NewPlayerHandler(mt.Coll, mt.Coll)
 
 		h.CreatePlayerState(c)
 		assert.Equal(t, `"Failed to bind the request to the player"`, strings.TrimSuffix(rec.Body.String(), "\n"))
@@ -192,12 +319,12 @@ func TestGetPlayerStateByWixID_PlayerFound(t *testing.T) {
 		c := e.NewContext(req, rec)
 		c.Set("wixID", wixID.String())
 
-		h := api.NewPlayerHandler(mt.Coll)
+		h := api.NewPlayerHandler(mt.Coll, mt.Coll)
 
 		// Use a string as the mock return value for "wixID" instead of binary.
-		mt.AddMockResponses(mtest.CreateCursorResponse(1, "foo.bar", mtest.FirstBatch, bson.D{
-			{"wixID", playerState.WixID},
-			{"email", playerState.Email},
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, bson.D{
+			{Key: "wixID", Value: playerState.WixID},
+			{Key: "email", Value: playerState.Email},
 		}))
 
 		h.GetPlayerStateByWixID(c, wixID.String())
@@ -221,7 +348,7 @@ func TestGetPlayerStateByWixID_InvalidWixID(t *testing.T) {
 		c := e.NewContext(req, rec)
 		c.Set("wixID", wixID)
 
-		h := api.NewPlayerHandler(mt.Coll)
+		h := api.NewPlayerHandler(mt.Coll, mt.Coll)
 		h.GetPlayerStateByWixID(c, wixID)
 
 		assert.Equal(t, http.StatusBadRequest, rec.Code)
@@ -242,7 +369,9 @@ func TestGetPlayerStateByWixID_PlayerNotFound(t *testing.T) {
 		c := e.NewContext(req, rec)
 		c.Set("wixID", wixID.String())
 
-		h := api.NewPlayerHandler(mt.Coll)
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch))
+
+		h := api.NewPlayerHandler(mt.Coll, mt.Coll)
 		h.GetPlayerStateByWixID(c, wixID.String())
 
 		assert.Equal(t, http.StatusNotFound, rec.Code)
@@ -262,7 +391,7 @@ func TestUpdatePlayerState_InvalidWixID(t *testing.T) {
 		rec := httptest.NewRecorder()
 		c := e.NewContext(req, rec)
 
-		h := api.NewPlayerHandler(mt.Coll)
+		h := api.NewPlayerHandler(mt.Coll, mt.Coll)
 		h.UpdatePlayerState(c, "invalidUUID", models.PatchPlayersPlayerIdJSONRequestBody{})
 
 		assert.Equal(t, http.StatusBadRequest, rec.Code)
@@ -281,7 +410,7 @@ func TestUpdatePlayerState_NoStoryStates(t *testing.T) {
 		rec := httptest.NewRecorder()
 		c := e.NewContext(req, rec)
 
-		h := api.NewPlayerHandler(mt.Coll)
+		h := api.NewPlayerHandler(mt.Coll, mt.Coll)
 		h.UpdatePlayerState(c, wixID, models.PatchPlayersPlayerIdJSONRequestBody{})
 		assert.Equal(t, http.StatusBadRequest, rec.Code)
 		assert.Contains(t, rec.Body.String(), "No story states provided")
@@ -318,18 +447,63 @@ func TestUpdatePlayerState_ValidUpdate(t *testing.T) {
 		rec := httptest.NewRecorder()
 		c := e.NewContext(req, rec)
 
-		// Mock the first update response for setting wisdom details
-		// mt.AddMockResponses(mtest.CreateWriteErrorsResponse(errors.New("duplicate"), 11000))
-
-		// Mock the second update response for adding new wisdom
-		mt.AddMockResponses(mtest.CreateSuccessResponse())
+		// Mock the player lookup, the email update and the update setting the wisdom details
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, playerDocument(playerWixID, storyID, "testStoryNodeID")),
+			matchedResponse(),
+			matchedResponse(),
+		)
 
-		h := api.NewPlayerHandler(mt.Coll)
+		h := api.NewPlayerHandler(mt.Coll, mt.Coll)
 
 		err := h.UpdatePlayerState(c, playerID, playerUpdate)
 		assert.Nil(t, err)
 		assert.Equal(t, http.StatusOK, rec.Code)
 		assert.Contains(t, rec.Body.String(), "Player state updated successfully")
+		assert.Len(t, mt.GetAllStartedEvents(), 3, "an existing wisdom is not pushed again")
+	})
+}
+
+func TestUpdatePlayerState_NewWisdom(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("new wisdom pushed", func(mt *mtest.T) {
+		wixID := uuid.New()
+		playerUpdate := models.PatchPlayersPlayerIdJSONRequestBody{
+			StoryStates: &[]models.StoryState{{
+				CurrentStoryNodeID: "start",
+				StoryID:            "s",
+				Wisdoms:            &[]models.Wisdom{{Name: "Courage", WisdomID: "courage"}},
+			}},
+		}
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(httptest.NewRequest(http.MethodPatch, "/", nil), rec)
+
+		// Mock the player lookup, the wisdom update matching no wisdom and the push
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, playerDocument(wixID, "s", "start")),
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 0}, bson.E{Key: "nModified", Value: 0}),
+			matchedResponse(),
+		)
+
+		h := api.NewPlayerHandler(mt.Coll, mt.Coll)
+
+		err := h.UpdatePlayerState(c, wixID.String(), playerUpdate)
+
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, rec.Code)
+		started := mt.GetAllStartedEvents()
+		if assert.Len(t, started, 3) {
+			filter := started[1].Command.Lookup("updates").Array().Index(0).Value().Document().Lookup("q")
+			assert.Equal(t, "courage", filter.Document().Lookup("storyStates", "$elemMatch", "wisdoms.wisdomID").StringValue(),
+				"the wisdom update only matches a story state holding the wisdom")
+			pushed := started[2].Command.Lookup("updates").Array().Index(0).Value().Document().Lookup("u", "$push", "storyStates.$.wisdoms")
+			assert.Equal(t, "courage", pushed.Document().Lookup("wisdomID").StringValue())
+		}
+		if staged := stagedEvents(mt); assert.Len(t, staged, 1) {
+			assert.Equal(t, models.WisdomGranted, staged[0].Type)
+		}
 	})
 }
 
@@ -353,16 +527,27 @@ func TestUpdatePlayerState_Success(t *testing.T) {
 		c := e.NewContext(req, rec)
 		c.Set("wixID", wixID.String())
 
-		h := api.NewPlayerHandler(mt.Coll)
+		h := api.NewPlayerHandler(mt.Coll, mt.Coll)
 
-		mt.AddMockResponses(mtest.CreateCursorResponse(1, "foo.bar", mtest.FirstBatch, bson.D{
-			{"wixID", playerState.WixID},
-			{"email", playerState.Email},
-		}))
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, bson.D{
+			{Key: "wixID", Value: playerState.WixID},
+			{Key: "email", Value: "old@example.com"},
+		}), matchedResponse())
 
 		err := h.UpdatePlayerState(c, wixID.String(), *playerState)
 		assert.Nil(t, err)
 		assert.Equal(t, http.StatusOK, rec.Code)
+
+		// An email-only body is written, not just acknowledged.
+		var update bson.Raw
+		for _, event := range mt.GetAllStartedEvents() {
+			if event.CommandName == "update" {
+				update = event.Command.Lookup("updates").Array().Index(0).Value().Document().Lookup("u").Document()
+			}
+		}
+		if assert.NotNil(t, update) {
+			assert.Equal(t, string(email), update.Lookup("$set", "email").StringValue())
+		}
 	})
 }
 
@@ -389,7 +574,11 @@ func TestUpdatePlayerState_FailedUpdate(t *testing.T) {
 	mt.Run("player update failed", func(mt *mtest.T) {
 		wixID := uuid.New()
 		playerState := models.PatchPlayersPlayerIdJSONRequestBody{
-			// populate the fields
+			StoryStates: &[]models.StoryState{{
+				CurrentStoryNodeID: "start",
+				StoryID:            "someStoryID",
+				Wisdoms:            &[]models.Wisdom{{Name: "Test Wisdom", WisdomID: "someWisdomID"}},
+			}},
 		}
 
 		req := httptest.NewRequest("PATCH", fmt.Sprintf("/player/%s", wixID), nil)
@@ -398,12 +587,609 @@ func TestUpdatePlayerState_FailedUpdate(t *testing.T) {
 		c := e.NewContext(req, rec)
 		c.Set("wixID", wixID.String())
 
-		h := api.NewPlayerHandler(mt.Coll)
+		h := api.NewPlayerHandler(mt.Coll, mt.Coll)
 
-		mt.AddMockResponses( /* mock to simulate failed UpdateOne */ )
+		// No player matches the Wix ID
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch))
 
 		h.UpdatePlayerState(c, wixID.String(), playerState)
 		assert.Equal(t, "\"Player not found or update failed\"", strings.TrimSuffix(rec.Body.String(), "\n"))
 		assert.Equal(t, http.StatusNotFound, rec.Code)
 	})
 }
+
+// PatchPlayerState
+
+func TestPatchPlayerState_ChangesEmail(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("email changed by merge patch", func(mt *mtest.T) {
+		wixID := uuid.New()
+		updatedAt := time.Date(2023, 11, 1, 12, 0, 0, 0, time.UTC)
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(patchRequest(api.MIMEMergePatch, `{"email":"new@example.com"}`), rec)
+
+		h := api.NewPlayerHandler(mt.Coll, mt.Coll)
+
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch,
+				append(playerDocument(wixID, "s", "start"), bson.E{Key: "updatedAt", Value: updatedAt})),
+			matchedResponse(),
+		)
+
+		err := h.PatchPlayerState(c, wixID.String())
+
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, rec.Code)
+		update := mt.GetAllStartedEvents()[1].Command.Lookup("updates").Array().Index(0).Value().Document()
+		set, _ := update.Lookup("u", "$set").Document().Elements()
+		assert.Len(t, set, 2, "email and updatedAt")
+		assert.Equal(t, "new@example.com", update.Lookup("u", "$set", "email").StringValue())
+		assert.Equal(t, updatedAt, update.Lookup("q", "updatedAt").Time().UTC(), "guarded by the timestamp that was read")
+	})
+}
+
+func TestPatchPlayerState_AddsWisdom(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("wisdom added by JSON Patch", func(mt *mtest.T) {
+		wixID := uuid.New()
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(patchRequest(api.MIMEJSONPatch,
+			`[{"op":"add","path":"/storyStates/0/wisdoms/-","value":{"wisdomID":"w2","name":"Second"}}]`), rec)
+
+		h := api.NewPlayerHandler(mt.Coll, mt.Coll)
+
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, playerDocument(wixID, "s", "start", "w1")),
+			matchedResponse(),
+		)
+
+		h.PatchPlayerState(c, wixID.String())
+
+		assert.Equal(t, http.StatusOK, rec.Code)
+		update := mt.GetAllStartedEvents()[1].Command.Lookup("updates").Array().Index(0).Value().Document()
+		wisdoms := update.Lookup("u", "$set", "storyStates.0.wisdoms").Array()
+		values, _ := wisdoms.Values()
+		assert.Len(t, values, 2)
+		staged := stagedEvents(mt)
+		if assert.Len(t, staged, 1) {
+			assert.Equal(t, models.WisdomGranted, staged[0].Type)
+			assert.Equal(t, "w2", staged[0].Wisdom.WisdomID)
+		}
+	})
+}
+
+func TestPatchPlayerState_RemovesWisdom(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("wisdom removed by JSON Patch", func(mt *mtest.T) {
+		wixID := uuid.New()
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(patchRequest(api.MIMEJSONPatch,
+			`[{"op":"test","path":"/storyStates/0/wisdoms/0/wisdomID","value":"w1"},{"op":"remove","path":"/storyStates/0/wisdoms/0"}]`), rec)
+
+		h := api.NewPlayerHandler(mt.Coll, mt.Coll)
+
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, playerDocument(wixID, "s", "start", "w1", "w2")),
+			matchedResponse(),
+		)
+
+		h.PatchPlayerState(c, wixID.String())
+
+		assert.Equal(t, http.StatusOK, rec.Code)
+		var player models.Player
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &player))
+		assert.Equal(t, []models.Wisdom{{WisdomID: "w2", Name: "w2"}}, *(*player.StoryStates)[0].Wisdoms)
+	})
+}
+
+func TestPatchPlayerState_WixIDImmutable(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("Wix ID cannot be patched", func(mt *mtest.T) {
+		wixID := uuid.New()
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(patchRequest(api.MIMEMergePatch, fmt.Sprintf(`{"wixID":%q}`, uuid.NewString())), rec)
+
+		h := api.NewPlayerHandler(mt.Coll, mt.Coll)
+
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, playerDocument(wixID, "s", "start")))
+
+		h.PatchPlayerState(c, wixID.String())
+
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+		assert.Contains(t, rec.Body.String(), "The wixID of a player cannot be changed")
+	})
+}
+
+func TestPatchPlayerState_ConcurrentChange(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("player changed since it was read", func(mt *mtest.T) {
+		wixID := uuid.New()
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(patchRequest(api.MIMEMergePatch, `{"email":"new@example.com"}`), rec)
+
+		h := api.NewPlayerHandler(mt.Coll, mt.Coll)
+
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, playerDocument(wixID, "s", "start")),
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 0}),
+		)
+
+		h.PatchPlayerState(c, wixID.String())
+
+		assert.Equal(t, http.StatusConflict, rec.Code)
+	})
+}
+
+func TestPatchPlayerState_InvalidEmail(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("patched email must be valid", func(mt *mtest.T) {
+		wixID := uuid.New()
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(patchRequest(api.MIMEMergePatch, `{"email":"not an email"}`), rec)
+
+		h := api.NewPlayerHandler(mt.Coll, mt.Coll)
+
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, playerDocument(wixID, "s", "start")))
+
+		h.PatchPlayerState(c, wixID.String())
+
+		assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+	})
+}
+
+// TakeChoice
+
+type publishedEvents struct {
+	events []models.DomainEvent
+}
+
+func (p *publishedEvents) Publish(ctx context.Context, event models.DomainEvent) error {
+	p.events = append(p.events, event)
+	return nil
+}
+
+// stagedEvents returns the events staged on players by the commands sent so far, in order.
+func stagedEvents(mt *mtest.T) []models.DomainEvent {
+	var staged []models.DomainEvent
+	for _, event := range mt.GetAllStartedEvents() {
+		var batches []bson.RawValue
+		switch event.CommandName {
+		case "insert":
+			documents, _ := event.Command.Lookup("documents").Array().Values()
+			for _, document := range documents {
+				if batch, err := document.Document().LookupErr("pendingEvents"); err == nil {
+					batches = append(batches, batch)
+				}
+			}
+		case "update":
+			updates, _ := event.Command.Lookup("updates").Array().Values()
+			for _, update := range updates {
+				if batch, err := update.Document().LookupErr("u", "$push", "pendingEvents", "$each"); err == nil {
+					batches = append(batches, batch)
+				}
+			}
+		}
+		for _, batch := range batches {
+			var events []models.DomainEvent
+			if err := batch.Unmarshal(&events); err == nil {
+				staged = append(staged, events...)
+			}
+		}
+	}
+	return staged
+}
+
+func playerDocument(wixID uuid.UUID, storyID, nodeID string, wisdomIDs ...string) bson.D {
+	wisdoms := bson.A{}
+	for _, wisdomID := range wisdomIDs {
+		wisdoms = append(wisdoms, bson.D{{Key: "wisdomID", Value: wisdomID}, {Key: "name", Value: wisdomID}})
+	}
+	return bson.D{
+		{Key: "wixID", Value: wixID},
+		{Key: "email", Value: "test@example.com"},
+		{Key: "storyStates", Value: bson.A{bson.D{
+			{Key: "storyID", Value: storyID},
+			{Key: "currentStoryNodeID", Value: nodeID},
+			{Key: "wisdoms", Value: wisdoms},
+		}}},
+	}
+}
+
+func storyElementDocument(storyID, nodeID string, choices ...bson.D) bson.D {
+	choiceDocs := bson.A{}
+	for _, choice := range choices {
+		choiceDocs = append(choiceDocs, choice)
+	}
+	return bson.D{
+		{Key: "storyID", Value: storyID},
+		{Key: "nodeID", Value: nodeID},
+		{Key: "content", Value: "content of " + nodeID},
+		{Key: "choices", Value: choiceDocs},
+	}
+}
+
+func endingDocument(storyID, nodeID, endingID string, outcome models.EndingOutcome) bson.D {
+	return append(storyElementDocument(storyID, nodeID), bson.E{Key: "ending", Value: bson.D{
+		{Key: "endingID", Value: endingID},
+		{Key: "title", Value: "Title of " + endingID},
+		{Key: "outcome", Value: string(outcome)},
+	}})
+}
+
+func choiceRequest(index int) *http.Request {
+	body, _ := json.Marshal(models.TakeChoiceRequest{ChoiceIndex: index})
+	req := httptest.NewRequest(http.MethodPost, "/", bytes.NewBuffer(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	return req
+}
+
+func TestTakeChoice_Advanced(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("player advanced", func(mt *mtest.T) {
+		wixID := uuid.New()
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(choiceRequest(0), rec)
+
+		h := api.NewPlayerHandler(mt.Coll, mt.Coll)
+
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, playerDocument(wixID, "s", "start")),
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, storyElementDocument("s", "start",
+				bson.D{{Key: "description", Value: "Enter"}, {Key: "nextNodeID", Value: "cave"}})),
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, endingDocument("s", "cave", "lost", models.EndingOutcomeBad)),
+			matchedResponse(),
+			matchedResponse(),
+		)
+
+		err := h.TakeChoice(c, wixID.String(), "s")
+
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Contains(t, rec.Body.String(), `"nodeID":"cave"`)
+		staged := stagedEvents(mt)
+		if assert.Len(t, staged, 3) {
+			assert.Equal(t, models.ChoiceTaken, staged[0].Type)
+			assert.Equal(t, "start", staged[0].Choice.FromNodeID)
+			assert.Equal(t, "cave", staged[0].Choice.ToNodeID)
+			assert.True(t, *staged[0].Choice.Completed)
+			assert.Equal(t, models.NodeEntered, staged[1].Type)
+			assert.Equal(t, models.StoryCompleted, staged[2].Type)
+			assert.Equal(t, "lost", staged[2].Ending.EndingID)
+		}
+
+		started := mt.GetAllStartedEvents()
+		set := started[3].Command.Lookup("updates").Array().Index(0).Value().Document().Lookup("u", "$set").Document()
+		assert.True(t, set.Lookup("storyStates.$.completed").Boolean())
+		assert.Equal(t, "lost", set.Lookup("storyStates.$.ending", "endingID").StringValue())
+		discovered := started[4].Command.Lookup("updates").Array().Index(0).Value().Document().Lookup("u", "$push", "storyStates.$.endingsDiscovered").Document()
+		assert.Equal(t, "cave", discovered.Lookup("nodeID").StringValue())
+	})
+}
+
+func TestTakeChoice_ConcurrentChoice(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("player moved on meanwhile", func(mt *mtest.T) {
+		wixID := uuid.New()
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(choiceRequest(0), rec)
+
+		h := api.NewPlayerHandler(mt.Coll, mt.Coll)
+
+		// Another choice moved the player away from start before this one was stored
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, playerDocument(wixID, "s", "start")),
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, storyElementDocument("s", "start",
+				bson.D{{Key: "description", Value: "Enter"}, {Key: "nextNodeID", Value: "cave"}})),
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, storyElementDocument("s", "cave")),
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 0}, bson.E{Key: "nModified", Value: 0}),
+		)
+
+		err := h.TakeChoice(c, wixID.String(), "s")
+
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusConflict, rec.Code)
+		started := mt.GetAllStartedEvents()
+		filter := started[3].Command.Lookup("updates").Array().Index(0).Value().Document().Lookup("q").Document()
+		assert.Equal(t, "start", filter.Lookup("storyStates", "$elemMatch", "currentStoryNodeID").StringValue(),
+			"the move only applies at the node the choice was taken from")
+	})
+}
+
+func TestGetCurrentStoryElement_SignsMedia(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("asset URLs signed for the player", func(mt *mtest.T) {
+		wixID := uuid.New()
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/", nil), rec)
+
+		h := api.NewPlayerHandler(mt.Coll, mt.Coll)
+		h.Media = api.NewMediaSigner("s3cret")
+
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, playerDocument(wixID, "s", "start")),
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, append(storyElementDocument("s", "start"),
+				bson.E{Key: "videoAssetID", Value: "intro"},
+				bson.E{Key: "videoURL", Value: "/assets/intro/content"},
+				bson.E{Key: "artURL", Value: "https://cdn.example.com/art.png"})),
+		)
+
+		err := h.GetCurrentStoryElement(c, wixID.String(), "s")
+
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, rec.Code)
+		var storyElement models.StoryElement
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &storyElement))
+		if assert.NotNil(t, storyElement.VideoURL) {
+			_, ok := h.Media.Verify("intro", signedQuery(t, *storyElement.VideoURL))
+			assert.True(t, ok)
+		}
+		assert.Equal(t, "https://cdn.example.com/art.png", *storyElement.ArtURL, "URLs that are not assets are left alone")
+		assert.Equal(t, "private, no-store", rec.Header().Get(echo.HeaderCacheControl))
+	})
+
+	mt.Run("no story state", func(mt *mtest.T) {
+		wixID := uuid.New()
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/", nil), rec)
+
+		h := api.NewPlayerHandler(mt.Coll, mt.Coll)
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, playerDocument(wixID, "s", "start")))
+
+		h.GetCurrentStoryElement(c, wixID.String(), "other")
+
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+	})
+}
+
+func TestTakeChoice_Audited(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("move summarized from the stored player", func(mt *mtest.T) {
+		wixID := uuid.New()
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(choiceRequest(0), rec)
+
+		audit := &recordedAudit{}
+		h := api.NewPlayerHandler(mt.Coll, mt.Coll)
+		h.Audit = audit
+
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, playerDocument(wixID, "s", "start", "w1")),
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, storyElementDocument("s", "start",
+				bson.D{{Key: "description", Value: "Enter"}, {Key: "nextNodeID", Value: "cave"}})),
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, storyElementDocument("s", "cave",
+				bson.D{{Key: "description", Value: "Leave"}, {Key: "nextNodeID", Value: "start"}})),
+			matchedResponse(),
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, playerDocument(wixID, "s", "cave", "w1")),
+		)
+
+		h.TakeChoice(c, wixID.String(), "s")
+
+		assert.Equal(t, http.StatusOK, rec.Code)
+		if assert.Len(t, audit.entries, 1) {
+			entry := audit.entries[0]
+			assert.Equal(t, models.AuditActionPlayerChoiceTaken, entry.Action)
+			assert.Equal(t, wixID, *entry.WixID)
+			assert.Equal(t, "cave", *entry.NodeID)
+			assert.Equal(t, "start", entry.Before.Player.Stories[0].CurrentStoryNodeID)
+			assert.Equal(t, []string{"w1"}, *entry.Before.Player.Stories[0].WisdomIDs)
+			assert.Equal(t, "cave", entry.After.Player.Stories[0].CurrentStoryNodeID)
+		}
+	})
+}
+
+func TestTakeChoice_DeadEndDoesNotComplete(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("node without choices or ending", func(mt *mtest.T) {
+		wixID := uuid.New()
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(choiceRequest(0), rec)
+
+		h := api.NewPlayerHandler(mt.Coll, mt.Coll)
+
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, playerDocument(wixID, "s", "start")),
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, storyElementDocument("s", "start",
+				bson.D{{Key: "description", Value: "Enter"}, {Key: "nextNodeID", Value: "cave"}})),
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, storyElementDocument("s", "cave")),
+			matchedResponse(),
+		)
+
+		h.TakeChoice(c, wixID.String(), "s")
+
+		assert.Equal(t, http.StatusOK, rec.Code)
+		staged := stagedEvents(mt)
+		if assert.Len(t, staged, 2) {
+			assert.False(t, *staged[0].Choice.Completed)
+			assert.Equal(t, models.NodeEntered, staged[1].Type)
+		}
+	})
+}
+
+func TestTakeChoice_MissingWisdom(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("choice gated by wisdom", func(mt *mtest.T) {
+		wixID := uuid.New()
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(choiceRequest(0), rec)
+
+		h := api.NewPlayerHandler(mt.Coll, mt.Coll)
+
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, playerDocument(wixID, "s", "start")),
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, storyElementDocument("s", "start",
+				bson.D{{Key: "description", Value: "Enter"}, {Key: "nextNodeID", Value: "cave"}, {Key: "wisdomID", Value: "torch"}})),
+		)
+
+		h.TakeChoice(c, wixID.String(), "s")
+
+		assert.Equal(t, http.StatusForbidden, rec.Code)
+		assert.Contains(t, rec.Body.String(), "Choice requires a wisdom the player does not hold")
+	})
+}
+
+func TestTakeChoice_InvalidChoiceIndex(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("choice index out of range", func(mt *mtest.T) {
+		wixID := uuid.New()
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(choiceRequest(3), rec)
+
+		h := api.NewPlayerHandler(mt.Coll, mt.Coll)
+
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, playerDocument(wixID, "s", "start")),
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, storyElementDocument("s", "start",
+				bson.D{{Key: "description", Value: "Enter"}, {Key: "nextNodeID", Value: "cave"}})),
+		)
+
+		h.TakeChoice(c, wixID.String(), "s")
+
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+		assert.Contains(t, rec.Body.String(), "Invalid choice index")
+	})
+}
+
+func TestTakeChoice_StoryNotStarted(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("no story state for story", func(mt *mtest.T) {
+		wixID := uuid.New()
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(choiceRequest(0), rec)
+
+		h := api.NewPlayerHandler(mt.Coll, mt.Coll)
+
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, playerDocument(wixID, "other", "start")))
+
+		h.TakeChoice(c, wixID.String(), "s")
+
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+		assert.Contains(t, rec.Body.String(), "Story state not found")
+	})
+}
+
+// GetStoryEndings
+
+func TestGetStoryEndings(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("discovered endings listed", func(mt *mtest.T) {
+		wixID := uuid.New()
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/", nil), rec)
+
+		h := api.NewPlayerHandler(mt.Coll, mt.Coll)
+
+		player := playerDocument(wixID, "s", "cave")
+		storyState := player[2].Value.(bson.A)[0].(bson.D)
+		player[2].Value = bson.A{append(storyState, bson.E{Key: "endingsDiscovered", Value: bson.A{bson.D{
+			{Key: "endingID", Value: "lost"},
+			{Key: "title", Value: "Lost"},
+			{Key: "outcome", Value: "bad"},
+			{Key: "nodeID", Value: "cave"},
+			{Key: "discoveredAt", Value: time.Now()},
+		}}})}
+
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, player),
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch,
+				endingDocument("s", "cave", "lost", models.EndingOutcomeBad),
+				endingDocument("s", "throne", "crowned", models.EndingOutcomeGood)),
+		)
+
+		err := h.GetStoryEndings(c, wixID.String(), "s")
+
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, rec.Code)
+		var endings models.StoryEndings
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &endings))
+		assert.Equal(t, 2, endings.Total)
+		if assert.Len(t, endings.Discovered, 1) {
+			assert.Equal(t, "lost", endings.Discovered[0].EndingID)
+		}
+	})
+}
+
+// ListPlayers
+
+func TestListPlayers_Summaries(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("summaries with next cursor", func(mt *mtest.T) {
+		first, second := uuid.New(), uuid.New()
+		req := httptest.NewRequest(http.MethodGet, "/?limit=1&emailPrefix=ann.&storyID=s&completed=true&createdFrom=2023-01-01T00:00:00Z", nil)
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(req, rec)
+
+		h := api.NewPlayerHandler(mt.Coll, mt.Coll)
+
+		completedState := playerDocument(first, "s", "end")
+		storyState := completedState[2].Value.(bson.A)[0].(bson.D)
+		completedState[2].Value = bson.A{append(storyState, bson.E{Key: "completed", Value: true})}
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch,
+			completedState, playerDocument(second, "s", "start")))
+
+		err := h.ListPlayers(c)
+
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.NotContains(t, rec.Body.String(), "wisdoms")
+		var page models.PlayerPage
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &page))
+		if assert.Len(t, page.Items, 1) {
+			assert.Equal(t, first, page.Items[0].WixID)
+			assert.Equal(t, []models.PlayerStorySummary{{StoryID: "s", CurrentStoryNodeID: "end", Completed: true}}, page.Items[0].Stories)
+		}
+		assert.NotNil(t, page.NextCursor)
+
+		filter := mt.GetStartedEvent().Command.Lookup("filter").Document()
+		pattern, _ := filter.Lookup("email").Regex()
+		assert.Equal(t, `^ann\.`, pattern)
+		assert.Equal(t, "s", filter.Lookup("storyStates", "$elemMatch", "storyID").StringValue())
+		assert.True(t, filter.Lookup("storyStates", "$elemMatch", "completed").Boolean())
+		_, err = filter.LookupErr("createdAt", "$gte")
+		assert.NoError(t, err)
+	})
+}
+
+func TestListPlayers_InvalidFilter(t *testing.T) {
+	for _, query := range []string{"limit=abc", "completed=sometimes", "updatedTo=yesterday", "cursor=bm90LWEtdXVpZA"} {
+		req := httptest.NewRequest(http.MethodGet, "/?"+query, nil)
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(req, rec)
+
+		h := api.NewPlayerHandler(nil, nil)
+		h.ListPlayers(c)
+
+		assert.Equal(t, http.StatusBadRequest, rec.Code, query)
+	}
+}
@@ -0,0 +1,276 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// APIKeyHeader carries the key identifying an API client. It is not checked
+// against anything; a client presenting one gets a rate limit budget of its own
+// on top of the budget of its address.
+const APIKeyHeader = "X-API-Key"
+
+// Headers of rate limited responses, after the IETF RateLimit header fields draft.
+const (
+	RateLimitLimitHeader     = "RateLimit-Limit"
+	RateLimitRemainingHeader = "RateLimit-Remaining"
+	RateLimitResetHeader     = "RateLimit-Reset"
+	RateLimitPolicyHeader    = "RateLimit-Policy"
+)
+
+// Rate limit classes, each with a budget of its own.
+const (
+	// RateClassRead is every reading request.
+	RateClassRead = "read"
+
+	// RateClassWrite is every mutating request to players and parties.
+	RateClassWrite = "write"
+
+	// RateClassAuthor is every mutating request to story elements and assets.
+	RateClassAuthor = "author"
+)
+
+// sweepEvery is how many takes the in-memory store handles between sweeps of
+// the buckets that have refilled.
+const sweepEvery = 1024
+
+// RateLimit is a token bucket budget: Requests may be made at once, and the
+// budget refills at Requests per Per. A budget of no requests is unlimited.
+type RateLimit struct {
+	Requests int           `yaml:"requests"`
+	Per      time.Duration `yaml:"per"`
+}
+
+// RateLimits are the budgets of the rate limit classes.
+type RateLimits struct {
+	Read   RateLimit `yaml:"read"`
+	Write  RateLimit `yaml:"write"`
+	Author RateLimit `yaml:"author"`
+}
+
+// DefaultRateLimits are the budgets used unless configured otherwise. Authors
+// import stories a node at a time, so they get more room than players.
+var DefaultRateLimits = RateLimits{
+	Read:   RateLimit{Requests: 600, Per: time.Minute},
+	Write:  RateLimit{Requests: 120, Per: time.Minute},
+	Author: RateLimit{Requests: 300, Per: time.Minute},
+}
+
+// For returns the budget of a rate limit class.
+func (l RateLimits) For(class string) RateLimit {
+	switch class {
+	case RateClassWrite:
+		return l.Write
+	case RateClassAuthor:
+		return l.Author
+	}
+	return l.Read
+}
+
+// RateDecision is the state of a token bucket once a request has taken from it.
+type RateDecision struct {
+	Allowed   bool
+	Remaining int
+
+	// Reset is how long until the bucket is full again.
+	Reset time.Duration
+
+	// RetryAfter is how long until a request that was not allowed can be retried.
+	RetryAfter time.Duration
+}
+
+// RateLimitStore keeps the token buckets. The in-memory store limits every
+// instance of the API on its own; a store shared by the instances, such as one
+// backed by Redis, limits them together.
+type RateLimitStore interface {
+	// Take takes a token from the bucket of key at time now. A key without a
+	// bucket gets a full one with the given budget.
+	Take(ctx context.Context, key string, limit RateLimit, now time.Time) (RateDecision, error)
+}
+
+// bucket is a token bucket of the in-memory store.
+type bucket struct {
+	tokens  float64
+	updated time.Time
+
+	// full is when the bucket will have refilled, after which it is no
+	// different from a missing one and can be swept.
+	full time.Time
+}
+
+// MemoryRateLimitStore is a RateLimitStore keeping the buckets in memory.
+// Buckets that have refilled are swept every so often, so that the memory used
+// is bounded by the clients active within a budget's period.
+type MemoryRateLimitStore struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	takes   int
+}
+
+// NewMemoryRateLimitStore creates an empty in-memory store.
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{buckets: map[string]*bucket{}}
+}
+
+// Take takes a token from the bucket of key. It never fails.
+func (s *MemoryRateLimitStore) Take(ctx context.Context, key string, limit RateLimit, now time.Time) (RateDecision, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.takes++
+	if s.takes%sweepEvery == 0 {
+		for k, b := range s.buckets {
+			if !now.Before(b.full) {
+				delete(s.buckets, k)
+			}
+		}
+	}
+
+	capacity := float64(limit.Requests)
+	perSecond := capacity / limit.Per.Seconds()
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &bucket{tokens: capacity, updated: now}
+		s.buckets[key] = b
+	}
+	if elapsed := now.Sub(b.updated).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(capacity, b.tokens+elapsed*perSecond)
+		b.updated = now
+	}
+
+	decision := RateDecision{}
+	if b.tokens >= 1 {
+		b.tokens--
+		decision.Allowed = true
+	} else {
+		decision.RetryAfter = seconds((1 - b.tokens) / perSecond)
+	}
+	decision.Remaining = int(b.tokens)
+	decision.Reset = seconds((capacity - b.tokens) / perSecond)
+	b.full = now.Add(decision.Reset)
+	return decision, nil
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+// RateLimiter throttles clients with token buckets. Every request takes a token
+// from the bucket of its address, of its API key if it presents one and of the
+// player if its route names one, each in the budget of the request's class, and
+// is rejected with a 429 status code once any of them is empty. Probes and
+// metrics are not limited.
+type RateLimiter struct {
+	// Store keeps the token buckets.
+	Store RateLimitStore
+
+	// Limits are the budgets of the classes.
+	Limits RateLimits
+
+	now func() time.Time
+}
+
+// NewRateLimiter creates a RateLimiter with the default budgets, keeping its
+// buckets in the given store.
+func NewRateLimiter(store RateLimitStore) *RateLimiter {
+	return &RateLimiter{
+		Store:  store,
+		Limits: DefaultRateLimits,
+		now:    time.Now,
+	}
+}
+
+// Middleware is the echo middleware applying the rate limits. Every response
+// carries the RateLimit headers of the emptiest bucket the request took from,
+// and rejected ones a Retry-After header as well. Should the store fail, the
+// request is let through.
+func (r *RateLimiter) Middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		class := rateClass(c)
+		if class == "" {
+			return next(c)
+		}
+		limit := r.Limits.For(class)
+		if limit.Requests <= 0 {
+			return next(c)
+		}
+
+		ctx := c.Request().Context()
+		now := r.now()
+		var tightest *RateDecision
+		for _, key := range rateKeys(c, class) {
+			decision, err := r.Store.Take(ctx, key, limit, now)
+			if err != nil {
+				slog.WarnContext(ctx, "Failed to apply rate limit", "class", class, "error", err)
+				continue
+			}
+			if tightest == nil || tighter(decision, *tightest) {
+				tightest = &decision
+			}
+		}
+		if tightest == nil {
+			return next(c)
+		}
+
+		header := c.Response().Header()
+		header.Set(RateLimitLimitHeader, strconv.Itoa(limit.Requests))
+		header.Set(RateLimitRemainingHeader, strconv.Itoa(tightest.Remaining))
+		header.Set(RateLimitResetHeader, strconv.Itoa(ceilSeconds(tightest.Reset)))
+		header.Set(RateLimitPolicyHeader, fmt.Sprintf("%d;w=%d", limit.Requests, ceilSeconds(limit.Per)))
+		if !tightest.Allowed {
+			header.Set(echo.HeaderRetryAfter, strconv.Itoa(ceilSeconds(tightest.RetryAfter)))
+			return c.JSON(http.StatusTooManyRequests, "Too many requests")
+		}
+		return next(c)
+	}
+}
+
+// rateClass returns the rate limit class of a request, or "" if it is not limited.
+func rateClass(c echo.Context) string {
+	path := c.Path()
+	switch {
+	case path == "/healthz" || path == "/readyz" || path == "/metrics":
+		return ""
+	case !isMutating(c.Request().Method):
+		return RateClassRead
+	case strings.HasPrefix(path, "/storyElements") || strings.HasPrefix(path, "/stories/") || strings.HasPrefix(path, "/assets"):
+		return RateClassAuthor
+	}
+	return RateClassWrite
+}
+
+// rateKeys returns the keys of the buckets a request takes from.
+func rateKeys(c echo.Context, class string) []string {
+	keys := []string{class + ":ip:" + c.RealIP()}
+	if apiKey := c.Request().Header.Get(APIKeyHeader); apiKey != "" {
+		keys = append(keys, class+":apiKey:"+apiKey)
+	}
+	if wixID := c.Param("wixID"); wixID != "" {
+		keys = append(keys, class+":wixID:"+strings.ToLower(wixID))
+	}
+	return keys
+}
+
+// tighter reports whether decision a constrains the client more than b.
+func tighter(a, b RateDecision) bool {
+	if a.Allowed != b.Allowed {
+		return !a.Allowed
+	}
+	if !a.Allowed {
+		return a.RetryAfter > b.RetryAfter
+	}
+	return a.Remaining < b.Remaining
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
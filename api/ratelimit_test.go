@@ -0,0 +1,145 @@
+package api_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/okcthulhu/ChooseYourOwnAdventure/api"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryRateLimitStore(t *testing.T) {
+	store := api.NewMemoryRateLimitStore()
+	limit := api.RateLimit{Requests: 2, Per: time.Minute}
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	first, _ := store.Take(context.Background(), "k", limit, start)
+	assert.True(t, first.Allowed)
+	assert.Equal(t, 1, first.Remaining)
+	assert.Equal(t, 30*time.Second, first.Reset)
+
+	store.Take(context.Background(), "k", limit, start)
+	denied, _ := store.Take(context.Background(), "k", limit, start)
+	assert.False(t, denied.Allowed)
+	assert.Equal(t, 0, denied.Remaining)
+	assert.Equal(t, 30*time.Second, denied.RetryAfter)
+
+	other, _ := store.Take(context.Background(), "other", limit, start)
+	assert.True(t, other.Allowed, "every key has a bucket of its own")
+
+	refilled, _ := store.Take(context.Background(), "k", limit, start.Add(30*time.Second))
+	assert.True(t, refilled.Allowed, "a token is back after a period per request")
+	assert.Equal(t, 0, refilled.Remaining)
+}
+
+// failingRateLimitStore is a RateLimitStore that cannot be reached.
+type failingRateLimitStore struct{}
+
+func (failingRateLimitStore) Take(ctx context.Context, key string, limit api.RateLimit, now time.Time) (api.RateDecision, error) {
+	return api.RateDecision{}, errors.New("unreachable")
+}
+
+func rateLimitedServer(store api.RateLimitStore, limits api.RateLimits) *echo.Echo {
+	limiter := api.NewRateLimiter(store)
+	limiter.Limits = limits
+
+	e := echo.New()
+	e.Use(limiter.Middleware)
+	ok := func(c echo.Context) error { return c.NoContent(http.StatusOK) }
+	e.GET("/healthz", ok)
+	e.GET("/player/:wixID", ok)
+	e.PATCH("/player/:wixID", ok)
+	e.PUT("/stories/:storyID/elements/:nodeId", ok)
+	return e
+}
+
+func serve(e *echo.Echo, method, path, ip string, header map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	req.RemoteAddr = ip + ":1234"
+	for name, value := range header {
+		req.Header.Set(name, value)
+	}
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestRateLimiter_Middleware(t *testing.T) {
+	limits := api.RateLimits{
+		Read:   api.RateLimit{Requests: 3, Per: time.Minute},
+		Write:  api.RateLimit{Requests: 1, Per: time.Minute},
+		Author: api.RateLimit{Requests: 2, Per: time.Hour},
+	}
+
+	t.Run("headers and rejection once the budget is spent", func(t *testing.T) {
+		e := rateLimitedServer(api.NewMemoryRateLimitStore(), limits)
+
+		rec := serve(e, http.MethodGet, "/player/a", "192.0.2.1", nil)
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "3", rec.Header().Get(api.RateLimitLimitHeader))
+		assert.Equal(t, "2", rec.Header().Get(api.RateLimitRemainingHeader))
+		assert.Equal(t, "20", rec.Header().Get(api.RateLimitResetHeader))
+		assert.Equal(t, "3;w=60", rec.Header().Get(api.RateLimitPolicyHeader))
+
+		serve(e, http.MethodGet, "/player/b", "192.0.2.1", nil)
+		serve(e, http.MethodGet, "/player/c", "192.0.2.1", nil)
+		rec = serve(e, http.MethodGet, "/player/d", "192.0.2.1", nil)
+		assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+		assert.Equal(t, "20", rec.Header().Get(echo.HeaderRetryAfter))
+		assert.Equal(t, "0", rec.Header().Get(api.RateLimitRemainingHeader))
+
+		rec = serve(e, http.MethodGet, "/player/d", "192.0.2.2", nil)
+		assert.Equal(t, http.StatusOK, rec.Code, "other addresses have budgets of their own")
+	})
+
+	t.Run("classes have budgets of their own", func(t *testing.T) {
+		e := rateLimitedServer(api.NewMemoryRateLimitStore(), limits)
+
+		assert.Equal(t, http.StatusOK, serve(e, http.MethodPatch, "/player/a", "192.0.2.1", nil).Code)
+		assert.Equal(t, http.StatusTooManyRequests, serve(e, http.MethodPatch, "/player/b", "192.0.2.1", nil).Code)
+		assert.Equal(t, http.StatusOK, serve(e, http.MethodGet, "/player/a", "192.0.2.1", nil).Code)
+
+		rec := serve(e, http.MethodPut, "/stories/s/elements/start", "192.0.2.1", nil)
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "2", rec.Header().Get(api.RateLimitLimitHeader))
+	})
+
+	t.Run("players are limited across addresses", func(t *testing.T) {
+		e := rateLimitedServer(api.NewMemoryRateLimitStore(), limits)
+
+		assert.Equal(t, http.StatusOK, serve(e, http.MethodPatch, "/player/a", "192.0.2.1", nil).Code)
+		assert.Equal(t, http.StatusTooManyRequests, serve(e, http.MethodPatch, "/player/A", "192.0.2.2", nil).Code)
+	})
+
+	t.Run("API keys are limited across addresses", func(t *testing.T) {
+		e := rateLimitedServer(api.NewMemoryRateLimitStore(), limits)
+		key := map[string]string{api.APIKeyHeader: "k1"}
+
+		assert.Equal(t, http.StatusOK, serve(e, http.MethodPut, "/stories/s/elements/a", "192.0.2.1", key).Code)
+		assert.Equal(t, http.StatusOK, serve(e, http.MethodPut, "/stories/s/elements/b", "192.0.2.2", key).Code)
+		assert.Equal(t, http.StatusTooManyRequests, serve(e, http.MethodPut, "/stories/s/elements/c", "192.0.2.3", key).Code)
+	})
+
+	t.Run("probes and unlimited classes pass through", func(t *testing.T) {
+		e := rateLimitedServer(api.NewMemoryRateLimitStore(), api.RateLimits{Read: api.RateLimit{Requests: 0}})
+
+		for i := 0; i < 5; i++ {
+			assert.Equal(t, http.StatusOK, serve(e, http.MethodGet, "/player/a", "192.0.2.1", nil).Code)
+		}
+		rec := serve(e, http.MethodGet, "/healthz", "192.0.2.1", nil)
+		assert.Empty(t, rec.Header().Get(api.RateLimitLimitHeader))
+	})
+
+	t.Run("requests let through when the store fails", func(t *testing.T) {
+		e := rateLimitedServer(failingRateLimitStore{}, limits)
+
+		rec := serve(e, http.MethodPatch, "/player/a", "192.0.2.1", nil)
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Empty(t, rec.Header().Get(api.RateLimitLimitHeader))
+	})
+}
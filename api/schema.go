@@ -0,0 +1,161 @@
+package api
+
+import (
+	"fmt"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"gopkg.in/yaml.v3"
+)
+
+// componentRef prefixes the references to the component schemas of an OpenAPI document.
+const componentRef = "#/components/schemas/"
+
+// Collections names the collections of the application database.
+type Collections struct {
+	Players         string `yaml:"players"`
+	StoryElements   string `yaml:"storyElements"`
+	ChoiceEvents    string `yaml:"choiceEvents"`
+	Outbox          string `yaml:"outbox"`
+	Parties         string `yaml:"parties"`
+	IdempotencyKeys string `yaml:"idempotencyKeys"`
+	AuditLog        string `yaml:"auditLog"`
+	Assets          string `yaml:"assets"`
+}
+
+// DefaultCollections are the collection names used unless configured otherwise.
+var DefaultCollections = Collections{
+	Players:         "players",
+	StoryElements:   "storyElements",
+	ChoiceEvents:    "choiceEvents",
+	Outbox:          "outbox",
+	Parties:         "parties",
+	IdempotencyKeys: "idempotencyKeys",
+	AuditLog:        "auditLog",
+	Assets:          "assets",
+}
+
+// Schemas maps the collections that are validated to the component schema of the
+// OpenAPI document their documents are stored as.
+func (c Collections) Schemas() map[string]string {
+	return map[string]string{
+		c.Players:       "Player",
+		c.StoryElements: "StoryElement",
+	}
+}
+
+// JSONSchemas converts component schemas of the OpenAPI document spec into MongoDB
+// $jsonSchema documents, keyed by collection as in collections, which maps a
+// collection name to a component name. References are inlined and the OpenAPI
+// types are translated into the BSON types the documents are stored with: UUIDs
+// are binary and date-times are dates. The _id field is left out because stored
+// documents carry an ObjectID, not the string the API exposes.
+func JSONSchemas(spec []byte, collections map[string]string) (map[string]bson.M, error) {
+	var document struct {
+		Components struct {
+			Schemas map[string]interface{} `yaml:"schemas"`
+		} `yaml:"components"`
+	}
+	if err := yaml.Unmarshal(spec, &document); err != nil {
+		return nil, err
+	}
+
+	schemas := make(map[string]bson.M, len(collections))
+	for collection, component := range collections {
+		schema, err := convertSchema(document.Components.Schemas, map[string]interface{}{"$ref": componentRef + component}, map[string]bool{})
+		if err != nil {
+			return nil, fmt.Errorf("schema %s: %w", component, err)
+		}
+		schemas[collection] = schema
+	}
+	return schemas, nil
+}
+
+// convertSchema translates a single OpenAPI schema. seen holds the components being
+// converted further up, so that recursive schemas are reported rather than expanded forever.
+func convertSchema(components map[string]interface{}, schema map[string]interface{}, seen map[string]bool) (bson.M, error) {
+	if ref, ok := schema["$ref"].(string); ok {
+		name := strings.TrimPrefix(ref, componentRef)
+		target, ok := components[name].(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("unresolved reference %q", ref)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("recursive reference %q", ref)
+		}
+		seen[name] = true
+		defer delete(seen, name)
+		return convertSchema(components, target, seen)
+	}
+
+	converted := bson.M{}
+	if description, ok := schema["description"].(string); ok {
+		converted["description"] = description
+	}
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		converted["enum"] = enum
+	}
+
+	switch schema["type"] {
+	case "string":
+		switch schema["format"] {
+		case "uuid":
+			converted["bsonType"] = "binData"
+		case "date-time":
+			converted["bsonType"] = "date"
+		default:
+			converted["bsonType"] = "string"
+		}
+	case "integer":
+		converted["bsonType"] = bson.A{"int", "long"}
+	case "number":
+		converted["bsonType"] = bson.A{"double", "int", "long", "decimal"}
+	case "boolean":
+		converted["bsonType"] = "bool"
+	case "array":
+		converted["bsonType"] = "array"
+		if items, ok := schema["items"].(map[string]interface{}); ok {
+			itemSchema, err := convertSchema(components, items, seen)
+			if err != nil {
+				return nil, err
+			}
+			converted["items"] = itemSchema
+		}
+	case "object":
+		converted["bsonType"] = "object"
+		if properties, ok := schema["properties"].(map[string]interface{}); ok {
+			convertedProperties := bson.M{}
+			for name, property := range properties {
+				propertySchema, ok := property.(map[string]interface{})
+				if !ok || name == "_id" {
+					continue
+				}
+				converted, err := convertSchema(components, propertySchema, seen)
+				if err != nil {
+					return nil, fmt.Errorf("%s: %w", name, err)
+				}
+				convertedProperties[name] = converted
+			}
+			converted["properties"] = convertedProperties
+		}
+		if required, ok := schema["required"].([]interface{}); ok {
+			fields := bson.A{}
+			for _, field := range required {
+				if field != "_id" {
+					fields = append(fields, field)
+				}
+			}
+			if len(fields) > 0 {
+				converted["required"] = fields
+			}
+		}
+		if additional, ok := schema["additionalProperties"].(map[string]interface{}); ok {
+			additionalSchema, err := convertSchema(components, additional, seen)
+			if err != nil {
+				return nil, err
+			}
+			converted["additionalProperties"] = additionalSchema
+		}
+	}
+	return converted, nil
+}
@@ -2,8 +2,12 @@ package api
 
 import (
 	"context"
-	"log"
+	"log/slog"
 	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/labstack/echo/v4"
 	"github.com/okcthulhu/ChooseYourOwnAdventure/api/models"
@@ -23,12 +27,33 @@ type StoryCollection interface {
 	// FindOne locates a single document from the story elements collection based on the filter.
 	// A single result is returned, which can be decoded to access the actual document.
 	FindOne(ctx context.Context, filter interface{}, opts ...*options.FindOneOptions) *mongo.SingleResult
+
+	// Find returns a cursor over all story elements matching the filter.
+	Find(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (*mongo.Cursor, error)
 	UpdateOne(ctx context.Context, filter interface{}, update interface{},
 		opts ...*options.UpdateOptions) (*mongo.UpdateResult, error)
 	DeleteOne(ctx context.Context, filter interface{},
 		opts ...*options.DeleteOptions) (*mongo.DeleteResult, error)
 }
 
+// StoryElementIndexes are the indexes the story elements collection needs to look
+// up, list, filter and search the elements of a story.
+// The (storyID, nodeID) lookup is served by StoryElementIdentityIndex.
+var StoryElementIndexes = []mongo.IndexModel{
+	{Keys: bson.D{{Key: "storyID", Value: 1}, {Key: "chapterName", Value: 1}, {Key: "nodeID", Value: 1}}},
+	{Keys: bson.D{{Key: "storyID", Value: 1}, {Key: "choices.wisdomID", Value: 1}}},
+	{
+		Keys:    bson.D{{Key: "storyID", Value: 1}, {Key: "content", Value: "text"}, {Key: "choices.description", Value: "text"}},
+		Options: options.Index().SetName("storyElementText"),
+	},
+}
+
+// StoryElementIdentityIndex makes (storyID, nodeID) the unique identity of a story element.
+var StoryElementIdentityIndex = mongo.IndexModel{
+	Keys:    bson.D{{Key: "storyID", Value: 1}, {Key: "nodeID", Value: 1}},
+	Options: options.Index().SetName("storyElementIdentity").SetUnique(true),
+}
+
 // StoryHandler is the main orchestrator for the application's HTTP API. It aggregates
 // various dependencies needed to process incoming HTTP requests and produce
 // appropriate responses. The fields in this struct adhere to interfaces, thus
@@ -36,6 +61,35 @@ type StoryCollection interface {
 type StoryHandler struct {
 	// StoryCol is an abstraction for the MongoDB collection containing story elements.
 	StoryCol StoryCollection
+
+	// Events receives a domain event for every story element change. It may be nil.
+	Events EventPublisher
+
+	// Audit records every change to a story element. It may be nil.
+	Audit AuditRecorder
+
+	// Timeouts bounds the storage calls of each operation.
+	Timeouts Timeouts
+
+	// Cache keeps the story elements and whole stories read, and is invalidated
+	// by the changes made through the handler. It may be nil.
+	Cache *StoryCache
+
+	// CacheMaxAge is how long browsers and CDNs may keep the story elements read.
+	CacheMaxAge time.Duration
+
+	// Assets resolves the assets story elements reference to the URLs they are
+	// served at. It may be nil, in which case references are stored unchecked.
+	Assets AssetLookup
+
+	// Paywalls lock the story elements sold separately away from everyone but
+	// the admin; players read them through the player routes. It may be nil, in
+	// which case nothing is locked.
+	Paywalls *Paywalls
+
+	// Media signs the URLs of the assets of the story elements returned to
+	// everyone but the admin. It may be nil, in which case URLs are unsigned.
+	Media *MediaSigner
 }
 
 // NewStoryHandler serves as a factory function for creating a new instance of the StoryHandler struct.
@@ -46,7 +100,9 @@ type StoryHandler struct {
 // the necessary dependencies for database interactions related to both player and story elements.
 func NewStoryHandler(storyCol StoryCollection) *StoryHandler {
 	return &StoryHandler{
-		StoryCol: storyCol,
+		StoryCol:    storyCol,
+		Timeouts:    DefaultTimeouts,
+		CacheMaxAge: DefaultCacheMaxAge,
 	}
 }
 
@@ -62,67 +118,666 @@ func (h *StoryHandler) CreateStoryElement(c echo.Context) error {
 
 	// Add this check to handle an empty request body
 	if storyElement.IsEmpty() { // Assume you have or will implement an IsEmpty method on your struct
-		log.Println("Received empty request body.")
 		return c.JSON(http.StatusBadRequest, "Empty request body")
 	}
 
-	_, err := h.StoryCol.InsertOne(context.Background(), storyElement)
+	if message := validateEnding(storyElement); message != "" {
+		return c.JSON(http.StatusBadRequest, message)
+	}
+	if message := validateOutcomes(storyElement); message != "" {
+		return c.JSON(http.StatusBadRequest, message)
+	}
+	if message := validateTimeLimit(storyElement); message != "" {
+		return c.JSON(http.StatusBadRequest, message)
+	}
+
+	ctx, cancel := h.Timeouts.context(c, "CreateStoryElement")
+	defer cancel()
+
+	if status, message := h.resolveAssets(ctx, storyElement); status != 0 {
+		return c.JSON(status, message)
+	}
+
+	_, err := h.StoryCol.InsertOne(ctx, storyElement)
+	// A write that failed may still have been applied, so the cache is invalidated either way.
+	h.Cache.Invalidate(storyElement.StoryID, storyElement.NodeID)
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, "Failed to create story element")
+		if mongo.IsDuplicateKeyError(err) {
+			return c.JSON(http.StatusConflict, "Story element already exists")
+		}
+		return storageError(c, err, "to insert story element", "Failed to create story element")
 	}
 
+	h.publish(ctx, models.StoryElementCreated, storyElement)
+	h.audit(ctx, storyElementChange(models.AuditActionStoryElementCreated, storyElement.StoryID, storyElement.NodeID, nil, storyElement))
+
 	return c.JSON(http.StatusCreated, storyElement)
 }
 
-// GetStoryElement retrieves a specific story element identified by its NodeId from the database.
-// The function returns a JSON-formatted response containing the details of the story element.
-// If the story element is not found in the database, a 404 status code is returned.
-func (h *StoryHandler) GetStoryElement(c echo.Context, nodeId string) error {
-	filter := bson.M{"nodeID": nodeId}
-	singleResult := h.StoryCol.FindOne(context.Background(), filter)
+// GetStoryElement retrieves a specific story element identified by its story and NodeId from the database.
+// The function returns a JSON-formatted response containing the details of the story element,
+// tagged with an ETag so that a request naming it in If-None-Match gets a 304 status code.
+// A locked story element is only returned to the admin; others get a 402 status code with
+// the product that unlocks it. Others also get the URLs of its assets signed, if media URLs
+// are signed. If the story element is not found in the database, a 404 status code is returned.
+func (h *StoryHandler) GetStoryElement(c echo.Context, storyID string, nodeId string) error {
+	if storyID == "" {
+		return c.JSON(http.StatusBadRequest, "Missing storyID")
+	}
+	if storyElement, ok := h.Cache.element(storyID, nodeId); ok {
+		if locked := h.withheld(c, &storyElement); locked != nil {
+			return c.JSON(http.StatusPaymentRequired, locked)
+		}
+		return respondCacheable(c, h.signed(c, storyElement), h.cacheControl(c))
+	}
+	generation := h.Cache.generation(storyID)
+
+	ctx, cancel := h.Timeouts.context(c, "GetStoryElement")
+	defer cancel()
+
+	filter := bson.M{"storyID": storyID, "nodeID": nodeId}
+	singleResult := h.StoryCol.FindOne(ctx, filter)
 	var storyElement models.StoryElement
 	err := singleResult.Decode(&storyElement)
 	if err != nil {
 		if err == mongo.ErrNoDocuments {
 			return c.JSON(http.StatusNotFound, "Story Element not found")
 		}
-		return c.JSON(http.StatusInternalServerError, "An error occurred")
+		return storageError(c, err, "to load story element", "An error occurred")
+	}
+	h.Cache.putElement(generation, storyElement)
+	if locked := h.withheld(c, &storyElement); locked != nil {
+		return c.JSON(http.StatusPaymentRequired, locked)
+	}
+
+	return respondCacheable(c, h.signed(c, storyElement), h.cacheControl(c))
+}
+
+// ListStoryElements returns a page of the story's elements ordered by node ID. The
+// page can be narrowed with the chapterName, hasVideo, hasArt and wisdomID query
+// parameters and a full-text search in q over the content and choice descriptions.
+// Pages are walked by passing the returned nextCursor as the cursor parameter.
+// Pages are tagged with an ETag like single elements. Locked elements are left out
+// of the pages unless the admin asks, so pages may hold fewer elements than the
+// limit, and the URLs of their assets are signed like those of single elements.
+// Malformed parameters result in a 400 status code.
+func (h *StoryHandler) ListStoryElements(c echo.Context, storyID string) error {
+	limit, ok := parsePageLimit(c.QueryParam("limit"))
+	if !ok {
+		return c.JSON(http.StatusBadRequest, "Invalid limit")
+	}
+
+	filter := bson.M{"storyID": storyID}
+	after := ""
+	if cursor := c.QueryParam("cursor"); cursor != "" {
+		var err error
+		after, err = decodeCursor(cursor)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, "Invalid cursor")
+		}
+		filter["nodeID"] = bson.M{"$gt": after}
+	}
+	narrowed := false
+	if chapterName := c.QueryParam("chapterName"); chapterName != "" {
+		filter["chapterName"] = chapterName
+		narrowed = true
+	}
+	for param, field := range map[string]string{"hasVideo": "videoURL", "hasArt": "artURL"} {
+		value := c.QueryParam(param)
+		if value == "" {
+			continue
+		}
+		present, err := strconv.ParseBool(value)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, "Invalid "+param+" filter")
+		}
+		if present {
+			filter[field] = bson.M{"$nin": bson.A{nil, ""}}
+		} else {
+			filter[field] = bson.M{"$in": bson.A{nil, ""}}
+		}
+		narrowed = true
+	}
+	if wisdomID := c.QueryParam("wisdomID"); wisdomID != "" {
+		// The wisdom ID becomes part of a field path, which must not be tampered with.
+		if strings.ContainsAny(wisdomID, ".$") {
+			return c.JSON(http.StatusBadRequest, "Invalid wisdomID filter")
+		}
+		filter["$or"] = bson.A{
+			bson.M{"choices.wisdomID": wisdomID},
+			bson.M{"wisdoms." + wisdomID: bson.M{"$exists": true}},
+		}
+		narrowed = true
+	}
+	if q := c.QueryParam("q"); q != "" {
+		filter["$text"] = bson.M{"$search": q}
+		narrowed = true
+	}
+
+	ctx, cancel := h.Timeouts.context(c, "ListStoryElements")
+	defer cancel()
+
+	// One extra element tells whether there is a next page.
+	var elements []models.StoryElement
+	if h.Cache != nil && !narrowed {
+		// Pages of the whole story are cut from the cached story.
+		story, err := h.loadStory(ctx, storyID)
+		if err != nil {
+			return storageError(c, err, "to load story", "Failed to list story elements")
+		}
+		start := sort.Search(len(story), func(i int) bool { return story[i].NodeID > after })
+		elements = story[start:min(start+limit+1, len(story))]
+	} else {
+		opts := options.Find().
+			SetSort(bson.D{{Key: "nodeID", Value: 1}}).
+			SetLimit(int64(limit + 1))
+		cursor, err := h.StoryCol.Find(ctx, filter, opts)
+		if err != nil {
+			return storageError(c, err, "to query story elements", "Failed to list story elements")
+		}
+		elements = []models.StoryElement{}
+		if err := cursor.All(ctx, &elements); err != nil {
+			return storageError(c, err, "to decode story elements", "Failed to list story elements")
+		}
+	}
+
+	page := models.StoryElementPage{Items: elements}
+	if len(elements) > limit {
+		page.Items = elements[:limit]
+		next := encodeCursor(page.Items[limit-1].NodeID)
+		page.NextCursor = &next
+	}
+	// The cursor is taken before locked elements are left out, so that no page is skipped.
+	// The items may be shared with the cache, so they are copied rather than changed.
+	if h.Paywalls != nil || h.Media != nil {
+		items := make([]models.StoryElement, 0, len(page.Items))
+		for i := range page.Items {
+			if h.withheld(c, &page.Items[i]) == nil {
+				items = append(items, h.signed(c, page.Items[i]))
+			}
+		}
+		page.Items = items
+	}
+	return respondCacheable(c, page, h.cacheControl(c))
+}
+
+// loadStory returns every element of a story ordered by node ID, from the cache
+// if it has the story. The elements are shared and must not be modified.
+func (h *StoryHandler) loadStory(ctx context.Context, storyID string) ([]models.StoryElement, error) {
+	if story, ok := h.Cache.story(storyID); ok {
+		return story, nil
+	}
+	generation := h.Cache.generation(storyID)
+
+	opts := options.Find().SetSort(bson.D{{Key: "nodeID", Value: 1}})
+	cursor, err := h.StoryCol.Find(ctx, bson.M{"storyID": storyID}, opts)
+	if err != nil {
+		return nil, err
+	}
+	story := []models.StoryElement{}
+	if err := cursor.All(ctx, &story); err != nil {
+		return nil, err
+	}
+	h.Cache.putStory(storyID, generation, story)
+	return story, nil
+}
+
+// MaxNeighborhoodDepth bounds the choices a neighborhood follows.
+const MaxNeighborhoodDepth = 5
+
+// maxNeighborhoodElements bounds the elements of a neighborhood, which grows
+// with the branching of the story.
+const maxNeighborhoodElements = 100
+
+// GetNeighborhood returns a story element together with every element reachable from it
+// within the number of choices given by the depth query parameter, 1 unless given, and the
+// media those elements use, so that clients can preload what the player may see next. Given
+// the wisdoms the player holds in the wisdomIDs query parameter, choices requiring other
+// wisdoms are not followed. Locked elements are neither returned nor followed unless the
+// admin asks, and the media URLs are signed like those of single elements. The response is tagged with an ETag like single elements. A 402 status code
+// is returned if the element itself is locked and a 404 status code if it does not exist.
+func (h *StoryHandler) GetNeighborhood(c echo.Context, storyID string, nodeId string) error {
+	if storyID == "" {
+		return c.JSON(http.StatusBadRequest, "Missing storyID")
+	}
+	depth := 1
+	if value := c.QueryParam("depth"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 0 || parsed > MaxNeighborhoodDepth {
+			return c.JSON(http.StatusBadRequest, "Invalid depth")
+		}
+		depth = parsed
+	}
+	// Without wisdoms every choice is followed.
+	var held map[string]bool
+	if values, ok := c.QueryParams()["wisdomIDs"]; ok {
+		held = map[string]bool{}
+		for _, value := range values {
+			for _, wisdomID := range strings.Split(value, ",") {
+				held[wisdomID] = true
+			}
+		}
+	}
+
+	ctx, cancel := h.Timeouts.context(c, "GetNeighborhood")
+	defer cancel()
+
+	neighborhood := models.StoryNeighborhood{
+		StoryID:  storyID,
+		NodeID:   nodeId,
+		Depth:    depth,
+		Elements: []models.StoryElement{},
+		Preload:  []models.MediaPreload{},
+	}
+	reached := map[string]bool{nodeId: true}
+	preloaded := map[string]bool{}
+	frontier := []string{nodeId}
+	for distance := 0; distance <= depth && len(frontier) > 0 && !neighborhood.Truncated; distance++ {
+		found, err := h.loadElements(ctx, storyID, frontier)
+		if err != nil {
+			return storageError(c, err, "to load story elements", "Failed to load the neighborhood")
+		}
+		if distance == 0 && len(found) == 0 {
+			return c.JSON(http.StatusNotFound, "Story Element not found")
+		}
+
+		var next []string
+		for _, nodeID := range frontier {
+			// Choices may lead to elements that do not exist yet.
+			storyElement, ok := found[nodeID]
+			if !ok {
+				continue
+			}
+			if locked := h.withheld(c, &storyElement); locked != nil {
+				if distance == 0 {
+					return c.JSON(http.StatusPaymentRequired, locked)
+				}
+				continue
+			}
+			if len(neighborhood.Elements) == maxNeighborhoodElements {
+				neighborhood.Truncated = true
+				break
+			}
+			storyElement = h.signed(c, storyElement)
+			neighborhood.Elements = append(neighborhood.Elements, storyElement)
+			neighborhood.Preload = appendPreload(neighborhood.Preload, preloaded, storyElement, distance)
+			if distance == depth || storyElement.Choices == nil {
+				continue
+			}
+			for _, choice := range *storyElement.Choices {
+				if held != nil && choice.WisdomID != nil && !held[*choice.WisdomID] {
+					continue
+				}
+				for _, nodeID := range choiceTargets(choice) {
+					if !reached[nodeID] {
+						reached[nodeID] = true
+						next = append(next, nodeID)
+					}
+				}
+			}
+		}
+		sort.Strings(next)
+		frontier = next
 	}
 
-	return c.JSON(http.StatusOK, storyElement)
+	return respondCacheable(c, neighborhood, h.cacheControl(c))
+}
+
+// loadElements returns the elements of a story with the given node IDs, by node
+// ID, from the cached story if there is a cache.
+func (h *StoryHandler) loadElements(ctx context.Context, storyID string, nodeIDs []string) (map[string]models.StoryElement, error) {
+	found := make(map[string]models.StoryElement, len(nodeIDs))
+	if h.Cache != nil {
+		story, err := h.loadStory(ctx, storyID)
+		if err != nil {
+			return nil, err
+		}
+		for _, nodeID := range nodeIDs {
+			if storyElement, ok := findNode(story, nodeID); ok {
+				found[nodeID] = storyElement
+			}
+		}
+		return found, nil
+	}
+
+	cursor, err := h.StoryCol.Find(ctx, bson.M{"storyID": storyID, "nodeID": bson.M{"$in": nodeIDs}})
+	if err != nil {
+		return nil, err
+	}
+	var elements []models.StoryElement
+	if err := cursor.All(ctx, &elements); err != nil {
+		return nil, err
+	}
+	for _, storyElement := range elements {
+		found[storyElement.NodeID] = storyElement
+	}
+	return found, nil
+}
+
+// appendPreload adds the media of a story element the given number of choices
+// away to preload, skipping the URLs already in it.
+func appendPreload(preload []models.MediaPreload, preloaded map[string]bool, storyElement models.StoryElement, distance int) []models.MediaPreload {
+	add := func(kind models.MediaPreloadKind, url *string) {
+		if url == nil || *url == "" || preloaded[*url] {
+			return
+		}
+		preloaded[*url] = true
+		preload = append(preload, models.MediaPreload{Distance: distance, Kind: kind, NodeID: storyElement.NodeID, Url: *url})
+	}
+	add(models.MediaPreloadKindVideo, storyElement.VideoURL)
+	add(models.MediaPreloadKindArt, storyElement.ArtURL)
+	if storyElement.Choices != nil {
+		for _, choice := range *storyElement.Choices {
+			add(models.MediaPreloadKindChoiceImage, choice.ImageUrl)
+		}
+	}
+	return preload
 }
 
 // UpdateStoryElement modifies an existing story element's state in the database based on the provided updates.
 // The function expects a JSON-formatted request body containing the updated attributes of the story element,
-// as well as the story element's unique NodeId to identify which record to update.
+// as well as the story element's story and NodeId to identify which record to update.
+// The identity of an element cannot be changed, so a body naming a different story or
+// node is rejected with a 400 status code.
 // Upon successful update, the function returns a JSON-formatted response reflecting the modified story element.
 // If the update operation fails or if the specified NodeId does not exist,
 // an appropriate HTTP status code and an error message are returned.
-func (h *StoryHandler) UpdateStoryElement(c echo.Context, nodeId string, storyElement models.PatchStoryElementsNodeIdJSONRequestBody) error {
-	filter := bson.M{"nodeID": nodeId}
+func (h *StoryHandler) UpdateStoryElement(c echo.Context, storyID string, nodeId string, storyElement models.PatchStoryElementsNodeIdJSONRequestBody) error {
+	if storyID == "" {
+		return c.JSON(http.StatusBadRequest, "Missing storyID")
+	}
+	if (storyElement.StoryID != "" && storyElement.StoryID != storyID) || (storyElement.NodeID != "" && storyElement.NodeID != nodeId) {
+		return c.JSON(http.StatusBadRequest, "Story element identity does not match the path")
+	}
+	storyElement.StoryID = storyID
+	storyElement.NodeID = nodeId
+
+	if message := validateEnding(&storyElement); message != "" {
+		return c.JSON(http.StatusBadRequest, message)
+	}
+	if message := validateOutcomes(&storyElement); message != "" {
+		return c.JSON(http.StatusBadRequest, message)
+	}
+	if message := validateTimeLimit(&storyElement); message != "" {
+		return c.JSON(http.StatusBadRequest, message)
+	}
+
+	ctx, cancel := h.Timeouts.context(c, "UpdateStoryElement")
+	defer cancel()
+
+	if status, message := h.resolveAssets(ctx, &storyElement); status != 0 {
+		return c.JSON(status, message)
+	}
+
+	filter := bson.M{"storyID": storyID, "nodeID": nodeId}
+
+	// The audit log summarizes the element as it was before the update.
+	var before *models.StoryElement
+	if h.Audit != nil {
+		before = h.loadAudited(ctx, filter)
+	}
+
 	update := bson.M{"$set": storyElement}
-	_, err := h.StoryCol.UpdateOne(context.Background(), filter, update)
+	_, err := h.StoryCol.UpdateOne(ctx, filter, update)
+	h.Cache.Invalidate(storyID, nodeId)
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, "Update failed due to an internal error")
+		return storageError(c, err, "to update story element", "Update failed due to an internal error")
+	}
+
+	h.publish(ctx, models.StoryElementUpdated, &storyElement)
+	if h.Audit != nil {
+		// Fields the body leaves out keep their values, so the element is read back.
+		h.audit(ctx, storyElementChange(models.AuditActionStoryElementUpdated, storyID, nodeId, before, h.loadAudited(ctx, filter)))
 	}
 
 	return c.JSON(http.StatusOK, "Story element updated successfully")
 }
 
-// DeleteStoryElement removes a story element identified by its node ID from the database.
-// It receives an Echo context and the node ID of the story element as parameters.
-// The function constructs a filter based on the node ID and attempts to delete the
+// PatchStoryElement applies a JSON Merge Patch (RFC 7396) or a JSON Patch (RFC 6902) to a
+// story element, selected by the Content-Type of the request; a plain JSON body is applied
+// as a merge patch. Unlike UpdateStoryElement, fields the patch leaves out keep their
+// values, and only the fields the patch changes are written. The identity of an element
+// cannot be patched. On success the patched story element is returned the way GetStoryElement
+// returns it, so a caller that has not unlocked it gets a 402 status code even though the patch
+// was applied. A 404 status code is returned if the element does not exist and a 409 status
+// code if a test operation failed.
+func (h *StoryHandler) PatchStoryElement(c echo.Context, storyID string, nodeId string) error {
+	if storyID == "" {
+		return c.JSON(http.StatusBadRequest, "Missing storyID")
+	}
+
+	ctx, cancel := h.Timeouts.context(c, "PatchStoryElement")
+	defer cancel()
+
+	filter := bson.M{"storyID": storyID, "nodeID": nodeId}
+	var storyElement models.StoryElement
+	if err := h.StoryCol.FindOne(ctx, filter).Decode(&storyElement); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return c.JSON(http.StatusNotFound, "Story element not found")
+		}
+		return storageError(c, err, "to load story element", "Failed to load story element")
+	}
+
+	var patched models.StoryElement
+	if status, message := applyPatch(c, storyElement, &patched); status != 0 {
+		return c.JSON(status, message)
+	}
+	if message := validateEnding(&patched); message != "" {
+		return c.JSON(http.StatusBadRequest, message)
+	}
+	if message := validateOutcomes(&patched); message != "" {
+		return c.JSON(http.StatusBadRequest, message)
+	}
+	if message := validateTimeLimit(&patched); message != "" {
+		return c.JSON(http.StatusBadRequest, message)
+	}
+	if status, message := h.resolveAssets(ctx, &patched); status != 0 {
+		return c.JSON(status, message)
+	}
+	update, err := patchUpdate(storyElement, patched)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to translate story element patch", "error", err)
+		return c.JSON(http.StatusInternalServerError, "Update failed due to an internal error")
+	}
+	for _, field := range []string{"_id", "storyID", "nodeID"} {
+		if updatesField(update, field) {
+			return c.JSON(http.StatusBadRequest, "Story element identity cannot be changed")
+		}
+	}
+	if len(update) == 0 {
+		return h.respondPatched(c, storyElement)
+	}
+
+	result, err := h.StoryCol.UpdateOne(ctx, filter, update)
+	h.Cache.Invalidate(storyID, nodeId)
+	if err != nil {
+		return storageError(c, err, "to patch story element", "Update failed due to an internal error")
+	}
+	if result.MatchedCount == 0 {
+		return c.JSON(http.StatusNotFound, "Story element not found")
+	}
+
+	h.publish(ctx, models.StoryElementUpdated, &patched)
+	h.audit(ctx, storyElementChange(models.AuditActionStoryElementPatched, storyID, nodeId, &storyElement, &patched))
+
+	return h.respondPatched(c, patched)
+}
+
+// respondPatched returns a patched story element behind its paywall and with the
+// URLs of its assets signed, so that patching does not read around either.
+func (h *StoryHandler) respondPatched(c echo.Context, storyElement models.StoryElement) error {
+	if locked := h.withheld(c, &storyElement); locked != nil {
+		return c.JSON(http.StatusPaymentRequired, locked)
+	}
+	return c.JSON(http.StatusOK, h.signed(c, storyElement))
+}
+
+// DeleteStoryElement removes a story element identified by its story and node ID from the database.
+// It receives an Echo context and the story and node ID of the story element as parameters.
+// The function constructs a filter based on both IDs and attempts to delete the
 // corresponding document from the story collection in MongoDB.
 // It returns an HTTP status code and a JSON response indicating the outcome of the operation.
 // If the deletion is successful, it responds with an HTTP 200 OK status and a success message.
 // If an error occurs during the deletion process, it responds with an HTTP 500 Internal Server Error
 // status and an error message describing the failure.
-func (h *StoryHandler) DeleteStoryElement(c echo.Context, nodeId string) error {
-	filter := bson.M{"nodeID": nodeId}
-	_, err := h.StoryCol.DeleteOne(context.Background(), filter)
+func (h *StoryHandler) DeleteStoryElement(c echo.Context, storyID string, nodeId string) error {
+	if storyID == "" {
+		return c.JSON(http.StatusBadRequest, "Missing storyID")
+	}
+	filter := bson.M{"storyID": storyID, "nodeID": nodeId}
+
+	ctx, cancel := h.Timeouts.context(c, "DeleteStoryElement")
+	defer cancel()
+
+	// Subscribers are told which story lost the element and the audit log what it
+	// was, so look it up before it is gone.
+	var deleted *models.StoryElement
+	if h.Events != nil || h.Audit != nil {
+		var storyElement models.StoryElement
+		if err := h.StoryCol.FindOne(ctx, filter).Decode(&storyElement); err == nil {
+			deleted = &storyElement
+		}
+	}
+
+	_, err := h.StoryCol.DeleteOne(ctx, filter)
+	h.Cache.Invalidate(storyID, nodeId)
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, "Delete failed due to an internal error")
+		return storageError(c, err, "to delete story element", "Delete failed due to an internal error")
+	}
+
+	if deleted != nil {
+		h.publish(ctx, models.StoryElementDeleted, deleted)
+		h.audit(ctx, storyElementChange(models.AuditActionStoryElementDeleted, storyID, nodeId, deleted, nil))
 	}
 
 	return c.JSON(http.StatusOK, "Story element deleted successfully")
 }
+
+// validateEnding checks the ending metadata of a story element, if it has any. An
+// ending must be identified, titled and have a known outcome, and cannot offer
+// choices. The returned message is empty when the element is valid.
+func validateEnding(storyElement *models.StoryElement) string {
+	ending := storyElement.Ending
+	if ending == nil {
+		return ""
+	}
+	if ending.EndingID == "" || ending.Title == "" {
+		return "An ending requires an endingID and a title"
+	}
+	switch ending.Outcome {
+	case models.EndingOutcomeGood, models.EndingOutcomeBad, models.EndingOutcomeNeutral:
+	default:
+		return "Unknown ending outcome"
+	}
+	if storyElement.Choices != nil && len(*storyElement.Choices) > 0 {
+		return "An ending cannot offer choices"
+	}
+	return ""
+}
+
+// resolveAssets checks that the assets a story element references exist and are
+// of the kind their fields take, and points the URL fields they take the place
+// of at them. It returns the status code and message to respond with when the
+// element cannot be stored, and a zero status code otherwise.
+func (h *StoryHandler) resolveAssets(ctx context.Context, storyElement *models.StoryElement) (int, string) {
+	references := assetReferences(storyElement)
+	if h.Assets == nil || len(references) == 0 {
+		return 0, ""
+	}
+	assetIDs := make([]string, len(references))
+	for i, reference := range references {
+		assetIDs[i] = reference.assetID
+	}
+	assets, err := h.Assets.FindAssets(ctx, assetIDs)
+	if err != nil {
+		return storageFailure(ctx, err, "to look up assets", "Failed to look up assets")
+	}
+	for _, reference := range references {
+		asset, ok := assets[reference.assetID]
+		if !ok {
+			return http.StatusBadRequest, "Unknown asset " + reference.assetID + " in " + reference.field
+		}
+		if asset.Kind != reference.kind {
+			return http.StatusBadRequest, "Asset " + reference.assetID + " in " + reference.field + " is not of kind " + string(reference.kind)
+		}
+		reference.setURL(asset.Url)
+	}
+	return 0, ""
+}
+
+// withheld returns the locked response of a story element the request may not
+// read, or nil if it is free or the admin asks for it.
+func (h *StoryHandler) withheld(c echo.Context, storyElement *models.StoryElement) *models.LockedContent {
+	if ActorFrom(c.Request().Context()) == ActorAdmin {
+		return nil
+	}
+	return h.Paywalls.lockFor(storyElement, nil, time.Time{})
+}
+
+// signed returns a story element read by a request with the URLs of its assets
+// signed, unless the admin reads it, whose media URLs need no signature.
+func (h *StoryHandler) signed(c echo.Context, storyElement models.StoryElement) models.StoryElement {
+	if ActorFrom(c.Request().Context()) == ActorAdmin {
+		return storyElement
+	}
+	return h.Media.signedCopy(storyElement)
+}
+
+// cacheControl returns the Cache-Control of the story elements read by a request.
+// With paywalls, what the admin reads includes locked elements, which shared
+// caches must not keep for others. Signed media URLs expire, so responses
+// carrying them must not outlive them.
+func (h *StoryHandler) cacheControl(c echo.Context) string {
+	admin := ActorFrom(c.Request().Context()) == ActorAdmin
+	if h.Media != nil && !admin {
+		return "private, no-store"
+	}
+	control := cacheControl(h.CacheMaxAge)
+	if h.Paywalls != nil && admin {
+		control = strings.Replace(control, "public", "private", 1)
+	}
+	return control
+}
+
+// publish raises a story element event on the configured publisher. The change has
+// already been stored, so a failure to publish is logged rather than failing the request,
+// and the event is published even if the client has gone away in the meantime.
+func (h *StoryHandler) publish(ctx context.Context, eventType models.DomainEventType, storyElement *models.StoryElement) {
+	if h.Events == nil {
+		return
+	}
+	ctx, cancel := h.Timeouts.detached(ctx)
+	defer cancel()
+
+	event := models.DomainEvent{
+		Type:    eventType,
+		NodeID:  &storyElement.NodeID,
+		Element: storyElement,
+	}
+	if storyElement.StoryID != "" {
+		event.StoryID = &storyElement.StoryID
+	}
+	if err := h.Events.Publish(ctx, event); err != nil {
+		slog.ErrorContext(ctx, "Failed to publish event", "type", eventType, "error", err)
+	}
+}
+
+// audit records a change to a story element in the audit log, if there is one.
+func (h *StoryHandler) audit(ctx context.Context, entry models.AuditEntry) {
+	if h.Audit != nil {
+		h.Audit.Record(ctx, entry)
+	}
+}
+
+// loadAudited reads a story element for the audit log. An element that cannot be
+// read is logged and summarized as missing.
+func (h *StoryHandler) loadAudited(ctx context.Context, filter bson.M) *models.StoryElement {
+	ctx, cancel := h.Timeouts.detached(ctx)
+	defer cancel()
+	var storyElement models.StoryElement
+	if err := h.StoryCol.FindOne(ctx, filter).Decode(&storyElement); err != nil {
+		slog.WarnContext(ctx, "Failed to read audited story element", "storyID", filter["storyID"], "nodeID", filter["nodeID"], "error", err)
+		return nil
+	}
+	return &storyElement
+}
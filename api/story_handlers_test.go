@@ -2,12 +2,14 @@ package api_test
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"log"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/labstack/echo/v4"
 	"github.com/okcthulhu/ChooseYourOwnAdventure/api"
@@ -76,6 +78,34 @@ func TestCreateStoryElement_EmptyRequestBody(t *testing.T) {
 	})
 }
 
+func TestCreateStoryElement_InvalidEnding(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("ending offering choices", func(mt *mtest.T) {
+		choices := []models.Choice{{Description: "Go on", NextNodeID: "next"}}
+		storyElement := &models.PostStoryElementsJSONRequestBody{
+			StoryID: "s",
+			NodeID:  "end",
+			Content: "The end.",
+			Choices: &choices,
+			Ending:  &models.Ending{EndingID: "end", Title: "The End", Outcome: models.EndingOutcomeNeutral},
+		}
+		body, _ := json.Marshal(storyElement)
+
+		req := httptest.NewRequest(http.MethodPost, "/story", bytes.NewBuffer(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(req, rec)
+
+		h := api.NewStoryHandler(mt.Coll)
+		h.CreateStoryElement(c)
+
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+		assert.Contains(t, rec.Body.String(), "An ending cannot offer choices")
+	})
+}
+
 func TestCreateStoryElement_InsertFailed(t *testing.T) {
 	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
 	defer mt.Close()
@@ -115,6 +145,62 @@ func TestCreateStoryElement_InsertFailed(t *testing.T) {
 	})
 }
 
+func TestCreateStoryElement_Duplicate(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("node ID already used in the story", func(mt *mtest.T) {
+		body, _ := json.Marshal(models.PostStoryElementsJSONRequestBody{StoryID: "s", NodeID: "start", Content: "Again"})
+		req := httptest.NewRequest(http.MethodPost, "/story", bytes.NewBuffer(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(req, rec)
+
+		h := api.NewStoryHandler(mt.Coll)
+
+		mt.AddMockResponses(mtest.CreateWriteErrorsResponse(mtest.WriteError{Index: 0, Code: 11000, Message: "duplicate key error"}))
+
+		h.CreateStoryElement(c)
+
+		assert.Equal(t, http.StatusConflict, rec.Code)
+		assert.Contains(t, rec.Body.String(), "Story element already exists")
+	})
+}
+
+func TestCreateStoryElement_PublishesEvent(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("created event published", func(mt *mtest.T) {
+		storyElement := &models.PostStoryElementsJSONRequestBody{
+			StoryID: "s",
+			NodeID:  "start",
+			Content: "Once upon a time.",
+		}
+		storyElementJSON, _ := json.Marshal(storyElement)
+
+		req := httptest.NewRequest(http.MethodPost, "/story", bytes.NewBuffer(storyElementJSON))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(req, rec)
+
+		published := &publishedEvents{}
+		h := api.NewStoryHandler(mt.Coll)
+		h.Events = published
+
+		mt.AddMockResponses(bson.D{{Key: "ok", Value: 1}})
+
+		h.CreateStoryElement(c)
+
+		assert.Equal(t, http.StatusCreated, rec.Code)
+		if assert.Len(t, published.events, 1) {
+			assert.Equal(t, models.StoryElementCreated, published.events[0].Type)
+			assert.Equal(t, "s", *published.events[0].StoryID)
+			assert.Equal(t, "start", *published.events[0].NodeID)
+		}
+	})
+}
+
 // GetStoryElement
 
 func TestGetStoryElement_StoryElementFound(t *testing.T) {
@@ -142,9 +228,11 @@ func TestGetStoryElement_StoryElementFound(t *testing.T) {
 			{Key: "content", Value: storyElement.Content},
 		}))
 
-		h.GetStoryElement(c, nodeId)
+		h.GetStoryElement(c, "SomeStoryID", nodeId)
 
 		// Validate
+		filter := mt.GetStartedEvent().Command.Lookup("filter").Document()
+		assert.Equal(t, "SomeStoryID", filter.Lookup("storyID").StringValue())
 		assert.Equal(t, http.StatusOK, rec.Code)
 		assert.Contains(t, rec.Body.String(), `"nodeID":"SomeNodeID"`)
 		assert.Contains(t, rec.Body.String(), `"content":"Some content"`)
@@ -167,7 +255,7 @@ func TestGetStoryElement_NotFound(t *testing.T) {
 
 		mt.AddMockResponses(mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch))
 
-		h.GetStoryElement(c, nodeId)
+		h.GetStoryElement(c, "SomeStoryID", nodeId)
 
 		// Validate
 		assert.Equal(t, http.StatusNotFound, rec.Code)
@@ -191,7 +279,7 @@ func TestGetStoryElement_InternalServerError(t *testing.T) {
 
 		mt.AddMockResponses(bson.D{{Key: "ok", Value: 0}, {Key: "errmsg", Value: "Internal Server Error"}})
 
-		h.GetStoryElement(c, nodeId)
+		h.GetStoryElement(c, "SomeStoryID", nodeId)
 
 		// Validate
 		assert.Equal(t, http.StatusInternalServerError, rec.Code)
@@ -216,7 +304,7 @@ func TestGetStoryElement_InvalidNodeID(t *testing.T) {
 		// Assuming that the MongoDB response would be empty for invalid nodeID
 		mt.AddMockResponses(mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch))
 
-		h.GetStoryElement(c, nodeId)
+		h.GetStoryElement(c, "SomeStoryID", nodeId)
 
 		// Validate
 		assert.Equal(t, http.StatusNotFound, rec.Code)
@@ -245,7 +333,7 @@ func TestUpdateStoryElement_SuccessfulUpdate(t *testing.T) {
 
 		mt.AddMockResponses(mtest.CreateSuccessResponse())
 
-		h.UpdateStoryElement(c, nodeId, storyElement)
+		h.UpdateStoryElement(c, "SomeStoryID", nodeId, storyElement)
 
 		// Validate
 		assert.Equal(t, http.StatusOK, rec.Code)
@@ -273,7 +361,7 @@ func TestUpdateStoryElement_InternalServerError(t *testing.T) {
 
 		mt.AddMockResponses(bson.D{{Key: "ok", Value: 0}, {Key: "errmsg", Value: "Internal Server Error"}})
 
-		h.UpdateStoryElement(c, nodeId, storyElement)
+		h.UpdateStoryElement(c, "SomeStoryID", nodeId, storyElement)
 
 		// Validate
 		assert.Equal(t, http.StatusInternalServerError, rec.Code)
@@ -281,6 +369,22 @@ func TestUpdateStoryElement_InternalServerError(t *testing.T) {
 	})
 }
 
+func TestUpdateStoryElement_IdentityMismatch(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("body names another story", func(mt *mtest.T) {
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(httptest.NewRequest(http.MethodPut, "/", nil), rec)
+
+		h := api.NewStoryHandler(mt.Coll)
+		h.UpdateStoryElement(c, "s", "start", models.PatchStoryElementsNodeIdJSONRequestBody{StoryID: "other", Content: "Moved"})
+
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+		assert.Contains(t, rec.Body.String(), "Story element identity does not match the path")
+	})
+}
+
 // DeleteStoryElement
 
 func TestDeleteStoryElement_Deleted(t *testing.T) {
@@ -300,13 +404,42 @@ func TestDeleteStoryElement_Deleted(t *testing.T) {
 
 		mt.AddMockResponses(mtest.CreateSuccessResponse())
 
-		err := h.DeleteStoryElement(c, nodeId)
+		err := h.DeleteStoryElement(c, "SomeStoryID", nodeId)
 		assert.NoError(t, err)
 		assert.Equal(t, http.StatusOK, rec.Code)
 		assert.Contains(t, rec.Body.String(), "Story element deleted successfully")
 	})
 }
 
+func TestDeleteStoryElement_Audited(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("deleted element summarized", func(mt *mtest.T) {
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(httptest.NewRequest(http.MethodDelete, "/", nil), rec)
+
+		audit := &recordedAudit{}
+		h := api.NewStoryHandler(mt.Coll)
+		h.Audit = audit
+
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, patchableElement()),
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}),
+		)
+
+		h.DeleteStoryElement(c, "s", "start")
+
+		assert.Equal(t, http.StatusOK, rec.Code)
+		if assert.Len(t, audit.entries, 1) {
+			entry := audit.entries[0]
+			assert.Equal(t, models.AuditActionStoryElementDeleted, entry.Action)
+			assert.Equal(t, "one", *entry.Before.StoryElement.ChapterName)
+			assert.Nil(t, entry.After)
+		}
+	})
+}
+
 func TestDeleteStoryElement_NotFound(t *testing.T) {
 	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
 	defer mt.Close()
@@ -325,7 +458,7 @@ func TestDeleteStoryElement_NotFound(t *testing.T) {
 
 		mt.AddMockResponses(bson.D{{Key: "n", Value: 0}, {Key: "ok", Value: 1}})
 
-		err := h.DeleteStoryElement(c, nodeId)
+		err := h.DeleteStoryElement(c, "SomeStoryID", nodeId)
 		// Since the MongoDB driver does not return an error for delete operations
 		// when no document is found, we don't expect an error here.
 		assert.NoError(t, err)
@@ -352,8 +485,448 @@ func TestDeleteStoryElement_InternalServerError(t *testing.T) {
 
 		mt.AddMockResponses(bson.D{{Key: "ok", Value: 0}, {Key: "errmsg", Value: "Internal Server Error"}})
 
-		h.DeleteStoryElement(c, nodeId)
+		h.DeleteStoryElement(c, "SomeStoryID", nodeId)
 		assert.Equal(t, http.StatusInternalServerError, rec.Code)
 		assert.Contains(t, rec.Body.String(), "Delete failed due to an internal error")
 	})
 }
+
+// ListStoryElements
+
+func TestListStoryElements_Paginates(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("next cursor when more elements exist", func(mt *mtest.T) {
+		req := httptest.NewRequest(http.MethodGet, "/?limit=2&chapterName=One&hasVideo=true", nil)
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(req, rec)
+
+		h := api.NewStoryHandler(mt.Coll)
+
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch,
+			storyElementDocument("s", "a"), storyElementDocument("s", "b"), storyElementDocument("s", "c")))
+
+		err := h.ListStoryElements(c, "s")
+
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, rec.Code)
+		var page models.StoryElementPage
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &page))
+		assert.Len(t, page.Items, 2)
+		if assert.NotNil(t, page.NextCursor) {
+			next := httptest.NewRequest(http.MethodGet, "/?cursor="+*page.NextCursor, nil)
+			c = echo.New().NewContext(next, httptest.NewRecorder())
+			mt.AddMockResponses(mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch))
+			assert.NoError(t, h.ListStoryElements(c, "s"))
+
+			filter := mt.GetAllStartedEvents()[1].Command.Lookup("filter").Document()
+			assert.Equal(t, "b", filter.Lookup("nodeID", "$gt").StringValue())
+		}
+
+		command := mt.GetAllStartedEvents()[0].Command
+		assert.Equal(t, int64(3), command.Lookup("limit").Int64())
+		filter := command.Lookup("filter").Document()
+		assert.Equal(t, "One", filter.Lookup("chapterName").StringValue())
+		_, err = filter.LookupErr("videoURL", "$nin")
+		assert.NoError(t, err)
+	})
+}
+
+func TestListStoryElements_LastPage(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("no cursor on the last page", func(mt *mtest.T) {
+		req := httptest.NewRequest(http.MethodGet, "/?q=dragon&wisdomID=torch", nil)
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(req, rec)
+
+		h := api.NewStoryHandler(mt.Coll)
+
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, storyElementDocument("s", "a")))
+
+		h.ListStoryElements(c, "s")
+
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.NotContains(t, rec.Body.String(), "nextCursor")
+		filter := mt.GetStartedEvent().Command.Lookup("filter").Document()
+		assert.Equal(t, "dragon", filter.Lookup("$text", "$search").StringValue())
+		_, err := filter.LookupErr("$or")
+		assert.NoError(t, err)
+	})
+}
+
+func TestListStoryElements_InvalidParameters(t *testing.T) {
+	for _, query := range []string{"limit=0", "limit=101", "hasArt=maybe", "wisdomID=a.b", "cursor=%25%25"} {
+		req := httptest.NewRequest(http.MethodGet, "/?"+query, nil)
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(req, rec)
+
+		h := api.NewStoryHandler(nil)
+		h.ListStoryElements(c, "s")
+
+		assert.Equal(t, http.StatusBadRequest, rec.Code, query)
+	}
+}
+
+// PatchStoryElement
+
+func patchRequest(contentType, body string) *http.Request {
+	req := httptest.NewRequest(http.MethodPatch, "/", strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, contentType)
+	return req
+}
+
+func patchableElement() bson.D {
+	return append(storyElementDocument("s", "start",
+		bson.D{{Key: "description", Value: "Left"}, {Key: "nextNodeID", Value: "left"}},
+		bson.D{{Key: "description", Value: "Right"}, {Key: "nextNodeID", Value: "right"}, {Key: "wisdomID", Value: "w2"}},
+	),
+		bson.E{Key: "chapterName", Value: "one"},
+		bson.E{Key: "wisdoms", Value: bson.D{
+			{Key: "w1", Value: bson.D{{Key: "wisdomID", Value: "w1"}, {Key: "name", Value: "First"}}},
+			{Key: "w2", Value: bson.D{{Key: "wisdomID", Value: "w2"}, {Key: "name", Value: "Second"}}},
+		}},
+	)
+}
+
+func TestPatchStoryElement_MergePatch(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("only patched fields written", func(mt *mtest.T) {
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(patchRequest(api.MIMEMergePatch, `{"content":"new content","wisdoms":{"w1":null}}`), rec)
+
+		h := api.NewStoryHandler(mt.Coll)
+
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, patchableElement()),
+			matchedResponse(),
+		)
+
+		err := h.PatchStoryElement(c, "s", "start")
+
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, rec.Code)
+		update := mt.GetAllStartedEvents()[1].Command.Lookup("updates").Array().Index(0).Value().Document().Lookup("u").Document()
+		set, _ := update.Lookup("$set").Document().Elements()
+		unset, _ := update.Lookup("$unset").Document().Elements()
+		if assert.Len(t, set, 1) {
+			assert.Equal(t, "content", set[0].Key())
+		}
+		if assert.Len(t, unset, 1) {
+			assert.Equal(t, "wisdoms.w1", unset[0].Key())
+		}
+		var patched models.StoryElement
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &patched))
+		assert.Equal(t, "one", *patched.ChapterName, "omitted fields keep their values")
+		assert.NotContains(t, *patched.Wisdoms, "w1")
+	})
+}
+
+func TestPatchStoryElement_Audited(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("change summarized before and after", func(mt *mtest.T) {
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(patchRequest(api.MIMEMergePatch, `{"chapterName":"two","choices":null}`), rec)
+
+		audit := &recordedAudit{}
+		h := api.NewStoryHandler(mt.Coll)
+		h.Audit = audit
+
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, patchableElement()),
+			matchedResponse(),
+		)
+
+		h.PatchStoryElement(c, "s", "start")
+
+		assert.Equal(t, http.StatusOK, rec.Code)
+		if assert.Len(t, audit.entries, 1) {
+			entry := audit.entries[0]
+			assert.Equal(t, models.AuditActionStoryElementPatched, entry.Action)
+			assert.Equal(t, "start", *entry.NodeID)
+			before, after := entry.Before.StoryElement, entry.After.StoryElement
+			assert.Equal(t, "one", *before.ChapterName)
+			assert.Equal(t, []string{"left", "right"}, before.NextNodeIDs)
+			assert.Equal(t, []string{"w1", "w2"}, *before.WisdomIDs)
+			assert.Equal(t, "two", *after.ChapterName)
+			assert.Empty(t, after.NextNodeIDs)
+		}
+	})
+}
+
+func TestPatchStoryElement_JSONPatchReplacesChoice(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("choice at an index replaced", func(mt *mtest.T) {
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(patchRequest(api.MIMEJSONPatch,
+			`[{"op":"replace","path":"/choices/1","value":{"description":"Back","nextNodeID":"home"}}]`), rec)
+
+		h := api.NewStoryHandler(mt.Coll)
+
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, patchableElement()),
+			matchedResponse(),
+		)
+
+		h.PatchStoryElement(c, "s", "start")
+
+		assert.Equal(t, http.StatusOK, rec.Code)
+		update := mt.GetAllStartedEvents()[1].Command.Lookup("updates").Array().Index(0).Value().Document().Lookup("u").Document()
+		assert.Equal(t, "Back", update.Lookup("$set", "choices.1.description").StringValue())
+		assert.Equal(t, "home", update.Lookup("$set", "choices.1.nextNodeID").StringValue())
+		_, err := update.Lookup("$unset").Document().LookupErr("choices.1.wisdomID")
+		assert.NoError(t, err)
+		_, err = update.Lookup("$set").Document().LookupErr("choices.0.description")
+		assert.Error(t, err, "the other choice is left alone")
+	})
+}
+
+func TestPatchStoryElement_TestOperationFails(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("failed test operation", func(mt *mtest.T) {
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(patchRequest(api.MIMEJSONPatch,
+			`[{"op":"test","path":"/chapterName","value":"two"},{"op":"replace","path":"/content","value":"x"}]`), rec)
+
+		h := api.NewStoryHandler(mt.Coll)
+
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, patchableElement()))
+
+		h.PatchStoryElement(c, "s", "start")
+
+		assert.Equal(t, http.StatusConflict, rec.Code)
+		assert.Len(t, mt.GetAllStartedEvents(), 1, "nothing is written")
+	})
+}
+
+func TestPatchStoryElement_IdentityChange(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("node ID cannot be patched", func(mt *mtest.T) {
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(patchRequest(api.MIMEMergePatch, `{"nodeID":"elsewhere"}`), rec)
+
+		h := api.NewStoryHandler(mt.Coll)
+
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, patchableElement()))
+
+		h.PatchStoryElement(c, "s", "start")
+
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+		assert.Contains(t, rec.Body.String(), "Story element identity cannot be changed")
+	})
+}
+
+func TestPatchStoryElement_UnsupportedMediaType(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("form body rejected", func(mt *mtest.T) {
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(patchRequest(echo.MIMEApplicationForm, "content=x"), rec)
+
+		h := api.NewStoryHandler(mt.Coll)
+
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, patchableElement()))
+
+		h.PatchStoryElement(c, "s", "start")
+
+		assert.Equal(t, http.StatusUnsupportedMediaType, rec.Code)
+	})
+}
+
+// GetNeighborhood
+
+func TestGetNeighborhood(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	// start leads to a, which requires the torch, and to b; both lead to c.
+	start := append(storyElementDocument("s", "start",
+		bson.D{{Key: "description", Value: "Dark"}, {Key: "nextNodeID", Value: "a"}, {Key: "wisdomID", Value: "torch"}},
+		bson.D{{Key: "description", Value: "Light"}, {Key: "nextNodeID", Value: "b"}, {Key: "imageUrl", Value: "https://cdn/b.png"}},
+	), bson.E{Key: "videoURL", Value: "https://cdn/start.mp4"})
+	a := append(storyElementDocument("s", "a", bson.D{{Key: "description", Value: "On"}, {Key: "nextNodeID", Value: "c"}}),
+		bson.E{Key: "videoURL", Value: "https://cdn/a.mp4"})
+	b := append(storyElementDocument("s", "b", bson.D{{Key: "description", Value: "On"}, {Key: "nextNodeID", Value: "c"}}),
+		bson.E{Key: "artURL", Value: "https://cdn/b.png"})
+	c := append(storyElementDocument("s", "c"), bson.E{Key: "videoURL", Value: "https://cdn/c.mp4"})
+
+	mt.Run("reachable nodes and their media", func(mt *mtest.T) {
+		rec := httptest.NewRecorder()
+		ctx := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/?depth=2", nil), rec)
+
+		h := api.NewStoryHandler(mt.Coll)
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, start),
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, b, a),
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, c),
+		)
+
+		err := h.GetNeighborhood(ctx, "s", "start")
+
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.NotEmpty(t, rec.Header().Get(api.ETagHeader))
+		var neighborhood models.StoryNeighborhood
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &neighborhood))
+		var nodeIDs []string
+		for _, element := range neighborhood.Elements {
+			nodeIDs = append(nodeIDs, element.NodeID)
+		}
+		assert.Equal(t, []string{"start", "a", "b", "c"}, nodeIDs)
+		assert.Equal(t, []models.MediaPreload{
+			{Distance: 0, Kind: models.MediaPreloadKindVideo, NodeID: "start", Url: "https://cdn/start.mp4"},
+			{Distance: 0, Kind: models.MediaPreloadKindChoiceImage, NodeID: "start", Url: "https://cdn/b.png"},
+			{Distance: 1, Kind: models.MediaPreloadKindVideo, NodeID: "a", Url: "https://cdn/a.mp4"},
+			{Distance: 2, Kind: models.MediaPreloadKindVideo, NodeID: "c", Url: "https://cdn/c.mp4"},
+		}, neighborhood.Preload, "every URL is preloaded once, nearest first")
+		assert.False(t, neighborhood.Truncated)
+
+		filter := mt.GetAllStartedEvents()[1].Command.Lookup("filter").Document()
+		values, _ := filter.Lookup("nodeID", "$in").Array().Values()
+		assert.Len(t, values, 2, "each level is loaded at once")
+	})
+
+	mt.Run("choices the player cannot take are not followed", func(mt *mtest.T) {
+		rec := httptest.NewRecorder()
+		ctx := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/?depth=1&wisdomIDs=map,compass", nil), rec)
+
+		h := api.NewStoryHandler(mt.Coll)
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, start),
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, b),
+		)
+
+		h.GetNeighborhood(ctx, "s", "start")
+
+		var neighborhood models.StoryNeighborhood
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &neighborhood))
+		assert.Len(t, neighborhood.Elements, 2)
+		filter := mt.GetAllStartedEvents()[1].Command.Lookup("filter").Document()
+		values, _ := filter.Lookup("nodeID", "$in").Array().Values()
+		if assert.Len(t, values, 1) {
+			assert.Equal(t, "b", values[0].StringValue())
+		}
+	})
+
+	mt.Run("served from the cached story", func(mt *mtest.T) {
+		rec := httptest.NewRecorder()
+		ctx := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/?depth=5", nil), rec)
+
+		h := api.NewStoryHandler(mt.Coll)
+		h.Cache = api.NewStoryCache(10, time.Minute)
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, a, b, c, start))
+
+		h.GetNeighborhood(ctx, "s", "start")
+
+		var neighborhood models.StoryNeighborhood
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &neighborhood))
+		assert.Len(t, neighborhood.Elements, 4)
+		assert.Len(t, mt.GetAllStartedEvents(), 1)
+	})
+
+	mt.Run("missing node", func(mt *mtest.T) {
+		rec := httptest.NewRecorder()
+		ctx := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/", nil), rec)
+
+		h := api.NewStoryHandler(mt.Coll)
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch))
+
+		h.GetNeighborhood(ctx, "s", "nowhere")
+
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+	})
+}
+
+func TestGetNeighborhood_InvalidDepth(t *testing.T) {
+	for _, depth := range []string{"-1", "6", "deep"} {
+		t.Run(depth, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			ctx := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/?depth="+depth, nil), rec)
+
+			api.NewStoryHandler(nil).GetNeighborhood(ctx, "s", "start")
+
+			assert.Equal(t, http.StatusBadRequest, rec.Code)
+		})
+	}
+}
+
+// knownAssets is an AssetLookup of a fixed set of assets.
+type knownAssets map[string]models.Asset
+
+func (a knownAssets) FindAssets(ctx context.Context, assetIDs []string) (map[string]models.Asset, error) {
+	found := map[string]models.Asset{}
+	for _, assetID := range assetIDs {
+		if asset, ok := a[assetID]; ok {
+			found[assetID] = asset
+		}
+	}
+	return found, nil
+}
+
+func TestCreateStoryElement_AssetReferences(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	assets := knownAssets{
+		"art":   {AssetID: "art", Kind: models.AssetKindImage, Url: "/assets/art/content"},
+		"intro": {AssetID: "intro", Kind: models.AssetKindVideo, Url: "/assets/intro/content"},
+	}
+	create := func(h *api.StoryHandler, storyElement models.StoryElement) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(storyElement)
+		req := httptest.NewRequest(http.MethodPost, "/storyElements", bytes.NewBuffer(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		h.CreateStoryElement(echo.New().NewContext(req, rec))
+		return rec
+	}
+
+	mt.Run("references resolved to URLs", func(mt *mtest.T) {
+		h := api.NewStoryHandler(mt.Coll)
+		h.Assets = assets
+		choices := []models.Choice{{Description: "Open", NextNodeID: "b", ImageAssetID: strPtr("art")}}
+
+		mt.AddMockResponses(mtest.CreateSuccessResponse())
+		rec := create(h, models.StoryElement{StoryID: "s", NodeID: "start", Content: "c",
+			ArtAssetID: strPtr("art"), VideoAssetID: strPtr("intro"), Choices: &choices})
+
+		assert.Equal(t, http.StatusCreated, rec.Code)
+		inserted := mt.GetStartedEvent().Command.Lookup("documents").Array().Index(0).Value().Document()
+		assert.Equal(t, "/assets/art/content", inserted.Lookup("artURL").StringValue())
+		assert.Equal(t, "/assets/intro/content", inserted.Lookup("videoURL").StringValue())
+		assert.Equal(t, "/assets/art/content", inserted.Lookup("choices", "0", "imageUrl").StringValue())
+	})
+
+	mt.Run("unknown asset", func(mt *mtest.T) {
+		h := api.NewStoryHandler(mt.Coll)
+		h.Assets = assets
+
+		rec := create(h, models.StoryElement{StoryID: "s", NodeID: "start", Content: "c", ArtAssetID: strPtr("gone")})
+
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+		assert.Contains(t, rec.Body.String(), "Unknown asset gone in artAssetID")
+		assert.Empty(t, mt.GetAllStartedEvents())
+	})
+
+	mt.Run("asset of the wrong kind", func(mt *mtest.T) {
+		h := api.NewStoryHandler(mt.Coll)
+		h.Assets = assets
+
+		rec := create(h, models.StoryElement{StoryID: "s", NodeID: "start", Content: "c", VideoAssetID: strPtr("art")})
+
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+		assert.Contains(t, rec.Body.String(), "is not of kind video")
+	})
+}
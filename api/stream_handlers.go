@@ -0,0 +1,347 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"github.com/okcthulhu/ChooseYourOwnAdventure/api/models"
+	"golang.org/x/net/websocket"
+)
+
+// StreamMessage is a domain event as delivered to stream clients. ID increases
+// monotonically across the hub and is what clients send back as Last-Event-ID.
+type StreamMessage struct {
+	ID    uint64             `json:"id"`
+	Event models.DomainEvent `json:"event"`
+}
+
+// DefaultHistoryTTL is how long the history of a topic nobody subscribes to is
+// kept after its last message unless configured otherwise.
+const DefaultHistoryTTL = 15 * time.Minute
+
+// Hub fans domain events out to connected stream clients. Every topic keeps a
+// bounded history so that reconnecting clients can replay what they missed.
+// The history lives in memory and is therefore local to one API instance.
+type Hub struct {
+	// HistorySize is the number of messages retained per topic for replay.
+	HistorySize int
+
+	// HistoryTTL is how long the history of a topic without subscribers is kept
+	// after its last message, so that the topics of players who have left do
+	// not accumulate.
+	HistoryTTL time.Duration
+
+	mu          sync.Mutex
+	seq         uint64
+	closed      bool
+	history     map[string][]StreamMessage
+	updated     map[string]time.Time
+	swept       time.Time
+	subscribers map[string]map[chan StreamMessage]struct{}
+
+	now func() time.Time
+}
+
+// NewHub creates a Hub that retains historySize messages per topic.
+func NewHub(historySize int) *Hub {
+	return &Hub{
+		HistorySize: historySize,
+		HistoryTTL:  DefaultHistoryTTL,
+		history:     map[string][]StreamMessage{},
+		updated:     map[string]time.Time{},
+		subscribers: map[string]map[chan StreamMessage]struct{}{},
+		now:         time.Now,
+	}
+}
+
+// PlayerTopic is the topic carrying the events of a single player.
+func PlayerTopic(wixID uuid.UUID) string {
+	return "player:" + wixID.String()
+}
+
+// StoryTopic is the topic carrying story element edits of a single story.
+func StoryTopic(storyID string) string {
+	return "story:" + storyID
+}
+
+// HandleEvent is an event bus subscriber that routes player events to the
+// player's topic and story element edits to the story's topic. The story topic
+// is open to anyone, so its events name the edited element without carrying
+// it; clients fetch the element through the routes that enforce paywalls.
+func (h *Hub) HandleEvent(ctx context.Context, event models.DomainEvent) error {
+	switch event.Type {
+	case models.StoryElementCreated, models.StoryElementUpdated, models.StoryElementDeleted:
+		if event.StoryID != nil {
+			event.Element = nil
+			h.Broadcast(StoryTopic(*event.StoryID), event)
+		}
+	default:
+		if event.WixID != nil {
+			h.Broadcast(PlayerTopic(*event.WixID), event)
+		}
+	}
+	return nil
+}
+
+// Broadcast records the event in the topic's history and sends it to every
+// subscriber. Subscribers that cannot keep up are disconnected; they are
+// expected to reconnect and replay from their last seen ID.
+func (h *Hub) Broadcast(topic string, event models.DomainEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.seq++
+	message := StreamMessage{ID: h.seq, Event: event}
+
+	now := h.now()
+	history := append(h.history[topic], message)
+	if len(history) > h.HistorySize {
+		history = history[len(history)-h.HistorySize:]
+	}
+	h.history[topic] = history
+	h.updated[topic] = now
+
+	for ch := range h.subscribers[topic] {
+		select {
+		case ch <- message:
+		default:
+			h.unsubscribe(topic, ch)
+		}
+	}
+	h.sweep(now)
+}
+
+// sweep drops the history of the topics without subscribers whose last message
+// is older than the history TTL. The topics are swept at most once per TTL.
+func (h *Hub) sweep(now time.Time) {
+	if now.Sub(h.swept) < h.HistoryTTL {
+		return
+	}
+	h.swept = now
+	for topic, updated := range h.updated {
+		if len(h.subscribers[topic]) == 0 && now.Sub(updated) >= h.HistoryTTL {
+			delete(h.history, topic)
+			delete(h.updated, topic)
+		}
+	}
+}
+
+// unsubscribe removes a subscriber from a topic and closes its channel, and
+// forgets the topic's subscribers once there are none.
+func (h *Hub) unsubscribe(topic string, ch chan StreamMessage) {
+	delete(h.subscribers[topic], ch)
+	close(ch)
+	if len(h.subscribers[topic]) == 0 {
+		delete(h.subscribers, topic)
+	}
+}
+
+// Subscribe registers a subscriber for the topic. It returns the retained
+// messages newer than lastID, a channel for live messages, and a function that
+// must be called to unsubscribe.
+func (h *Hub) Subscribe(topic string, lastID uint64) ([]StreamMessage, <-chan StreamMessage, func()) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var replay []StreamMessage
+	if lastID > 0 {
+		for _, message := range h.history[topic] {
+			if message.ID > lastID {
+				replay = append(replay, message)
+			}
+		}
+	}
+
+	ch := make(chan StreamMessage, 64)
+	if h.closed {
+		close(ch)
+		return replay, ch, func() {}
+	}
+	if h.subscribers[topic] == nil {
+		h.subscribers[topic] = map[chan StreamMessage]struct{}{}
+	}
+	h.subscribers[topic][ch] = struct{}{}
+
+	unsubscribe := func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if _, ok := h.subscribers[topic][ch]; ok {
+			h.unsubscribe(topic, ch)
+		}
+	}
+	return replay, ch, unsubscribe
+}
+
+// Close disconnects every subscriber so that their streams end and the clients
+// reconnect, to another instance when this one is shutting down. Subscribers
+// that arrive after Close are disconnected right away.
+func (h *Hub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.closed = true
+	for topic, subscribers := range h.subscribers {
+		for ch := range subscribers {
+			close(ch)
+		}
+		delete(h.subscribers, topic)
+	}
+}
+
+// StreamHandler serves the real-time player and story streams over
+// Server-Sent Events and WebSocket.
+type StreamHandler struct {
+	// Hub is the source of the streamed events.
+	Hub *Hub
+
+	// Heartbeat is the interval at which idle SSE connections receive a keep-alive comment.
+	Heartbeat time.Duration
+}
+
+// NewStreamHandler creates a StreamHandler reading from the given hub.
+func NewStreamHandler(hub *Hub) *StreamHandler {
+	return &StreamHandler{
+		Hub:       hub,
+		Heartbeat: 15 * time.Second,
+	}
+}
+
+// StreamPlayerEvents streams story-state and wisdom changes of a player over SSE.
+// Clients resume after a disconnect by sending the standard Last-Event-ID header.
+func (h *StreamHandler) StreamPlayerEvents(c echo.Context, wixID string) error {
+	parsedUUID, err := uuid.Parse(wixID)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, "Invalid WixID format")
+	}
+	return h.serveSSE(c, PlayerTopic(parsedUUID))
+}
+
+// StreamStoryEvents streams edits to the story elements of a story over SSE.
+func (h *StreamHandler) StreamStoryEvents(c echo.Context, storyID string) error {
+	return h.serveSSE(c, StoryTopic(storyID))
+}
+
+// PlayerEventsSocket is the WebSocket alternative to StreamPlayerEvents. Each
+// message is a JSON StreamMessage; clients resume with the lastEventId query parameter.
+func (h *StreamHandler) PlayerEventsSocket(c echo.Context, wixID string) error {
+	parsedUUID, err := uuid.Parse(wixID)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, "Invalid WixID format")
+	}
+	return h.serveWebSocket(c, PlayerTopic(parsedUUID))
+}
+
+// StoryEventsSocket is the WebSocket alternative to StreamStoryEvents.
+func (h *StreamHandler) StoryEventsSocket(c echo.Context, storyID string) error {
+	return h.serveWebSocket(c, StoryTopic(storyID))
+}
+
+func (h *StreamHandler) serveSSE(c echo.Context, topic string) error {
+	lastID, err := parseLastEventID(c.Request().Header.Get("Last-Event-ID"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, "Invalid Last-Event-ID")
+	}
+
+	replay, messages, unsubscribe := h.Hub.Subscribe(topic, lastID)
+	defer unsubscribe()
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "text/event-stream")
+	res.Header().Set(echo.HeaderCacheControl, "no-cache")
+	res.Header().Set(echo.HeaderConnection, "keep-alive")
+	res.WriteHeader(http.StatusOK)
+
+	for _, message := range replay {
+		if err := writeSSE(res, message); err != nil {
+			return nil
+		}
+	}
+	res.Flush()
+
+	heartbeat := time.NewTicker(h.Heartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-c.Request().Context().Done():
+			return nil
+		case message, ok := <-messages:
+			if !ok {
+				// Dropped for falling behind; the client reconnects and replays.
+				return nil
+			}
+			if err := writeSSE(res, message); err != nil {
+				return nil
+			}
+			res.Flush()
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(res, ": keep-alive\n\n"); err != nil {
+				return nil
+			}
+			res.Flush()
+		}
+	}
+}
+
+func (h *StreamHandler) serveWebSocket(c echo.Context, topic string) error {
+	lastID, err := parseLastEventID(c.QueryParam("lastEventId"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, "Invalid lastEventId")
+	}
+
+	websocket.Handler(func(ws *websocket.Conn) {
+		defer ws.Close()
+
+		replay, messages, unsubscribe := h.Hub.Subscribe(topic, lastID)
+		defer unsubscribe()
+
+		// The stream is one-way; reading only serves to notice the client going away.
+		closed := make(chan struct{})
+		go func() {
+			defer close(closed)
+			var discard string
+			for websocket.Message.Receive(ws, &discard) == nil {
+			}
+		}()
+
+		for _, message := range replay {
+			if websocket.JSON.Send(ws, message) != nil {
+				return
+			}
+		}
+		for {
+			select {
+			case <-closed:
+				return
+			case message, ok := <-messages:
+				if !ok || websocket.JSON.Send(ws, message) != nil {
+					return
+				}
+			}
+		}
+	}).ServeHTTP(c.Response(), c.Request())
+	return nil
+}
+
+func writeSSE(w http.ResponseWriter, message StreamMessage) error {
+	data, err := json.Marshal(message.Event)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", message.ID, message.Event.Type, data)
+	return err
+}
+
+func parseLastEventID(value string) (uint64, error) {
+	if value == "" {
+		return 0, nil
+	}
+	return strconv.ParseUint(value, 10, 64)
+}
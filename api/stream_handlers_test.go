@@ -0,0 +1,210 @@
+package api_test
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"github.com/okcthulhu/ChooseYourOwnAdventure/api"
+	"github.com/okcthulhu/ChooseYourOwnAdventure/api/models"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/websocket"
+)
+
+func streamServer(hub *api.Hub) *httptest.Server {
+	h := api.NewStreamHandler(hub)
+	e := echo.New()
+	e.GET("/player/:wixID/stream", func(c echo.Context) error {
+		return h.StreamPlayerEvents(c, c.Param("wixID"))
+	})
+	e.GET("/stories/:storyID/stream/ws", func(c echo.Context) error {
+		return h.StoryEventsSocket(c, c.Param("storyID"))
+	})
+	return httptest.NewServer(e)
+}
+
+// Hub
+
+func TestHub_RoutesEventsToTopics(t *testing.T) {
+	hub := api.NewHub(10)
+	wixID := uuid.New()
+	storyID := "s"
+
+	_, playerMessages, unsubscribePlayer := hub.Subscribe(api.PlayerTopic(wixID), 0)
+	defer unsubscribePlayer()
+	_, storyMessages, unsubscribeStory := hub.Subscribe(api.StoryTopic(storyID), 0)
+	defer unsubscribeStory()
+
+	hub.HandleEvent(context.Background(), models.DomainEvent{Type: models.NodeEntered, WixID: &wixID, StoryID: &storyID})
+	hub.HandleEvent(context.Background(), models.DomainEvent{Type: models.StoryElementUpdated, StoryID: &storyID})
+
+	assert.Equal(t, models.NodeEntered, (<-playerMessages).Event.Type)
+	assert.Equal(t, models.StoryElementUpdated, (<-storyMessages).Event.Type)
+	assert.Empty(t, playerMessages)
+	assert.Empty(t, storyMessages)
+}
+
+func TestHub_StoryEventsCarryNoElement(t *testing.T) {
+	hub := api.NewHub(10)
+	storyID, nodeID := "s", "start"
+
+	_, messages, unsubscribe := hub.Subscribe(api.StoryTopic(storyID), 0)
+	defer unsubscribe()
+
+	hub.HandleEvent(context.Background(), models.DomainEvent{
+		Type:    models.StoryElementUpdated,
+		StoryID: &storyID,
+		NodeID:  &nodeID,
+		Element: &models.StoryElement{StoryID: storyID, NodeID: nodeID, Content: "paid content"},
+	})
+
+	message := <-messages
+	assert.Equal(t, nodeID, *message.Event.NodeID)
+	assert.Nil(t, message.Event.Element)
+}
+
+func TestHub_ReplaysAfterLastID(t *testing.T) {
+	hub := api.NewHub(2)
+	for i := 0; i < 3; i++ {
+		hub.Broadcast("topic", models.DomainEvent{Type: models.NodeEntered})
+	}
+
+	replay, _, unsubscribe := hub.Subscribe("topic", 1)
+	defer unsubscribe()
+
+	if assert.Len(t, replay, 2) {
+		assert.Equal(t, uint64(2), replay[0].ID)
+		assert.Equal(t, uint64(3), replay[1].ID)
+	}
+
+	fresh, _, unsubscribeFresh := hub.Subscribe("topic", 0)
+	defer unsubscribeFresh()
+	assert.Empty(t, fresh, "clients without a Last-Event-ID only get live events")
+}
+
+func TestHub_ForgetsIdleTopics(t *testing.T) {
+	hub := api.NewHub(10)
+	hub.HistoryTTL = 10 * time.Millisecond
+	hub.Broadcast("left", models.DomainEvent{Type: models.NodeEntered})
+	hub.Broadcast("watched", models.DomainEvent{Type: models.NodeEntered})
+	_, _, unsubscribe := hub.Subscribe("watched", 0)
+	defer unsubscribe()
+
+	time.Sleep(20 * time.Millisecond)
+	hub.Broadcast("other", models.DomainEvent{Type: models.NodeEntered})
+
+	left, _, unsubscribeLeft := hub.Subscribe("left", 1)
+	defer unsubscribeLeft()
+	assert.Empty(t, left, "the history of a topic nobody watches expires")
+
+	watched, _, unsubscribeWatched := hub.Subscribe("watched", 1)
+	defer unsubscribeWatched()
+	assert.Len(t, watched, 1, "the history of a watched topic is kept")
+}
+
+func TestHub_CloseDisconnectsSubscribers(t *testing.T) {
+	hub := api.NewHub(10)
+	_, messages, unsubscribe := hub.Subscribe("topic", 0)
+
+	hub.Close()
+	unsubscribe()
+
+	_, open := <-messages
+	assert.False(t, open)
+
+	_, late, unsubscribeLate := hub.Subscribe("topic", 0)
+	defer unsubscribeLate()
+	_, open = <-late
+	assert.False(t, open, "subscribers after Close are disconnected right away")
+}
+
+// StreamPlayerEvents
+
+func TestStreamPlayerEvents_ReplayAndLive(t *testing.T) {
+	hub := api.NewHub(10)
+	wixID := uuid.New()
+	hub.Broadcast(api.PlayerTopic(wixID), models.DomainEvent{Id: "old", Type: models.NodeEntered})
+	hub.Broadcast(api.PlayerTopic(wixID), models.DomainEvent{Id: "missed", Type: models.WisdomGranted})
+
+	server := streamServer(hub)
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/player/"+wixID.String()+"/stream", nil)
+	req.Header.Set("Last-Event-ID", "1")
+	resp, err := http.DefaultClient.Do(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer resp.Body.Close()
+	assert.Equal(t, "text/event-stream", resp.Header.Get(echo.HeaderContentType))
+
+	reader := bufio.NewReader(resp.Body)
+	readEvent := func() string {
+		var lines []string
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil || line == "\n" {
+				return strings.Join(lines, "")
+			}
+			lines = append(lines, line)
+		}
+	}
+
+	replayed := readEvent()
+	assert.Contains(t, replayed, "id: 2\n")
+	assert.Contains(t, replayed, "event: WisdomGranted\n")
+	assert.Contains(t, replayed, `"id":"missed"`)
+
+	hub.Broadcast(api.PlayerTopic(wixID), models.DomainEvent{Id: "live", Type: models.StoryCompleted})
+	live := readEvent()
+	assert.Contains(t, live, "id: 3\n")
+	assert.Contains(t, live, `"id":"live"`)
+}
+
+func TestStreamPlayerEvents_InvalidWixID(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/player/invalid/stream", nil)
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(req, rec)
+
+	h := api.NewStreamHandler(api.NewHub(10))
+	h.StreamPlayerEvents(c, "invalid")
+
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Contains(t, rec.Body.String(), "Invalid WixID format")
+}
+
+// StoryEventsSocket
+
+func TestStoryEventsSocket_ReplayAndLive(t *testing.T) {
+	hub := api.NewHub(10)
+	hub.Broadcast(api.StoryTopic("s"), models.DomainEvent{Id: "first", Type: models.StoryElementCreated})
+	hub.Broadcast(api.StoryTopic("s"), models.DomainEvent{Id: "second", Type: models.StoryElementUpdated})
+
+	server := streamServer(hub)
+	defer server.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/stories/s/stream/ws?lastEventId=1"
+	ws, err := websocket.Dial(wsURL, "", server.URL)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer ws.Close()
+	ws.SetDeadline(time.Now().Add(5 * time.Second))
+
+	var message api.StreamMessage
+	assert.NoError(t, websocket.JSON.Receive(ws, &message))
+	assert.Equal(t, uint64(2), message.ID)
+	assert.Equal(t, "second", message.Event.Id)
+
+	hub.Broadcast(api.StoryTopic("s"), models.DomainEvent{Id: "third", Type: models.StoryElementDeleted})
+	assert.NoError(t, websocket.JSON.Receive(ws, &message))
+	assert.Equal(t, "third", message.Event.Id)
+}
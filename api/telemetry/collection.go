@@ -0,0 +1,86 @@
+package telemetry
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Collection is a MongoDB collection whose calls are traced and have their
+// latency and failures recorded. It satisfies the collection interfaces of the
+// handlers; the methods they do not use are passed through uninstrumented.
+type Collection struct {
+	*mongo.Collection
+
+	metrics *Metrics
+}
+
+// Collection instruments a MongoDB collection with the metrics.
+func (m *Metrics) Collection(col *mongo.Collection) *Collection {
+	return &Collection{Collection: col, metrics: m}
+}
+
+// observe starts the span of a storage call and returns the function that ends
+// it with the outcome of the call.
+func (c *Collection) observe(ctx context.Context, operation string) (context.Context, func(error)) {
+	start := time.Now()
+	ctx, span := startStorageSpan(ctx, c.Name(), operation)
+	return ctx, func(err error) {
+		c.metrics.observeStorage(c.Name(), operation, time.Since(start), err)
+		endStorageSpan(span, err)
+	}
+}
+
+// InsertOne inserts a document.
+func (c *Collection) InsertOne(ctx context.Context, document interface{}, opts ...*options.InsertOneOptions) (*mongo.InsertOneResult, error) {
+	ctx, done := c.observe(ctx, "insertOne")
+	result, err := c.Collection.InsertOne(ctx, document, opts...)
+	done(err)
+	return result, err
+}
+
+// FindOne finds a single document. The query runs before FindOne returns.
+func (c *Collection) FindOne(ctx context.Context, filter interface{}, opts ...*options.FindOneOptions) *mongo.SingleResult {
+	ctx, done := c.observe(ctx, "findOne")
+	result := c.Collection.FindOne(ctx, filter, opts...)
+	done(result.Err())
+	return result
+}
+
+// Find queries the documents. Only the first batch is covered; iterating the
+// cursor fetches the rest.
+func (c *Collection) Find(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (*mongo.Cursor, error) {
+	ctx, done := c.observe(ctx, "find")
+	cursor, err := c.Collection.Find(ctx, filter, opts...)
+	done(err)
+	return cursor, err
+}
+
+// UpdateOne updates a single document.
+func (c *Collection) UpdateOne(ctx context.Context, filter interface{}, update interface{},
+	opts ...*options.UpdateOptions) (*mongo.UpdateResult, error) {
+	ctx, done := c.observe(ctx, "updateOne")
+	result, err := c.Collection.UpdateOne(ctx, filter, update, opts...)
+	done(err)
+	return result, err
+}
+
+// DeleteOne deletes a single document.
+func (c *Collection) DeleteOne(ctx context.Context, filter interface{},
+	opts ...*options.DeleteOptions) (*mongo.DeleteResult, error) {
+	ctx, done := c.observe(ctx, "deleteOne")
+	result, err := c.Collection.DeleteOne(ctx, filter, opts...)
+	done(err)
+	return result, err
+}
+
+// FindOneAndUpdate atomically finds and updates a single document.
+func (c *Collection) FindOneAndUpdate(ctx context.Context, filter interface{}, update interface{},
+	opts ...*options.FindOneAndUpdateOptions) *mongo.SingleResult {
+	ctx, done := c.observe(ctx, "findOneAndUpdate")
+	result := c.Collection.FindOneAndUpdate(ctx, filter, update, opts...)
+	done(result.Err())
+	return result
+}
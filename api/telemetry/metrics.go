@@ -0,0 +1,156 @@
+// Package telemetry instruments the API. It records Prometheus metrics for the
+// HTTP requests, the storage calls and the domain events, and traces requests
+// and storage calls with OpenTelemetry.
+package telemetry
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/okcthulhu/ChooseYourOwnAdventure/api/models"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// namespace prefixes the names of all metrics.
+const namespace = "cyoa"
+
+// unmatchedRoute labels requests that matched no route, so that arbitrary paths
+// do not each create a time series.
+const unmatchedRoute = "unmatched"
+
+// Metrics holds the Prometheus metrics of the API.
+type Metrics struct {
+	registry *prometheus.Registry
+
+	requests        *prometheus.CounterVec
+	requestDuration *prometheus.HistogramVec
+	storageDuration *prometheus.HistogramVec
+	storageErrors   *prometheus.CounterVec
+	domainEvents    map[models.DomainEventType]prometheus.Counter
+}
+
+// NewMetrics creates the metrics and registers them, along with the Go runtime
+// and process metrics, with a registry of their own.
+func NewMetrics() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "http_requests_total",
+			Help:      "HTTP requests handled, by route and status code.",
+		}, []string{"method", "route", "status"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "Latency of the HTTP requests, by route.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"method", "route"}),
+		storageDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "storage_operation_duration_seconds",
+			Help:      "Latency of the MongoDB calls, by collection and operation.",
+			Buckets:   []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+		}, []string{"collection", "operation"}),
+		storageErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "storage_errors_total",
+			Help:      "Failed MongoDB calls, by collection, operation and kind of failure.",
+		}, []string{"collection", "operation", "kind"}),
+		domainEvents: map[models.DomainEventType]prometheus.Counter{},
+	}
+
+	for eventType, name := range map[models.DomainEventType]string{
+		models.PlayerCreated:  "players_created_total",
+		models.ChoiceTaken:    "choices_taken_total",
+		models.WisdomGranted:  "wisdoms_granted_total",
+		models.StoryCompleted: "stories_completed_total",
+	} {
+		m.domainEvents[eventType] = prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      name,
+			Help:      "Domain events of type " + string(eventType) + " delivered.",
+		})
+		m.registry.MustRegister(m.domainEvents[eventType])
+	}
+	m.registry.MustRegister(
+		m.requests, m.requestDuration, m.storageDuration, m.storageErrors,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+// Handler serves the metrics in the Prometheus exposition format.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{Registry: m.registry})
+}
+
+// Middleware is the echo middleware that counts and times every request by its
+// route and traces it, continuing the trace of the caller if there is one.
+func (m *Metrics) Middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		start := time.Now()
+		ctx, span := startRequestSpan(c)
+		defer span.End()
+		c.SetRequest(c.Request().WithContext(ctx))
+
+		err := next(c)
+		if err != nil {
+			// Let echo write the error response now, so that its status is recorded.
+			c.Error(err)
+		}
+
+		route := c.Path()
+		if route == "" {
+			route = unmatchedRoute
+		}
+		method := c.Request().Method
+		status := c.Response().Status
+		m.requests.WithLabelValues(method, route, strconv.Itoa(status)).Inc()
+		m.requestDuration.WithLabelValues(method, route).Observe(time.Since(start).Seconds())
+		endRequestSpan(span, method, route, status, err)
+		return nil
+	}
+}
+
+// HandleEvent is an event bus subscriber that counts the domain events. The bus
+// delivers at least once, so a redelivered event is counted again.
+func (m *Metrics) HandleEvent(ctx context.Context, event models.DomainEvent) error {
+	if counter, ok := m.domainEvents[event.Type]; ok {
+		counter.Inc()
+	}
+	return nil
+}
+
+// observeStorage records the latency and outcome of a storage call.
+func (m *Metrics) observeStorage(collection, operation string, duration time.Duration, err error) {
+	m.storageDuration.WithLabelValues(collection, operation).Observe(duration.Seconds())
+	if kind := failureKind(err); kind != "" {
+		m.storageErrors.WithLabelValues(collection, operation, kind).Inc()
+	}
+}
+
+// failureKind classifies a failed storage call. Finding no document is an
+// answer rather than a failure, so it has no kind.
+func failureKind(err error) string {
+	switch {
+	case err == nil, errors.Is(err, mongo.ErrNoDocuments):
+		return ""
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.Is(err, context.DeadlineExceeded), mongo.IsTimeout(err):
+		return "timeout"
+	case mongo.IsDuplicateKeyError(err):
+		return "duplicate_key"
+	case mongo.IsNetworkError(err):
+		return "network"
+	}
+	return "other"
+}
@@ -0,0 +1,121 @@
+package telemetry_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/okcthulhu/ChooseYourOwnAdventure/api/models"
+	"github.com/okcthulhu/ChooseYourOwnAdventure/api/telemetry"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// scrape returns the metrics in the Prometheus exposition format.
+func scrape(t *testing.T, metrics *telemetry.Metrics) string {
+	rec := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body, err := io.ReadAll(rec.Body)
+	assert.NoError(t, err)
+	return string(body)
+}
+
+func TestMiddleware_CountsRequestsByRoute(t *testing.T) {
+	metrics := telemetry.NewMetrics()
+	e := echo.New()
+	e.Use(metrics.Middleware)
+	e.GET("/things/:id", func(c echo.Context) error {
+		return c.JSON(http.StatusOK, "thing")
+	})
+	e.GET("/broken", func(c echo.Context) error {
+		return echo.NewHTTPError(http.StatusTeapot)
+	})
+
+	for _, path := range []string{"/things/1", "/things/2", "/broken", "/nowhere"} {
+		e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	scraped := scrape(t, metrics)
+	assert.Contains(t, scraped, `cyoa_http_requests_total{method="GET",route="/things/:id",status="200"} 2`)
+	assert.Contains(t, scraped, `cyoa_http_requests_total{method="GET",route="/broken",status="418"} 1`)
+	assert.Contains(t, scraped, `cyoa_http_request_duration_seconds_count{method="GET",route="/things/:id"} 2`)
+	assert.NotContains(t, scraped, "/nowhere", "unmatched paths do not become labels")
+}
+
+func TestHandleEvent_CountsDomainEvents(t *testing.T) {
+	metrics := telemetry.NewMetrics()
+
+	metrics.HandleEvent(context.Background(), models.DomainEvent{Type: models.ChoiceTaken})
+	metrics.HandleEvent(context.Background(), models.DomainEvent{Type: models.ChoiceTaken})
+	metrics.HandleEvent(context.Background(), models.DomainEvent{Type: models.PlayerCreated})
+	metrics.HandleEvent(context.Background(), models.DomainEvent{Type: models.NodeEntered})
+
+	scraped := scrape(t, metrics)
+	assert.Contains(t, scraped, "cyoa_choices_taken_total 2")
+	assert.Contains(t, scraped, "cyoa_players_created_total 1")
+	assert.Contains(t, scraped, "cyoa_wisdoms_granted_total 0")
+}
+
+func TestCollection_RecordsStorageCalls(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("latency and failures", func(mt *mtest.T) {
+		metrics := telemetry.NewMetrics()
+		col := metrics.Collection(mt.Coll)
+
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch),
+			mtest.CreateCommandErrorResponse(mtest.CommandError{Code: 1, Message: "boom"}),
+		)
+		notFound := col.FindOne(context.Background(), bson.M{}).Err()
+		failed := col.FindOne(context.Background(), bson.M{}).Err()
+
+		assert.Error(t, notFound)
+		assert.Error(t, failed)
+		scraped := scrape(t, metrics)
+		name := mt.Coll.Name()
+		assert.Contains(t, scraped, `cyoa_storage_operation_duration_seconds_count{collection="`+name+`",operation="findOne"} 2`)
+		assert.Contains(t, scraped, `cyoa_storage_errors_total{collection="`+name+`",kind="other",operation="findOne"} 1`)
+	})
+}
+
+func TestTracing_StorageSpansNestInRequestSpans(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("spans", func(mt *mtest.T) {
+		exporter := tracetest.NewInMemoryExporter()
+		provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+		previous := otel.GetTracerProvider()
+		otel.SetTracerProvider(provider)
+		defer otel.SetTracerProvider(previous)
+
+		metrics := telemetry.NewMetrics()
+		col := metrics.Collection(mt.Coll)
+		e := echo.New()
+		e.Use(metrics.Middleware)
+		e.GET("/things/:id", func(c echo.Context) error {
+			col.FindOne(c.Request().Context(), bson.M{"id": c.Param("id")})
+			return c.JSON(http.StatusOK, "thing")
+		})
+
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, bson.D{{Key: "id", Value: "1"}}))
+		e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/things/1", nil))
+
+		spans := exporter.GetSpans()
+		if assert.Len(t, spans, 2) {
+			storage, request := spans[0], spans[1]
+			assert.Equal(t, mt.Coll.Name()+".findOne", storage.Name)
+			assert.Equal(t, "GET /things/:id", request.Name)
+			assert.Equal(t, request.SpanContext.SpanID(), storage.Parent.SpanID())
+		}
+	})
+}
@@ -0,0 +1,119 @@
+package telemetry
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/labstack/echo/v4"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Trace exporters.
+const (
+	// ExporterNone disables tracing.
+	ExporterNone = "none"
+
+	// ExporterStdout writes the spans to standard output.
+	ExporterStdout = "stdout"
+
+	// ExporterOTLP sends the spans to an OpenTelemetry collector over OTLP/HTTP.
+	ExporterOTLP = "otlp"
+)
+
+// instrumentation names the tracer of the API's spans.
+const instrumentation = "github.com/okcthulhu/ChooseYourOwnAdventure/api/telemetry"
+
+// SetupTracing installs the global tracer provider exporting the spans of the
+// service with the given exporter; endpoint is the collector URL for OTLP. The
+// returned function flushes the pending spans and must be called on shutdown.
+// With ExporterNone the spans are not recorded at all.
+func SetupTracing(ctx context.Context, exporter, endpoint, serviceName string) (func(context.Context) error, error) {
+	var spanExporter sdktrace.SpanExporter
+	var err error
+	switch exporter {
+	case ExporterNone:
+		return func(context.Context) error { return nil }, nil
+	case ExporterStdout:
+		spanExporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case ExporterOTLP:
+		spanExporter, err = otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(endpoint))
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q", exporter)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(semconv.ServiceName(serviceName)))
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(spanExporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return provider.Shutdown, nil
+}
+
+func tracer() trace.Tracer {
+	return otel.Tracer(instrumentation)
+}
+
+// startRequestSpan starts the server span of a request, as a child of the
+// caller's span if the request carries its trace context.
+func startRequestSpan(c echo.Context) (context.Context, trace.Span) {
+	req := c.Request()
+	ctx := otel.GetTextMapPropagator().Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+	return tracer().Start(ctx, req.Method,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(semconv.HTTPRequestMethodKey.String(req.Method)),
+	)
+}
+
+// endRequestSpan names the span of a request after its route, which is known
+// once the request has been routed, and records the outcome.
+func endRequestSpan(span trace.Span, method, route string, status int, err error) {
+	span.SetName(method + " " + route)
+	span.SetAttributes(semconv.HTTPRoute(route), semconv.HTTPResponseStatusCode(status))
+	if err != nil {
+		span.RecordError(err)
+	}
+	if status >= http.StatusInternalServerError {
+		span.SetStatus(codes.Error, http.StatusText(status))
+	}
+}
+
+// startStorageSpan starts the client span of a storage call.
+func startStorageSpan(ctx context.Context, collection, operation string) (context.Context, trace.Span) {
+	return tracer().Start(ctx, collection+"."+operation,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.DBSystemMongoDB,
+			semconv.DBMongoDBCollection(collection),
+			semconv.DBOperation(operation),
+		),
+	)
+}
+
+// endStorageSpan records the outcome of a storage call.
+func endStorageSpan(span trace.Span, err error) {
+	if kind := failureKind(err); kind != "" {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, kind)
+		span.SetAttributes(attribute.String("error.type", kind))
+	}
+	span.End()
+}
@@ -0,0 +1,74 @@
+package api
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/okcthulhu/ChooseYourOwnAdventure/api/models"
+)
+
+// ChoiceTimedOutHeader marks a response to a player whose time to choose had run
+// out, so the default choice of their story element was taken for them.
+const ChoiceTimedOutHeader = "Choice-Timed-Out"
+
+// ChoiceDeadlineHeader carries the deadline of the timed story element returned to a player.
+const ChoiceDeadlineHeader = "Choice-Deadline"
+
+// choiceDeadline returns when the choices of a timed story element expire for a
+// player, counted from when the server presented the element to them. It
+// reports false if the element is not timed or was never presented.
+func choiceDeadline(storyElement *models.StoryElement, storyState *models.StoryState) (time.Time, bool) {
+	if storyElement.TimeLimitSeconds == nil || storyElement.DefaultChoiceIndex == nil || storyState.PresentedAt == nil {
+		return time.Time{}, false
+	}
+	return storyState.PresentedAt.Add(time.Duration(*storyElement.TimeLimitSeconds) * time.Second), true
+}
+
+// expiredDefault returns the index of the default choice of a timed story
+// element whose deadline has passed at the given time. It reports false if the
+// player still has time, or if the default does not name one of the element's
+// choices.
+func expiredDefault(storyElement *models.StoryElement, storyState *models.StoryState, at time.Time) (int, bool) {
+	deadline, ok := choiceDeadline(storyElement, storyState)
+	if !ok || at.Before(deadline) {
+		return 0, false
+	}
+	index := *storyElement.DefaultChoiceIndex
+	if storyElement.Choices == nil || index < 0 || index >= len(*storyElement.Choices) {
+		return 0, false
+	}
+	return index, true
+}
+
+// setChoiceDeadline sets the deadline header of a response returning a story
+// element to a player, if the element is timed.
+func setChoiceDeadline(c echo.Context, storyElement *models.StoryElement, storyState *models.StoryState) {
+	if deadline, ok := choiceDeadline(storyElement, storyState); ok {
+		c.Response().Header().Set(ChoiceDeadlineHeader, deadline.UTC().Format(time.RFC3339))
+	}
+}
+
+// validateTimeLimit checks the time limit of a story element: a limit and a
+// default choice go together, the limit is positive, and the default is one of
+// the element's choices that any player can take. The returned message is
+// empty when the element is valid.
+func validateTimeLimit(storyElement *models.StoryElement) string {
+	if storyElement.TimeLimitSeconds == nil && storyElement.DefaultChoiceIndex == nil {
+		return ""
+	}
+	if storyElement.TimeLimitSeconds == nil || storyElement.DefaultChoiceIndex == nil {
+		return "A time limit requires a defaultChoiceIndex, and a defaultChoiceIndex a time limit"
+	}
+	if *storyElement.TimeLimitSeconds <= 0 {
+		return "The time limit must be at least one second"
+	}
+	index := *storyElement.DefaultChoiceIndex
+	if storyElement.Choices == nil || index < 0 || index >= len(*storyElement.Choices) {
+		return fmt.Sprintf("Default choice %d is not one of the element's choices", index)
+	}
+	if (*storyElement.Choices)[index].WisdomID != nil {
+		return fmt.Sprintf("Default choice %d requires a wisdom", index)
+	}
+	return ""
+}
@@ -0,0 +1,330 @@
+package api_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"github.com/okcthulhu/ChooseYourOwnAdventure/api"
+	"github.com/okcthulhu/ChooseYourOwnAdventure/api/models"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+// timedElement is a story element at "start" giving the player limit seconds to
+// choose between going "left" and the default, going "right".
+func timedElement(limit int) bson.D {
+	return append(storyElementDocument("s", "start",
+		bson.D{{Key: "description", Value: "Left"}, {Key: "nextNodeID", Value: "left"}},
+		bson.D{{Key: "description", Value: "Right"}, {Key: "nextNodeID", Value: "right"}},
+	), bson.E{Key: "timeLimitSeconds", Value: limit}, bson.E{Key: "defaultChoiceIndex", Value: 1})
+}
+
+// presentedAgo sets when the player was presented with the node of the only story
+// state of a player document.
+func presentedAgo(player bson.D, ago time.Duration) bson.D {
+	for i, field := range player {
+		if field.Key == "storyStates" {
+			storyState := field.Value.(bson.A)[0].(bson.D)
+			player[i].Value = bson.A{append(storyState, bson.E{Key: "presentedAt", Value: time.Now().Add(-ago)})}
+		}
+	}
+	return player
+}
+
+// playerUpdate returns the update document of the first update sent to the collection.
+func playerUpdate(mt *mtest.T) bson.Raw {
+	for _, event := range mt.GetAllStartedEvents() {
+		if event.CommandName == "update" {
+			return event.Command.Lookup("updates").Array().Index(0).Value().Document().Lookup("u").Document()
+		}
+	}
+	return nil
+}
+
+func TestTakeChoice_Timed(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("deadline passed takes the default", func(mt *mtest.T) {
+		wixID := uuid.New()
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(choiceRequest(0), rec)
+
+		h := api.NewPlayerHandler(mt.Coll, mt.Coll)
+
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, presentedAgo(playerDocument(wixID, "s", "start"), time.Minute)),
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, timedElement(30)),
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, storyElementDocument("s", "right")),
+			matchedResponse(),
+		)
+
+		assert.NoError(t, h.TakeChoice(c, wixID.String(), "s"))
+
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "true", rec.Header().Get(api.ChoiceTimedOutHeader))
+		var element models.StoryElement
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &element))
+		assert.Equal(t, "right", element.NodeID)
+
+		update := playerUpdate(mt)
+		assert.Equal(t, "right", update.Lookup("$set", "storyStates.$.currentStoryNodeID").StringValue())
+		assert.WithinDuration(t, time.Now(), update.Lookup("$set", "storyStates.$.presentedAt").Time(), time.Minute)
+
+		staged := stagedEvents(mt)
+		if assert.NotEmpty(t, staged) && assert.NotNil(t, staged[0].Choice) {
+			choice := staged[0].Choice
+			assert.Equal(t, 1, choice.ChoiceIndex)
+			if assert.NotNil(t, choice.TimedOut) {
+				assert.True(t, *choice.TimedOut)
+			}
+		}
+	})
+
+	mt.Run("within time takes the requested choice", func(mt *mtest.T) {
+		wixID := uuid.New()
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(choiceRequest(0), rec)
+
+		h := api.NewPlayerHandler(mt.Coll, mt.Coll)
+
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, presentedAgo(playerDocument(wixID, "s", "start"), 5*time.Second)),
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, timedElement(30)),
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, storyElementDocument("s", "left")),
+			matchedResponse(),
+		)
+
+		assert.NoError(t, h.TakeChoice(c, wixID.String(), "s"))
+
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Empty(t, rec.Header().Get(api.ChoiceTimedOutHeader))
+		assert.Equal(t, "left", playerUpdate(mt).Lookup("$set", "storyStates.$.currentStoryNodeID").StringValue())
+	})
+
+	mt.Run("deadline of the next element", func(mt *mtest.T) {
+		wixID := uuid.New()
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(choiceRequest(0), rec)
+
+		h := api.NewPlayerHandler(mt.Coll, mt.Coll)
+
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, playerDocument(wixID, "s", "gate")),
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, storyElementDocument("s", "gate",
+				bson.D{{Key: "description", Value: "On"}, {Key: "nextNodeID", Value: "start"}})),
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, timedElement(30)),
+			matchedResponse(),
+		)
+
+		assert.NoError(t, h.TakeChoice(c, wixID.String(), "s"))
+
+		assert.Equal(t, http.StatusOK, rec.Code)
+		deadline, err := time.Parse(time.RFC3339, rec.Header().Get(api.ChoiceDeadlineHeader))
+		if assert.NoError(t, err) {
+			assert.WithinDuration(t, time.Now().Add(30*time.Second), deadline, 5*time.Second)
+		}
+	})
+}
+
+func TestGetCurrentStoryElement_Timed(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("clock started on first presentation", func(mt *mtest.T) {
+		wixID := uuid.New()
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/", nil), rec)
+
+		h := api.NewPlayerHandler(mt.Coll, mt.Coll)
+
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, playerDocument(wixID, "s", "start")),
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, timedElement(30)),
+			matchedResponse(),
+		)
+
+		assert.NoError(t, h.GetCurrentStoryElement(c, wixID.String(), "s"))
+
+		assert.Equal(t, http.StatusOK, rec.Code)
+		update := playerUpdate(mt)
+		if assert.NotNil(t, update) {
+			assert.WithinDuration(t, time.Now(), update.Lookup("$set", "storyStates.$.presentedAt").Time(), time.Minute)
+		}
+		assert.NotEmpty(t, rec.Header().Get(api.ChoiceDeadlineHeader))
+	})
+
+	mt.Run("clock left running", func(mt *mtest.T) {
+		wixID := uuid.New()
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/", nil), rec)
+
+		h := api.NewPlayerHandler(mt.Coll, mt.Coll)
+
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, presentedAgo(playerDocument(wixID, "s", "start"), 10*time.Second)),
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, timedElement(30)),
+		)
+
+		assert.NoError(t, h.GetCurrentStoryElement(c, wixID.String(), "s"))
+
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Nil(t, playerUpdate(mt), "a running clock is not restarted")
+		deadline, err := time.Parse(time.RFC3339, rec.Header().Get(api.ChoiceDeadlineHeader))
+		if assert.NoError(t, err) {
+			assert.WithinDuration(t, time.Now().Add(20*time.Second), deadline, 5*time.Second)
+		}
+	})
+
+	mt.Run("deadline passed takes the default", func(mt *mtest.T) {
+		wixID := uuid.New()
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/", nil), rec)
+
+		h := api.NewPlayerHandler(mt.Coll, mt.Coll)
+
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, presentedAgo(playerDocument(wixID, "s", "start"), time.Hour)),
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, timedElement(30)),
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, storyElementDocument("s", "right")),
+			matchedResponse(),
+		)
+
+		assert.NoError(t, h.GetCurrentStoryElement(c, wixID.String(), "s"))
+
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "true", rec.Header().Get(api.ChoiceTimedOutHeader))
+		var element models.StoryElement
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &element))
+		assert.Equal(t, "right", element.NodeID)
+		assert.Equal(t, "right", playerUpdate(mt).Lookup("$set", "storyStates.$.currentStoryNodeID").StringValue())
+	})
+}
+
+func TestPatchPlayerState_PresentedAt(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("clock cannot be restarted", func(mt *mtest.T) {
+		wixID := uuid.New()
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(patchRequest(api.MIMEJSONPatch,
+			`[{"op":"replace","path":"/storyStates/0/presentedAt","value":"2099-01-01T00:00:00Z"}]`), rec)
+
+		h := api.NewPlayerHandler(mt.Coll, mt.Coll)
+
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, presentedAgo(playerDocument(wixID, "s", "start"), time.Minute)),
+		)
+
+		h.PatchPlayerState(c, wixID.String())
+
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+		assert.Contains(t, rec.Body.String(), "presentedAt")
+		assert.Nil(t, playerUpdate(mt))
+	})
+}
+
+func TestPatchPlayerState_Progress(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	rejected := map[string]struct{ contentType, body, message string }{
+		"timed node skipped": {api.MIMEJSONPatch,
+			`[{"op":"replace","path":"/storyStates/0/currentStoryNodeID","value":"left"}]`, "currentStoryNodeID"},
+		"story completed": {api.MIMEJSONPatch,
+			`[{"op":"add","path":"/storyStates/0/completed","value":true}]`, "completed"},
+		"ending discovered": {api.MIMEJSONPatch,
+			`[{"op":"add","path":"/storyStates/0/endingsDiscovered","value":[{"endingID":"e","nodeID":"left","discoveredAt":"2024-01-01T00:00:00Z"}]}]`, "endingsDiscovered"},
+		"story state removed": {api.MIMEMergePatch, `{"storyStates":[]}`, "removed"},
+	}
+	for name, patch := range rejected {
+		mt.Run(name, func(mt *mtest.T) {
+			wixID := uuid.New()
+			rec := httptest.NewRecorder()
+			c := echo.New().NewContext(patchRequest(patch.contentType, patch.body), rec)
+
+			mt.AddMockResponses(
+				mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, presentedAgo(playerDocument(wixID, "s", "start"), time.Minute)),
+			)
+
+			api.NewPlayerHandler(mt.Coll, mt.Coll).PatchPlayerState(c, wixID.String())
+
+			assert.Equal(t, http.StatusBadRequest, rec.Code)
+			assert.Contains(t, rec.Body.String(), patch.message)
+			assert.Nil(t, playerUpdate(mt))
+		})
+	}
+
+	startStory := `[{"op":"add","path":"/storyStates/-","value":{"storyID":"t","currentStoryNodeID":"middle"}}]`
+
+	mt.Run("story started in the middle", func(mt *mtest.T) {
+		wixID := uuid.New()
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(patchRequest(api.MIMEJSONPatch, startStory), rec)
+
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, playerDocument(wixID, "s", "start")),
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, storyElementDocument("t", "middle")),
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, storyElementDocument("t", "start")),
+		)
+
+		api.NewPlayerHandler(mt.Coll, mt.Coll).PatchPlayerState(c, wixID.String())
+
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+		assert.Contains(t, rec.Body.String(), "beginning")
+		assert.Nil(t, playerUpdate(mt))
+	})
+
+	mt.Run("story started at its beginning", func(mt *mtest.T) {
+		wixID := uuid.New()
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(patchRequest(api.MIMEJSONPatch, startStory), rec)
+
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, playerDocument(wixID, "s", "start")),
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, storyElementDocument("t", "middle")),
+			mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch),
+			matchedResponse(),
+		)
+
+		api.NewPlayerHandler(mt.Coll, mt.Coll).PatchPlayerState(c, wixID.String())
+
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Contains(t, playerUpdate(mt).String(), "presentedAt", "the clock starts with the story")
+	})
+}
+
+func TestCreateStoryElement_InvalidTimeLimit(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	cases := map[string]string{
+		"limit without default": `"timeLimitSeconds":30`,
+		"default without limit": `"defaultChoiceIndex":0`,
+		"no time at all":        `"timeLimitSeconds":0,"defaultChoiceIndex":0`,
+		"default out of range":  `"timeLimitSeconds":30,"defaultChoiceIndex":2`,
+		"gated default":         `"timeLimitSeconds":30,"defaultChoiceIndex":1`,
+	}
+	for name, fields := range cases {
+		mt.Run(name, func(mt *mtest.T) {
+			body := `{"storyID":"s","nodeID":"n","content":"c",` + fields + `,"choices":[` +
+				`{"description":"Wait","nextNodeID":"a"},{"description":"Sneak","nextNodeID":"b","wisdomID":"stealth"}]}`
+			req := httptest.NewRequest(http.MethodPost, "/", bytes.NewBufferString(body))
+			req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+			rec := httptest.NewRecorder()
+
+			api.NewStoryHandler(mt.Coll).CreateStoryElement(echo.New().NewContext(req, rec))
+
+			assert.Equal(t, http.StatusBadRequest, rec.Code)
+			assert.Empty(t, mt.GetAllStartedEvents())
+		})
+	}
+}
@@ -0,0 +1,91 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// DefaultStorageTimeout bounds the storage calls of an operation that has no
+// timeout of its own.
+const DefaultStorageTimeout = 5 * time.Second
+
+// statusClientClosedRequest is recorded for requests whose client went away
+// before the storage answered. Nobody reads the response.
+const statusClientClosedRequest = 499
+
+// Timeouts bounds the storage calls made while handling a request. Operations
+// are named after the handler methods, such as "ListPlayers", and get Default
+// unless Operations gives them a timeout of their own.
+type Timeouts struct {
+	Default    time.Duration            `yaml:"default"`
+	Operations map[string]time.Duration `yaml:"operations"`
+}
+
+// DefaultTimeouts are the timeouts used unless configured otherwise. Party
+// lookups and votes load the members and the story as well, so they get longer.
+var DefaultTimeouts = Timeouts{
+	Default: DefaultStorageTimeout,
+	Operations: map[string]time.Duration{
+		"GetParty": 10 * time.Second,
+		"CastVote": 10 * time.Second,
+	},
+}
+
+// For returns the timeout of an operation.
+func (t Timeouts) For(operation string) time.Duration {
+	if timeout, ok := t.Operations[operation]; ok && timeout > 0 {
+		return timeout
+	}
+	if t.Default > 0 {
+		return t.Default
+	}
+	return DefaultStorageTimeout
+}
+
+// context derives the context of the storage calls of an operation from the
+// request, so that they are abandoned when the client goes away.
+func (t Timeouts) context(c echo.Context, operation string) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(c.Request().Context(), t.For(operation))
+}
+
+// detached returns a context for work that must complete once a change has been
+// stored, such as publishing its events, even if the client has gone away.
+func (t Timeouts) detached(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.WithoutCancel(ctx), t.For(""))
+}
+
+// IsTimeout reports whether a storage call failed because its deadline passed.
+func IsTimeout(err error) bool {
+	return errors.Is(err, context.DeadlineExceeded) || mongo.IsTimeout(err)
+}
+
+// storageError responds to a failed storage call with a 504 status code if the
+// call timed out and a 500 status code with the given message otherwise. The
+// failure is logged with what was being done.
+func storageError(c echo.Context, err error, doing, message string) error {
+	status, message := storageFailure(c.Request().Context(), err, doing, message)
+	if status == statusClientClosedRequest {
+		return c.NoContent(status)
+	}
+	return c.JSON(status, message)
+}
+
+// storageFailure is storageError for helpers that return the status code and
+// message to respond with. ctx is the context of the request, whose ID is logged.
+func storageFailure(ctx context.Context, err error, doing, message string) (int, string) {
+	switch {
+	case IsTimeout(err):
+		slog.ErrorContext(ctx, "Failed "+doing, "error", err, "timeout", true)
+		return http.StatusGatewayTimeout, "Storage timed out"
+	case errors.Is(err, context.Canceled):
+		return statusClientClosedRequest, ""
+	}
+	slog.ErrorContext(ctx, "Failed "+doing, "error", err)
+	return http.StatusInternalServerError, message
+}
@@ -0,0 +1,87 @@
+package api_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/okcthulhu/ChooseYourOwnAdventure/api"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestTimeoutsFor(t *testing.T) {
+	timeouts := api.Timeouts{
+		Default:    3 * time.Second,
+		Operations: map[string]time.Duration{"ListPlayers": 20 * time.Second},
+	}
+
+	assert.Equal(t, 20*time.Second, timeouts.For("ListPlayers"))
+	assert.Equal(t, 3*time.Second, timeouts.For("TakeChoice"))
+	assert.Equal(t, api.DefaultStorageTimeout, api.Timeouts{}.For("TakeChoice"), "unset timeouts fall back to the default")
+}
+
+func TestStorageTimeout_RespondsWithGatewayTimeout(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("operation timeout exceeded", func(mt *mtest.T) {
+		req := httptest.NewRequest(http.MethodGet, "/stories/s/elements/start", nil)
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(req, rec)
+
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, storyElementDocument("s", "start")))
+
+		h := api.NewStoryHandler(mt.Coll)
+		h.Timeouts.Operations = map[string]time.Duration{"GetStoryElement": time.Nanosecond}
+		h.GetStoryElement(c, "s", "start")
+
+		assert.Equal(t, http.StatusGatewayTimeout, rec.Code)
+		assert.Equal(t, "\"Storage timed out\"", strings.TrimSuffix(rec.Body.String(), "\n"))
+	})
+}
+
+func TestStorageTimeout_OtherOperationsUnaffected(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("only the configured operation times out", func(mt *mtest.T) {
+		req := httptest.NewRequest(http.MethodGet, "/stories/s/elements/start", nil)
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(req, rec)
+
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, storyElementDocument("s", "start")))
+
+		h := api.NewStoryHandler(mt.Coll)
+		h.Timeouts.Operations = map[string]time.Duration{"ListStoryElements": time.Nanosecond}
+		h.GetStoryElement(c, "s", "start")
+
+		assert.Equal(t, http.StatusOK, rec.Code)
+	})
+}
+
+func TestStorageCall_CanceledWithRequest(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("client gone away", func(mt *mtest.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		req := httptest.NewRequest(http.MethodGet, "/stories/s/elements/start", nil).WithContext(ctx)
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(req, rec)
+
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "foo.bar", mtest.FirstBatch, storyElementDocument("s", "start")))
+
+		h := api.NewStoryHandler(mt.Coll)
+		h.GetStoryElement(c, "s", "start")
+
+		assert.NotEqual(t, http.StatusOK, rec.Code, "the storage call is abandoned with the request")
+		assert.NotEqual(t, http.StatusGatewayTimeout, rec.Code, "a client going away is not a timeout")
+		assert.Empty(t, rec.Body.String())
+	})
+}
@@ -0,0 +1,555 @@
+// Package config loads the configuration of the API server.
+//
+// Every setting has a default and can be overridden, from lowest to highest
+// precedence, by an optional YAML file, by an environment variable and by a
+// command-line flag. The YAML file is named by the -config flag or the
+// CYOA_CONFIG environment variable.
+package config
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/okcthulhu/ChooseYourOwnAdventure/api"
+	"github.com/okcthulhu/ChooseYourOwnAdventure/api/models"
+	"github.com/okcthulhu/ChooseYourOwnAdventure/api/telemetry"
+	"gopkg.in/yaml.v3"
+)
+
+// FileEnv names the environment variable holding the path of the YAML file.
+const FileEnv = "CYOA_CONFIG"
+
+// redacted replaces secrets in the printed configuration.
+const redacted = "REDACTED"
+
+// Config is the configuration of the API server.
+type Config struct {
+	Server           Server    `yaml:"server"`
+	Mongo            Mongo     `yaml:"mongo"`
+	Events           Events    `yaml:"events"`
+	Telemetry        Telemetry `yaml:"telemetry"`
+	Log              Log       `yaml:"log"`
+	Cache            Cache     `yaml:"cache"`
+	Assets           Assets    `yaml:"assets"`
+	AdminToken       string    `yaml:"adminToken"`
+	AchievementsFile string    `yaml:"achievementsFile"`
+	PaywallsFile     string    `yaml:"paywallsFile"`
+
+	// Timeouts bounds the storage calls of each request. Only the default can be
+	// set from the environment and flags; the operations are set in the file.
+	Timeouts api.Timeouts `yaml:"timeouts"`
+
+	// RateLimits are the budgets of the read, write and author requests of each
+	// client. Only the requests can be set from the environment and flags; the
+	// periods are set in the file.
+	RateLimits api.RateLimits `yaml:"rateLimits"`
+}
+
+// Server configures the HTTP server.
+type Server struct {
+	Port int `yaml:"port"`
+
+	// DrainTimeout is how long the requests in flight may take to finish on shutdown.
+	DrainTimeout time.Duration `yaml:"drainTimeout"`
+
+	// ReadinessDelay is how long the server keeps serving after it stops reporting
+	// ready on shutdown, for load balancers to notice before connections are closed.
+	// It is taken out of the drain timeout.
+	ReadinessDelay time.Duration `yaml:"readinessDelay"`
+
+	// ReadinessTimeout bounds the storage ping of a readiness check.
+	ReadinessTimeout time.Duration `yaml:"readinessTimeout"`
+}
+
+// Mongo configures the storage.
+type Mongo struct {
+	URI      string `yaml:"uri"`
+	Database string `yaml:"database"`
+
+	// ConnectTimeout bounds connecting to and pinging MongoDB on startup.
+	ConnectTimeout time.Duration `yaml:"connectTimeout"`
+
+	// MigrationTimeout bounds applying the pending migrations.
+	MigrationTimeout time.Duration `yaml:"migrationTimeout"`
+
+	Collections api.Collections `yaml:"collections"`
+}
+
+// Events configures where domain events are delivered besides the in-process subscribers.
+type Events struct {
+	// File is appended every event as a line of JSON when set.
+	File string `yaml:"file"`
+
+	// WebhookURL is posted every event when set, signed with WebhookSecret.
+	WebhookURL    string `yaml:"webhookURL"`
+	WebhookSecret string `yaml:"webhookSecret"`
+
+	// PollInterval is how often the outbox is checked for events to deliver.
+	PollInterval time.Duration `yaml:"pollInterval"`
+
+	// StreamHistoryTTL is how long the events of a stream nobody is connected to
+	// are kept for replay after the last one.
+	StreamHistoryTTL time.Duration `yaml:"streamHistoryTTL"`
+}
+
+// Telemetry configures the tracing. The metrics are always served on /metrics.
+type Telemetry struct {
+	// TracesExporter is where the spans go: none, stdout or otlp.
+	TracesExporter string `yaml:"tracesExporter"`
+
+	// OTLPEndpoint is the URL of the OpenTelemetry collector the otlp exporter sends to.
+	OTLPEndpoint string `yaml:"otlpEndpoint"`
+
+	// ServiceName identifies the API in the traces.
+	ServiceName string `yaml:"serviceName"`
+}
+
+// Log configures the logs, which are written to standard error.
+type Log struct {
+	// Level is the least severe level logged: debug, info, warn or error.
+	Level string `yaml:"level"`
+
+	// Format is json for a JSON object per record or text for key=value lines.
+	Format string `yaml:"format"`
+}
+
+// SlogLevel parses the level.
+func (l Log) SlogLevel() (slog.Level, error) {
+	var level slog.Level
+	err := level.UnmarshalText([]byte(l.Level))
+	return level, err
+}
+
+// Cache configures the caching of story elements.
+type Cache struct {
+	// Size is how many story elements and whole stories are kept in memory, 0
+	// for none.
+	Size int `yaml:"size"`
+
+	// TTL is how long they are kept, which bounds how long changes made through
+	// other instances go unnoticed.
+	TTL time.Duration `yaml:"ttl"`
+
+	// MaxAge is how long browsers and CDNs may keep the story elements they read.
+	MaxAge time.Duration `yaml:"maxAge"`
+}
+
+// Assets configures the storage of uploaded media assets.
+type Assets struct {
+	// Dir is the directory the content of the assets is kept under.
+	Dir string `yaml:"dir"`
+
+	// MaxUploadMB bounds the content of an uploaded asset in megabytes.
+	MaxUploadMB int `yaml:"maxUploadMB"`
+
+	// URLSecret signs the media URLs handed to players when set, and the
+	// content is then only served through them.
+	URLSecret string `yaml:"urlSecret"`
+
+	// URLTTLs are how long the signed media URLs of images and videos stay valid.
+	URLTTLs api.MediaTTLs `yaml:"urlTTLs"`
+}
+
+// Default returns the configuration used where nothing else is set.
+func Default() Config {
+	cfg := Config{
+		Server: Server{
+			Port:             8080,
+			DrainTimeout:     15 * time.Second,
+			ReadinessDelay:   5 * time.Second,
+			ReadinessTimeout: 2 * time.Second,
+		},
+		Mongo: Mongo{
+			Database:         "cyoa",
+			ConnectTimeout:   10 * time.Second,
+			MigrationTimeout: 5 * time.Minute,
+			Collections:      api.DefaultCollections,
+		},
+		Events: Events{
+			PollInterval:     time.Second,
+			StreamHistoryTTL: api.DefaultHistoryTTL,
+		},
+		Telemetry: Telemetry{
+			TracesExporter: telemetry.ExporterNone,
+			OTLPEndpoint:   "http://localhost:4318",
+			ServiceName:    "cyoa-api",
+		},
+		Log: Log{
+			Level:  "info",
+			Format: api.LogFormatJSON,
+		},
+		Cache: Cache{
+			Size:   api.DefaultCacheSize,
+			TTL:    api.DefaultCacheTTL,
+			MaxAge: api.DefaultCacheMaxAge,
+		},
+		Assets: Assets{
+			Dir:         "assets",
+			MaxUploadMB: api.DefaultMaxUploadSize >> 20,
+			URLTTLs:     api.DefaultMediaTTLs,
+		},
+		AchievementsFile: "achievements.yaml",
+		PaywallsFile:     "paywalls.yaml",
+		Timeouts:         api.DefaultTimeouts,
+		RateLimits:       api.DefaultRateLimits,
+	}
+	// The file adds to the operations, which must not change the shared defaults
+	cfg.Timeouts.Operations = make(map[string]time.Duration, len(api.DefaultTimeouts.Operations))
+	for operation, timeout := range api.DefaultTimeouts.Operations {
+		cfg.Timeouts.Operations[operation] = timeout
+	}
+	return cfg
+}
+
+// setting is a value that can be set from the environment or a flag.
+type setting struct {
+	// key is the path of the setting in the YAML file.
+	key   string
+	env   string
+	flag  string
+	usage string
+
+	// field returns a pointer to the setting in a Config.
+	field func(*Config) interface{}
+}
+
+var settings = []setting{
+	{"server.port", "PORT", "port", "Port to run the application on",
+		func(c *Config) interface{} { return &c.Server.Port }},
+	{"server.drainTimeout", "DRAIN_TIMEOUT", "drain-timeout", "How long to wait for requests in flight on shutdown",
+		func(c *Config) interface{} { return &c.Server.DrainTimeout }},
+	{"server.readinessDelay", "READINESS_DELAY", "readiness-delay", "How long to keep serving after reporting not ready on shutdown, out of the drain timeout",
+		func(c *Config) interface{} { return &c.Server.ReadinessDelay }},
+	{"server.readinessTimeout", "READINESS_TIMEOUT", "readiness-timeout", "How long a readiness check waits for the storage",
+		func(c *Config) interface{} { return &c.Server.ReadinessTimeout }},
+	{"mongo.uri", "MONGO_URI", "mongo-uri", "MongoDB connection string",
+		func(c *Config) interface{} { return &c.Mongo.URI }},
+	{"mongo.database", "MONGO_DATABASE", "mongo-database", "MongoDB database name",
+		func(c *Config) interface{} { return &c.Mongo.Database }},
+	{"mongo.connectTimeout", "MONGO_CONNECT_TIMEOUT", "mongo-connect-timeout", "How long to wait for MongoDB on startup",
+		func(c *Config) interface{} { return &c.Mongo.ConnectTimeout }},
+	{"mongo.migrationTimeout", "MONGO_MIGRATION_TIMEOUT", "mongo-migration-timeout", "How long applying the migrations may take",
+		func(c *Config) interface{} { return &c.Mongo.MigrationTimeout }},
+	{"events.file", "EVENTS_FILE", "events-file", "File to append domain events to",
+		func(c *Config) interface{} { return &c.Events.File }},
+	{"events.webhookURL", "EVENTS_WEBHOOK_URL", "events-webhook-url", "URL to post domain events to",
+		func(c *Config) interface{} { return &c.Events.WebhookURL }},
+	{"events.webhookSecret", "EVENTS_WEBHOOK_SECRET", "events-webhook-secret", "Secret signing the posted domain events",
+		func(c *Config) interface{} { return &c.Events.WebhookSecret }},
+	{"events.pollInterval", "EVENTS_POLL_INTERVAL", "events-poll-interval", "How often the event outbox is checked",
+		func(c *Config) interface{} { return &c.Events.PollInterval }},
+	{"events.streamHistoryTTL", "STREAM_HISTORY_TTL", "stream-history-ttl", "How long the events of a stream nobody is connected to are kept for replay",
+		func(c *Config) interface{} { return &c.Events.StreamHistoryTTL }},
+	{"telemetry.tracesExporter", "TRACES_EXPORTER", "traces-exporter", "Where spans are exported to: none, stdout or otlp",
+		func(c *Config) interface{} { return &c.Telemetry.TracesExporter }},
+	{"telemetry.otlpEndpoint", "OTLP_ENDPOINT", "otlp-endpoint", "URL of the OpenTelemetry collector",
+		func(c *Config) interface{} { return &c.Telemetry.OTLPEndpoint }},
+	{"telemetry.serviceName", "SERVICE_NAME", "service-name", "Service name reported in traces",
+		func(c *Config) interface{} { return &c.Telemetry.ServiceName }},
+	{"log.level", "LOG_LEVEL", "log-level", "Least severe level logged: debug, info, warn or error",
+		func(c *Config) interface{} { return &c.Log.Level }},
+	{"log.format", "LOG_FORMAT", "log-format", "Format of the logs: json or text",
+		func(c *Config) interface{} { return &c.Log.Format }},
+	{"cache.size", "CACHE_SIZE", "cache-size", "Story elements and stories kept in memory, 0 for none",
+		func(c *Config) interface{} { return &c.Cache.Size }},
+	{"cache.ttl", "CACHE_TTL", "cache-ttl", "How long story elements and stories are kept in memory",
+		func(c *Config) interface{} { return &c.Cache.TTL }},
+	{"cache.maxAge", "CACHE_MAX_AGE", "cache-max-age", "How long browsers and CDNs may keep story elements, 0 to always revalidate",
+		func(c *Config) interface{} { return &c.Cache.MaxAge }},
+	{"assets.dir", "ASSETS_DIR", "assets-dir", "Directory the content of uploaded assets is kept under",
+		func(c *Config) interface{} { return &c.Assets.Dir }},
+	{"assets.maxUploadMB", "MAX_UPLOAD_MB", "max-upload-mb", "Largest asset that may be uploaded, in megabytes",
+		func(c *Config) interface{} { return &c.Assets.MaxUploadMB }},
+	{"assets.urlSecret", "MEDIA_URL_SECRET", "media-url-secret", "Secret signing the media URLs handed to players; unset serves media to everyone",
+		func(c *Config) interface{} { return &c.Assets.URLSecret }},
+	{"assets.urlTTLs.image", "MEDIA_URL_IMAGE_TTL", "media-url-image-ttl", "How long signed image URLs stay valid",
+		func(c *Config) interface{} { return &c.Assets.URLTTLs.Image }},
+	{"assets.urlTTLs.video", "MEDIA_URL_VIDEO_TTL", "media-url-video-ttl", "How long signed video URLs stay valid",
+		func(c *Config) interface{} { return &c.Assets.URLTTLs.Video }},
+	{"adminToken", "ADMIN_TOKEN", "admin-token", "Bearer token of the admin routes",
+		func(c *Config) interface{} { return &c.AdminToken }},
+	{"achievementsFile", "ACHIEVEMENTS_FILE", "achievements-file", "YAML file of the achievement catalog",
+		func(c *Config) interface{} { return &c.AchievementsFile }},
+	{"paywallsFile", "PAYWALLS_FILE", "paywalls-file", "YAML file of the stories and chapters sold separately",
+		func(c *Config) interface{} { return &c.PaywallsFile }},
+	{"timeouts.default", "STORAGE_TIMEOUT", "storage-timeout", "How long the storage calls of a request may take",
+		func(c *Config) interface{} { return &c.Timeouts.Default }},
+	{"rateLimits.read.requests", "RATE_LIMIT_READ", "rate-limit-read", "Reading requests a client may make per period, 0 for no limit",
+		func(c *Config) interface{} { return &c.RateLimits.Read.Requests }},
+	{"rateLimits.write.requests", "RATE_LIMIT_WRITE", "rate-limit-write", "Player and party changes a client may make per period, 0 for no limit",
+		func(c *Config) interface{} { return &c.RateLimits.Write.Requests }},
+	{"rateLimits.author.requests", "RATE_LIMIT_AUTHOR", "rate-limit-author", "Story element changes a client may make per period, 0 for no limit",
+		func(c *Config) interface{} { return &c.RateLimits.Author.Requests }},
+}
+
+// Load builds the configuration from the command-line arguments args, the
+// environment looked up with getenv and the YAML file named by either, and
+// validates it. Flags take precedence over the environment, which takes
+// precedence over the file. The flag usage is written to output when args
+// cannot be parsed.
+func Load(name string, args []string, getenv func(string) string, output io.Writer) (Config, error) {
+	// The flags are parsed first since one of them names the file, and applied last
+	flagged := Default()
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(output)
+	file := flags.String("config", getenv(FileEnv), "YAML configuration file (env "+FileEnv+")")
+	for _, s := range settings {
+		usage := fmt.Sprintf("%s (env %s)", s.usage, s.env)
+		switch p := s.field(&flagged).(type) {
+		case *string:
+			flags.StringVar(p, s.flag, *p, usage)
+		case *int:
+			flags.IntVar(p, s.flag, *p, usage)
+		case *time.Duration:
+			flags.DurationVar(p, s.flag, *p, usage)
+		}
+	}
+	if err := flags.Parse(args); err != nil {
+		return Config{}, err
+	}
+	if flags.NArg() > 0 {
+		return Config{}, fmt.Errorf("unexpected arguments: %v", flags.Args())
+	}
+
+	cfg := Default()
+	if *file != "" {
+		if err := cfg.readFile(*file); err != nil {
+			return Config{}, err
+		}
+	}
+	for _, s := range settings {
+		value := getenv(s.env)
+		if value == "" {
+			continue
+		}
+		if err := parseInto(s.field(&cfg), value); err != nil {
+			return Config{}, fmt.Errorf("environment variable %s: %w", s.env, err)
+		}
+	}
+	flags.Visit(func(f *flag.Flag) {
+		for _, s := range settings {
+			if s.flag == f.Name {
+				reflect.ValueOf(s.field(&cfg)).Elem().Set(reflect.ValueOf(s.field(&flagged)).Elem())
+			}
+		}
+	})
+
+	return cfg, cfg.Validate()
+}
+
+// readFile overrides the configuration with the settings of a YAML file. Unknown
+// settings are rejected, so that misspelt ones do not go unnoticed.
+func (c *Config) readFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("configuration file: %w", err)
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(c); err != nil && err != io.EOF {
+		return fmt.Errorf("configuration file %s: %w", path, err)
+	}
+	return nil
+}
+
+func parseInto(field interface{}, value string) error {
+	switch p := field.(type) {
+	case *string:
+		*p = value
+	case *int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("%q is not a number", value)
+		}
+		*p = n
+	case *time.Duration:
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("%q is not a duration, such as 5s or 1m30s", value)
+		}
+		*p = d
+	}
+	return nil
+}
+
+// Validate reports every invalid setting of the configuration.
+func (c Config) Validate() error {
+	var errs []error
+	invalid := func(key, format string, args ...interface{}) {
+		for _, s := range settings {
+			if s.key == key {
+				key = fmt.Sprintf("%s (env %s, flag -%s)", key, s.env, s.flag)
+			}
+		}
+		errs = append(errs, fmt.Errorf("%s: "+format, append([]interface{}{key}, args...)...))
+	}
+
+	if c.Server.Port < 1 || c.Server.Port > 65535 {
+		invalid("server.port", "%d is not a port number", c.Server.Port)
+	}
+	positive := map[string]time.Duration{
+		"server.drainTimeout":     c.Server.DrainTimeout,
+		"server.readinessTimeout": c.Server.ReadinessTimeout,
+		"mongo.connectTimeout":    c.Mongo.ConnectTimeout,
+		"mongo.migrationTimeout":  c.Mongo.MigrationTimeout,
+		"events.pollInterval":     c.Events.PollInterval,
+		"events.streamHistoryTTL": c.Events.StreamHistoryTTL,
+		"timeouts.default":        c.Timeouts.Default,
+	}
+	for _, s := range settings {
+		if d, ok := positive[s.key]; ok && d <= 0 {
+			invalid(s.key, "must be positive")
+		}
+	}
+	if c.Server.ReadinessDelay < 0 {
+		invalid("server.readinessDelay", "must not be negative")
+	} else if c.Server.DrainTimeout > 0 && c.Server.ReadinessDelay >= c.Server.DrainTimeout {
+		invalid("server.readinessDelay", "must be shorter than server.drainTimeout")
+	}
+
+	if c.Mongo.URI == "" {
+		invalid("mongo.uri", "is required")
+	} else if u, err := url.Parse(c.Mongo.URI); err != nil || (u.Scheme != "mongodb" && u.Scheme != "mongodb+srv") {
+		invalid("mongo.uri", "must be a mongodb:// or mongodb+srv:// connection string")
+	}
+	if c.Mongo.Database == "" {
+		invalid("mongo.database", "is required")
+	}
+	names := map[string]string{}
+	collections := reflect.ValueOf(c.Mongo.Collections)
+	for i := 0; i < collections.NumField(); i++ {
+		key := "mongo.collections." + collections.Type().Field(i).Tag.Get("yaml")
+		name := collections.Field(i).String()
+		if name == "" {
+			invalid(key, "is required")
+			continue
+		}
+		if other, ok := names[name]; ok {
+			invalid(key, "collection %q is already used by %s", name, other)
+		}
+		names[name] = key
+	}
+
+	if c.Events.WebhookURL != "" {
+		if u, err := url.Parse(c.Events.WebhookURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			invalid("events.webhookURL", "must be an http:// or https:// URL")
+		}
+	} else if c.Events.WebhookSecret != "" {
+		invalid("events.webhookSecret", "is set but events.webhookURL is not")
+	}
+	for _, operation := range sortedKeys(c.Timeouts.Operations) {
+		if c.Timeouts.Operations[operation] <= 0 {
+			invalid("timeouts.operations."+operation, "must be positive")
+		}
+	}
+	for _, class := range []string{api.RateClassRead, api.RateClassWrite, api.RateClassAuthor} {
+		limit := c.RateLimits.For(class)
+		if limit.Requests < 0 {
+			invalid("rateLimits."+class+".requests", "must not be negative")
+		} else if limit.Requests > 0 && limit.Per <= 0 {
+			invalid("rateLimits."+class+".per", "must be positive")
+		}
+	}
+	switch c.Telemetry.TracesExporter {
+	case telemetry.ExporterNone, telemetry.ExporterStdout:
+	case telemetry.ExporterOTLP:
+		if u, err := url.Parse(c.Telemetry.OTLPEndpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			invalid("telemetry.otlpEndpoint", "must be an http:// or https:// URL")
+		}
+	default:
+		invalid("telemetry.tracesExporter", "%q is not one of none, stdout or otlp", c.Telemetry.TracesExporter)
+	}
+	if c.Telemetry.ServiceName == "" {
+		invalid("telemetry.serviceName", "is required")
+	}
+	if _, err := c.Log.SlogLevel(); err != nil {
+		invalid("log.level", "%q is not one of debug, info, warn or error", c.Log.Level)
+	}
+	if c.Log.Format != api.LogFormatJSON && c.Log.Format != api.LogFormatText {
+		invalid("log.format", "%q is not one of json or text", c.Log.Format)
+	}
+	if c.Cache.Size < 0 {
+		invalid("cache.size", "must not be negative")
+	} else if c.Cache.Size > 0 && c.Cache.TTL <= 0 {
+		invalid("cache.ttl", "must be positive")
+	}
+	if c.Cache.MaxAge < 0 {
+		invalid("cache.maxAge", "must not be negative")
+	}
+	if c.Assets.Dir == "" {
+		invalid("assets.dir", "is required")
+	}
+	if c.Assets.MaxUploadMB <= 0 {
+		invalid("assets.maxUploadMB", "must be positive")
+	}
+	if c.Assets.URLSecret != "" {
+		for _, kind := range []models.AssetKind{models.AssetKindImage, models.AssetKindVideo} {
+			if c.Assets.URLTTLs.For(kind) <= 0 {
+				invalid("assets.urlTTLs."+string(kind), "must be positive")
+			}
+		}
+	}
+	if c.AchievementsFile == "" {
+		invalid("achievementsFile", "is required")
+	}
+	if c.PaywallsFile == "" {
+		invalid("paywallsFile", "is required")
+	}
+
+	return errors.Join(errs...)
+}
+
+// Redacted returns a copy of the configuration with its secrets replaced, fit to
+// be printed or logged. The password of the MongoDB URI is redacted and the
+// rest of the URI kept.
+func (c Config) Redacted() Config {
+	if c.Mongo.URI != "" {
+		if u, err := url.Parse(c.Mongo.URI); err == nil {
+			if _, ok := u.User.Password(); ok {
+				u.User = url.UserPassword(u.User.Username(), redacted)
+				c.Mongo.URI = u.String()
+			}
+		} else {
+			c.Mongo.URI = redacted
+		}
+	}
+	if c.AdminToken != "" {
+		c.AdminToken = redacted
+	}
+	if c.Events.WebhookSecret != "" {
+		c.Events.WebhookSecret = redacted
+	}
+	if c.Assets.URLSecret != "" {
+		c.Assets.URLSecret = redacted
+	}
+	return c
+}
+
+// Print writes the configuration as YAML, with its secrets redacted.
+func (c Config) Print(w io.Writer) error {
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(c.Redacted()); err != nil {
+		return err
+	}
+	return encoder.Close()
+}
+
+func sortedKeys(m map[string]time.Duration) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
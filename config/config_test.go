@@ -0,0 +1,205 @@
+package config_test
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/okcthulhu/ChooseYourOwnAdventure/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func env(values map[string]string) func(string) string {
+	return func(key string) string {
+		return values[key]
+	}
+}
+
+func writeFile(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "cyoa.yaml")
+	assert.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	return path
+}
+
+func TestLoad_Defaults(t *testing.T) {
+	cfg, err := config.Load("cyoa", nil, env(map[string]string{"MONGO_URI": "mongodb://localhost:27017"}), io.Discard)
+
+	assert.NoError(t, err)
+	assert.Equal(t, 8080, cfg.Server.Port)
+	assert.Equal(t, 15*time.Second, cfg.Server.DrainTimeout)
+	assert.Equal(t, 5*time.Second, cfg.Server.ReadinessDelay)
+	assert.Equal(t, "cyoa", cfg.Mongo.Database)
+	assert.Equal(t, "players", cfg.Mongo.Collections.Players)
+	assert.Equal(t, "achievements.yaml", cfg.AchievementsFile)
+	assert.Equal(t, "paywalls.yaml", cfg.PaywallsFile)
+}
+
+func TestLoad_Precedence(t *testing.T) {
+	path := writeFile(t, `
+server:
+  port: 7000
+  drainTimeout: 30s
+mongo:
+  uri: mongodb://file:27017
+  database: fromfile
+  collections:
+    players: filePlayers
+`)
+	getenv := env(map[string]string{
+		config.FileEnv:   path,
+		"PORT":           "7001",
+		"MONGO_DATABASE": "fromenv",
+	})
+
+	cfg, err := config.Load("cyoa", []string{"-port", "7002"}, getenv, io.Discard)
+
+	assert.NoError(t, err)
+	assert.Equal(t, 7002, cfg.Server.Port, "flags override the environment")
+	assert.Equal(t, "fromenv", cfg.Mongo.Database, "the environment overrides the file")
+	assert.Equal(t, 30*time.Second, cfg.Server.DrainTimeout, "the file overrides the defaults")
+	assert.Equal(t, "mongodb://file:27017", cfg.Mongo.URI)
+	assert.Equal(t, "filePlayers", cfg.Mongo.Collections.Players)
+	assert.Equal(t, "storyElements", cfg.Mongo.Collections.StoryElements, "unset settings keep their defaults")
+}
+
+func TestLoad_ConfigFlagNamesFile(t *testing.T) {
+	path := writeFile(t, "mongo:\n  uri: mongodb://file:27017\n")
+
+	cfg, err := config.Load("cyoa", []string{"-config", path}, env(nil), io.Discard)
+
+	assert.NoError(t, err)
+	assert.Equal(t, "mongodb://file:27017", cfg.Mongo.URI)
+}
+
+func TestLoad_UnknownFileSetting(t *testing.T) {
+	path := writeFile(t, "mongo:\n  url: mongodb://file:27017\n")
+
+	_, err := config.Load("cyoa", []string{"-config", path}, env(nil), io.Discard)
+
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "field url not found")
+	}
+}
+
+func TestLoad_InvalidEnvironment(t *testing.T) {
+	_, err := config.Load("cyoa", nil, env(map[string]string{"MONGO_URI": "mongodb://x", "DRAIN_TIMEOUT": "15"}), io.Discard)
+
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "DRAIN_TIMEOUT")
+		assert.Contains(t, err.Error(), "is not a duration")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	cfg := config.Default()
+	cfg.Server.Port = 0
+	cfg.Server.DrainTimeout = 0
+	cfg.Server.ReadinessDelay = -time.Second
+	cfg.Mongo.Collections.Parties = "players"
+	cfg.Events.WebhookSecret = "s"
+	cfg.Telemetry.TracesExporter = "jaeger"
+	cfg.Log.Level = "verbose"
+	cfg.Log.Format = "xml"
+	cfg.RateLimits.Write.Requests = -1
+	cfg.RateLimits.Author.Per = 0
+	cfg.Cache.TTL = 0
+	cfg.Assets.MaxUploadMB = 0
+	cfg.Assets.URLSecret = "s"
+	cfg.Assets.URLTTLs.Video = 0
+
+	err := cfg.Validate()
+
+	if assert.Error(t, err) {
+		for _, message := range []string{
+			"mongo.uri (env MONGO_URI, flag -mongo-uri): is required",
+			"server.port (env PORT, flag -port): 0 is not a port number",
+			"server.drainTimeout (env DRAIN_TIMEOUT, flag -drain-timeout): must be positive",
+			"server.readinessDelay (env READINESS_DELAY, flag -readiness-delay): must not be negative",
+			`mongo.collections.parties: collection "players" is already used by mongo.collections.players`,
+			"events.webhookSecret (env EVENTS_WEBHOOK_SECRET, flag -events-webhook-secret): is set but events.webhookURL is not",
+			`telemetry.tracesExporter (env TRACES_EXPORTER, flag -traces-exporter): "jaeger" is not one of none, stdout or otlp`,
+			`log.level (env LOG_LEVEL, flag -log-level): "verbose" is not one of debug, info, warn or error`,
+			`log.format (env LOG_FORMAT, flag -log-format): "xml" is not one of json or text`,
+			"rateLimits.write.requests (env RATE_LIMIT_WRITE, flag -rate-limit-write): must not be negative",
+			"rateLimits.author.per: must be positive",
+			"cache.ttl (env CACHE_TTL, flag -cache-ttl): must be positive",
+			"assets.maxUploadMB (env MAX_UPLOAD_MB, flag -max-upload-mb): must be positive",
+			"assets.urlTTLs.video (env MEDIA_URL_VIDEO_TTL, flag -media-url-video-ttl): must be positive",
+		} {
+			assert.Contains(t, err.Error(), message)
+		}
+	}
+}
+
+func TestPrint_RedactsSecrets(t *testing.T) {
+	cfg := config.Default()
+	cfg.Mongo.URI = "mongodb://cyoa:hunter2@db:27017/?authSource=admin"
+	cfg.AdminToken = "admin-secret"
+	cfg.Events.WebhookURL = "https://hooks.example.com"
+	cfg.Events.WebhookSecret = "webhook-secret"
+	cfg.Assets.URLSecret = "media-secret"
+
+	var out bytes.Buffer
+	err := cfg.Print(&out)
+
+	assert.NoError(t, err)
+	printed := out.String()
+	assert.NotContains(t, printed, "hunter2")
+	assert.NotContains(t, printed, "admin-secret")
+	assert.NotContains(t, printed, "webhook-secret")
+	assert.NotContains(t, printed, "media-secret")
+	assert.Contains(t, printed, "mongodb://cyoa:REDACTED@db:27017/?authSource=admin")
+	assert.Contains(t, printed, "drainTimeout: 15s")
+	assert.Equal(t, "admin-secret", cfg.AdminToken, "the configuration itself is left alone")
+}
+
+func TestLoad_Timeouts(t *testing.T) {
+	path := writeFile(t, `
+mongo:
+  uri: mongodb://file:27017
+timeouts:
+  operations:
+    ListPlayers: 20s
+`)
+
+	cfg, err := config.Load("cyoa", []string{"-config", path, "-storage-timeout", "3s"}, env(nil), io.Discard)
+
+	assert.NoError(t, err)
+	assert.Equal(t, 3*time.Second, cfg.Timeouts.For("TakeChoice"))
+	assert.Equal(t, 20*time.Second, cfg.Timeouts.For("ListPlayers"))
+	assert.Equal(t, 10*time.Second, cfg.Timeouts.For("CastVote"), "default operation timeouts are kept")
+	assert.NotContains(t, config.Default().Timeouts.Operations, "ListPlayers", "the defaults are not changed")
+}
+
+func TestLoad_RateLimits(t *testing.T) {
+	path := writeFile(t, `
+mongo:
+  uri: mongodb://file:27017
+rateLimits:
+  author:
+    per: 1h
+`)
+
+	cfg, err := config.Load("cyoa", []string{"-config", path, "-rate-limit-author", "1000"}, env(map[string]string{"RATE_LIMIT_READ": "0"}), io.Discard)
+
+	assert.NoError(t, err)
+	assert.Equal(t, 1000, cfg.RateLimits.Author.Requests)
+	assert.Equal(t, time.Hour, cfg.RateLimits.Author.Per)
+	assert.Equal(t, 0, cfg.RateLimits.Read.Requests, "reads can be left unlimited")
+	assert.Equal(t, 120, cfg.RateLimits.Write.Requests)
+}
+
+func TestValidate_ReadinessDelay(t *testing.T) {
+	cfg := config.Default()
+	cfg.Mongo.URI = "mongodb://x"
+	cfg.Server.ReadinessDelay = cfg.Server.DrainTimeout
+
+	err := cfg.Validate()
+
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "server.readinessDelay (env READINESS_DELAY, flag -readiness-delay): must be shorter than server.drainTimeout")
+	}
+}
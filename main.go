@@ -2,90 +2,431 @@ package main
 
 import (
 	"context"
+	_ "embed"
+	"errors"
 	"flag"
 	"fmt"
+	"io/fs"
 	"log"
+	"log/slog"
+	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/joho/godotenv"
 	"github.com/labstack/echo/v4"
 	"github.com/okcthulhu/ChooseYourOwnAdventure/api"
+	"github.com/okcthulhu/ChooseYourOwnAdventure/api/events"
 	"github.com/okcthulhu/ChooseYourOwnAdventure/api/models"
+	"github.com/okcthulhu/ChooseYourOwnAdventure/api/telemetry"
+	"github.com/okcthulhu/ChooseYourOwnAdventure/config"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
 )
 
+// openAPISpec is the API document; the database validators are generated from its schemas.
+//
+//go:embed cyoa.yaml
+var openAPISpec []byte
+
+// main serves the API. Run as "migrate", it only applies the pending database
+// migrations and exits; the server applies them on startup as well. Run as
+// "config print", it prints the effective configuration with secrets redacted.
 func main() {
-	err := godotenv.Load() // Load .env file
-	if err != nil {
-		log.Fatal("Error loading .env file")
+	// A .env file is optional; deployments set the environment themselves
+	if err := godotenv.Load(); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Fatal("Failed to load .env file: ", err)
+	}
+
+	command, args := "serve", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+	if command == "config" {
+		if len(args) == 0 || args[0] != "print" {
+			log.Fatal("Usage: config print [flags]")
+		}
+		command, args = "config print", args[1:]
+	}
+	if command != "serve" && command != "migrate" && command != "config print" {
+		log.Fatalf("Unknown command %q; expected migrate or config print", command)
 	}
 
-	// Initialize handler with DB connection
-	mongoURI := os.Getenv("MONGO_URI") // Read the URI from an environment variable
-	if mongoURI == "" {
-		log.Fatal("Environment variable MONGO_URI not set")
+	cfg, err := config.Load(os.Args[0]+" "+command, args, os.Getenv, os.Stderr)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		log.Fatal("Invalid configuration:\n", err)
 	}
+	if command == "config print" {
+		if err := cfg.Print(os.Stdout); err != nil {
+			log.Fatal("Failed to print the configuration: ", err)
+		}
+		return
+	}
+
+	// From here on everything is logged as structured records, including the log package's output
+	level, _ := cfg.Log.SlogLevel()
+	logger := api.NewLogger(os.Stderr, cfg.Log.Format, level)
+	slog.SetDefault(logger)
 
 	clientOptions := options.Client().
-		ApplyURI(mongoURI).
+		ApplyURI(cfg.Mongo.URI).
 		SetRegistry(api.MongoRegistry)
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Mongo.ConnectTimeout)
 	defer cancel()
 
 	client, err := mongo.Connect(ctx, clientOptions)
 	if err != nil {
-		fmt.Println("Failed to connect to MongoDB:", err)
+		fatal("Failed to connect to MongoDB", err)
 	}
+	// Connect does not wait for the server; refuse to start without one
+	if err := client.Ping(ctx, readpref.Primary()); err != nil {
+		fatal("MongoDB is unreachable", err)
+	}
+
+	db := client.Database(cfg.Mongo.Database)
+	collections := cfg.Mongo.Collections
 
-	playerCol := client.Database("cyoa").Collection("players")
-	storyCol := client.Database("cyoa").Collection("storyElements")
-	playerHandler := api.NewPlayerHandler(playerCol)
+	// Indexes, validators and other database changes are applied as migrations
+	migrations, err := api.Migrations(openAPISpec, collections)
+	if err != nil {
+		fatal("Failed to prepare migrations", err)
+	}
+	migrator := api.NewMigrator(db, migrations)
+	migrateCtx, cancelMigrations := context.WithTimeout(context.Background(), cfg.Mongo.MigrationTimeout)
+	applied, err := migrator.Run(migrateCtx)
+	cancelMigrations()
+	for _, record := range applied {
+		slog.Info("Applied migration", "version", record.Version, "description", record.Description)
+	}
+	if err != nil {
+		fatal("Failed to migrate the database", err)
+	}
+	if command == "migrate" {
+		slog.Info("Database is up to date", "applied", len(applied))
+		if err := client.Disconnect(context.Background()); err != nil {
+			slog.Error("Failed to disconnect from MongoDB", "error", err)
+		}
+		return
+	}
+
+	// Every storage call is traced and measured
+	shutdownTracing, err := telemetry.SetupTracing(context.Background(),
+		cfg.Telemetry.TracesExporter, cfg.Telemetry.OTLPEndpoint, cfg.Telemetry.ServiceName)
+	if err != nil {
+		fatal("Failed to set up tracing", err)
+	}
+	metrics := telemetry.NewMetrics()
+
+	playerCol := metrics.Collection(db.Collection(collections.Players))
+	storyCol := metrics.Collection(db.Collection(collections.StoryElements))
+	eventCol := metrics.Collection(db.Collection(collections.ChoiceEvents))
+	outboxCol := metrics.Collection(db.Collection(collections.Outbox))
+	partyCol := metrics.Collection(db.Collection(collections.Parties))
+	idempotencyCol := metrics.Collection(db.Collection(collections.IdempotencyKeys))
+	auditCol := metrics.Collection(db.Collection(collections.AuditLog))
+	assetCol := metrics.Collection(db.Collection(collections.Assets))
+
+	// Every change to players and story elements is recorded in the audit log
+	auditLog := api.NewAuditLog(auditCol)
+	auditLog.Timeouts = cfg.Timeouts
+
+	playerHandler := api.NewPlayerHandler(playerCol, storyCol)
 	storyHandler := api.NewStoryHandler(storyCol)
+	analyticsHandler := api.NewAnalyticsHandler(eventCol)
+	partyHandler := api.NewPartyHandler(partyCol, playerCol, storyCol)
+	playerHandler.Timeouts = cfg.Timeouts
+	storyHandler.Timeouts = cfg.Timeouts
+	storyHandler.Cache = api.NewStoryCache(cfg.Cache.Size, cfg.Cache.TTL)
+	storyHandler.CacheMaxAge = cfg.Cache.MaxAge
+	analyticsHandler.Timeouts = cfg.Timeouts
+	partyHandler.Timeouts = cfg.Timeouts
+	playerHandler.Audit = auditLog
+	storyHandler.Audit = auditLog
+	partyHandler.Audit = auditLog
+
+	// Asset content is kept on the local filesystem; story elements reference assets by ID
+	blobs, err := api.NewLocalBlobStore(cfg.Assets.Dir)
+	if err != nil {
+		fatal("Failed to prepare the asset directory", err)
+	}
+	assetHandler := api.NewAssetHandler(assetCol, storyCol, blobs)
+	assetHandler.Timeouts = cfg.Timeouts
+	assetHandler.MaxSize = int64(cfg.Assets.MaxUploadMB) << 20
+	storyHandler.Assets = assetHandler
+
+	// With a secret, media is only served through the short-lived URLs handed to players
+	if mediaSigner := api.NewMediaSigner(cfg.Assets.URLSecret); mediaSigner != nil {
+		mediaSigner.TTLs = cfg.Assets.URLTTLs
+		assetHandler.Signer = mediaSigner
+		playerHandler.Media = mediaSigner
+		storyHandler.Media = mediaSigner
+	}
+
+	// Stories and chapters sold separately are locked away from players not entitled to them
+	paywallCatalog, err := api.LoadPaywallCatalog(cfg.PaywallsFile)
+	if err != nil {
+		fatal("Failed to load paywall catalog", err)
+	}
+	paywalls := api.NewPaywalls(paywallCatalog)
+	playerHandler.Paywalls = paywalls
+	storyHandler.Paywalls = paywalls
+	partyHandler.Paywalls = paywalls
+
+	catalog, err := api.LoadAchievementCatalog(cfg.AchievementsFile)
+	if err != nil {
+		fatal("Failed to load achievement catalog", err)
+	}
+	achievementHandler := api.NewAchievementHandler(catalog, playerCol, storyCol, eventCol)
+	achievementHandler.Timeouts = cfg.Timeouts
+	achievementHandler.Audit = auditLog
 
-	// Handle port flag
-	var port string
-	flag.StringVar(&port, "port", "8080", "Port to run the application on")
-	flag.Parse()
+	// Domain events are staged in the outbox, or on the players whose changes raised them
+	// until relayed to the outbox, and fanned out to the configured sinks
+	var sinks []events.Sink
+	if cfg.Events.File != "" {
+		sinks = append(sinks, events.NewFileSink(cfg.Events.File))
+	}
+	if cfg.Events.WebhookURL != "" {
+		sinks = append(sinks, events.NewWebhookSink(cfg.Events.WebhookURL, cfg.Events.WebhookSecret))
+	}
+	bus := events.NewBus(outboxCol, sinks...)
+	bus.Subscribe(analyticsHandler.HandleEvent, models.ChoiceTaken)
+	bus.Subscribe(achievementHandler.HandleEvent,
+		models.PlayerCreated, models.NodeEntered, models.ChoiceTaken, models.WisdomGranted, models.StoryCompleted)
+	bus.Subscribe(metrics.HandleEvent, models.PlayerCreated, models.ChoiceTaken, models.WisdomGranted, models.StoryCompleted)
+	bus.Staging = []events.StagingCollection{playerCol}
+	storyHandler.Events = bus
 
-	// Initialize Echo
+	// Stream clients are fed from the bus
+	hub := api.NewHub(256)
+	hub.HistoryTTL = cfg.Events.StreamHistoryTTL
+	bus.Subscribe(hub.HandleEvent,
+		models.PlayerCreated, models.NodeEntered, models.ChoiceTaken, models.WisdomGranted, models.StoryCompleted,
+		models.StoryElementCreated, models.StoryElementUpdated, models.StoryElementDeleted)
+	streamHandler := api.NewStreamHandler(hub)
+	busCtx, stopBus := context.WithCancel(context.Background())
+	busDone := make(chan struct{})
+	go func() {
+		defer close(busDone)
+		bus.Run(busCtx, cfg.Events.PollInterval)
+	}()
+
+	healthHandler := api.NewHealthHandler(client)
+	healthHandler.Timeout = cfg.Server.ReadinessTimeout
+
+	// Initialize Echo; it logs through the structured logger too
 	e := echo.New()
+	e.HideBanner = true
+	e.HidePort = true
+	e.StdLogger = slog.NewLogLogger(logger.Handler(), slog.LevelError)
+	// Client addresses are rate limited and logged, so X-Forwarded-For is only trusted from proxies on private networks
+	e.IPExtractor = echo.ExtractIPFromXFFHeader()
+
+	// Every request gets an ID that its logs and audit entries carry, and is logged once handled
+	e.Use(api.RequestID)
+	e.Use(api.AccessLog)
+
+	// Every request is counted, timed and traced, including replayed ones
+	e.Use(metrics.Middleware)
+
+	// Clients are throttled per address, API key and player before anything touches the storage
+	rateLimiter := api.NewRateLimiter(api.NewMemoryRateLimitStore())
+	rateLimiter.Limits = cfg.RateLimits
+	e.Use(rateLimiter.Middleware)
+
+	// Changes are attributed to the admin or an anonymous client in the audit log
+	e.Use(api.IdentifyActor(cfg.AdminToken))
+
+	// Mutating requests carrying an Idempotency-Key header can be retried safely
+	idempotency := api.NewIdempotency(idempotencyCol)
+	idempotency.Timeouts = cfg.Timeouts
+	idempotency.MaxBody = assetHandler.MaxBody()
+	e.Use(idempotency.Middleware)
 
 	// Define the routes
 	// General route comes first
 
+	// Probes and metrics
+	e.GET("/healthz", healthHandler.Healthz)
+	e.GET("/readyz", healthHandler.Readyz)
+	e.GET("/metrics", echo.WrapHandler(metrics.Handler()))
+
 	//Player routes
 	e.POST("/player", playerHandler.CreatePlayerState)
+	e.GET("/players", playerHandler.ListPlayers, api.RequireAdmin(cfg.AdminToken))
+	e.GET("/audit", auditLog.ListAuditEntries, api.RequireAdmin(cfg.AdminToken))
 	e.GET("/player/:wixID", func(c echo.Context) error {
 		wixID := c.Param("wixID")
 		return playerHandler.GetPlayerStateByWixID(c, wixID)
 	})
 	e.PATCH("/player/:wixID", func(c echo.Context) error {
 		wixID := c.Param("wixID")
+		// Merge patches and JSON Patches change any field; plain JSON only merges wisdoms
+		if api.IsPatchDocument(c) {
+			return playerHandler.PatchPlayerState(c, wixID)
+		}
 		playerState := new(models.PatchPlayersPlayerIdJSONRequestBody)
 		if err := c.Bind(playerState); err != nil {
 			return err
 		}
 		return playerHandler.UpdatePlayerState(c, wixID, *playerState)
 	})
+	e.POST("/player/:wixID/stories/:storyID/choices", func(c echo.Context) error {
+		return playerHandler.TakeChoice(c, c.Param("wixID"), c.Param("storyID"))
+	})
+	e.GET("/player/:wixID/stories/:storyID/element", func(c echo.Context) error {
+		return playerHandler.GetCurrentStoryElement(c, c.Param("wixID"), c.Param("storyID"))
+	})
+	e.GET("/player/:wixID/stories/:storyID/endings", func(c echo.Context) error {
+		return playerHandler.GetStoryEndings(c, c.Param("wixID"), c.Param("storyID"))
+	})
+	e.POST("/player/:wixID/entitlements", func(c echo.Context) error {
+		return playerHandler.GrantEntitlement(c, c.Param("wixID"))
+	}, api.RequireAdmin(cfg.AdminToken))
+	e.DELETE("/player/:wixID/entitlements/:productID", func(c echo.Context) error {
+		return playerHandler.RevokeEntitlement(c, c.Param("wixID"), c.Param("productID"))
+	}, api.RequireAdmin(cfg.AdminToken))
+	e.GET("/player/:wixID/stream", func(c echo.Context) error {
+		return streamHandler.StreamPlayerEvents(c, c.Param("wixID"))
+	})
+	e.GET("/player/:wixID/stream/ws", func(c echo.Context) error {
+		return streamHandler.PlayerEventsSocket(c, c.Param("wixID"))
+	})
+
+	// Achievement routes
+	e.GET("/achievements", achievementHandler.GetAchievementCatalog)
+	e.GET("/players/:wixID/achievements", func(c echo.Context) error {
+		return achievementHandler.GetPlayerAchievements(c, c.Param("wixID"))
+	})
 
 	// StoryElement routes
 	e.POST("/storyElements", storyHandler.CreateStoryElement)
+	// The flat routes are kept for existing clients; they need the story as a query parameter
 	e.GET("/storyElements/:nodeId", func(c echo.Context) error {
-		return storyHandler.GetStoryElement(c, c.Param("nodeId"))
+		return storyHandler.GetStoryElement(c, c.QueryParam("storyID"), c.Param("nodeId"))
 	})
 	e.DELETE("/storyElements/:nodeId", func(c echo.Context) error {
-		return storyHandler.DeleteStoryElement(c, c.Param("nodeId"))
+		return storyHandler.DeleteStoryElement(c, c.QueryParam("storyID"), c.Param("nodeId"))
 	})
 	e.PUT("/storyElements/:nodeId", func(c echo.Context) error {
 		storyElement := new(models.StoryElement)
 		if err := c.Bind(storyElement); err != nil {
 			return err
 		}
-		return storyHandler.UpdateStoryElement(c, c.Param("nodeId"), *storyElement)
+		storyID := c.QueryParam("storyID")
+		if storyID == "" {
+			storyID = storyElement.StoryID
+		}
+		return storyHandler.UpdateStoryElement(c, storyID, c.Param("nodeId"), *storyElement)
+	})
+	e.PATCH("/storyElements/:nodeId", func(c echo.Context) error {
+		return storyHandler.PatchStoryElement(c, c.QueryParam("storyID"), c.Param("nodeId"))
+	})
+	e.GET("/stories/:storyID/elements/:nodeId", func(c echo.Context) error {
+		return storyHandler.GetStoryElement(c, c.Param("storyID"), c.Param("nodeId"))
+	})
+	e.GET("/stories/:storyID/elements/:nodeId/neighborhood", func(c echo.Context) error {
+		return storyHandler.GetNeighborhood(c, c.Param("storyID"), c.Param("nodeId"))
+	})
+	e.PATCH("/stories/:storyID/elements/:nodeId", func(c echo.Context) error {
+		return storyHandler.PatchStoryElement(c, c.Param("storyID"), c.Param("nodeId"))
+	})
+	e.DELETE("/stories/:storyID/elements/:nodeId", func(c echo.Context) error {
+		return storyHandler.DeleteStoryElement(c, c.Param("storyID"), c.Param("nodeId"))
+	})
+	e.PUT("/stories/:storyID/elements/:nodeId", func(c echo.Context) error {
+		storyElement := new(models.StoryElement)
+		if err := c.Bind(storyElement); err != nil {
+			return err
+		}
+		return storyHandler.UpdateStoryElement(c, c.Param("storyID"), c.Param("nodeId"), *storyElement)
 	})
 
+	e.GET("/stories/:storyID/elements", func(c echo.Context) error {
+		return storyHandler.ListStoryElements(c, c.Param("storyID"))
+	})
+	e.GET("/stories/:storyID/stream", func(c echo.Context) error {
+		return streamHandler.StreamStoryEvents(c, c.Param("storyID"))
+	})
+	e.GET("/stories/:storyID/stream/ws", func(c echo.Context) error {
+		return streamHandler.StoryEventsSocket(c, c.Param("storyID"))
+	})
+
+	// Asset routes
+	e.POST("/assets", assetHandler.UploadAsset, api.RequireAdmin(cfg.AdminToken))
+	e.GET("/assets/missing", assetHandler.GetMissingAssets, api.RequireAdmin(cfg.AdminToken))
+	e.GET("/assets/:assetID", func(c echo.Context) error {
+		return assetHandler.GetAsset(c, c.Param("assetID"))
+	})
+	e.GET("/assets/:assetID/content", func(c echo.Context) error {
+		return assetHandler.GetAssetContent(c, c.Param("assetID"))
+	})
+	e.DELETE("/assets/:assetID", func(c echo.Context) error {
+		return assetHandler.DeleteAsset(c, c.Param("assetID"))
+	}, api.RequireAdmin(cfg.AdminToken))
+
+	// Party routes
+	e.POST("/parties", partyHandler.CreateParty)
+	e.GET("/parties/:partyID", func(c echo.Context) error {
+		return partyHandler.GetParty(c, c.Param("partyID"))
+	})
+	e.POST("/parties/:partyID/members", func(c echo.Context) error {
+		return partyHandler.JoinParty(c, c.Param("partyID"))
+	})
+	e.POST("/parties/:partyID/votes", func(c echo.Context) error {
+		return partyHandler.CastVote(c, c.Param("partyID"))
+	})
+
+	// Analytics routes
+	e.GET("/stories/:storyID/analytics", func(c echo.Context) error {
+		return analyticsHandler.GetStoryReport(c, c.Param("storyID"))
+	})
+
+	// Open streams end on shutdown so that their clients reconnect to another instance
+	e.Server.RegisterOnShutdown(hub.Close)
+
 	// Start the Echo web server
-	e.Logger.Fatal(e.Start(fmt.Sprintf(":%s", port)))
+	go func() {
+		slog.Info("Serving", "port", cfg.Server.Port)
+		if err := e.Start(fmt.Sprintf(":%d", cfg.Server.Port)); err != nil && err != http.ErrServerClosed {
+			fatal("Failed to start the server", err)
+		}
+	}()
+
+	// Drain on SIGINT or SIGTERM: stop taking traffic, finish the requests in flight, then let go of storage
+	signals, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stopSignals()
+	<-signals.Done()
+	slog.Info("Shutting down, draining requests", "drainTimeout", cfg.Server.DrainTimeout)
+	healthHandler.Drain()
+	// Keep serving until load balancers have seen the failing readiness probe
+	time.Sleep(cfg.Server.ReadinessDelay)
+
+	drainCtx, cancelDrain := context.WithTimeout(context.Background(), cfg.Server.DrainTimeout-cfg.Server.ReadinessDelay)
+	defer cancelDrain()
+	if err := e.Shutdown(drainCtx); err != nil {
+		slog.Error("Failed to drain requests in flight", "error", err)
+	}
+	stopBus()
+	<-busDone
+	if err := shutdownTracing(drainCtx); err != nil {
+		slog.Error("Failed to flush traces", "error", err)
+	}
+	if err := client.Disconnect(drainCtx); err != nil {
+		slog.Error("Failed to disconnect from MongoDB", "error", err)
+	}
+	slog.Info("Shut down")
+}
+
+// fatal logs an error that keeps the server from running and exits.
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
 }